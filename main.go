@@ -8,6 +8,8 @@ import (
 	_ "cycledb/pkg/tsdb/engine"
 	_ "cycledb/pkg/tsdb/index"
 	"cycledb/pkg/tsdb/index/tsi1"
+	_ "cycledb/pkg/tsdb/index/tsi2"
+	"flag"
 	"io"
 	"log"
 	"os"
@@ -20,9 +22,13 @@ var (
 	shardPath      string = "shard"
 	shardWalPath   string = "wal"
 	seriesFilePath string = "series_file"
+	indexVersion   string = tsdb.DefaultIndex
 )
 
 func main() {
+	flag.StringVar(&indexVersion, "index-version", tsdb.DefaultIndex, "index used by the shard, tsi1 or tsi2")
+	flag.Parse()
+
 	basePath := "../instance/" + time.Now().Format(time.RFC850) + "/"
 	shardPath = basePath + shardPath
 	shardWalPath = basePath + shardWalPath
@@ -32,6 +38,8 @@ func main() {
 	ctx := context.Background()
 
 	opt := tsdb.NewEngineOptions()
+	opt.Config.Index = indexVersion
+	opt.IndexVersion = indexVersion
 
 	seriesFile := tsdb.NewSeriesFile(seriesFilePath)
 
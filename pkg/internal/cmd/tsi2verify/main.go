@@ -0,0 +1,89 @@
+// Command tsi2verify checks tsi2 index files for corruption.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"cycledb/pkg/tsdb"
+	"cycledb/pkg/tsdb/index/tsi2"
+)
+
+var usageMsg = `Usage: tsi2verify [-series-file <path>] <index file or directory>...
+
+Verifies the .tsi2 files, and those of the directories and of their partition
+directories. With -series-file, the series of the files are checked against
+the series file.`
+
+func usage() {
+	fmt.Println(usageMsg)
+	os.Exit(1)
+}
+
+func main() {
+	seriesFilePath := flag.String("series-file", "", "path of the series file of the index")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+	}
+
+	paths, err := indexFilePaths(flag.Args())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var sfile *tsdb.SeriesFile
+	if *seriesFilePath != "" {
+		sfile = tsdb.NewSeriesFile(*seriesFilePath)
+		if err := sfile.Open(); err != nil {
+			fmt.Printf("cannot open series file: %v\n", err)
+			os.Exit(1)
+		}
+		defer sfile.Close()
+	}
+
+	invalid := 0
+	for _, path := range paths {
+		if err := tsi2.VerifyIndexFile(path, sfile); err != nil {
+			fmt.Println(err) // the error names the file
+			invalid++
+			continue
+		}
+		fmt.Printf("%s: ok\n", path)
+	}
+	if invalid != 0 {
+		fmt.Printf("%d of %d index files are invalid\n", invalid, len(paths))
+		if sfile != nil {
+			sfile.Close()
+		}
+		os.Exit(1)
+	}
+}
+
+// indexFilePaths returns the paths, with the directories replaced by the
+// index files they hold.
+func indexFilePaths(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		} else if !fi.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		// Index files are in the directory, or in the directories of its partitions.
+		for _, pattern := range []string{"*" + tsi2.IndexFileExt, filepath.Join("[0-9]*", "*"+tsi2.IndexFileExt)} {
+			matches, err := filepath.Glob(filepath.Join(arg, pattern))
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, matches...)
+		}
+	}
+	return paths, nil
+}
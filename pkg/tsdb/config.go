@@ -65,6 +65,17 @@ const (
 	// DefaultSeriesIDSetCacheSize is the default number of series ID sets to cache in the TSI index.
 	DefaultSeriesIDSetCacheSize = 100
 
+	// MultiplierGridOptimizer sizes the grids of the tsi2 index by how many
+	// earlier grids each tag key filled up.
+	MultiplierGridOptimizer = "multiplier"
+
+	// StatisticsGridOptimizer sizes the grids of the tsi2 index from the
+	// tag values of the series written.
+	StatisticsGridOptimizer = "statistics"
+
+	// DefaultGridOptimizer is the default optimizer of the tsi2 grids.
+	DefaultGridOptimizer = MultiplierGridOptimizer
+
 	// DefaultSeriesFileMaxConcurrentSnapshotCompactions is the maximum number of concurrent series
 	// partition snapshot compactions that can run at one time.
 	// A value of 0 results in runtime.GOMAXPROCS(0).
@@ -131,6 +142,14 @@ type Config struct {
 	// Setting series-id-set-cache-size to 0 disables the cache.
 	SeriesIDSetCacheSize int `toml:"series-id-set-cache-size"`
 
+	// GridOptimizer is the optimizer sizing the grids of the tsi2 index: "multiplier" grows
+	// the capacity of a tag key each time it fills up a grid, "statistics" sizes the grids
+	// from the arrival of new tag values and the tag keys occurring together.
+	GridOptimizer string `toml:"grid-optimizer"`
+
+	// DatabaseGridOptimizers overrides GridOptimizer for some databases, by database name.
+	DatabaseGridOptimizers map[string]string `toml:"database-grid-optimizers"`
+
 	// SeriesFileMaxConcurrentSnapshotCompactions is the maximum number of concurrent snapshot compactions
 	// that can be running at one time across all series partitions in a database. Snapshots scheduled
 	// to run when the limit is reached are blocked until a running snapshot completes.  Only snapshot
@@ -168,6 +187,7 @@ func NewConfig() Config {
 
 		MaxIndexLogFileSize:  toml.Size(DefaultMaxIndexLogFileSize),
 		SeriesIDSetCacheSize: DefaultSeriesIDSetCacheSize,
+		GridOptimizer:        DefaultGridOptimizer,
 
 		SeriesFileMaxConcurrentSnapshotCompactions: DefaultSeriesFileMaxConcurrentSnapshotCompactions,
 
@@ -192,6 +212,15 @@ func (c *Config) Validate() error {
 		return errors.New("series-id-set-cache-size must be non-negative")
 	}
 
+	if !validGridOptimizer(c.GridOptimizer) {
+		return fmt.Errorf("unrecognized grid-optimizer %s", c.GridOptimizer)
+	}
+	for db, optimizer := range c.DatabaseGridOptimizers {
+		if !validGridOptimizer(optimizer) {
+			return fmt.Errorf("unrecognized grid-optimizer %s for database %s", optimizer, db)
+		}
+	}
+
 	if c.SeriesFileMaxConcurrentSnapshotCompactions < 0 {
 		return errors.New("series-file-max-concurrent-compactions must be non-negative")
 	}
@@ -220,3 +249,21 @@ func (c *Config) Validate() error {
 
 	return nil
 }
+
+// GridOptimizerFor returns the optimizer of the tsi2 grids of the database.
+func (c *Config) GridOptimizerFor(database string) string {
+	if optimizer, ok := c.DatabaseGridOptimizers[database]; ok {
+		return optimizer
+	}
+	return c.GridOptimizer
+}
+
+// validGridOptimizer returns true if name is a tsi2 grid optimizer.
+// An empty name is the default optimizer.
+func validGridOptimizer(name string) bool {
+	switch name {
+	case "", MultiplierGridOptimizer, StatisticsGridOptimizer:
+		return true
+	}
+	return false
+}
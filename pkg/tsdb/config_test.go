@@ -17,6 +17,10 @@ dir = "/var/lib/influxdb/data"
 wal-dir = "/var/lib/influxdb/wal"
 wal-fsync-delay = "10s"
 tsm-use-madv-willneed = true
+grid-optimizer = "statistics"
+
+[database-grid-optimizers]
+telegraf = "multiplier"
 `, &c); err != nil {
 		t.Fatal(err)
 	}
@@ -37,6 +41,12 @@ tsm-use-madv-willneed = true
 	if got, exp := c.TSMWillNeed, true; got != exp {
 		t.Errorf("unexpected tsm-madv-willneed:\n\nexp=%v\n\ngot=%v\n\n", exp, got)
 	}
+	if got, exp := c.GridOptimizerFor("telegraf"), tsdb.MultiplierGridOptimizer; got != exp {
+		t.Errorf("unexpected grid-optimizer of telegraf:\n\nexp=%v\n\ngot=%v\n\n", exp, got)
+	}
+	if got, exp := c.GridOptimizerFor("db0"), tsdb.StatisticsGridOptimizer; got != exp {
+		t.Errorf("unexpected grid-optimizer of db0:\n\nexp=%v\n\ngot=%v\n\n", exp, got)
+	}
 }
 
 func TestConfig_Validate_Error(t *testing.T) {
@@ -71,6 +81,18 @@ func TestConfig_Validate_Error(t *testing.T) {
 	if err := c.Validate(); err == nil || err.Error() != "series-id-set-cache-size must be non-negative" {
 		t.Errorf("unexpected error: %s", err)
 	}
+
+	c.SeriesIDSetCacheSize = 0
+	c.GridOptimizer = "foo"
+	if err := c.Validate(); err == nil || err.Error() != "unrecognized grid-optimizer foo" {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	c.GridOptimizer = tsdb.StatisticsGridOptimizer
+	c.DatabaseGridOptimizers = map[string]string{"db0": "bar"}
+	if err := c.Validate(); err == nil || err.Error() != "unrecognized grid-optimizer bar for database db0" {
+		t.Errorf("unexpected error: %s", err)
+	}
 }
 
 func TestConfig_ByteSizes(t *testing.T) {
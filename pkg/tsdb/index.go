@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"sync"
@@ -22,6 +23,7 @@ import (
 // Available index types.
 const (
 	TSI1IndexName = "tsi1"
+	TSI2IndexName = "tsi2"
 )
 
 // ErrIndexClosing can be returned to from an Index method if the index is currently closing.
@@ -79,6 +81,23 @@ type Index interface {
 	UniqueReferenceID() uintptr
 }
 
+// TagValueMatcher is implemented by indexes which evaluate regular expressions
+// and negations on tag values themselves, without a series lookup for each
+// matching value or a difference with all series of the measurement.
+// Their TagValueSeriesIDIterator returns the series without the tag key for
+// an empty value.
+type TagValueMatcher interface {
+	MatchTagValueSeriesIDIterator(name, key []byte, value *regexp.Regexp, matches bool) (SeriesIDIterator, error)
+	TagValueNotEqualSeriesIDIterator(name, key, value []byte) (SeriesIDIterator, error)
+}
+
+// SeriesDecoder is implemented by indexes which derive the name and tags of a
+// series from its id, without reading the series file. SeriesByID returns a
+// nil name if the index does not hold the series.
+type SeriesDecoder interface {
+	SeriesByID(id uint64) ([]byte, models.Tags, error)
+}
+
 // SeriesElem represents a generic series element.
 type SeriesElem interface {
 	Name() []byte
@@ -922,6 +941,7 @@ func (itr *seriesPointIterator) readSeriesKeys(name []byte) error {
 
 	// Slurp all series keys.
 	itr.keys = itr.keys[:0]
+	decode := itr.indexSet.seriesDecoders()
 	for i := 0; ; i++ {
 		elem, err := sitr.Next()
 		if err != nil {
@@ -939,7 +959,17 @@ func (itr *seriesPointIterator) readSeriesKeys(name []byte) error {
 			}
 		}
 
-		key := itr.indexSet.SeriesFile.SeriesKey(elem.SeriesID)
+		var key []byte
+		if decode {
+			name, tags, err := itr.indexSet.seriesByID(elem.SeriesID)
+			if err != nil {
+				return err
+			} else if name != nil {
+				key = AppendSeriesKey(nil, name, tags)
+			}
+		} else {
+			key = itr.indexSet.SeriesFile.SeriesKey(elem.SeriesID)
+		}
 		if len(key) == 0 {
 			continue
 		}
@@ -2564,8 +2594,9 @@ func (is IndexSet) seriesByBinaryExprStringIterator(name, key, value []byte, op
 	}
 
 	if op == influxql.EQ {
-		// Match a specific value.
-		if len(value) != 0 {
+		// Match a specific value, or the series without the key if the
+		// indexes resolve empty values.
+		if len(value) != 0 || is.tagValueMatchers() {
 			return is.tagValueSeriesIDIterator(name, key, value)
 		}
 
@@ -2587,7 +2618,19 @@ func (is IndexSet) seriesByBinaryExprStringIterator(name, key, value []byte, op
 	}
 
 	// Return all measurement series without this tag value.
-	if len(value) != 0 {
+	if len(value) != 0 && is.tagValueMatchers() {
+		a := make([]SeriesIDIterator, 0, len(is.Indexes))
+		for _, idx := range is.Indexes {
+			itr, err := idx.(TagValueMatcher).TagValueNotEqualSeriesIDIterator(name, key, value)
+			if err != nil {
+				SeriesIDIterators(a).Close()
+				return nil, err
+			} else if itr != nil {
+				a = append(a, itr)
+			}
+		}
+		return MergeSeriesIDIterators(a...), nil
+	} else if len(value) != 0 {
 		mitr, err := is.measurementSeriesIDIterator(name)
 		if err != nil {
 			return nil, err
@@ -2661,6 +2704,20 @@ func (is IndexSet) MatchTagValueSeriesIDIterator(name, key []byte, value *regexp
 //
 // It guarantees to never take any locks on the underlying series file.
 func (is IndexSet) matchTagValueSeriesIDIterator(name, key []byte, value *regexp.Regexp, matches bool) (SeriesIDIterator, error) {
+	if is.tagValueMatchers() {
+		a := make([]SeriesIDIterator, 0, len(is.Indexes))
+		for _, idx := range is.Indexes {
+			itr, err := idx.(TagValueMatcher).MatchTagValueSeriesIDIterator(name, key, value, matches)
+			if err != nil {
+				SeriesIDIterators(a).Close()
+				return nil, err
+			} else if itr != nil {
+				a = append(a, itr)
+			}
+		}
+		return MergeSeriesIDIterators(a...), nil
+	}
+
 	matchEmpty := value.MatchString("")
 	if matches {
 		if matchEmpty {
@@ -2675,6 +2732,37 @@ func (is IndexSet) matchTagValueSeriesIDIterator(name, key []byte, value *regexp
 	return is.matchTagValueNotEqualNotEmptySeriesIDIterator(name, key, value)
 }
 
+// seriesDecoders returns true if all indexes are SeriesDecoders.
+func (is IndexSet) seriesDecoders() bool {
+	for _, idx := range is.Indexes {
+		if _, ok := idx.(SeriesDecoder); !ok {
+			return false
+		}
+	}
+	return len(is.Indexes) != 0
+}
+
+// seriesByID returns the name and tags of the series from the index holding
+// it. All indexes must be SeriesDecoders.
+func (is IndexSet) seriesByID(id uint64) ([]byte, models.Tags, error) {
+	for _, idx := range is.Indexes {
+		if name, tags, err := idx.(SeriesDecoder).SeriesByID(id); err != nil || name != nil {
+			return name, tags, err
+		}
+	}
+	return nil, nil, nil
+}
+
+// tagValueMatchers returns true if all indexes are TagValueMatchers.
+func (is IndexSet) tagValueMatchers() bool {
+	for _, idx := range is.Indexes {
+		if _, ok := idx.(TagValueMatcher); !ok {
+			return false
+		}
+	}
+	return len(is.Indexes) != 0
+}
+
 func (is IndexSet) matchTagValueEqualEmptySeriesIDIterator(name, key []byte, value *regexp.Regexp) (SeriesIDIterator, error) {
 	vitr, err := is.tagValueIterator(name, key)
 	if err != nil {
@@ -3080,6 +3168,7 @@ func (is IndexSet) TagSets(sfile *SeriesFile, name []byte, opt query.IteratorOpt
 	// end up as strings we can re-use an intermediate buffer for this process.
 	var keyBuf []byte
 	var tagsBuf models.Tags // Buffer for tags. Tags are not needed outside of each loop iteration.
+	decode := is.seriesDecoders()
 	for {
 		se, err := itr.Next()
 		if err != nil {
@@ -3088,9 +3177,17 @@ func (is IndexSet) TagSets(sfile *SeriesFile, name []byte, opt query.IteratorOpt
 			break
 		}
 
-		// Skip if the series has been tombstoned.
-		key := sfile.SeriesKey(se.SeriesID)
-		if len(key) == 0 {
+		// Skip if the series has been tombstoned. Indexes decoding the tags
+		// from the id do not need the series file.
+		var key []byte
+		if decode {
+			var seriesName []byte
+			if seriesName, tagsBuf, err = is.seriesByID(se.SeriesID); err != nil {
+				return nil, err
+			} else if seriesName == nil {
+				continue
+			}
+		} else if key = sfile.SeriesKey(se.SeriesID); len(key) == 0 {
 			continue
 		}
 
@@ -3108,7 +3205,9 @@ func (is IndexSet) TagSets(sfile *SeriesFile, name []byte, opt query.IteratorOpt
 		}
 
 		// NOTE - must not escape this loop iteration.
-		_, tagsBuf = ParseSeriesKeyInto(key, tagsBuf)
+		if !decode {
+			_, tagsBuf = ParseSeriesKeyInto(key, tagsBuf)
+		}
 		if opt.Authorizer != nil && !opt.Authorizer.AuthorizeSeriesRead(db, name, tagsBuf) {
 			continue
 		}
@@ -3188,7 +3287,20 @@ func NewIndex(id uint64, database, path string, seriesIDSet *SeriesIDSet, sfile
 	} else if err != nil {
 		return nil, err
 	} else if err == nil {
-		format = TSI1IndexName
+		// Existing indexes keep their format, whatever the configured one.
+		// A directory without index files is opened as a tsi1 index, unless
+		// the grid index is configured.
+		if ok, err := hasTSI1Files(path); err != nil {
+			return nil, err
+		} else if ok {
+			format = TSI1IndexName
+		} else if ok, err := hasTSI2Files(path); err != nil {
+			return nil, err
+		} else if ok {
+			format = TSI2IndexName
+		} else if format != TSI2IndexName {
+			format = TSI1IndexName
+		}
 	}
 
 	// Lookup index by format.
@@ -3199,6 +3311,34 @@ func NewIndex(id uint64, database, path string, seriesIDSet *SeriesIDSet, sfile
 	return fn(id, database, path, seriesIDSet, sfile, options), nil
 }
 
+// hasTSI1Files returns true if path, or one of its partition directories,
+// contains tsi1 log or index files.
+func hasTSI1Files(path string) (bool, error) {
+	return hasFiles(path, "*.tsl", "*.tsi")
+}
+
+// hasTSI2Files returns true if path, or one of its partition directories,
+// contains grid index log or index files.
+func hasTSI2Files(path string) (bool, error) {
+	return hasFiles(path, "*.tsl2", "*.tsi2")
+}
+
+// hasFiles returns true if path, or one of its subdirectories, contains a
+// file matching one of the patterns.
+func hasFiles(path string, patterns ...string) (bool, error) {
+	for _, pattern := range patterns {
+		for _, p := range []string{pattern, filepath.Join("*", pattern)} {
+			matches, err := filepath.Glob(filepath.Join(path, p))
+			if err != nil {
+				return false, err
+			} else if len(matches) > 0 {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
 func MustOpenIndex(id uint64, database, path string, seriesIDSet *SeriesIDSet, sfile *SeriesFile, options EngineOptions) Index {
 	idx, err := NewIndex(id, database, path, seriesIDSet, sfile, options)
 	if err != nil {
@@ -5,4 +5,50 @@ import "errors"
 var (
 	ErrFailToSetSeriesKey  = errors.New("fail to set series key")
 	ErrMeasurementNotFound = errors.New("fail to find measurement")
+
+	// ErrSeriesIDOverflow is returned when the ids of a new grid do not fit
+	// in the series bits of the id layout.
+	ErrSeriesIDOverflow = errors.New("series id overflows the id layout")
+
+	// ErrMeasurementIDOverflow is returned when a new measurement id does not
+	// fit in the measurement bits of the id layout.
+	ErrMeasurementIDOverflow = errors.New("measurement id overflows the id layout")
+
+	// ErrInvalidIDLayout is returned for an id layout which does not fit in a series id.
+	ErrInvalidIDLayout = errors.New("invalid tsi2 id layout")
+
+	// ErrIncompatibleIDLayout is returned when files written with another
+	// id layout than the one of the index are opened.
+	ErrIncompatibleIDLayout = errors.New("incompatible tsi2 id layout")
+
+	// ErrUnknownGridOptimizer is returned for a grid optimizer name which is
+	// not one of the optimizers of the configuration.
+	ErrUnknownGridOptimizer = errors.New("unknown tsi2 grid optimizer")
+
+	// ErrUnsupportedIndexFileVersion is returned when reading an index file
+	// with a version this tsi2 index cannot read.
+	ErrUnsupportedIndexFileVersion = errors.New("unsupported tsi2 index file version")
+
+	// ErrInvalidIndexFile is returned when the signature, trailer or
+	// measurement block of an index file is truncated or malformed.
+	ErrInvalidIndexFile = errors.New("invalid tsi2 index file")
+
+	// ErrInvalidGrid is returned when an encoded grid or grid dictionary is
+	// truncated, malformed or fails its checksum.
+	ErrInvalidGrid = errors.New("invalid tsi2 grid")
+
+	// ErrGridDictionaryTooLarge is returned when the strings of a grid
+	// dictionary do not fit in its 4-byte offsets.
+	ErrGridDictionaryTooLarge = errors.New("tsi2 grid dictionary exceeds 4GB")
+
+	// ErrInvalidTagBlock is returned when a tag block is truncated or malformed.
+	ErrInvalidTagBlock = errors.New("invalid tsi2 tag block")
+
+	// ErrPartitionFailed is returned by the writes to a partition whose grids
+	// in memory are ahead of its log, until the index is reopened.
+	ErrPartitionFailed = errors.New("tsi2 partition failed, the index must be reopened")
+
+	// ErrIncompatibleVersion is returned when attempting to read from an
+	// incompatible tsi2 manifest file.
+	ErrIncompatibleVersion = errors.New("incompatible tsi2 index MANIFEST")
 )
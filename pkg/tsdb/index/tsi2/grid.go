@@ -1,6 +1,9 @@
 package tsi2
 
 import (
+	"sort"
+	"unsafe"
+
 	"cycledb/pkg/tsdb"
 
 	"github.com/influxdata/influxdb/v2/models"
@@ -18,6 +21,11 @@ type Grid struct {
 
 	// bitmap
 	seriesIDSet *tsdb.SeriesIDSet
+
+	// coordinates of the series dropped from the grid in memory, which are
+	// not given to a series again, as the series file requires recreated
+	// series to get new ids. Nil until a series is dropped.
+	dropped *tsdb.SeriesIDSet
 }
 
 func NewGridWithSingleTags(offset uint64, tags models.Tags, tagValuesSlice []*TagValues) *Grid {
@@ -49,6 +57,17 @@ func NewGridWithKeysAndValuesSlice(offset uint64, keys []string, tagValuesSlice
 	return g
 }
 
+// addTagValuesTo adds the values of each tag key of the grid to sets,
+// including the empty value of the series lacking the key.
+func (g *Grid) addTagValuesTo(sets map[string]map[string]struct{}) {
+	for i, key := range g.tagKeys {
+		values := tagValueSet(sets, key)
+		for _, value := range g.tagValuesSlice[i].values {
+			values[value] = struct{}{}
+		}
+	}
+}
+
 func (g *Grid) HasTagKey(key string) bool {
 	if _, ok := g.tagKeyToIndex[key]; ok {
 		return true
@@ -56,7 +75,12 @@ func (g *Grid) HasTagKey(key string) bool {
 	return false
 }
 
+// HasTagValue returns true if the tag value is in the grid. The empty value,
+// which marks the series without the key, is not a tag value.
 func (g *Grid) HasTagValue(key, value string) bool {
+	if value == "" {
+		return false
+	}
 	if index, ok := g.tagKeyToIndex[key]; !ok {
 		return false
 	} else {
@@ -70,6 +94,44 @@ func (g *Grid) HasTagValue(key, value string) bool {
 
 }
 
+// bytes estimates the memory footprint of the grid, in bytes.
+func (g *Grid) bytes() int {
+	var b int
+	b += int(unsafe.Sizeof(g.offset))
+	b += int(unsafe.Sizeof(g.tagValuesSlice))
+	for _, tagValues := range g.tagValuesSlice {
+		b += int(unsafe.Sizeof(tagValues)) + tagValues.bytes()
+	}
+	b += int(unsafe.Sizeof(g.tagKeys))
+	for _, key := range g.tagKeys {
+		b += int(unsafe.Sizeof(key)) + len(key)
+	}
+	b += int(unsafe.Sizeof(g.tagKeyToIndex))
+	for key, index := range g.tagKeyToIndex {
+		b += int(unsafe.Sizeof(key)) + int(unsafe.Sizeof(index))
+	}
+	b += int(unsafe.Sizeof(g.seriesIDSet)) + g.seriesIDSet.Bytes()
+	b += int(unsafe.Sizeof(g.dropped))
+	if g.dropped != nil {
+		b += g.dropped.Bytes()
+	}
+	return b
+}
+
+// drop retires the coordinate of the series id, the series keeps its id in
+// the grid until it is removed from seriesIDSet.
+func (g *Grid) drop(id uint64) {
+	if g.dropped == nil {
+		g.dropped = tsdb.NewSeriesIDSet()
+	}
+	g.dropped.Add(id)
+}
+
+// isDropped returns true if the coordinate of the id was retired.
+func (g *Grid) isDropped(id uint64) bool {
+	return g.dropped != nil && g.dropped.Contains(id)
+}
+
 // getNumOfDimensions: return the number of tag keys inside
 func (g *Grid) getNumOfDimensions() int {
 	return len(g.tagKeys)
@@ -84,22 +146,28 @@ func (g *Grid) getCapacityOfIDs() uint64 {
 	return capacity
 }
 
-func (g *Grid) tagValueExists(tag models.Tag) bool {
-	if tagValuesIndex, ok := g.tagKeyToIndex[string(tag.Key)]; !ok {
-		return false
-	} else {
-		if g.tagValuesSlice[tagValuesIndex].GetValueIndex(string(tag.Value)) == -1 {
-			return false
-		} else {
-			return true
+// dimValues returns the value of each dimension for the tags. A series
+// without some keys of the grid has the empty value in their dimensions.
+// Returns false if a tag key with a value is not a dimension of the grid.
+func (g *Grid) dimValues(tags models.Tags) ([]string, bool) {
+	values := make([]string, g.getNumOfDimensions())
+	for _, tag := range tags {
+		index, ok := g.tagKeyToIndex[string(tag.Key)]
+		if !ok {
+			if len(tag.Value) == 0 {
+				continue
+			}
+			return nil, false
 		}
+		values[index] = string(tag.Value)
 	}
+	return values, true
 }
 
 // GetStrictlyMatchedIDForTags: return 0, false if not find it, else return id, true
 func (g *Grid) GetStrictlyMatchedIDForTags(tags models.Tags) (uint64, bool) {
 	id, ok := g.GetStrictlyMatchedIDForTagsNoIDSet(tags)
-	if !ok || !g.seriesIDSet.Contains(id) {
+	if !ok || !g.seriesIDSet.Contains(id) || g.isDropped(id) {
 		return 0, false
 	}
 	return id, true
@@ -107,84 +175,102 @@ func (g *Grid) GetStrictlyMatchedIDForTags(tags models.Tags) (uint64, bool) {
 
 // GetStrictlyMatchedIDForTagsNoIDSet: Only check grid, ignore SeriesIdsSet, return 0, false if not find it, else return id, true
 func (g *Grid) GetStrictlyMatchedIDForTagsNoIDSet(tags models.Tags) (uint64, bool) {
-	if len(tags) != g.getNumOfDimensions() {
+	values, ok := g.dimValues(tags)
+	if !ok {
 		return 0, false
 	}
 
-	ids := g.GetSeriesIDsWithTagsNoIDSet(tags)
-	if len(ids) == 0 {
-		return 0, false
+	choices := make([][]uint64, len(values))
+	for d, value := range values {
+		index := g.tagValuesSlice[d].GetValueIndex(value)
+		if index == -1 {
+			return 0, false
+		}
+		choices[d] = []uint64{uint64(index)}
 	}
+	runs := newGridIDRuns(g, choices)
+	return runs.offset + runs.base, true
+}
 
-	return ids[0], true
+// tagsForID returns the tags of the coordinate of the id, without the keys
+// with the empty value. Returns nil if the id is not a coordinate of the grid.
+func (g *Grid) tagsForID(id uint64) models.Tags {
+	if id < g.offset || id-g.offset >= g.getCapacityOfIDs() {
+		return nil
+	}
+	local := id - g.offset
+	tags := make(models.Tags, 0, len(g.tagKeys))
+	for d := len(g.tagKeys) - 1; d >= 0; d-- {
+		tagValues := g.tagValuesSlice[d]
+		index := local % tagValues.capacity
+		local /= tagValues.capacity
+		if index >= uint64(len(tagValues.values)) {
+			return nil
+		} else if value := tagValues.values[index]; value != "" {
+			tags = append(tags, models.NewTag([]byte(g.tagKeys[d]), []byte(value)))
+		}
+	}
+	sort.Sort(tags)
+	return tags
 }
 
 // SetTags: return whether the insert succeed and the corresponding id.
 // The returned bool represents whether the id will exist after calling, which means, 1) already exist and 2) insert successfully both return true.
-// Only when tags matches and all have free slot, the insert succeeds.
+// Only when the tag keys are dimensions of the grid and all new values have free slot, the insert succeeds.
+// The dimensions of the keys missing from the tags get the empty value.
+// The insert fails if the coordinate of the tags was dropped.
 func (g *Grid) SetTags(tags models.Tags) (uint64, bool) {
+	id, _, ok := g.setTags(tags)
+	return id, ok
+}
+
+// setTags works as SetTags, and also returns the dimensions which got a new tag value.
+func (g *Grid) setTags(tags models.Tags) (uint64, []int, bool) {
 	id, ok := g.GetStrictlyMatchedIDForTags(tags)
 	if ok {
-		return id, ok
+		return id, nil, ok
+	} else if id, ok := g.GetStrictlyMatchedIDForTagsNoIDSet(tags); ok && g.isDropped(id) {
+		return 0, nil, false
 	}
-	if !g.ableToSetTags(tags) {
-		return 0, false
-	}
-	// get the tag pairs already exist, which means they don't need to be inserted
-	existedTagIndex := map[int]struct{}{}
-	for i, tag := range tags {
-		index, ok := g.tagKeyToIndex[string(tag.Key)]
-		// the tag key does not match
-		if !ok {
-			return 0, false
-		}
-
-		// if value already exist, no need to insert
-		tagValues := g.tagValuesSlice[index]
-		if tagValues.GetValueIndex(string(tag.Value)) != -1 {
-			existedTagIndex[i] = struct{}{}
-		}
+	values, ok := g.dimValues(tags)
+	if !ok || !g.ableToSetValues(values) {
+		return 0, nil, false
 	}
 
-	// do the insert
-	for i, tag := range tags {
-		if _, ok := existedTagIndex[i]; ok {
-			continue
+	// do the insert, the values already exist don't need to be inserted
+	var dims []int
+	for d, value := range values {
+		tagValues := g.tagValuesSlice[d]
+		if tagValues.GetValueIndex(value) == -1 {
+			tagValues.SetValue(value)
+			dims = append(dims, d)
 		}
-		index := g.tagKeyToIndex[string(tag.Key)]
-		tagValues := g.tagValuesSlice[index]
-		tagValues.SetValue(string(tag.Value))
 	}
 
 	// calculate id
 	id, _ = g.GetStrictlyMatchedIDForTagsNoIDSet(tags)
 	g.seriesIDSet.Add(id)
-	return id, true
+	return id, dims, true
 }
 
 // ableToSetTags: returns whether tags could be inserted in grid.
 // For grids could represent tags already, also return true.
+// The tag keys must be dimensions of the grid, the series may lack some of them.
 func (g *Grid) ableToSetTags(tags models.Tags) bool {
-	// check each tag key matches and have free slot
-	// the tag key does not match
-	if len(tags) != g.getNumOfDimensions() {
-		return false
-	}
-	for _, tag := range tags {
-		index, ok := g.tagKeyToIndex[string(tag.Key)]
-		// the tag key does not match
-		if !ok {
-			return false
-		}
+	values, ok := g.dimValues(tags)
+	return ok && g.ableToSetValues(values)
+}
 
+// ableToSetValues returns whether each dimension has the value or a free slot for it.
+func (g *Grid) ableToSetValues(values []string) bool {
+	for d, value := range values {
+		tagValues := g.tagValuesSlice[d]
 		// if value already exist, no need to insert
-		tagValues := g.tagValuesSlice[index]
-		if tagValues.GetValueIndex(string(tag.Value)) != -1 {
+		if tagValues.GetValueIndex(value) != -1 {
 			continue
 		}
-
 		// no free slot
-		if g.tagKeyExistsAndFilledUp(string(tag.Key)) {
+		if tagValues.capacity == uint64(len(tagValues.values)) {
 			return false
 		}
 	}
@@ -203,56 +289,341 @@ func (g *Grid) tagKeyExistsAndFilledUp(tagKey string) bool {
 	return tagValues.capacity == uint64(len(tagValues.values))
 }
 
+// TagValueSet maps tag keys to the values allowed for them. A series matches
+// the set if its value of each key is one of the values of the key.
+type TagValueSet map[string][]string
+
+// GetSeriesIDSetForTags returns the ids of the series of the grid matching all tags.
 func (g *Grid) GetSeriesIDSetForTags(tags models.Tags) *tsdb.SeriesIDSet {
-	ids := g.GetSeriesIDsWithTagsNoIDSet(tags)
-	idsSet := tsdb.NewSeriesIDSet(ids...)
+	runs, ok := g.idRuns(tags)
+	return g.seriesIDSetForRuns(runs, ok)
+}
+
+// GetSeriesIDSetForTagValue returns the ids of the series of the grid whose
+// value of the tag key is value. The empty value matches the series without
+// the key, including all series of a grid without the key.
+func (g *Grid) GetSeriesIDSetForTagValue(key, value string) *tsdb.SeriesIDSet {
+	return g.GetSeriesIDSetForTags(models.Tags{models.NewTag([]byte(key), []byte(value))})
+}
+
+// GetSeriesIDSetForTagKey returns the ids of the series of the grid with a
+// value for the tag key.
+func (g *Grid) GetSeriesIDSetForTagKey(key string) *tsdb.SeriesIDSet {
+	return g.GetSeriesIDSetForTagValueNotEqual(key, "")
+}
+
+// GetSeriesIDSetForTagValueSet returns the ids of the series of the grid
+// matching the tag value set. The coordinates allowed in all dimensions are
+// computed in one pass, instead of a lookup for each value.
+func (g *Grid) GetSeriesIDSetForTagValueSet(set TagValueSet) *tsdb.SeriesIDSet {
+	runs, ok := g.idRunsForTagValueSet(set)
+	return g.seriesIDSetForRuns(runs, ok)
+}
+
+// GetSeriesIDSetForTagValueFunc returns the ids of the series of the grid whose
+// value of the tag key satisfies fn. The values of the dimension are filtered
+// once, then the matching coordinates are computed together.
+// The series of a grid without the key have an empty value.
+func (g *Grid) GetSeriesIDSetForTagValueFunc(key string, fn func(value string) bool) *tsdb.SeriesIDSet {
+	idx, ok := g.tagKeyToIndex[key]
+	if !ok {
+		if fn("") {
+			return g.seriesIDSet.Clone()
+		}
+		return tsdb.NewSeriesIDSet()
+	}
+
+	values := g.tagValuesSlice[idx].values
+	indexes := make([]uint64, 0, len(values))
+	others := make([]uint64, 0, len(values))
+	for i, value := range values {
+		if fn(value) {
+			indexes = append(indexes, uint64(i))
+		} else {
+			others = append(others, uint64(i))
+		}
+	}
+
+	// Most values match a negation, its complement has fewer coordinates.
+	if len(others) < len(indexes) {
+		return g.complementSeriesIDSet(idx, others)
+	}
+	return g.seriesIDSetForDimValues(idx, indexes)
+}
+
+// GetSeriesIDSetForTagValueNotEqual returns the ids of the series of the grid
+// whose value of the tag key is not value. They are the complement of the
+// coordinates of the value within its dimension, intersected with the series
+// of the grid. The series of a grid without the key have an empty value.
+func (g *Grid) GetSeriesIDSetForTagValueNotEqual(key, value string) *tsdb.SeriesIDSet {
+	idx, ok := g.tagKeyToIndex[key]
+	if !ok {
+		if value != "" {
+			return g.seriesIDSet.Clone()
+		}
+		return tsdb.NewSeriesIDSet()
+	}
+
+	index := g.tagValuesSlice[idx].GetValueIndex(value)
+	if index == -1 {
+		return g.seriesIDSet.Clone()
+	}
+	return g.complementSeriesIDSet(idx, []uint64{uint64(index)})
+}
+
+// seriesIDSetForDimValues returns the ids of the series whose value of
+// dimension idx is one of the sorted value indexes.
+func (g *Grid) seriesIDSetForDimValues(idx int, indexes []uint64) *tsdb.SeriesIDSet {
+	if len(indexes) == 0 {
+		return tsdb.NewSeriesIDSet()
+	} else if len(indexes) == len(g.tagValuesSlice[idx].values) {
+		// The slots without value hold no series.
+		return g.seriesIDSet.Clone()
+	}
+
+	choices := make([][]uint64, g.getNumOfDimensions())
+	choices[idx] = indexes
+	return g.seriesIDSetForRuns(newGridIDRuns(g, choices), true)
+}
+
+// complementSeriesIDSet returns the ids of the series whose value of
+// dimension idx is not one of the sorted value indexes.
+func (g *Grid) complementSeriesIDSet(idx int, indexes []uint64) *tsdb.SeriesIDSet {
+	if len(indexes) == 0 {
+		return g.seriesIDSet.Clone()
+	}
+	return g.seriesIDSet.AndNot(g.seriesIDSetForDimValues(idx, indexes))
+}
+
+// seriesIDSetForRuns intersects the runs with the series of the grid, unless
+// there are more runs than series, then the series are matched one by one.
+func (g *Grid) seriesIDSetForRuns(runs *gridIDRuns, ok bool) *tsdb.SeriesIDSet {
+	if !ok {
+		return tsdb.NewSeriesIDSet()
+	} else if runs == nil {
+		return g.seriesIDSet.Clone()
+	}
+
+	if runs.n() > g.seriesIDSet.Cardinality() {
+		idsSet := tsdb.NewSeriesIDSet()
+		g.seriesIDSet.ForEach(func(id uint64) {
+			if runs.contains(id) {
+				idsSet.AddNoLock(id)
+			}
+		})
+		return idsSet
+	}
+
+	idsSet := tsdb.NewSeriesIDSet()
+	runs.forEach(idsSet.AddRangeNoLock)
 	return idsSet.And(g.seriesIDSet)
 }
 
+// GetSeriesIDsWithTagsNoIDSet returns all ids of the grid matching the tags,
+// whether the series exist or not.
 func (g *Grid) GetSeriesIDsWithTagsNoIDSet(tags models.Tags) []uint64 {
 	ids := []uint64{}
-	// check if tag pairs match
-	if len(tags) > g.getNumOfDimensions() {
+	runs, ok := g.idRuns(tags)
+	if !ok {
+		return ids
+	} else if runs == nil {
+		g.seriesIDSet.ForEach(func(id uint64) {
+			ids = append(ids, id)
+		})
 		return ids
 	}
+
+	runs.forEach(func(start, end uint64) {
+		for id := start; id < end; id++ {
+			ids = append(ids, id)
+		}
+	})
+	return ids
+}
+
+// idRuns returns the runs of ids matching the tags, or nil runs if no tag
+// constrains a dimension. A tag with the empty value and a key which is not
+// a dimension matches all series. Returns false if a tag is not in the grid.
+func (g *Grid) idRuns(tags models.Tags) (*gridIDRuns, bool) {
+	var choices [][]uint64
 	for _, tag := range tags {
-		if !g.tagValueExists(tag) {
-			return ids
+		idx, ok := g.tagKeyToIndex[string(tag.Key)]
+		if !ok {
+			if len(tag.Value) == 0 {
+				continue
+			}
+			return nil, false
+		}
+		index := g.tagValuesSlice[idx].GetValueIndex(string(tag.Value))
+		if index == -1 {
+			return nil, false
 		}
+		if choices == nil {
+			choices = make([][]uint64, g.getNumOfDimensions())
+		}
+		choices[idx] = []uint64{uint64(index)}
+	}
+	if choices == nil {
+		return nil, true
 	}
+	return newGridIDRuns(g, choices), true
+}
 
-	if len(tags) == 0 {
-		g.seriesIDSet.ForEach(func(id uint64) {
-			ids = append(ids, id)
-		})
-		return ids
+// idRunsForTagValueSet returns the runs of ids matching the tag value set,
+// or nil runs if no key of the set is a dimension. Values not in the grid are
+// skipped. A key which is not a dimension matches all series if the empty
+// value is allowed. Returns false if no value of a key is in the grid.
+func (g *Grid) idRunsForTagValueSet(set TagValueSet) (*gridIDRuns, bool) {
+	var choices [][]uint64
+	for key, values := range set {
+		idx, ok := g.tagKeyToIndex[key]
+		if !ok {
+			// The series of the grid have the empty value.
+			if containsString(values, "") {
+				continue
+			}
+			return nil, false
+		}
+		indexes := make([]uint64, 0, len(values))
+		for _, value := range values {
+			if index := g.tagValuesSlice[idx].GetValueIndex(value); index != -1 {
+				indexes = append(indexes, uint64(index))
+			}
+		}
+		if len(indexes) == 0 {
+			return nil, false
+		}
+		if choices == nil {
+			choices = make([][]uint64, g.getNumOfDimensions())
+		}
+		choices[idx] = uniqueSortedUint64s(indexes)
+	}
+	if choices == nil {
+		return nil, true
 	}
+	return newGridIDRuns(g, choices), true
+}
+
+// gridIDRuns describes the ids of a grid matching allowed values of some
+// dimensions. The id of a coordinate is the offset of the grid plus the
+// coordinate in mixed radix, the first dimension being the most significant.
+// Matching ids form one run of consecutive ids for each combination of the
+// dimensions up to the last constrained one.
+type gridIDRuns struct {
+	offset     uint64
+	base       uint64     // first id of the first run, without offset
+	length     uint64     // number of ids of a run
+	choices    [][]uint64 // sorted value indexes allowed in each dimension, nil if free
+	capacities []uint64
+	weights    []uint64 // id distance between two values of a dimension
+	varying    []int    // dimensions up to the last constrained one with several values
+}
 
-	indexes := make([]int, 0, g.getNumOfDimensions())
-	capacities := make([]uint64, 0, g.getNumOfDimensions())
-	for i := range g.tagKeys {
-		indexes = append(indexes, -1)
-		capacities = append(capacities, g.tagValuesSlice[i].capacity)
+func newGridIDRuns(g *Grid, choices [][]uint64) *gridIDRuns {
+	n := len(choices)
+	r := &gridIDRuns{
+		offset:     g.offset,
+		length:     1,
+		choices:    choices,
+		capacities: make([]uint64, n),
+		weights:    make([]uint64, n),
 	}
-	for _, tag := range tags {
-		idx := g.tagKeyToIndex[string(tag.Key)]
-		valueIdx := g.tagValuesSlice[idx].GetValueIndex(string(tag.Value))
-		indexes[idx] = valueIdx
+	weight := uint64(1)
+	last := -1
+	for d := n - 1; d >= 0; d-- {
+		r.capacities[d] = g.tagValuesSlice[d].capacity
+		r.weights[d] = weight
+		if choices[d] != nil && last == -1 {
+			last, r.length = d, weight
+		}
+		weight *= r.capacities[d]
+	}
+	for d := 0; d <= last; d++ {
+		r.base += r.value(d, 0) * r.weights[d]
+		if r.size(d) > 1 {
+			r.varying = append(r.varying, d)
+		}
 	}
+	return r
+}
 
-	prev := []uint64{}
-	if indexes[0] != -1 {
-		prev = append(prev, uint64(indexes[0]))
-	} else {
-		for i := uint64(0); i < capacities[0]; i++ {
-			prev = append(prev, i)
+// size returns the number of values allowed in dimension d.
+func (r *gridIDRuns) size(d int) uint64 {
+	if r.choices[d] == nil {
+		return r.capacities[d]
+	}
+	return uint64(len(r.choices[d]))
+}
+
+// value returns the i-th value allowed in dimension d.
+func (r *gridIDRuns) value(d int, i uint64) uint64 {
+	if r.choices[d] == nil {
+		return i
+	}
+	return r.choices[d][i]
+}
+
+// n returns the number of runs.
+func (r *gridIDRuns) n() uint64 {
+	n := uint64(1)
+	for _, d := range r.varying {
+		n *= r.size(d)
+	}
+	return n
+}
+
+// forEach calls fn with each run [start, end), in increasing order.
+func (r *gridIDRuns) forEach(fn func(start, end uint64)) {
+	positions := make([]uint64, len(r.varying))
+	start := r.offset + r.base
+	for {
+		fn(start, start+r.length)
+
+		// Move to the next combination of the varying dimensions.
+		k := len(r.varying) - 1
+		for ; k >= 0; k-- {
+			d := r.varying[k]
+			start -= r.value(d, positions[k]) * r.weights[d]
+			if positions[k]++; positions[k] < r.size(d) {
+				start += r.value(d, positions[k]) * r.weights[d]
+				break
+			}
+			positions[k] = 0
+			start += r.value(d, 0) * r.weights[d]
+		}
+		if k < 0 {
+			return
 		}
 	}
-	ids = VariableBaseConvert(indexes, capacities, 1, prev)
+}
 
-	for i := range ids {
-		ids[i] += g.offset
+// contains returns true if the id is in one of the runs.
+func (r *gridIDRuns) contains(id uint64) bool {
+	local := id - r.offset
+	if id < r.offset || local >= r.weights[0]*r.capacities[0] {
+		return false
 	}
+	for d, values := range r.choices {
+		if values == nil {
+			continue
+		}
+		v := (local / r.weights[d]) % r.capacities[d]
+		if i := sort.Search(len(values), func(i int) bool { return values[i] >= v }); i == len(values) || values[i] != v {
+			return false
+		}
+	}
+	return true
+}
 
-	return ids
+// uniqueSortedUint64s sorts a and removes its duplicates in place.
+func uniqueSortedUint64s(a []uint64) []uint64 {
+	sort.Slice(a, func(i, j int) bool { return a[i] < a[j] })
+	n := 0
+	for i := range a {
+		if i == 0 || a[i] != a[n-1] {
+			a[n] = a[i]
+			n++
+		}
+	}
+	return a[:n]
 }
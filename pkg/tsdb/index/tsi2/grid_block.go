@@ -2,6 +2,8 @@ package tsi2
 
 import (
 	"bytes"
+	"fmt"
+	"hash/crc32"
 	"io"
 )
 
@@ -15,10 +17,27 @@ import (
 // 	version int // tag block version
 // }
 
+// GridBlockVersion is the version of the grids written by GridBlockEncoder,
+// in their first byte. Grids of version 1 have no version byte and start
+// with their offset as a big-endian uint64, whose first byte is zero as the
+// ids of the grids fit in 32 bits.
+const GridBlockVersion = 2
+
+// GridChecksumSize is the size of the checksum ending a grid of version 2.
+const GridChecksumSize = 4
+
 // GridBlockEncoder encodes a grid to a GridBlock section.
+//
+// A grid holds its offset, then each tag key with the capacity and the tag
+// values of the key, and its series id set. Lengths and counts are uvarints,
+// keys and values are their indexes in the dictionary of the measurement,
+// and a CRC32 checksum of the grid ends it.
 type GridBlockEncoder struct {
-	w   io.Writer
-	buf bytes.Buffer
+	w    io.Writer
+	dict *GridDictionaryWriter
+
+	buf       bytes.Buffer // grid
+	seriesBuf bytes.Buffer // series id set of the grid
 
 	// // Track value offsets.
 	// offsets *rhh.HashMap
@@ -32,10 +51,13 @@ type GridBlockEncoder struct {
 	// prevValue []byte
 }
 
-// NewGridBlockEncoder returns a new TagBlockEncoder.
-func NewGridBlockEncoder(w io.Writer) *GridBlockEncoder {
+// NewGridBlockEncoder returns a new GridBlockEncoder, which encodes the tag
+// keys and values of the grids with their indexes in dict. The dictionary
+// must be written before the grids are encoded.
+func NewGridBlockEncoder(w io.Writer, dict *GridDictionaryWriter) *GridBlockEncoder {
 	return &GridBlockEncoder{
 		w:       w,
+		dict:    dict,
 		trailer: GridBlockTrailer{},
 	}
 }
@@ -43,52 +65,67 @@ func NewGridBlockEncoder(w io.Writer) *GridBlockEncoder {
 // N returns the number of bytes written.
 func (enc *GridBlockEncoder) N() int64 { return enc.n }
 
+// EncodeGrid encodes the grid and writes it to the underlying writer.
 func (enc *GridBlockEncoder) EncodeGrid(g *Grid) error {
-	// 8 bytes
-	writeUint64To(enc.w, g.offset, &enc.n)
-
-	// 8 + (8 + len(key) ...)
-	writeUint64To(enc.w, uint64(len(g.tagKeys)), &enc.n)
-	for _, key := range g.tagKeys {
-		writeUint64To(enc.w, uint64(len(key)), &enc.n)
-		writeTo(enc.w, []byte(key), &enc.n)
+	// Build the grid in buffer, to checksum it.
+	enc.buf.Reset()
+	var n int64
+	if err := writeUint8To(&enc.buf, GridBlockVersion, &n); err != nil {
+		return err
+	} else if err := writeUvarintTo(&enc.buf, g.offset, &n); err != nil {
+		return err
 	}
 
-	// 8 + (8 + 8 + (8 + len(value) ...) ... )
-	writeUint64To(enc.w, uint64(len(g.tagValuesSlice)), &enc.n)
-	for _, tagValues := range g.tagValuesSlice {
-		writeUint64To(enc.w, tagValues.capacity, &enc.n)
-		writeUint64To(enc.w, uint64(len(tagValues.values)), &enc.n)
+	if err := writeUvarintTo(&enc.buf, uint64(len(g.tagKeys)), &n); err != nil {
+		return err
+	}
+	for i, key := range g.tagKeys {
+		tagValues := g.tagValuesSlice[i]
+		if err := enc.writeStringTo(&enc.buf, key, &n); err != nil {
+			return err
+		} else if err := writeUvarintTo(&enc.buf, tagValues.capacity, &n); err != nil {
+			return err
+		} else if err := writeUvarintTo(&enc.buf, uint64(len(tagValues.values)), &n); err != nil {
+			return err
+		}
 		for _, value := range tagValues.values {
-			writeUint64To(enc.w, uint64(len(value)), &enc.n)
-			writeTo(enc.w, []byte(value), &enc.n)
+			if err := enc.writeStringTo(&enc.buf, value, &n); err != nil {
+				return err
+			}
 		}
 	}
 
-	ss := g.seriesIDSet
-	// Build series data in buffer.
-	enc.buf.Reset()
-	if _, err := ss.WriteTo(&enc.buf); err != nil {
+	// Write series data size & data.
+	enc.seriesBuf.Reset()
+	if _, err := g.seriesIDSet.WriteTo(&enc.seriesBuf); err != nil {
+		return err
+	} else if err := writeUvarintTo(&enc.buf, uint64(enc.seriesBuf.Len()), &n); err != nil {
+		return err
+	} else if err := writeTo(&enc.buf, enc.seriesBuf.Bytes(), &n); err != nil {
 		return err
 	}
 
-	// // Write series count.
-	// if err := writeUvarintTo(enc.w, uint64(ss.Cardinality()), &enc.n); err != nil {
-	// 	return err
-	// }
-
-	// Write data size & buffer.
-	if err := writeUint64To(enc.w, uint64(enc.buf.Len()), &enc.n); err != nil {
+	// Write checksum.
+	if err := writeUint32To(&enc.buf, crc32.ChecksumIEEE(enc.buf.Bytes()), &n); err != nil {
 		return err
 	}
+
 	nn, err := enc.buf.WriteTo(enc.w)
 	if enc.n += nn; err != nil {
 		return err
 	}
-
 	return nil
 }
 
+// writeStringTo writes the index of s in the dictionary.
+func (enc *GridBlockEncoder) writeStringTo(w io.Writer, s string, n *int64) error {
+	i, ok := enc.dict.index(s)
+	if !ok {
+		return fmt.Errorf("%q is not in the grid dictionary", s)
+	}
+	return writeUvarintTo(w, i, n)
+}
+
 // // ensureHeaderWritten writes a single byte to offset the rest of the block.
 // func (enc *GridBlockEncoder) ensureHeaderWritten() error {
 // 	if enc.n > 0 {
@@ -1,13 +1,17 @@
 package tsi2
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"reflect"
 	"testing"
 
+	"cycledb/pkg/tsdb"
+
 	"github.com/influxdata/influxdb/v2/models"
-	"github.com/influxdata/influxdb/v2/pkg/testing/assert"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestEncodeGrid(t *testing.T) {
@@ -39,7 +43,15 @@ func TestEncodeGrid(t *testing.T) {
 		os.Remove(f.Name())
 	})
 
-	enc := NewGridBlockEncoder(f)
+	dw := NewGridDictionaryWriter()
+	dw.AddGrid(grid)
+	var dictBuf bytes.Buffer
+	_, err = dw.WriteTo(&dictBuf)
+	assert.NoError(t, err)
+	var dict GridDictionary
+	assert.NoError(t, dict.UnmarshalBinary(dictBuf.Bytes()))
+
+	enc := NewGridBlockEncoder(f, dw)
 	enc.EncodeGrid(grid)
 	// fmt.Printf("enc.n: %d\n", enc.n)
 
@@ -48,7 +60,7 @@ func TestEncodeGrid(t *testing.T) {
 	assert.Equal(t, err, nil)
 	assert.NotEqual(t, n, 0)
 
-	g, err := DecodeGrid(buf)
+	g, err := DecodeGrid(buf, &dict)
 	assert.Equal(t, err, nil)
 
 	assert.Equal(t, grid.offset, g.offset)
@@ -58,3 +70,95 @@ func TestEncodeGrid(t *testing.T) {
 	assert.Equal(t, grid.seriesIDSet.Cardinality(), g.seriesIDSet.Cardinality())
 	// assert.Equal(t, reflect.DeepEqual(grid, g), true)
 }
+
+func TestDecodeGrid_Truncated(t *testing.T) {
+	values := newTagValues(2)
+	values.SetValue("east")
+	grid := NewGridWithKeysAndValuesSlice(0, []string{"region"}, []*TagValues{values}, tsdb.NewSeriesIDSet(0))
+
+	buf, dict := encodeTestGrid(t, grid)
+	for n := 0; n < len(buf); n++ {
+		if _, err := DecodeGrid(buf[:n], dict); !errors.Is(err, ErrInvalidGrid) {
+			t.Fatalf("truncated to %d bytes: unexpected error: %v", n, err)
+		}
+	}
+	_, err := DecodeGrid(buf, dict)
+	assert.NoError(t, err)
+
+	// The checksum covers the whole grid.
+	for i := 1; i < len(buf); i++ {
+		corrupt := append([]byte(nil), buf...)
+		corrupt[i] ^= 0xff
+		if _, err := DecodeGrid(corrupt, dict); !errors.Is(err, ErrInvalidGrid) {
+			t.Fatalf("corrupt byte %d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+// Ensure grids of version 1 are still decoded, and are larger.
+func TestDecodeGrid_V1(t *testing.T) {
+	regions, servers := newTagValues(4), newTagValues(4)
+	for _, v := range []string{"east", "west", "north"} {
+		regions.SetValue(v)
+	}
+	for _, v := range []string{"server_a", "server_b"} {
+		servers.SetValue(v)
+	}
+	grid := NewGridWithKeysAndValuesSlice(32, []string{"region", "server"}, []*TagValues{regions, servers}, tsdb.NewSeriesIDSet(32, 37, 45))
+
+	v1 := encodeGridV1(grid)
+	g, err := DecodeGrid(v1, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, grid.offset, g.offset)
+	assert.Equal(t, grid.tagKeys, g.tagKeys)
+	assert.Equal(t, reflect.DeepEqual(grid.tagValuesSlice, g.tagValuesSlice), true)
+	assert.Equal(t, grid.seriesIDSet.Slice(), g.seriesIDSet.Slice())
+
+	v2, _ := encodeTestGrid(t, grid)
+	assert.Less(t, len(v2), len(v1))
+
+	// Grids of version 2 cannot be decoded without their dictionary.
+	_, err = DecodeGrid(v2, nil)
+	assert.True(t, errors.Is(err, ErrInvalidGrid))
+}
+
+// encodeTestGrid encodes the grid, and returns it with its dictionary.
+func encodeTestGrid(t *testing.T, g *Grid) ([]byte, *GridDictionary) {
+	t.Helper()
+	var dictBuf, buf bytes.Buffer
+	dw := NewGridDictionaryWriter()
+	dw.AddGrid(g)
+	_, err := dw.WriteTo(&dictBuf)
+	assert.NoError(t, err)
+	assert.NoError(t, NewGridBlockEncoder(&buf, dw).EncodeGrid(g))
+
+	var dict GridDictionary
+	assert.NoError(t, dict.UnmarshalBinary(dictBuf.Bytes()))
+	return buf.Bytes(), &dict
+}
+
+// encodeGridV1 encodes the grid as files of version 4 and before did.
+func encodeGridV1(g *Grid) []byte {
+	var buf bytes.Buffer
+	var n int64
+	writeUint64To(&buf, g.offset, &n)
+	writeUint64To(&buf, uint64(len(g.tagKeys)), &n)
+	for _, key := range g.tagKeys {
+		writeUint64To(&buf, uint64(len(key)), &n)
+		writeTo(&buf, []byte(key), &n)
+	}
+	writeUint64To(&buf, uint64(len(g.tagValuesSlice)), &n)
+	for _, tagValues := range g.tagValuesSlice {
+		writeUint64To(&buf, tagValues.capacity, &n)
+		writeUint64To(&buf, uint64(len(tagValues.values)), &n)
+		for _, value := range tagValues.values {
+			writeUint64To(&buf, uint64(len(value)), &n)
+			writeTo(&buf, []byte(value), &n)
+		}
+	}
+	var ss bytes.Buffer
+	g.seriesIDSet.WriteTo(&ss)
+	writeUint64To(&buf, uint64(ss.Len()), &n)
+	writeTo(&buf, ss.Bytes(), &n)
+	return buf.Bytes()
+}
@@ -0,0 +1,88 @@
+package tsi2
+
+import (
+	"container/list"
+	"sync"
+	"unsafe"
+)
+
+// DefaultGridCacheSize is the number of decoded grids kept by each index file.
+const DefaultGridCacheSize = 1024
+
+// gridCache is an LRU cache of the grids decoded from an index file, by
+// their offset in the file. When more than capacity grids are added, the
+// least recently used grid is evicted.
+type gridCache struct {
+	mu      sync.Mutex
+	cache   map[int64]*list.Element
+	evictor *list.List
+
+	capacity int
+}
+
+type gridCacheElement struct {
+	offset int64
+	grid   *Grid
+}
+
+// newGridCache returns a gridCache holding up to c grids.
+func newGridCache(c int) *gridCache {
+	return &gridCache{
+		cache:    map[int64]*list.Element{},
+		evictor:  list.New(),
+		capacity: c,
+	}
+}
+
+// get returns the grid at the offset, or nil if it is not cached.
+func (c *gridCache) get(offset int64) *Grid {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ele, ok := c.cache[offset]; ok {
+		c.evictor.MoveToFront(ele) // This now becomes most recently used.
+		return ele.Value.(*gridCacheElement).grid
+	}
+	return nil
+}
+
+// put caches the grid at the offset, evicting the least recently used grid
+// if the cache is full.
+func (c *gridCache) put(offset int64, grid *Grid) {
+	if c.capacity <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ele, ok := c.cache[offset]; ok {
+		c.evictor.MoveToFront(ele)
+		ele.Value.(*gridCacheElement).grid = grid
+		return
+	}
+	c.cache[offset] = c.evictor.PushFront(&gridCacheElement{offset: offset, grid: grid})
+
+	if c.evictor.Len() > c.capacity {
+		e := c.evictor.Back()
+		c.evictor.Remove(e)
+		delete(c.cache, e.Value.(*gridCacheElement).offset)
+	}
+}
+
+// len returns the number of cached grids.
+func (c *gridCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evictor.Len()
+}
+
+// bytes estimates the memory footprint of the cached grids, in bytes.
+func (c *gridCache) bytes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var b int
+	for _, ele := range c.cache {
+		b += int(unsafe.Sizeof(*ele)) + int(unsafe.Sizeof(gridCacheElement{}))
+		b += ele.Value.(*gridCacheElement).grid.bytes()
+	}
+	return b
+}
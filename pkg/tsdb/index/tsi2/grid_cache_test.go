@@ -0,0 +1,27 @@
+package tsi2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGridCache(t *testing.T) {
+	c := newGridCache(2)
+	g1, g2, g3 := &Grid{offset: 1}, &Grid{offset: 2}, &Grid{offset: 3}
+	c.put(10, g1)
+	c.put(20, g2)
+	assert.Same(t, g1, c.get(10))
+
+	// The least recently used grid is evicted.
+	c.put(30, g3)
+	assert.Equal(t, 2, c.len())
+	assert.Nil(t, c.get(20))
+	assert.Same(t, g1, c.get(10))
+	assert.Same(t, g3, c.get(30))
+
+	// A cache without capacity keeps nothing.
+	c = newGridCache(0)
+	c.put(10, g1)
+	assert.Nil(t, c.get(10))
+}
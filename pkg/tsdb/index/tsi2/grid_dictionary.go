@@ -0,0 +1,146 @@
+package tsi2
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"sort"
+)
+
+// Grid dictionary field size constants.
+const (
+	// GridDictionaryOffsetSize is the size of the offset of each string.
+	GridDictionaryOffsetSize = 4
+
+	// GridDictionaryTrailerSize is the size of the trailer of a grid dictionary.
+	GridDictionaryTrailerSize = 0 +
+		4 + // string count
+		4 // checksum
+)
+
+// GridDictionary holds the tag keys and values of the grids of a measurement,
+// which grids of version 2 refer to by their index in the dictionary.
+//
+// The strings are sorted and concatenated, then followed by the offset of
+// each string, the string count and a CRC32 checksum of the block.
+type GridDictionary struct {
+	data    []byte
+	offsets []byte
+	n       uint64
+}
+
+// UnmarshalBinary unpacks data into the dictionary, after verifying its
+// checksum. Dictionary is not copied so data should be retained and
+// unchanged after being passed into this function.
+func (d *GridDictionary) UnmarshalBinary(data []byte) error {
+	if len(data) < GridDictionaryTrailerSize {
+		return ErrInvalidGrid
+	}
+	buf := data[len(data)-GridDictionaryTrailerSize:]
+	n, checksum := uint64(binary.BigEndian.Uint32(buf[0:4])), binary.BigEndian.Uint32(buf[4:8])
+	if crc32.ChecksumIEEE(data[:len(data)-4]) != checksum {
+		return ErrInvalidGrid
+	}
+
+	size := uint64(len(data) - GridDictionaryTrailerSize)
+	if n > size/GridDictionaryOffsetSize {
+		return ErrInvalidGrid
+	}
+	d.data = data[:size-n*GridDictionaryOffsetSize]
+	d.offsets = data[size-n*GridDictionaryOffsetSize : size]
+	d.n = n
+
+	// Strings are sorted, so their offsets increase.
+	var prev uint32
+	for i := uint64(0); i < n; i++ {
+		offset := binary.BigEndian.Uint32(d.offsets[i*GridDictionaryOffsetSize:])
+		if offset < prev || uint64(offset) > uint64(len(d.data)) {
+			return ErrInvalidGrid
+		}
+		prev = offset
+	}
+	return nil
+}
+
+// Len returns the number of strings in the dictionary.
+func (d *GridDictionary) Len() int { return int(d.n) }
+
+// String returns a copy of the string at index i.
+// Returns false if i is out of range.
+func (d *GridDictionary) String(i uint64) (string, bool) {
+	if i >= d.n {
+		return "", false
+	}
+	start := binary.BigEndian.Uint32(d.offsets[i*GridDictionaryOffsetSize:])
+	end := uint32(len(d.data))
+	if i+1 < d.n {
+		end = binary.BigEndian.Uint32(d.offsets[(i+1)*GridDictionaryOffsetSize:])
+	}
+	return string(d.data[start:end]), true
+}
+
+// GridDictionaryWriter writes the dictionary of the tag keys and values of
+// grids, and assigns the index of each string.
+type GridDictionaryWriter struct {
+	indexes map[string]uint64
+}
+
+// NewGridDictionaryWriter returns a new GridDictionaryWriter.
+func NewGridDictionaryWriter() *GridDictionaryWriter {
+	return &GridDictionaryWriter{indexes: map[string]uint64{}}
+}
+
+// AddGrid adds the tag keys and values of the grid to the dictionary.
+func (dw *GridDictionaryWriter) AddGrid(g *Grid) {
+	for i, key := range g.tagKeys {
+		dw.indexes[key] = 0
+		for _, value := range g.tagValuesSlice[i].values {
+			dw.indexes[value] = 0
+		}
+	}
+}
+
+// index returns the index of the string, once the dictionary is written.
+func (dw *GridDictionaryWriter) index(s string) (uint64, bool) {
+	i, ok := dw.indexes[s]
+	return i, ok
+}
+
+// WriteTo writes the dictionary to w, and assigns the index of each string.
+func (dw *GridDictionaryWriter) WriteTo(w io.Writer) (n int64, err error) {
+	a := make([]string, 0, len(dw.indexes))
+	for s := range dw.indexes {
+		a = append(a, s)
+	}
+	sort.Strings(a)
+
+	// Checksum everything before the checksum.
+	h := crc32.NewIEEE()
+	hw := io.MultiWriter(w, h)
+
+	// Write the strings.
+	offsets := make([]uint32, 0, len(a))
+	for i, s := range a {
+		if n+int64(len(s)) > math.MaxUint32 {
+			return n, ErrGridDictionaryTooLarge
+		}
+		dw.indexes[s] = uint64(i)
+		offsets = append(offsets, uint32(n))
+		if err := writeTo(hw, []byte(s), &n); err != nil {
+			return n, err
+		}
+	}
+
+	// Write the offsets of the strings, then the trailer.
+	for _, offset := range offsets {
+		if err := writeUint32To(hw, offset, &n); err != nil {
+			return n, err
+		}
+	}
+	if err := writeUint32To(hw, uint32(len(a)), &n); err != nil {
+		return n, err
+	}
+	err = writeUint32To(w, h.Sum32(), &n)
+	return n, err
+}
@@ -0,0 +1,66 @@
+package tsi2
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"cycledb/pkg/tsdb"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensure grid dictionaries can be written and opened.
+func TestGridDictionary(t *testing.T) {
+	dw := NewGridDictionaryWriter()
+	dw.AddGrid(newTagBlockTestGrid([]string{"region", "host"}, []string{"west", "east"}, []string{"a", ""}))
+	dw.AddGrid(newTagBlockTestGrid([]string{"region"}, []string{"east", "north"}))
+
+	var buf bytes.Buffer
+	_, err := dw.WriteTo(&buf)
+	assert.NoError(t, err)
+	var dict GridDictionary
+	assert.NoError(t, dict.UnmarshalBinary(buf.Bytes()))
+
+	// Strings are deduplicated, and sorted.
+	exp := []string{"", "a", "east", "host", "north", "region", "west"}
+	assert.Equal(t, len(exp), dict.Len())
+	for i, s := range exp {
+		got, ok := dict.String(uint64(i))
+		assert.True(t, ok)
+		assert.Equal(t, s, got)
+		idx, ok := dw.index(s)
+		assert.True(t, ok)
+		assert.Equal(t, uint64(i), idx)
+	}
+	_, ok := dict.String(uint64(len(exp)))
+	assert.False(t, ok)
+
+	// The checksum covers the whole dictionary.
+	for i := 0; i < buf.Len(); i++ {
+		corrupt := append([]byte(nil), buf.Bytes()...)
+		corrupt[i] ^= 0xff
+		if err := (&GridDictionary{}).UnmarshalBinary(corrupt); !errors.Is(err, ErrInvalidGrid) {
+			t.Fatalf("corrupt byte %d: unexpected error: %v", i, err)
+		}
+	}
+	assert.True(t, errors.Is((&GridDictionary{}).UnmarshalBinary(buf.Bytes()[:4]), ErrInvalidGrid))
+}
+
+// Ensure an empty dictionary can be written and opened.
+func TestGridDictionary_Empty(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := NewGridDictionaryWriter().WriteTo(&buf)
+	assert.NoError(t, err)
+	var dict GridDictionary
+	assert.NoError(t, dict.UnmarshalBinary(buf.Bytes()))
+	assert.Equal(t, 0, dict.Len())
+
+	// Grids without tag keys need no strings.
+	grid := NewGridWithKeysAndValuesSlice(0, nil, nil, tsdb.NewSeriesIDSet(0))
+	buf.Reset()
+	assert.NoError(t, NewGridBlockEncoder(&buf, NewGridDictionaryWriter()).EncodeGrid(grid))
+	g, err := DecodeGrid(buf.Bytes(), &dict)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0}, g.seriesIDSet.Slice())
+}
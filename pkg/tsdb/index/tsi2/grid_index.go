@@ -3,6 +3,7 @@ package tsi2
 import (
 	"cycledb/pkg/tsdb"
 	"sync"
+	"unsafe"
 
 	"github.com/influxdata/influxdb/v2/models"
 )
@@ -11,17 +12,95 @@ type GridIndex struct {
 	grids     []*Grid
 	optimizer Optimizer
 
+	// offset of the first grid in memory, the ids below it belong to
+	// grids which were flushed to index files
+	offset uint64
+
+	// sealedN is the number of the first grids which are sealed for a flush
+	// to an index file. They no longer change, the series are added to the
+	// later grids, and the grid positions of the log entries start after them.
+	sealedN int
+
+	// highest id a grid may hold, set by the id layout
+	maxID uint64
+
 	mu sync.RWMutex
 }
 
-func NewGridIndex(optimizer *MultiplierOptimizer) *GridIndex {
+func NewGridIndex(optimizer Optimizer) *GridIndex {
 	return &GridIndex{
 		grids:     []*Grid{},
 		optimizer: optimizer,
+		// so that the id begins at 1, not 0
+		offset: 1,
+		maxID:  DefaultIDLayout.MaxIndexID(),
+	}
+}
+
+// nextOffset returns the offset for the next grid to be created.
+func (gi *GridIndex) nextOffset() uint64 {
+	if len(gi.grids) == 0 {
+		return gi.offset
+	}
+	lastGrid := gi.grids[len(gi.grids)-1]
+	return lastGrid.offset + lastGrid.getCapacityOfIDs()
+}
+
+// seal seals all grids in memory and returns them. They are written to an
+// index file without the lock, while the series are added to new grids.
+func (gi *GridIndex) seal() []*Grid {
+	gi.mu.Lock()
+	defer gi.mu.Unlock()
+	gi.sealedN = len(gi.grids)
+	return gi.grids[:gi.sealedN:gi.sealedN]
+}
+
+// releaseSealed drops the sealed grids from memory after they are flushed
+// to an index file. The ids of later grids continue after the released ones.
+func (gi *GridIndex) releaseSealed() {
+	gi.mu.Lock()
+	defer gi.mu.Unlock()
+	if gi.sealedN == 0 {
+		return
+	}
+	last := gi.grids[gi.sealedN-1]
+	gi.offset = last.offset + last.getCapacityOfIDs()
+	gi.grids = append([]*Grid{}, gi.grids[gi.sealedN:]...)
+	gi.sealedN = 0
+}
+
+// allGrids returns the grids in memory.
+func (gi *GridIndex) allGrids() []*Grid {
+	gi.mu.RLock()
+	defer gi.mu.RUnlock()
+	return gi.grids[:len(gi.grids):len(gi.grids)]
+}
+
+// bytes estimates the memory footprint of the grid index, in bytes.
+func (gi *GridIndex) bytes() int {
+	var b int
+	b += int(unsafe.Sizeof(gi.grids)) + gi.gridBytes()
+	b += int(unsafe.Sizeof(gi.optimizer))
+	b += int(unsafe.Sizeof(gi.offset))
+	b += int(unsafe.Sizeof(gi.sealedN))
+	b += int(unsafe.Sizeof(gi.maxID))
+	b += 24 // mu RWMutex is 24 bytes
+	return b
+}
+
+// gridBytes estimates the memory footprint of the grids, which is
+// released once they are flushed.
+func (gi *GridIndex) gridBytes() int {
+	gi.mu.RLock()
+	defer gi.mu.RUnlock()
+	var b int
+	for _, grid := range gi.grids {
+		b += int(unsafe.Sizeof(grid)) + grid.bytes()
 	}
+	return b
 }
 
-func (gi *GridIndex) WithAnalyzer(analyzer *MultiplierOptimizer) {
+func (gi *GridIndex) WithAnalyzer(analyzer Optimizer) {
 	gi.optimizer = analyzer
 }
 
@@ -39,6 +118,41 @@ func (gi *GridIndex) GetSeriesIDsForTags(tags models.Tags) *tsdb.SeriesIDSet {
 	return ids
 }
 
+// GetSeriesIDsForTagValueSet returns the ids of the series matching the tag value set.
+func (gi *GridIndex) GetSeriesIDsForTagValueSet(set TagValueSet) *tsdb.SeriesIDSet {
+	ids := tsdb.NewSeriesIDSet()
+	gi.mu.RLock()
+	defer gi.mu.RUnlock()
+	for _, grid := range gi.grids {
+		ids.MergeInPlace(grid.GetSeriesIDSetForTagValueSet(set))
+	}
+	return ids
+}
+
+// GetSeriesIDsForTagValueFunc returns the ids of the series whose value of
+// the tag key satisfies fn.
+func (gi *GridIndex) GetSeriesIDsForTagValueFunc(key string, fn func(value string) bool) *tsdb.SeriesIDSet {
+	ids := tsdb.NewSeriesIDSet()
+	gi.mu.RLock()
+	defer gi.mu.RUnlock()
+	for _, grid := range gi.grids {
+		ids.MergeInPlace(grid.GetSeriesIDSetForTagValueFunc(key, fn))
+	}
+	return ids
+}
+
+// GetSeriesIDsForTagValueNotEqual returns the ids of the series whose value
+// of the tag key is not value.
+func (gi *GridIndex) GetSeriesIDsForTagValueNotEqual(key, value string) *tsdb.SeriesIDSet {
+	ids := tsdb.NewSeriesIDSet()
+	gi.mu.RLock()
+	defer gi.mu.RUnlock()
+	for _, grid := range gi.grids {
+		ids.MergeInPlace(grid.GetSeriesIDSetForTagValueNotEqual(key, value))
+	}
+	return ids
+}
+
 // GetStrictlyMatchedSeriesIDForTags: each dimension must match strictly, or return -1
 func (gi *GridIndex) GetStrictlyMatchedSeriesIDForTags(tags models.Tags) (uint64, bool) {
 	for _, grid := range gi.grids {
@@ -50,14 +164,24 @@ func (gi *GridIndex) GetStrictlyMatchedSeriesIDForTags(tags models.Tags) (uint64
 	return 0, false
 }
 
-// SetTags: (insert series keys, then) return corresponding id
-func (gi *GridIndex) SetTags(tags models.Tags) (uint64, bool) {
+// SetTags: (insert series keys, then) return corresponding id.
+// ErrSeriesIDOverflow is returned if a new grid is needed and its ids
+// do not fit in the id layout.
+func (gi *GridIndex) SetTags(tags models.Tags) (uint64, bool, error) {
+	id, entries, err := gi.setTags(tags)
+	return id, len(entries) != 0, err
+}
+
+// setTags works as SetTags, and also returns the log entries describing
+// how the grids were changed, or nil if the tags already exist.
+// The entries are returned without measurement name.
+func (gi *GridIndex) setTags(tags models.Tags) (uint64, []LogEntry, error) {
 	// 1. if tag pair sets already exist
 	gi.mu.RLock()
 	id, ok := gi.GetStrictlyMatchedSeriesIDForTags(tags)
 	if ok {
 		gi.mu.RUnlock()
-		return id, false
+		return id, nil, nil
 	}
 	gi.mu.RUnlock()
 
@@ -67,12 +191,17 @@ func (gi *GridIndex) SetTags(tags models.Tags) (uint64, bool) {
 	defer gi.mu.Unlock()
 	id, ok = gi.GetStrictlyMatchedSeriesIDForTags(tags)
 	if ok {
-		return id, false
+		return id, nil, nil
 	}
+	gi.optimizer.Observe(tags)
 
-	for _, grid := range gi.grids {
-		if id, ok = grid.SetTags(tags); ok {
-			return id, true
+	for n, grid := range gi.grids[gi.sealedN:] {
+		if id, dims, ok := grid.setTags(tags); ok {
+			entries := make([]LogEntry, 0, len(dims)+1)
+			for _, dim := range dims {
+				entries = append(entries, newTagValueLogEntry(n, dim, grid))
+			}
+			return id, append(entries, LogEntry{Flag: LogEntrySeriesIDInsertFlag, Grid: n, SeriesID: id}), nil
 		}
 	}
 
@@ -93,23 +222,145 @@ func (gi *GridIndex) HasTagKey(key string) bool {
 
 func (gi *GridIndex) HasTagValue(key, value string) bool {
 	gi.mu.RLock()
-	defer gi.mu.Unlock()
+	defer gi.mu.RUnlock()
 	for _, grid := range gi.grids {
-		if index, ok := grid.tagKeyToIndex[key]; ok {
-			if _, ok := grid.tagValuesSlice[index].valueToIndex[value]; ok {
-				return true
-			}
+		if grid.HasTagValue(key, value) {
+			return true
 		}
 	}
 	return false
 }
 
-func (gi *GridIndex) initGridAndSetTags(tags models.Tags) (uint64, bool) {
+func (gi *GridIndex) initGridAndSetTags(tags models.Tags) (uint64, []LogEntry, error) {
 	grid := gi.optimizer.NewOptimizedGrid(gi, tags)
+	if !gi.fits(grid.offset, grid.tagValuesSlice) {
+		return 0, nil, ErrSeriesIDOverflow
+	}
 	gi.grids = append(gi.grids, grid)
 	grid.seriesIDSet.Add(grid.offset)
 
-	return grid.offset, true
+	n := len(gi.grids) - 1 - gi.sealedN
+	entries := make([]LogEntry, 0, len(grid.tagKeys)+2)
+	e := LogEntry{Flag: LogEntryGridInsertFlag, Grid: n, Offset: grid.offset}
+	for i, key := range grid.tagKeys {
+		e.Keys = append(e.Keys, []byte(key))
+		e.Capacities = append(e.Capacities, grid.tagValuesSlice[i].capacity)
+	}
+	entries = append(entries, e)
+	for dim := range grid.tagKeys {
+		entries = append(entries, newTagValueLogEntry(n, dim, grid))
+	}
+	return grid.offset, append(entries, LogEntry{Flag: LogEntrySeriesIDInsertFlag, Grid: n, SeriesID: grid.offset}), nil
+}
+
+// fits returns true if the ids of a grid at offset with the dimensions
+// do not exceed the highest id of the grid index.
+func (gi *GridIndex) fits(offset uint64, dims []*TagValues) bool {
+	if offset > gi.maxID {
+		return false
+	}
+	// The capacity is checked dimension by dimension, as the product may overflow.
+	n := gi.maxID - offset + 1
+	for _, tagValues := range dims {
+		if tagValues.capacity == 0 || tagValues.capacity > n {
+			return false
+		}
+		n /= tagValues.capacity
+	}
+	return true
+}
+
+// newTagValueLogEntry returns the log entry of the last tag value appended to dimension dim of grid.
+func newTagValueLogEntry(n, dim int, grid *Grid) LogEntry {
+	values := grid.tagValuesSlice[dim].values
+	return LogEntry{Flag: LogEntryTagValueInsertFlag, Grid: n, Dim: dim, Value: []byte(values[len(values)-1])}
+}
+
+// execEntry applies a log entry to the grid index, rebuilding the grids on replay of the log.
+func (gi *GridIndex) execEntry(e *LogEntry) error {
+	gi.mu.Lock()
+	defer gi.mu.Unlock()
+
+	if e.Flag == LogEntryGridInsertFlag {
+		if e.Grid != len(gi.grids)-gi.sealedN || len(e.Keys) != len(e.Capacities) {
+			return ErrInvalidLogEntry
+		}
+		keys := make([]string, 0, len(e.Keys))
+		tagValuesSlice := make([]*TagValues, 0, len(e.Keys))
+		for i, key := range e.Keys {
+			keys = append(keys, string(key))
+			tagValuesSlice = append(tagValuesSlice, newTagValues(e.Capacities[i]))
+		}
+		if !gi.fits(e.Offset, tagValuesSlice) {
+			return ErrSeriesIDOverflow
+		}
+		gi.grids = append(gi.grids, NewGridWithKeysAndValuesSlice(e.Offset, keys, tagValuesSlice, tsdb.NewSeriesIDSet()))
+		return nil
+	}
+
+	if e.Grid < 0 || e.Grid >= len(gi.grids)-gi.sealedN {
+		return ErrInvalidLogEntry
+	}
+	grid := gi.grids[gi.sealedN+e.Grid]
+
+	switch e.Flag {
+	case LogEntryTagValueInsertFlag:
+		if e.Dim < 0 || e.Dim >= len(grid.tagValuesSlice) || !grid.tagValuesSlice[e.Dim].SetValue(string(e.Value)) {
+			return ErrInvalidLogEntry
+		}
+	case LogEntrySeriesIDInsertFlag:
+		grid.seriesIDSet.Add(e.SeriesID)
+	default:
+		return ErrLogEntryUnknownFlag
+	}
+	return nil
+}
+
+// hasSeriesID returns true if a grid in memory holds the series id.
+func (gi *GridIndex) hasSeriesID(id uint64) bool {
+	gi.mu.RLock()
+	defer gi.mu.RUnlock()
+	for _, g := range gi.grids {
+		if g.seriesIDSet.Contains(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropSeriesID removes the series id from the grid in memory holding it, and
+// retires its coordinate so that the tags get a new id if they are written
+// again. Returns false if no grid in memory holds it, or if its grid is sealed,
+// as sealed grids are written to an index file without the lock.
+func (gi *GridIndex) dropSeriesID(id uint64) bool {
+	gi.mu.Lock()
+	defer gi.mu.Unlock()
+	for i, g := range gi.grids {
+		if !g.seriesIDSet.Contains(id) || g.isDropped(id) {
+			continue
+		}
+		g.drop(id)
+		if i < gi.sealedN {
+			return false
+		}
+		g.seriesIDSet.Remove(id)
+		return true
+	}
+	return false
+}
+
+// SeriesTags returns the tags of the series id, decoded from the coordinates
+// of the id in its grid. Returns false if no grid in memory holds it.
+func (gi *GridIndex) SeriesTags(id uint64) (models.Tags, bool) {
+	gi.mu.RLock()
+	defer gi.mu.RUnlock()
+	for _, g := range gi.grids {
+		if g.seriesIDSet.Contains(id) {
+			tags := g.tagsForID(id)
+			return tags, tags != nil
+		}
+	}
+	return nil, false
 }
 
 func (gi *GridIndex) GetNumOfFilledUpGridForSingleTagKey(tagKey string) int {
@@ -123,33 +374,51 @@ func (gi *GridIndex) GetNumOfFilledUpGridForSingleTagKey(tagKey string) int {
 }
 
 func (gi *GridIndex) NewTagKeyIterator() *TagKeyIterator {
+	return &TagKeyIterator{
+		keys: mapToSlice(gi.tagKeys()),
+	}
+}
+
+func (gi *GridIndex) NewTagValueIterator(key string) *TagValueIterator {
+	return &TagValueIterator{
+		values: mapToSlice(gi.tagValues(key)),
+	}
+}
+
+// addTagValuesTo adds the values of each tag key of the grids in memory to
+// sets, including the empty value of the series lacking the key.
+func (gi *GridIndex) addTagValuesTo(sets map[string]map[string]struct{}) {
 	gi.mu.RLock()
-	res := map[string]struct{}{}
+	defer gi.mu.RUnlock()
 	for _, g := range gi.grids {
-		res = unionStringSets2(res, g.tagKeyToIndex)
+		g.addTagValuesTo(sets)
 	}
-	gi.mu.RUnlock()
+}
 
-	slice := mapToSlice(res)
-	return &TagKeyIterator{
-		keys: slice,
+// tagKeys returns the tag keys of the grids in memory.
+func (gi *GridIndex) tagKeys() map[string]struct{} {
+	gi.mu.RLock()
+	defer gi.mu.RUnlock()
+	res := map[string]struct{}{}
+	for _, g := range gi.grids {
+		res = unionStringSets2(res, g.tagKeyToIndex)
 	}
+	return res
 }
 
-func (gi *GridIndex) NewTagValueIterator(key string) *TagValueIterator {
+// tagValues returns the values of the tag key in the grids in memory,
+// without the empty value of the series lacking the key.
+func (gi *GridIndex) tagValues(key string) map[string]struct{} {
 	gi.mu.RLock()
+	defer gi.mu.RUnlock()
 	res := map[string]struct{}{}
 	for _, g := range gi.grids {
 		if index, ok := g.tagKeyToIndex[key]; ok {
 			res = unionStringSets2(res, g.tagValuesSlice[index].valueToIndex)
 		}
 	}
-	gi.mu.RUnlock()
-
-	slice := mapToSlice(res)
-	return &TagValueIterator{
-		values: slice,
-	}
+	delete(res, "")
+	return res
 }
 
 func (gi *GridIndex) SeriesIDSet() *tsdb.SeriesIDSet {
@@ -168,7 +437,7 @@ func (gi *GridIndex) SeriesIDSetForTagKey(key string) *tsdb.SeriesIDSet {
 	idsSet := tsdb.NewSeriesIDSet()
 	for _, g := range gi.grids {
 		if g.HasTagKey(key) {
-			idsSet.MergeInPlace(g.GetSeriesIDSetForTags(nil))
+			idsSet.MergeInPlace(g.GetSeriesIDSetForTagKey(key))
 		}
 	}
 	return idsSet
@@ -179,16 +448,9 @@ func (gi *GridIndex) SeriesIDSetForTagValue(key, value string) *tsdb.SeriesIDSet
 	defer gi.mu.RUnlock()
 	idsSet := tsdb.NewSeriesIDSet()
 	for _, g := range gi.grids {
-		if g.HasTagValue(key, value) {
-			idsSet.MergeInPlace(g.GetSeriesIDSetForTags(models.NewTags(
-				map[string]string{
-					key: value,
-				},
-			)))
+		if value == "" || g.HasTagValue(key, value) {
+			idsSet.MergeInPlace(g.GetSeriesIDSetForTagValue(key, value))
 		}
 	}
-	// idsSet.ForEach(func (id uint64) {
-	// 	fmt.Printf("SeriesIDSetWithTagValue returns idSet containing %d\n", id)
-	// })
 	return idsSet
 }
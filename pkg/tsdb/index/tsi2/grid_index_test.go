@@ -17,11 +17,13 @@ func TestNothing(t *testing.T) {
 func TestInitAndGetSeriesID(t *testing.T) {
 	gi := tsi2.NewGridIndex(tsi2.NewMultiplierOptimizer(10, 1))
 	// first series
-	id, ok := gi.SetTags(GetTagPairsExample("0"))
+	id, ok, err := gi.SetTags(GetTagPairsExample("0"))
+	assert.NoError(t, err)
 	assert.True(t, ok)
 	assert.True(t, id == 1)
 	// insert the same series twice, should return false and 0
-	id, ok = gi.SetTags(GetTagPairsExample("0"))
+	id, ok, err = gi.SetTags(GetTagPairsExample("0"))
+	assert.NoError(t, err)
 	assert.True(t, id == 1)
 	assert.True(t, !ok)
 	// println(idSet.Cardinality())
@@ -29,11 +31,13 @@ func TestInitAndGetSeriesID(t *testing.T) {
 	// 	println(id)
 	// })
 	// insert the second series
-	id, ok = gi.SetTags(GetTagPairsExample("1"))
+	id, ok, err = gi.SetTags(GetTagPairsExample("1"))
+	assert.NoError(t, err)
 	assert.Equal(t, uint64(1112), id)
 	assert.True(t, ok)
 	// insert the same series twice, should return false and 1111
-	id, ok = gi.SetTags(GetTagPairsExample("1"))
+	id, ok, err = gi.SetTags(GetTagPairsExample("1"))
+	assert.NoError(t, err)
 	assert.Equal(t, uint64(1112), id)
 	assert.True(t, !ok)
 	// get ids of tag pairs (specific)
@@ -49,7 +53,8 @@ func TestInitAndGetSeriesID(t *testing.T) {
 	// incoming tagpairs: [a, 02][b, 12][c, 21][d, 32]
 	// similar to previous one: [a, 01][b, 11][c, 21][d, 31] for c
 	tagPairSet[2].Value = []byte("21")
-	id, ok = gi.SetTags(tagPairSet)
+	id, ok, err = gi.SetTags(tagPairSet)
+	assert.NoError(t, err)
 	assert.Equal(t, id, uint64(2213))
 	assert.True(t, ok)
 	// when looking up with {c, 21}, should return multiple ids
@@ -70,7 +75,8 @@ func TestMultiGrid(t *testing.T) {
 	tagPairSets = append(tagPairSets, gen.GenerateInsertTagsSlice(3, 2)...)
 	wanted := []uint64{0, 3, 4, 7, 8, 12, 19}
 	for i, tagPairSet := range tagPairSets {
-		id, ok := gi.SetTags(tagPairSet)
+		id, ok, err := gi.SetTags(tagPairSet)
+		assert.NoError(t, err)
 		assert.Equal(t, wanted[i]+1, id)
 		assert.True(t, ok)
 	}
@@ -97,7 +103,8 @@ func TestMultiGridWithMultiplier(t *testing.T) {
 	//           20		            31
 	wanted := []uint64{0, 3, 4, 9, 14, 20, 31}
 	for i, tagPairSet := range tagPairSets {
-		id, ok := gi.SetTags(tagPairSet)
+		id, ok, err := gi.SetTags(tagPairSet)
+		assert.NoError(t, err)
 		assert.Equal(t, wanted[i]+1, id)
 		assert.True(t, ok)
 	}
@@ -111,11 +118,12 @@ func TestMultiGridWithMultiplier(t *testing.T) {
 func TestMultiGridWithMultiplier2(t *testing.T) {
 	gen := generators[DiagonalGen]
 	gi := tsi2.NewGridIndex(tsi2.NewMultiplierOptimizer(2, 2))
-	tagPairSets := gen.GenerateInsertTagsSlice(10, 20)
+	tagPairSets := gen.GenerateInsertTagsSlice(5, 20)
 	ids := make([]uint64, 0, len(tagPairSets))
 
 	for _, tagPairSet := range tagPairSets {
-		id, ok := gi.SetTags(tagPairSet)
+		id, ok, err := gi.SetTags(tagPairSet)
+		assert.NoError(t, err)
 		ids = append(ids, id)
 		assert.True(t, ok)
 	}
@@ -127,16 +135,43 @@ func TestMultiGridWithMultiplier2(t *testing.T) {
 	}
 }
 
+// Ensure a grid whose ids exceed the id layout is not created.
+func TestGridIndex_SetTags_Overflow(t *testing.T) {
+	gen := generators[DiagonalGen]
+	gi := tsi2.NewGridIndex(tsi2.NewMultiplierOptimizer(2, 2))
+	tagPairSets := gen.GenerateInsertTagsSlice(10, 20)
+
+	// The third grid holds 8^10 ids, more than the 24 bits of the default layout.
+	var err error
+	var n int
+	for _, tagPairSet := range tagPairSets {
+		if _, _, err = gi.SetTags(tagPairSet); err != nil {
+			break
+		}
+		n++
+	}
+	assert.ErrorIs(t, err, tsi2.ErrSeriesIDOverflow)
+	assert.Equal(t, 6, n)
+
+	// The series inserted before still have distinct ids.
+	ids := gi.SeriesIDSet()
+	assert.Equal(t, uint64(n), ids.Cardinality())
+	for _, tagPairSet := range tagPairSets[:n] {
+		assert.Equal(t, uint64(1), gi.GetSeriesIDsForTags(tagPairSet).Cardinality())
+	}
+}
+
 func TestIfThreadSafeForGridIndex(t *testing.T) {
 	gen := generators[DiagonalGen]
 	index := tsi2.NewGridIndex(tsi2.NewMultiplierOptimizer(2, 2))
-	tagPairSets := gen.GenerateInsertTagsSlice(10, 20)
+	tagPairSets := gen.GenerateInsertTagsSlice(5, 20)
 	wantedIds := sync.Map{}
 	queryTagPairSets := randomSelectTagPairSets(tagPairSets, queryNum)
 	insertData := func(mod int) {
 		for i, tagPairSet := range tagPairSets {
 			if i%mod == 0 {
-				id, okInsert := index.SetTags(tagPairSet)
+				id, okInsert, err := index.SetTags(tagPairSet)
+				assert.NoError(t, err)
 				if existedId, ok := wantedIds.Load(i); ok {
 					assert.Equal(t, existedId.(uint64), id)
 					assert.True(t, !okInsert)
@@ -178,3 +213,50 @@ func TestIfThreadSafeForGridIndex(t *testing.T) {
 		assert.True(t, idSet.Contains(id.(uint64)))
 	}
 }
+
+// Ensure series lacking some tag keys of a grid are inserted in it while the
+// empty value has a free slot.
+func TestGridIndex_SetTags_Sparse(t *testing.T) {
+	gi := tsi2.NewGridIndex(tsi2.NewMultiplierOptimizer(2, 1))
+	for _, tt := range []struct {
+		tags map[string]string
+		id   uint64
+	}{
+		{map[string]string{"a": "a0", "b": "b0"}, 1},
+		{map[string]string{"a": "a1"}, 4},
+		// No free slot for the empty value of a.
+		{map[string]string{"b": "b1"}, 5},
+		{map[string]string{"a": "a1"}, 4},
+	} {
+		id, _, err := gi.SetTags(models.NewTags(tt.tags))
+		assert.NoError(t, err)
+		assert.Equal(t, tt.id, id, tt.tags)
+	}
+
+	assert.Equal(t, []uint64{1, 5}, gi.SeriesIDSetForTagKey("b").Slice())
+	assert.Equal(t, []uint64{4}, gi.SeriesIDSetForTagValue("b", "").Slice())
+	assert.Equal(t, []uint64{5}, gi.SeriesIDSetForTagValue("a", "").Slice())
+	assert.True(t, gi.HasTagValue("a", "a1"))
+	assert.False(t, gi.HasTagValue("a", ""))
+}
+
+func TestGridIndex_SeriesTags(t *testing.T) {
+	gi := tsi2.NewGridIndex(tsi2.NewMultiplierOptimizer(2, 1))
+	series := []models.Tags{
+		models.NewTags(map[string]string{"a": "a0", "b": "b0"}),
+		models.NewTags(map[string]string{"a": "a1", "b": "b1"}),
+		models.NewTags(map[string]string{"a": "a1"}),
+		models.NewTags(map[string]string{"b": "b2"}),
+	}
+	for _, tags := range series {
+		id, _, err := gi.SetTags(tags)
+		assert.NoError(t, err)
+		got, ok := gi.SeriesTags(id)
+		assert.True(t, ok)
+		assert.Equal(t, tags.String(), got.String())
+	}
+
+	// a0,b1 is a free coordinate of the first grid.
+	_, ok := gi.SeriesTags(2)
+	assert.False(t, ok)
+}
@@ -0,0 +1,196 @@
+package tsi2
+
+import (
+	"fmt"
+	"testing"
+
+	"cycledb/pkg/tsdb"
+
+	"github.com/influxdata/influxdb/v2/models"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testGridKeys       = []string{"a", "b", "c"}
+	testGridCapacities = []uint64{4, 5, 6}
+)
+
+const testGridOffset = 7
+
+// newTestGrid returns a grid with all values of testGridKeys set, named
+// after their key and index, holding the series ids.
+func newTestGrid(ids *tsdb.SeriesIDSet) *Grid {
+	tagValuesSlice := make([]*TagValues, 0, len(testGridKeys))
+	for i, key := range testGridKeys {
+		values := newTagValues(testGridCapacities[i])
+		for v := uint64(0); v < testGridCapacities[i]; v++ {
+			values.SetValue(fmt.Sprintf("%s%d", key, v))
+		}
+		tagValuesSlice = append(tagValuesSlice, values)
+	}
+	return NewGridWithKeysAndValuesSlice(testGridOffset, testGridKeys, tagValuesSlice, ids)
+}
+
+// testGridIDSets returns a set with all ids of the test grid, and a set with
+// fewer series than most queries have runs.
+func testGridIDSets() map[string]*tsdb.SeriesIDSet {
+	dense := tsdb.NewSeriesIDSet()
+	dense.AddRange(testGridOffset, testGridOffset+120)
+	sparse := tsdb.NewSeriesIDSet(testGridOffset, testGridOffset+13, testGridOffset+39, testGridOffset+119)
+	return map[string]*tsdb.SeriesIDSet{"dense": dense, "sparse": sparse}
+}
+
+// expectedTestGridIDs returns the ids of ids whose coordinates have one of
+// the allowed values in each dimension of allowed.
+func expectedTestGridIDs(ids *tsdb.SeriesIDSet, allowed map[int][]uint64) []uint64 {
+	res := []uint64{}
+	for a := uint64(0); a < testGridCapacities[0]; a++ {
+		for b := uint64(0); b < testGridCapacities[1]; b++ {
+			for c := uint64(0); c < testGridCapacities[2]; c++ {
+				coord := []uint64{a, b, c}
+				match := true
+				for d, values := range allowed {
+					found := false
+					for _, v := range values {
+						found = found || coord[d] == v
+					}
+					match = match && found
+				}
+				id := testGridOffset + (a*testGridCapacities[1]+b)*testGridCapacities[2] + c
+				if match && ids.Contains(id) {
+					res = append(res, id)
+				}
+			}
+		}
+	}
+	return res
+}
+
+// Ensure the ids computed as runs match the ids of the coordinates, whether
+// the runs or the series of the grid are iterated.
+func TestGrid_GetSeriesIDSetForTags(t *testing.T) {
+	for _, fixed := range []map[int][]uint64{
+		{0: {1}},
+		{1: {2}},
+		{2: {3}},
+		{0: {1}, 2: {3}},
+		{1: {4}, 2: {0}},
+		{0: {3}, 1: {0}, 2: {5}},
+	} {
+		var tags models.Tags
+		for d, v := range fixed {
+			tags = append(tags, models.NewTag([]byte(testGridKeys[d]), []byte(fmt.Sprintf("%s%d", testGridKeys[d], v[0]))))
+		}
+		for name, ids := range testGridIDSets() {
+			t.Run(fmt.Sprintf("%s/%s", name, tags), func(t *testing.T) {
+				g := newTestGrid(ids)
+				assert.Equal(t, expectedTestGridIDs(ids, fixed), g.GetSeriesIDSetForTags(tags).Slice())
+				assert.Equal(t, expectedTestGridIDs(testGridIDSets()["dense"], fixed), g.GetSeriesIDsWithTagsNoIDSet(tags))
+			})
+		}
+	}
+}
+
+func TestGrid_GetSeriesIDSetForTagValueSet(t *testing.T) {
+	for _, allowed := range []map[int][]uint64{
+		{0: {1, 3}},
+		{2: {5, 0, 2}},
+		{0: {1}, 2: {3, 4}},
+		{0: {0, 2}, 1: {1, 3}, 2: {5}},
+		{1: {4, 4}},
+	} {
+		set := TagValueSet{}
+		for d, values := range allowed {
+			for _, v := range values {
+				set[testGridKeys[d]] = append(set[testGridKeys[d]], fmt.Sprintf("%s%d", testGridKeys[d], v))
+			}
+		}
+		for name, ids := range testGridIDSets() {
+			t.Run(fmt.Sprintf("%s/%v", name, set), func(t *testing.T) {
+				g := newTestGrid(ids)
+				assert.Equal(t, expectedTestGridIDs(ids, allowed), g.GetSeriesIDSetForTagValueSet(set).Slice())
+			})
+		}
+	}
+
+	g := newTestGrid(testGridIDSets()["dense"])
+
+	// Values not in the grid are skipped.
+	assert.Equal(t, expectedTestGridIDs(testGridIDSets()["dense"], map[int][]uint64{0: {2}}),
+		g.GetSeriesIDSetForTagValueSet(TagValueSet{"a": {"a2", "a9"}}).Slice())
+
+	// Nothing matches a key without any value in the grid.
+	assert.Equal(t, uint64(0), g.GetSeriesIDSetForTagValueSet(TagValueSet{"a": {"a2"}, "b": {"b9"}}).Cardinality())
+	assert.Equal(t, uint64(0), g.GetSeriesIDSetForTagValueSet(TagValueSet{"z": {"z0"}}).Cardinality())
+}
+
+func TestGrid_GetSeriesIDSetForTagValueFunc(t *testing.T) {
+	for name, ids := range testGridIDSets() {
+		t.Run(name, func(t *testing.T) {
+			g := newTestGrid(ids)
+			odd := func(v string) bool { return v == "b1" || v == "b3" }
+			assert.Equal(t, expectedTestGridIDs(ids, map[int][]uint64{1: {1, 3}}), g.GetSeriesIDSetForTagValueFunc("b", odd).Slice())
+
+			all := func(v string) bool { return true }
+			assert.Equal(t, ids.Slice(), g.GetSeriesIDSetForTagValueFunc("c", all).Slice())
+
+			// The series of a grid without the key have an empty value.
+			empty := func(v string) bool { return v == "" }
+			assert.Equal(t, ids.Slice(), g.GetSeriesIDSetForTagValueFunc("z", empty).Slice())
+			assert.Equal(t, uint64(0), g.GetSeriesIDSetForTagValueFunc("z", odd).Cardinality())
+		})
+	}
+}
+
+func TestGrid_GetSeriesIDSetForTagValueNotEqual(t *testing.T) {
+	for name, ids := range testGridIDSets() {
+		t.Run(name, func(t *testing.T) {
+			g := newTestGrid(ids)
+			assert.Equal(t, expectedTestGridIDs(ids, map[int][]uint64{1: {0, 1, 3, 4}}), g.GetSeriesIDSetForTagValueNotEqual("b", "b2").Slice())
+
+			// A negation matching most values is computed as a complement.
+			notC1 := func(v string) bool { return v != "c1" }
+			assert.Equal(t, expectedTestGridIDs(ids, map[int][]uint64{2: {0, 2, 3, 4, 5}}), g.GetSeriesIDSetForTagValueFunc("c", notC1).Slice())
+
+			assert.Equal(t, ids.Slice(), g.GetSeriesIDSetForTagValueNotEqual("b", "b9").Slice())
+			assert.Equal(t, ids.Slice(), g.GetSeriesIDSetForTagValueNotEqual("z", "z0").Slice())
+			assert.Equal(t, uint64(0), g.GetSeriesIDSetForTagValueNotEqual("z", "").Cardinality())
+		})
+	}
+}
+
+// Ensure series lacking some keys of a grid share it, with the empty value
+// in the dimensions of the missing keys.
+func TestGrid_SetTags_Sparse(t *testing.T) {
+	g := NewGridWithKeysAndValuesSlice(1, []string{"a", "b"}, []*TagValues{newTagValues(2), newTagValues(2)}, tsdb.NewSeriesIDSet())
+
+	full := models.NewTags(map[string]string{"a": "a0", "b": "b0"})
+	id, ok := g.SetTags(full)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), id)
+
+	sparse := models.NewTags(map[string]string{"a": "a0"})
+	id, ok = g.SetTags(sparse)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), id)
+	id, ok = g.GetStrictlyMatchedIDForTags(sparse)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), id)
+
+	// A tag with the empty value is the same as a missing tag.
+	id, ok = g.GetStrictlyMatchedIDForTags(models.NewTags(map[string]string{"a": "a0", "b": "", "z": ""}))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), id)
+
+	// Keys which are not dimensions, or values without a free slot, do not fit.
+	assert.False(t, g.ableToSetTags(models.NewTags(map[string]string{"a": "a0", "z": "z0"})))
+	assert.False(t, g.ableToSetTags(models.NewTags(map[string]string{"b": "b1"})))
+	assert.True(t, g.ableToSetTags(models.NewTags(map[string]string{"a": "a1"})))
+
+	assert.Equal(t, []uint64{1}, g.GetSeriesIDSetForTagKey("b").Slice())
+	assert.Equal(t, []uint64{2}, g.GetSeriesIDSetForTagValue("b", "").Slice())
+	assert.Equal(t, []uint64{1, 2}, g.GetSeriesIDSetForTagValue("z", "").Slice())
+	assert.Equal(t, []uint64{2}, g.GetSeriesIDSetForTagValueSet(TagValueSet{"b": {""}, "z": {"", "z0"}}).Slice())
+	assert.Equal(t, uint64(0), g.GetSeriesIDSetForTagValueSet(TagValueSet{"z": {"z0"}}).Cardinality())
+	assert.False(t, g.HasTagValue("b", ""))
+}
@@ -1,27 +1,42 @@
 package tsi2
 
 import (
-	"bufio"
-	"context"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
-	"time"
+	"strconv"
+	"sync"
+	"unsafe"
 
-	"github.com/influxdata/influxdb/pkg/bytesutil"
-	"github.com/influxdata/influxdb/v2/logger"
+	"github.com/cespare/xxhash"
 	"github.com/influxdata/influxdb/v2/models"
 	"github.com/influxdata/influxdb/v2/pkg/estimator"
+	"github.com/influxdata/influxdb/v2/pkg/estimator/hll"
 	"github.com/influxdata/influxql"
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
 
 	"cycledb/pkg/tsdb"
 )
 
+// IndexName is the name of the index.
+const IndexName = tsdb.TSI2IndexName
+
+func init() {
+	tsdb.RegisterIndex(IndexName, func(_ uint64, db, path string, _ *tsdb.SeriesIDSet, sfile *tsdb.SeriesFile, opt tsdb.EngineOptions) tsdb.Index {
+		idx := NewIndex(sfile, db,
+			WithPath(path),
+			WithMaxInMemorySize(int64(opt.Config.MaxIndexLogFileSize)),
+			WithSeriesIDSetCacheSize(opt.Config.SeriesIDSetCacheSize),
+			WithGridOptimizer(opt.Config.GridOptimizerFor(db)),
+		)
+		return idx
+	})
+}
+
 var (
 	Version      = 1
 	IndexFileExt = ".tsi2"
@@ -33,10 +48,51 @@ var (
 	IndexFilePath = "./tmp"
 )
 
+// DefaultPartitionN determines how many partitions the index is split into.
+//
+// NOTE: This must not be changed once a database is created, as the
+// measurements are assigned to partitions by the hash of their name.
+var DefaultPartitionN = 8
+
+// MaxIndexFileLevel is the highest level of index files, they are never
+// compacted further. Flushed grids are written at level 1.
+const MaxIndexFileLevel = 6
+
+// Default compaction thresholds. The files of a level are merged into the
+// next level once there are DefaultMaxLevelFileN of them, or once they add
+// up to DefaultMaxLevelSize, which grows 4 times with each level.
+const (
+	DefaultMaxLevelFileN       = 4
+	DefaultMaxLevelSize  int64 = 16 << 20 // 16MB
+)
+
+// Index splits the grids of the measurements between partitions, by the hash
+// of the measurement name. Each partition has its own lock, log file, index
+// files and compactions, so that writes to measurements of different
+// partitions run in parallel.
+//
+// The measurement ids are allocated across partitions, so that the series
+// ids are unique within the index.
 type Index struct {
-	// todo(vinland): partition
+	mu         sync.RWMutex
+	partitions []*Partition
+	partitionN int
+
+	// ids allocates the measurement ids of the partitions.
+	ids *measurementIDs
 
-	measurements *Measurements
+	// tagValueCache holds the series id sets of the tag values of the
+	// measurements of all partitions.
+	tagValueCache     *TagValueSeriesIDCache
+	tagValueCacheSize int
+
+	// compaction thresholds of a level of each partition
+	maxLevelFileN int
+	maxLevelSize  int64
+
+	// The grids in memory of a partition are flushed to an index file in
+	// the background once their estimated size reaches maxInMemorySize.
+	maxInMemorySize int64
 
 	logger *zap.Logger // Index's logger.
 
@@ -44,11 +100,12 @@ type Index struct {
 	sfile    *tsdb.SeriesFile // series lookup file
 	database string           // Name of database.
 
-	// todo(vinland): to estimate bytes
-	// need to be protected by mutex
-	// // Cached sketches.
-	// mSketch, mTSketch estimator.Sketch // Measurement sketches, add, delete?
-	// sSketch, sTSketch estimator.Sketch // Series sketches
+	// idLayout splits the series ids between measurements and grids.
+	// It is recorded in the manifest and the index files.
+	idLayout IDLayout
+
+	// gridOptimizer is the name of the optimizer sizing the new grids.
+	gridOptimizer string
 
 	path string // Root directory of the index partitions.
 
@@ -71,13 +128,78 @@ var WithPath = func(path string) IndexOption {
 	}
 }
 
+// WithPartitionN sets the number of partitions of a new index. An existing
+// index must be opened with the number of partitions it was created with.
+var WithPartitionN = func(n int) IndexOption {
+	return func(i *Index) {
+		i.partitionN = n
+	}
+}
+
+// WithMaxLevelFileN sets the number of index files of a level which
+// triggers a compaction to the next level.
+var WithMaxLevelFileN = func(n int) IndexOption {
+	return func(i *Index) {
+		i.maxLevelFileN = n
+	}
+}
+
+// WithMaxLevelSize sets the size of the index files of level 1 which
+// triggers a compaction to the next level.
+var WithMaxLevelSize = func(size int64) IndexOption {
+	return func(i *Index) {
+		i.maxLevelSize = size
+	}
+}
+
+// WithMaxInMemorySize sets the estimated size of the grids in memory of
+// a partition which triggers a flush to a new index file.
+var WithMaxInMemorySize = func(size int64) IndexOption {
+	return func(i *Index) {
+		i.maxInMemorySize = size
+	}
+}
+
+// WithSeriesIDSetCacheSize sets the number of series id sets of tag values
+// kept in memory. A size of 0 disables the cache.
+var WithSeriesIDSetCacheSize = func(sz int) IndexOption {
+	return func(i *Index) {
+		i.tagValueCacheSize = sz
+	}
+}
+
+// WithIDLayout sets the layout of the series ids. An existing index can
+// only be opened with the layout it was created with.
+var WithIDLayout = func(layout IDLayout) IndexOption {
+	return func(i *Index) {
+		i.idLayout = layout
+	}
+}
+
+// WithGridOptimizer sets the optimizer sizing the new grids of the
+// measurements, by its name in the configuration.
+var WithGridOptimizer = func(name string) IndexOption {
+	return func(i *Index) {
+		i.gridOptimizer = name
+	}
+}
+
 // NewIndex returns a new instance of Index.
 func NewIndex(sfile *tsdb.SeriesFile, database string, options ...IndexOption) *Index {
 	idx := &Index{
-		logger:   zap.NewNop(),
-		version:  Version,
-		sfile:    sfile,
-		database: database,
+		logger:        zap.NewNop(),
+		version:       Version,
+		sfile:         sfile,
+		database:      database,
+		partitionN:    DefaultPartitionN,
+		maxLevelFileN: DefaultMaxLevelFileN,
+		maxLevelSize:  DefaultMaxLevelSize,
+
+		maxInMemorySize: tsdb.DefaultMaxIndexLogFileSize,
+
+		tagValueCacheSize: tsdb.DefaultSeriesIDSetCacheSize,
+
+		idLayout: DefaultIDLayout,
 	}
 
 	for _, option := range options {
@@ -87,51 +209,146 @@ func NewIndex(sfile *tsdb.SeriesFile, database string, options ...IndexOption) *
 	return idx
 }
 
+// Open opens the partitions of the index concurrently. The partitions are
+// in numbered directories under the path of the index, except for an index
+// with a single partition, which is in the path itself. An index with a
+// manifest in its path was created with a single partition.
 func (i *Index) Open() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
 	if i.opened {
 		return errors.New("index already open")
 	}
-	i.measurements = NewMeasurements()
+	if i.path == "" {
+		i.path = IndexFilePath
+	}
+	if i.partitionN <= 0 {
+		return fmt.Errorf("invalid partition count %d", i.partitionN)
+	}
+
+	n := i.partitionN
+	if _, err := os.Stat(filepath.Join(i.path, ManifestFileName)); err == nil {
+		n = 1
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	i.ids = newMeasurementIDs()
+	i.tagValueCache = NewTagValueSeriesIDCache(i.tagValueCacheSize)
+	i.partitions = make([]*Partition, n)
+	for j := range i.partitions {
+		path := i.path
+		if n > 1 {
+			path = filepath.Join(i.path, strconv.Itoa(j))
+		}
+		p := NewPartition(i.sfile, path)
+		p.id = j
+		p.ids = i.ids
+		p.tagValueCache = i.tagValueCache
+		p.maxLevelFileN = i.maxLevelFileN
+		p.maxLevelSize = i.maxLevelSize
+		p.maxInMemorySize = i.maxInMemorySize
+		p.idLayout = i.idLayout
+		p.gridOptimizer = i.gridOptimizer
+		p.logger = i.logger.With(zap.Int("tsi2_partition", j))
+		i.partitions[j] = p
+	}
+
+	// Open all the partitions. The log of each partition reserves the ids
+	// of its measurements.
+	var g errgroup.Group
+	for _, p := range i.partitions {
+		g.Go(p.Open)
+	}
+	if err := g.Wait(); err != nil {
+		for _, p := range i.partitions {
+			p.Close()
+		}
+		i.partitions = nil
+		return err
+	}
+
 	i.opened = true
-	i.path = IndexFilePath
 	return nil
 }
 
+// Wait blocks until all outstanding flushes have completed.
+func (i *Index) Wait() {
+	for _, p := range i.partitions {
+		p.Wait()
+	}
+}
+
 func (i *Index) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var err error
+	for _, p := range i.partitions {
+		if e := p.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
 	i.opened = false
+	return err
+}
+
+// Path returns the path the index was opened with.
+func (i *Index) Path() string { return i.path }
+
+// PartitionN returns the number of partitions of the open index.
+func (i *Index) PartitionN() int { return len(i.partitions) }
+
+// PartitionAt returns the partition by index.
+func (i *Index) PartitionAt(index int) *Partition {
+	return i.partitions[index]
+}
+
+// partition returns the partition of the measurement.
+func (i *Index) partition(name []byte) *Partition {
+	return i.partitions[i.partitionIdx(name)]
+}
+
+// partitionIdx returns the index of the partition of the measurement.
+func (i *Index) partitionIdx(name []byte) int {
+	return int(xxhash.Sum64(name) % uint64(len(i.partitions)))
+}
+
+// seriesPartition returns the partition of the measurement of the series,
+// or nil if the measurement id was never allocated.
+func (i *Index) seriesPartition(id uint64) *Partition {
+	measurementID, _ := i.idLayout.splitSeriesID(id)
+	if j, ok := i.ids.partition(measurementID); ok {
+		return i.partitions[j]
+	}
 	return nil
 }
 
-func (i *Index) WithLogger(*zap.Logger) {}
+// WithLogger sets the logger for the index.
+func (i *Index) WithLogger(l *zap.Logger) {
+	i.logger = l.With(zap.String("index", "tsi2"))
+	for j, p := range i.partitions {
+		p.logger = i.logger.With(zap.Int("tsi2_partition", j))
+	}
+}
 
 func (i *Index) Database() string {
 	return i.database
 }
 
 func (i *Index) MeasurementExists(name []byte) (bool, error) {
-	// if _, ok := i.measurementToGIndexes[string(name[:])]; !ok {
-	// 	return false, nil
-	// } else {
-	// 	return true, nil
-	// }
-	gIndex, err := i.measurements.MeasurementByName(name)
-	if err != nil {
-		return false, err
-	}
-	if gIndex == nil {
-		return false, nil
-	}
-	return true, nil
+	return i.partition(name).MeasurementExists(name)
 }
 
 func (i *Index) MeasurementNamesByRegex(re *regexp.Regexp) ([][]byte, error) {
-	// return [][]byte{[]byte("measurement_test")}, nil
 	var res [][]byte
-	for m, _ := range i.measurements.measurementId {
-		if re.MatchString(m) {
-			// Clone bytes since they will be used after the fileset is released.
-			res = append(res, bytesutil.Clone([]byte(m)))
+	for _, p := range i.partitions {
+		names, err := p.MeasurementNamesByRegex(re)
+		if err != nil {
+			return nil, err
 		}
+		res = append(res, names...)
 	}
 	return res, nil
 }
@@ -140,11 +357,12 @@ func (i *Index) MeasurementNamesByRegex(re *regexp.Regexp) ([][]byte, error) {
 func (i *Index) SeriesFile() *tsdb.SeriesFile { return i.sfile }
 
 func (i *Index) DropMeasurement(name []byte) error {
-	return i.measurements.DropMeasurement(name)
+	return i.partition(name).DropMeasurement(name)
 }
 
 func (i *Index) ForEachMeasurementName(fn func(name []byte) error) error {
-	for m := range i.measurements.measurementId {
+	// fn is called without the locks of the partitions, it could use the index.
+	for _, m := range i.MeasurementNames() {
 		if err := fn([]byte(m)); err != nil {
 			return err
 		}
@@ -152,199 +370,199 @@ func (i *Index) ForEachMeasurementName(fn func(name []byte) error) error {
 	return nil
 }
 
+// CreateSeriesListIfNotExists splits the batch between the partitions of
+// the measurements, which add their series concurrently.
 func (i *Index) CreateSeriesListIfNotExists(keys, names [][]byte, tagsSlice []models.Tags) error {
 	if len(names) == 0 {
 		return nil
 	} else if len(names) != len(tagsSlice) {
 		return fmt.Errorf("uneven batch, sent %d names and %d tags", len(names), len(tagsSlice))
 	}
-	newIDs := make([]uint64, 0)
-	newNames := make([][]byte, 0)
-	newTagsSlice := make([]models.Tags, 0)
-	for index := range names {
-		buf := make([]byte, 1024)
-		// 1. check if this seriesKey already exists in seriesFile
-		// todo(vinland): series file and index could have inconsistent series
-		if exist := i.sfile.HasSeries(names[index], tagsSlice[index], buf); !exist {
-			// 2. if not. add to grid index
-			exist, err := i.MeasurementExists(names[index])
-			if err != nil {
-				return err
-			}
-			if !exist {
-				i.measurements.AppendMeasurement(names[index])
-			}
-			id, success := i.measurements.SetTags(names[index], tagsSlice[index])
-			if !success {
-				continue
-			}
-			newIDs = append(newIDs, id)
-			newTagsSlice = append(newTagsSlice, tagsSlice[index])
-			newNames = append(newNames, names[index])
-		}
+
+	// Fast path for a batch of a single partition.
+	if len(i.partitions) == 1 {
+		return i.partitions[0].createSeriesListIfNotExists(keys, names, tagsSlice)
 	}
 
-	// 3. add to seriesFile
-	_, err := i.sfile.CreateSeriesListIfNotExistsWithDesignatedIDs(newNames, newTagsSlice, newIDs)
-	if err != nil {
-		return err
+	pKeys := make([][][]byte, len(i.partitions))
+	pNames := make([][][]byte, len(i.partitions))
+	pTags := make([][]models.Tags, len(i.partitions))
+	for j := range names {
+		pidx := i.partitionIdx(names[j])
+		pKeys[pidx] = append(pKeys[pidx], keys[j])
+		pNames[pidx] = append(pNames[pidx], names[j])
+		pTags[pidx] = append(pTags[pidx], tagsSlice[j])
 	}
 
-	return nil
+	var g errgroup.Group
+	for j := range i.partitions {
+		if len(pNames[j]) == 0 {
+			continue
+		}
+		p, keys, names, tagsSlice := i.partitions[j], pKeys[j], pNames[j], pTags[j]
+		g.Go(func() error {
+			return p.createSeriesListIfNotExists(keys, names, tagsSlice)
+		})
+	}
+	return g.Wait()
 }
 
 func (i *Index) CreateSeriesIfNotExists(key, name []byte, tags models.Tags) error {
-	return i.CreateSeriesListIfNotExists([][]byte{name}, [][]byte{name}, []models.Tags{tags})
+	return i.CreateSeriesListIfNotExists([][]byte{key}, [][]byte{name}, []models.Tags{tags})
 }
 
+// DropSeries removes the series from its grid in memory, or tombstones it if
+// the grid was flushed to an index file. With cascade, the measurement is
+// dropped along with its last series.
 func (i *Index) DropSeries(seriesID uint64, key []byte, cascade bool) error {
-	panic("unimplemented")
+	if p := i.seriesPartition(seriesID); p != nil {
+		return p.DropSeries(seriesID, key, cascade)
+	}
+	return nil
 }
+
+// DropMeasurementIfSeriesNotExist drops a measurement only if there are no more
+// series for the measurement.
 func (i *Index) DropMeasurementIfSeriesNotExist(name []byte) (bool, error) {
-	panic("unimplemented")
+	return i.partition(name).DropMeasurementIfSeriesNotExist(name)
 }
 
 // MeasurementsSketches returns the two measurement sketches for the index.
 func (i *Index) MeasurementsSketches() (estimator.Sketch, estimator.Sketch, error) {
-	// i.mu.RLock()
-	// defer i.mu.RUnlock()
-	// return i.mSketch.Clone(), i.mTSketch.Clone(), nil
-	panic("not implemented")
+	sketch, tSketch := hll.NewDefaultPlus(), hll.NewDefaultPlus()
+	for _, p := range i.partitions {
+		if s, t, err := p.MeasurementsSketches(); err != nil {
+			return nil, nil, err
+		} else if err := sketch.Merge(s); err != nil {
+			return nil, nil, err
+		} else if err := tSketch.Merge(t); err != nil {
+			return nil, nil, err
+		}
+	}
+	return sketch, tSketch, nil
 }
 
 // SeriesSketches returns the two series sketches for the index.
 func (i *Index) SeriesSketches() (estimator.Sketch, estimator.Sketch, error) {
-	// i.mu.RLock()
-	// defer i.mu.RUnlock()
-	// return i.sSketch.Clone(), i.sTSketch.Clone(), nil
-	panic("not implemented")
+	sketch, tSketch := hll.NewDefaultPlus(), hll.NewDefaultPlus()
+	for _, p := range i.partitions {
+		if s, t, err := p.SeriesSketches(); err != nil {
+			return nil, nil, err
+		} else if err := sketch.Merge(s); err != nil {
+			return nil, nil, err
+		} else if err := tSketch.Merge(t); err != nil {
+			return nil, nil, err
+		}
+	}
+	return sketch, tSketch, nil
 }
 
+// SeriesIDSet returns the ids of all series in the index.
 func (i *Index) SeriesIDSet() *tsdb.SeriesIDSet {
-	// return i.measurements.SeriesIDSet()
-	panic("unimplemented")
+	ss := tsdb.NewSeriesIDSet()
+	for _, p := range i.partitions {
+		ss.MergeInPlace(p.SeriesIDSet())
+	}
+	return ss
 }
 
+// SeriesN returns the number of series in the index.
 func (i *Index) SeriesN() int64 {
-	return int64(i.SeriesIDSet().Cardinality())
+	var n int64
+	for _, p := range i.partitions {
+		n += p.SeriesN()
+	}
+	return n
+}
+
+// SeriesByID returns the name and tags of the series, decoded from the
+// coordinates of its id in its grid, without reading the series file.
+// Returns a nil name if the series does not exist.
+func (i *Index) SeriesByID(id uint64) ([]byte, models.Tags, error) {
+	if p := i.seriesPartition(id); p != nil {
+		return p.SeriesByID(id)
+	}
+	return nil, nil, nil
 }
 
 func (i *Index) HasTagKey(name, key []byte) (bool, error) {
-	return i.measurements.HasTagKey(name, key)
+	return i.partition(name).HasTagKey(name, key)
 }
 func (i *Index) HasTagValue(name, key, value []byte) (bool, error) {
-	return i.measurements.HasTagValue(name, key, value)
+	return i.partition(name).HasTagValue(name, key, value)
 }
 
 // MeasurementTagKeysByExpr extracts the tag keys wanted by the expression.
 func (i *Index) MeasurementTagKeysByExpr(name []byte, expr influxql.Expr) (map[string]struct{}, error) {
-	// Return all keys if no condition was passed in.
-	// if expr == nil {
-	// 	m := make(map[string]struct{})
-	// 	if itr := i.TagKeyIterator(name); itr != nil {
-	// 		for e := itr.Next(); e != nil; e = itr.Next() {
-	// 			m[string(e.Key())] = struct{}{}
-	// 		}
-	// 	}
-	// 	return m, nil
-	// }
-
-	// switch e := expr.(type) {
-	// case *influxql.BinaryExpr:
-	// 	switch e.Op {
-	// 	case influxql.EQ, influxql.NEQ, influxql.EQREGEX, influxql.NEQREGEX:
-	// 		tag, ok := e.LHS.(*influxql.VarRef)
-	// 		if !ok {
-	// 			return nil, fmt.Errorf("left side of '%s' must be a tag key", e.Op.String())
-	// 		} else if tag.Val != "_tagKey" {
-	// 			return nil, nil
-	// 		}
-
-	// 		if influxql.IsRegexOp(e.Op) {
-	// 			re, ok := e.RHS.(*influxql.RegexLiteral)
-	// 			if !ok {
-	// 				return nil, fmt.Errorf("right side of '%s' must be a regular expression", e.Op.String())
-	// 			}
-	// 			return i.tagKeysByFilter(name, e.Op, nil, re.Val), nil
-	// 		}
-
-	// 		s, ok := e.RHS.(*influxql.StringLiteral)
-	// 		if !ok {
-	// 			return nil, fmt.Errorf("right side of '%s' must be a tag value string", e.Op.String())
-	// 		}
-	// 		return i.tagKeysByFilter(name, e.Op, []byte(s.Val), nil), nil
-
-	// 	case influxql.AND, influxql.OR:
-	// 		lhs, err := i.MeasurementTagKeysByExpr(name, e.LHS)
-	// 		if err != nil {
-	// 			return nil, err
-	// 		}
-
-	// 		rhs, err := i.MeasurementTagKeysByExpr(name, e.RHS)
-	// 		if err != nil {
-	// 			return nil, err
-	// 		}
-
-	// 		if lhs != nil && rhs != nil {
-	// 			if e.Op == influxql.OR {
-	// 				return unionStringSets(lhs, rhs), nil
-	// 			}
-	// 			return intersectStringSets(lhs, rhs), nil
-	// 		} else if lhs != nil {
-	// 			return lhs, nil
-	// 		} else if rhs != nil {
-	// 			return rhs, nil
-	// 		}
-	// 		return nil, nil
-	// 	default:
-	// 		return nil, fmt.Errorf("invalid operator for tag keys by expression")
-	// 	}
-
-	// case *influxql.ParenExpr:
-	// 	return i.MeasurementTagKeysByExpr(name, e.Expr)
-	// }
-
-	// return nil, fmt.Errorf("invalid measurement tag keys expression: %#v", expr)
-	panic("not implemented")
-}
-
-// TagKeyCardinality always returns zero.
-// It is not possible to determine cardinality of tags across index files, and
-// thus it cannot be done across partitions.
+	return i.partition(name).MeasurementTagKeysByExpr(name, expr)
+}
+
+// TagKeyCardinality returns the number of distinct values of the tag key of
+// the measurement, across the grids in memory and in the index files.
 func (i *Index) TagKeyCardinality(name, key []byte) int {
-	return 0
+	return i.partition(name).TagKeyCardinality(name, key)
 }
 
+// TagValueN returns the number of distinct values of each tag key of the
+// measurement, or nil if the measurement does not exist.
+func (i *Index) TagValueN(name []byte) (map[string]int, error) {
+	return i.partition(name).TagValueN(name)
+}
+
+// MeasurementIterator returns an iterator over the sorted names of the
+// measurements of all partitions.
 func (i *Index) MeasurementIterator() (tsdb.MeasurementIterator, error) {
-	return NewMeasurementsIterator(i.measurements), nil
+	names := i.MeasurementNames()
+	a := make([][]byte, len(names))
+	for j, name := range names {
+		a[j] = []byte(name)
+	}
+	return tsdb.NewMeasurementSliceIterator(a), nil
 }
 
 func (i *Index) TagKeyIterator(name []byte) (tsdb.TagKeyIterator, error) {
-	m, err := i.measurements.MeasurementByName(name)
-	if err != nil || m == nil {
-		return nil, err
-	}
-	return NewTagKeyIterator(m.gIndex), nil
+	return i.partition(name).TagKeyIterator(name)
 }
 
 func (i *Index) TagValueIterator(name, key []byte) (tsdb.TagValueIterator, error) {
-	m, err := i.measurements.MeasurementByName(name)
-	if err != nil || m == nil {
-		return nil, err
-	}
-	return NewTagValueIterator(m.gIndex, key), nil
+	return i.partition(name).TagValueIterator(name, key)
 }
 
 func (i *Index) MeasurementSeriesIDIterator(name []byte) (tsdb.SeriesIDIterator, error) {
-	return i.measurements.MeasurementSeriesIDIterator(name)
+	return i.partition(name).MeasurementSeriesIDIterator(name)
 }
 
 func (i *Index) TagKeySeriesIDIterator(name, key []byte) (tsdb.SeriesIDIterator, error) {
-	return i.measurements.TagKeySeriesIDIterator(name, key)
+	return i.partition(name).TagKeySeriesIDIterator(name, key)
 }
 
+// TagValueSeriesIDIterator returns an iterator over the series of the
+// measurement whose value of the tag key is value. An empty value matches
+// the series without the key.
 func (i *Index) TagValueSeriesIDIterator(name, key, value []byte) (tsdb.SeriesIDIterator, error) {
-	return i.measurements.TagValueSeriesIDIterator(name, key, value)
+	return i.partition(name).TagValueSeriesIDIterator(name, key, value)
+}
+
+// TagValueSetSeriesIDIterator returns an iterator over the series of the
+// measurement whose value of each key of set is one of the values of the key,
+// as in `host IN ('a', 'b') AND region = 'x'`. The disjunctions are computed
+// by the grids, without a lookup and a union for each value.
+func (i *Index) TagValueSetSeriesIDIterator(name []byte, set TagValueSet) (tsdb.SeriesIDIterator, error) {
+	return i.partition(name).TagValueSetSeriesIDIterator(name, set)
+}
+
+// MatchTagValueSeriesIDIterator returns an iterator over the series of the
+// measurement whose value of the tag key matches the regex, or does not match
+// it if matches is false. Series without the key have an empty value.
+func (i *Index) MatchTagValueSeriesIDIterator(name, key []byte, value *regexp.Regexp, matches bool) (tsdb.SeriesIDIterator, error) {
+	return i.partition(name).MatchTagValueSeriesIDIterator(name, key, value, matches)
+}
+
+// TagValueNotEqualSeriesIDIterator returns an iterator over the series of the
+// measurement whose value of the tag key is not value, including the series
+// without the key.
+func (i *Index) TagValueNotEqualSeriesIDIterator(name, key, value []byte) (tsdb.SeriesIDIterator, error) {
+	return i.partition(name).TagValueNotEqualSeriesIDIterator(name, key, value)
 }
 
 // Sets a shared fieldset from the engine.
@@ -355,211 +573,111 @@ func (i *Index) SetFieldSet(fs *tsdb.MeasurementFieldSet) {
 	i.fieldSet = fs
 }
 
-// Size of the index on disk, if applicable.
+// DiskSizeBytes returns the size of the index files and log files of the
+// partitions, in bytes.
 func (i *Index) DiskSizeBytes() int64 {
-	panic("unimplemented")
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var n int64
+	for _, p := range i.partitions {
+		n += p.DiskSizeBytes()
+	}
+	return n
 }
 
 // Bytes estimates the memory footprint of this Index, in bytes.
 func (i *Index) Bytes() int {
-	panic("unimplemented")
-}
-
-func (i *Index) Type() string {
-	panic("unimplemented")
-}
-
-// Returns a unique reference ID to the index instance.
-func (i *Index) UniqueReferenceID() uintptr {
-	panic("unimplemented")
-}
-
-func (i *Index) Compact(id int) error {
-	start := time.Now()
-
-	log, logEnd := logger.NewOperation(context.TODO(), i.logger, "TSI2 compaction", "tsi2_compact", zap.Int("tsi2_id", id))
-	defer logEnd()
-
-	// Create new index file.
-	path := filepath.Join(i.path, FormatIndexFileName(id, 1))
-	f, err := os.Create(path)
-	if err != nil {
-		log.Error("Cannot create index file", zap.Error(err))
-		return err
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var b int
+	b += 24 // mu RWMutex is 24 bytes
+	b += int(unsafe.Sizeof(i.partitions))
+	for _, p := range i.partitions {
+		b += int(unsafe.Sizeof(p)) + p.Bytes()
 	}
-	// defer f.Close()
-
-	// Compact index in memory to new index file.
-	// lvl := tsi1.CompactionLevel{M: 1 << 25, K: 6}
-	n, err := i.CompactTo(f)
-	if err != nil {
-		log.Error("Cannot compact index", zap.Error(err))
-		return err
+	b += int(unsafe.Sizeof(i.partitionN))
+	b += int(unsafe.Sizeof(i.ids))
+	if i.ids != nil {
+		b += i.ids.bytes()
 	}
-
-	if err = f.Sync(); err != nil {
-		log.Error("Cannot sync index file", zap.Error(err))
-		return err
+	b += int(unsafe.Sizeof(i.tagValueCache))
+	if i.tagValueCache != nil {
+		b += i.tagValueCache.bytes()
 	}
-
-	// Close file.
-	if err := f.Close(); err != nil {
-		log.Error("Cannot close index file", zap.Error(err))
-		return err
+	b += int(unsafe.Sizeof(i.tagValueCacheSize))
+	b += int(unsafe.Sizeof(i.maxLevelFileN))
+	b += int(unsafe.Sizeof(i.maxLevelSize))
+	b += int(unsafe.Sizeof(i.maxInMemorySize))
+	b += int(unsafe.Sizeof(i.logger))
+	// Do not count SeriesFile because it belongs to the code that constructed this Index.
+	b += int(unsafe.Sizeof(i.sfile))
+	b += int(unsafe.Sizeof(i.database)) + len(i.database)
+	b += int(unsafe.Sizeof(i.idLayout))
+	b += int(unsafe.Sizeof(i.gridOptimizer)) + len(i.gridOptimizer)
+	b += int(unsafe.Sizeof(i.path)) + len(i.path)
+	b += int(unsafe.Sizeof(i.fieldSet))
+	if i.fieldSet != nil {
+		b += i.fieldSet.Bytes()
 	}
-
-	// todo(vinland):// Reopen as an index file.
-
-	elapsed := time.Since(start)
-	log.Info("index compacted",
-		logger.DurationLiteral("elapsed", elapsed),
-		zap.Int64("bytes", n),
-		zap.Int("kb_per_sec", int(float64(n)/elapsed.Seconds())/1024),
-	)
-
-	// fmt.Printf("write %d byte to file\n", n)
-
-	return nil
+	b += int(unsafe.Sizeof(i.version))
+	b += int(unsafe.Sizeof(i.opened))
+	return b
 }
 
-// CompactTo compacts the in-memory index and writes it to w.
-func (i *Index) CompactTo(w io.Writer) (n int64, err error) {
-	// Wrap in bufferred writer with a buffer equivalent to the LogFile size.
-	bw := bufio.NewWriterSize(w, indexFileBufferSize) // 128K
-
-	// Setup compaction offset tracking data.
-	var t IndexFileTrailer
-	info := NewIndexFileCompactInfo()
-	// info.cancel = cancel
+// Type returns the type of Index this is.
+func (i *Index) Type() string { return IndexName }
 
-	// Write magic number.
-	if err := writeTo(bw, []byte(FileSignature), &n); err != nil {
-		return n, err
-	}
-
-	// Retreve measurement names in order.
-	names := i.MeasurementNames()
-
-	// Flush buffer & mmap series block.
-	// todo(vinland): series block?
-	if err := bw.Flush(); err != nil {
-		return n, err
-	}
-
-	// Write grid blocks in measurement order.
-	if err := i.WriteGridBlockTo(bw, names, info, &n); err != nil {
-		return n, err
-	}
-
-	// Write measurement block.
-	t.MeasurementBlock.Offset = n
-	if err := i.WriteMeasurementBlockTo(bw, names, info, &n); err != nil {
-		return n, err
-	}
-	t.MeasurementBlock.Size = n - t.MeasurementBlock.Offset
-
-	// Write trailer.
-	nn, err := t.WriteTo(bw)
-	n += nn
-	if err != nil {
-		return n, err
-	}
-
-	// Flush buffer.
-	if err := bw.Flush(); err != nil {
-		return n, err
-	}
-
-	return n, nil
-}
-
-func (i *Index) MeasurementNames() []string {
-	a := make([]string, 0, len(i.measurements.measurementId))
-	for name := range i.measurements.measurementId {
-		a = append(a, name)
-	}
-	sort.Strings(a)
-	return a
+// UniqueReferenceID returns a unique reference ID to the index instance.
+func (i *Index) UniqueReferenceID() uintptr {
+	return uintptr(unsafe.Pointer(i))
 }
 
-func (i *Index) WriteGridBlockTo(w io.Writer, names []string, info *IndexFileCompactInfo, n *int64) error {
-	for _, name := range names {
-		if err := i.writeGridsForMeasurementTo(w, name, info, n); err != nil {
+// Compact flushes the grids in memory of each partition to a new index file
+// of level 1, with the given id.
+func (i *Index) Compact(id int) error {
+	for _, p := range i.partitions {
+		if err := p.Compact(id); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// writeGridsForMeasurementTo writes a single tagset to w and saves the tagset offset.
-func (i *Index) writeGridsForMeasurementTo(w io.Writer, name string, info *IndexFileCompactInfo, n *int64) error {
-	mm, err := i.measurements.MeasurementByName([]byte(name))
-	if err != nil {
-		return err
+// Repack repacks the measurements in their partitions, or all measurements
+// if no name is given. See Partition.Repack.
+//
+// Returns the new id of each series of the repacked measurements, by old id.
+func (i *Index) Repack(names ...[]byte) (map[uint64]uint64, error) {
+	pNames := make([][][]byte, len(i.partitions))
+	for _, name := range names {
+		pidx := i.partitionIdx(name)
+		pNames[pidx] = append(pNames[pidx], name)
 	}
 
-	// // Check for cancellation.
-	// select {
-	// case <-info.cancel:
-	// 	return ErrCompactionInterrupted
-	// default:
-	// }
-
-	// Save tagset offset to measurement.
-	offset := *n
-
-	enc := NewGridBlockEncoder(w)
-	gridInfos := make([]*GridCompactInfo, 0, len(mm.gIndex.grids))
-	for _, grid := range mm.gIndex.grids {
-		gridInfo := &GridCompactInfo{offset: offset + enc.n}
-		err = enc.EncodeGrid(grid)
-		if err != nil {
-			return err
+	remap := map[uint64]uint64{}
+	for j, p := range i.partitions {
+		if len(names) != 0 && len(pNames[j]) == 0 {
+			continue
 		}
-		gridInfo.size = offset + enc.n - gridInfo.offset
-		gridInfos = append(gridInfos, gridInfo)
-	}
-
-	// Flush tag block.
-	// err := enc.Close()
-	*n += enc.N()
-	if err != nil {
-		return err
-	}
-
-	// Save tagset offset to measurement.
-	size := *n - offset
-
-	info.Mms[name] = &IndexFileMeasurementCompactInfo{Offset: offset, Size: size, gridInfos: gridInfos, MeasurementID: mm.measurementID}
-
-	return nil
-}
-
-func (i *Index) WriteMeasurementBlockTo(w io.Writer, names []string, info *IndexFileCompactInfo, n *int64) error {
-	mw := NewMeasurementBlockWriter()
-
-	// // Check for cancellation.
-	// select {
-	// case <-info.cancel:
-	// 	return ErrCompactionInterrupted
-	// default:
-	// }
-
-	// Add measurement data.
-	for _, name := range names {
-		mm, err := i.measurements.MeasurementByName([]byte(name))
+		m, err := p.Repack(pNames[j]...)
 		if err != nil {
-			return ErrMeasurementNotFound
+			return nil, err
 		}
-		mmInfo := info.Mms[name]
-		if mmInfo == nil {
-			return ErrMeasurementNotFound
+		for oldID, newID := range m {
+			remap[oldID] = newID
 		}
-		mw.Add([]byte(mm.name), mmInfo, mm.CacheSeriesIDSet())
 	}
+	return remap, nil
+}
 
-	// Flush data to writer.
-	nn, err := mw.WriteTo(w)
-	*n += nn
-	return err
+// MeasurementNames returns the sorted names of the measurements of all partitions.
+func (i *Index) MeasurementNames() []string {
+	var a []string
+	for _, p := range i.partitions {
+		a = append(a, p.MeasurementNames()...)
+	}
+	sort.Strings(a)
+	return a
 }
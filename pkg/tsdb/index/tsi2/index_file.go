@@ -1,25 +1,66 @@
 package tsi2
 
 import (
+	"bytes"
 	"cycledb/pkg/tsdb"
 	"encoding/binary"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
-	"io/ioutil"
-	"log"
+	"sync"
+	"unsafe"
 
 	"github.com/influxdata/influxdb/v2/models"
+	"github.com/influxdata/influxdb/v2/pkg/estimator"
+	"github.com/influxdata/influxdb/v2/pkg/estimator/hll"
+	"github.com/influxdata/influxdb/v2/pkg/mmap"
 )
 
-// IndexFileVersion is the current TSI1 index file version.
-const IndexFileVersion = 1
+// IndexFileVersion is the current TSI2 index file version.
+// Version 1 files have no tombstones, versions 1 and 2 use DefaultIDLayout,
+// versions 1 to 3 have no tag blocks, versions 1 to 4 hold grids of
+// version 1 without dictionaries, and versions 1 to 5 have no checksums.
+// They are still readable.
+const IndexFileVersion = 6
+
+// IndexFile field size constants.
+const (
+	// IndexFile trailer fields
+	IndexFileVersionSize  = 2
+	IndexFileChecksumSize = 4
+
+	// IndexFileTrailerSize is the size of the trailer. Currently 108 bytes.
+	IndexFileTrailerSize = indexFileTrailerSizeV3 +
+		IndexFileChecksumSize + // grid block checksum
+		IndexFileChecksumSize // checksum
+
+	// indexFileTrailerSizeV3 is the size of the trailer of version 3 to 5 files.
+	indexFileTrailerSizeV3 = indexFileTrailerSizeV2 +
+		1 + 1 // id layout measurement bits + series bits
+
+	// indexFileTrailerSizeV2 is the size of the trailer of version 2 files.
+	indexFileTrailerSizeV2 = IndexFileVersionSize +
+		8 + 8 + // measurement block offset + size
+		8 + 8 + // tombstone series id set offset + size
+		8 + 8 + // series sketch offset + size
+		8 + 8 + // tombstone series sketch offset + size
+		8 + 8 + // measurement sketch offset + size
+		8 + 8 + // tombstone measurement sketch offset + size
+		0
+
+	// indexFileTrailerSizeV1 is the size of the trailer of version 1 files.
+	indexFileTrailerSizeV1 = IndexFileVersionSize +
+		8 + 8 + // measurement block offset + size
+		0
+)
 
 // FileSignature represents a magic number at the header of the index file.
 const FileSignature = "TSI2"
 
 // IndexFileTrailer represents meta data written to the end of the index file.
 type IndexFileTrailer struct {
-	// Version int
+	Version int
 
 	MeasurementBlock struct {
 		Offset int64
@@ -36,20 +77,41 @@ type IndexFileTrailer struct {
 	// 	Size   int64
 	// }
 
-	// TombstoneSeriesIDSet struct {
-	// 	Offset int64
-	// 	Size   int64
-	// }
+	TombstoneSeriesIDSet struct {
+		Offset int64
+		Size   int64
+	}
 
-	// SeriesSketch struct {
-	// 	Offset int64
-	// 	Size   int64
-	// }
+	SeriesSketch struct {
+		Offset int64
+		Size   int64
+	}
 
-	// TombstoneSeriesSketch struct {
-	// 	Offset int64
-	// 	Size   int64
-	// }
+	TombstoneSeriesSketch struct {
+		Offset int64
+		Size   int64
+	}
+
+	MeasurementSketch struct {
+		Offset int64
+		Size   int64
+	}
+
+	TombstoneMeasurementSketch struct {
+		Offset int64
+		Size   int64
+	}
+
+	// IDLayout is the layout of the series ids of the file.
+	IDLayout IDLayout
+
+	// GridBlockChecksum is the CRC-32 of the file before the measurement
+	// block: the signature and the grid block.
+	GridBlockChecksum uint32
+
+	// Checksum is the CRC-32 of the file from the measurement block to the
+	// end, except the checksum itself.
+	Checksum uint32
 }
 
 // WriteTo writes the trailer to w.
@@ -75,26 +137,54 @@ func (t *IndexFileTrailer) WriteTo(w io.Writer) (n int64, err error) {
 	// 	return n, err
 	// }
 
-	// // Write tombstone series id set info.
-	// if err := writeUint64To(w, uint64(t.TombstoneSeriesIDSet.Offset), &n); err != nil {
-	// 	return n, err
-	// } else if err := writeUint64To(w, uint64(t.TombstoneSeriesIDSet.Size), &n); err != nil {
-	// 	return n, err
-	// }
+	// Write tombstone series id set info.
+	if err := writeUint64To(w, uint64(t.TombstoneSeriesIDSet.Offset), &n); err != nil {
+		return n, err
+	} else if err := writeUint64To(w, uint64(t.TombstoneSeriesIDSet.Size), &n); err != nil {
+		return n, err
+	}
 
-	// // Write series sketch info.
-	// if err := writeUint64To(w, uint64(t.SeriesSketch.Offset), &n); err != nil {
-	// 	return n, err
-	// } else if err := writeUint64To(w, uint64(t.SeriesSketch.Size), &n); err != nil {
-	// 	return n, err
-	// }
+	// Write series sketch info.
+	if err := writeUint64To(w, uint64(t.SeriesSketch.Offset), &n); err != nil {
+		return n, err
+	} else if err := writeUint64To(w, uint64(t.SeriesSketch.Size), &n); err != nil {
+		return n, err
+	}
 
-	// // Write series tombstone sketch info.
-	// if err := writeUint64To(w, uint64(t.TombstoneSeriesSketch.Offset), &n); err != nil {
-	// 	return n, err
-	// } else if err := writeUint64To(w, uint64(t.TombstoneSeriesSketch.Size), &n); err != nil {
-	// 	return n, err
-	// }
+	// Write series tombstone sketch info.
+	if err := writeUint64To(w, uint64(t.TombstoneSeriesSketch.Offset), &n); err != nil {
+		return n, err
+	} else if err := writeUint64To(w, uint64(t.TombstoneSeriesSketch.Size), &n); err != nil {
+		return n, err
+	}
+
+	// Write measurement sketch info.
+	if err := writeUint64To(w, uint64(t.MeasurementSketch.Offset), &n); err != nil {
+		return n, err
+	} else if err := writeUint64To(w, uint64(t.MeasurementSketch.Size), &n); err != nil {
+		return n, err
+	}
+
+	// Write measurement tombstone sketch info.
+	if err := writeUint64To(w, uint64(t.TombstoneMeasurementSketch.Offset), &n); err != nil {
+		return n, err
+	} else if err := writeUint64To(w, uint64(t.TombstoneMeasurementSketch.Size), &n); err != nil {
+		return n, err
+	}
+
+	// Write id layout.
+	if err := writeUint8To(w, t.IDLayout.MeasurementBits, &n); err != nil {
+		return n, err
+	} else if err := writeUint8To(w, t.IDLayout.SeriesBits, &n); err != nil {
+		return n, err
+	}
+
+	// Write checksums.
+	if err := writeUint32To(w, t.GridBlockChecksum, &n); err != nil {
+		return n, err
+	} else if err := writeUint32To(w, t.Checksum, &n); err != nil {
+		return n, err
+	}
 
 	// Write index file encoding version.
 	if err := writeUint16To(w, IndexFileVersion, &n); err != nil {
@@ -104,6 +194,118 @@ func (t *IndexFileTrailer) WriteTo(w io.Writer) (n int64, err error) {
 	return n, nil
 }
 
+// ReadIndexFileTrailer returns the index file trailer from data.
+func ReadIndexFileTrailer(data []byte) (IndexFileTrailer, error) {
+	var t IndexFileTrailer
+	if len(data) < IndexFileVersionSize {
+		return t, io.ErrShortBuffer
+	}
+
+	// Read version.
+	t.Version = int(binary.BigEndian.Uint16(data[len(data)-IndexFileVersionSize:]))
+	size := IndexFileTrailerSize
+	switch t.Version {
+	case IndexFileVersion:
+	case 5, 4, 3:
+		size = indexFileTrailerSizeV3
+	case 2:
+		size = indexFileTrailerSizeV2
+	case 1:
+		size = indexFileTrailerSizeV1
+	default:
+		return t, ErrUnsupportedIndexFileVersion
+	}
+	if len(data) < size {
+		return t, io.ErrShortBuffer
+	}
+
+	// Slice trailer data.
+	buf := data[len(data)-size:]
+
+	// Read measurement block info.
+	t.MeasurementBlock.Offset, buf = int64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+	t.MeasurementBlock.Size, buf = int64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+
+	if t.Version >= 2 {
+		// Read series tombstone id set info.
+		t.TombstoneSeriesIDSet.Offset, buf = int64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+		t.TombstoneSeriesIDSet.Size, buf = int64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+
+		// Read series sketch info.
+		t.SeriesSketch.Offset, buf = int64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+		t.SeriesSketch.Size, buf = int64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+
+		// Read series tombstone sketch info.
+		t.TombstoneSeriesSketch.Offset, buf = int64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+		t.TombstoneSeriesSketch.Size, buf = int64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+
+		// Read measurement sketch info.
+		t.MeasurementSketch.Offset, buf = int64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+		t.MeasurementSketch.Size, buf = int64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+
+		// Read measurement tombstone sketch info.
+		t.TombstoneMeasurementSketch.Offset, buf = int64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+		t.TombstoneMeasurementSketch.Size, buf = int64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+	}
+
+	t.IDLayout = DefaultIDLayout
+	if t.Version >= 3 {
+		// Read id layout.
+		t.IDLayout.MeasurementBits, buf = buf[0], buf[1:]
+		t.IDLayout.SeriesBits, buf = buf[0], buf[1:]
+	}
+
+	if t.Version >= 6 {
+		// Read checksums.
+		t.GridBlockChecksum, buf = binary.BigEndian.Uint32(buf[0:4]), buf[4:]
+		t.Checksum, buf = binary.BigEndian.Uint32(buf[0:4]), buf[4:]
+	}
+
+	if len(buf) != 2 { // Version field still in buffer.
+		return t, fmt.Errorf("unread %d bytes left unread in trailer", len(buf)-2)
+	}
+	return t, nil
+}
+
+// checksum returns the checksum of the trailer, extending sum, the CRC-32 of
+// the file from the measurement block to the trailer, with the fields of the
+// trailer before the checksum and the version.
+func (t *IndexFileTrailer) checksum(sum uint32) uint32 {
+	var buf bytes.Buffer
+	t.WriteTo(&buf) // writes to a buffer do not fail
+	return checksumTrailer(sum, buf.Bytes())
+}
+
+// checksumTrailer extends sum with the encoded trailer, except its checksum.
+func checksumTrailer(sum uint32, trailer []byte) uint32 {
+	i := len(trailer) - IndexFileVersionSize
+	sum = crc32.Update(sum, crc32.IEEETable, trailer[:i-IndexFileChecksumSize])
+	return crc32.Update(sum, crc32.IEEETable, trailer[i:])
+}
+
+// checksumWriter checksums the bytes written to w.
+type checksumWriter struct {
+	w    io.Writer
+	hash hash.Hash32
+}
+
+func newChecksumWriter(w io.Writer) *checksumWriter {
+	return &checksumWriter{w: w, hash: crc32.NewIEEE()}
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+// reset returns the checksum of the bytes written since the last reset.
+func (w *checksumWriter) reset() uint32 {
+	sum := w.hash.Sum32()
+	w.hash.Reset()
+	return sum
+}
+
 // FormatIndexFileName generates an index filename for the given index.
 func FormatIndexFileName(id, level int) string {
 	return fmt.Sprintf("L%d-%08d%s", level, id, IndexFileExt)
@@ -132,6 +334,15 @@ func writeUint16To(w io.Writer, v uint16, n *int64) error {
 	return err
 }
 
+// writeUint32To writes write v into w using big endian encoding. Updates n.
+func writeUint32To(w io.Writer, v uint32, n *int64) error {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	nn, err := w.Write(buf[:])
+	*n += int64(nn)
+	return err
+}
+
 // writeUint64To writes write v into w using big endian encoding. Updates n.
 func writeUint64To(w io.Writer, v uint64, n *int64) error {
 	var buf [8]byte
@@ -178,6 +389,12 @@ type IndexFileMeasurementCompactInfo struct {
 
 	// todo(vinland): have not been compacted to measurement block
 	gridInfos []*GridCompactInfo
+
+	// tag block written after the grids
+	tagBlock GridCompactInfo
+
+	// dictionary of the tag keys and values, written before the grids
+	dictionary GridCompactInfo
 }
 
 func (info *IndexFileMeasurementCompactInfo) Show() string {
@@ -198,41 +415,369 @@ type IndexFile struct {
 	// id    int
 	// level int
 	name string
+	size int64
+
+	// mmap'd data of the file
+	data []byte
 
 	gridBlock []byte
 	mblk      MeasurementBlock
+
+	// grids decoded on demand, by offset in the grid block
+	gridCache *gridCache
+
+	// dictionaries of the grids, by offset in the grid block, which are
+	// only verified once
+	dictMu       sync.Mutex
+	dictionaries map[int64]*GridDictionary
+
+	// ids of series dropped from the files written before this one
+	tombstones *tsdb.SeriesIDSet
+
+	// Series and measurement sketches of the index when the file was written.
+	sketchData, tSketchData   []byte
+	mSketchData, mTSketchData []byte
+
+	layout IDLayout
+
+	// version of the file, and checksum of its grid block, which is only
+	// verified by VerifyIndexFile
+	version           int
+	gridBlockChecksum uint32
 }
 
 func NewIndexFile(name string) *IndexFile {
 	return &IndexFile{
-		name: name,
+		name:       name,
+		gridCache:  newGridCache(DefaultGridCacheSize),
+		tombstones: tsdb.NewSeriesIDSet(),
 	}
 }
 
+// Restore memory maps the file and reads its trailer and measurement block.
+// The grids are decoded when they are queried.
 func (ifile *IndexFile) Restore() error {
-	// if not read data, read it
-	// reference count ++
-	// now, only read
-	// todo(vinland): use name format to generate filepath with id and level
-	buf, err := ioutil.ReadFile(ifile.name)
+	data, err := mmap.Map(ifile.name, 0)
 	if err != nil {
 		return err
 	}
-	fileSize := len(buf)
+	if err := ifile.unmarshal(data); err != nil {
+		mmap.Unmap(data)
+		return err
+	}
+	ifile.data = data
+	ifile.size = int64(len(data))
+	return nil
+}
 
-	msz := int64(binary.BigEndian.Uint64(buf[fileSize-10 : fileSize-2]))
-	moffset := int64(binary.BigEndian.Uint64(buf[fileSize-18 : fileSize-10]))
-	ifile.gridBlock = buf[:moffset]
+// unmarshal reads the file from its data.
+func (ifile *IndexFile) unmarshal(buf []byte) error {
+	t, err := ReadIndexFileTrailer(buf)
+	if err != nil {
+		return fmt.Errorf("%q: %w", ifile.name, err)
+	}
 
-	// Unmarshal into a block.
-	err = ifile.mblk.UnmarshalBinary(buf[moffset : moffset+msz])
+	// Check the signature.
+	if len(buf) < len(FileSignature) || string(buf[:len(FileSignature)]) != FileSignature {
+		return fmt.Errorf("%q: invalid signature: %w", ifile.name, ErrInvalidIndexFile)
+	}
+
+	// Check the sections after the grid block and the trailer against their
+	// checksum. The grids and their dictionaries have checksums of their own.
+	if t.Version >= 6 {
+		end := int64(len(buf) - IndexFileTrailerSize)
+		if t.MeasurementBlock.Offset < int64(len(FileSignature)) || t.MeasurementBlock.Offset > end {
+			return fmt.Errorf("%q: measurement block out of bounds: %w", ifile.name, ErrInvalidIndexFile)
+		}
+		sum := crc32.ChecksumIEEE(buf[t.MeasurementBlock.Offset:end])
+		if checksumTrailer(sum, buf[end:]) != t.Checksum {
+			return fmt.Errorf("%q: checksum mismatch: %w", ifile.name, ErrInvalidIndexFile)
+		}
+	}
+
+	if err := t.IDLayout.Validate(); err != nil {
+		return fmt.Errorf("%q: %w", ifile.name, err)
+	}
+	ifile.layout = t.IDLayout
+	ifile.version, ifile.gridBlockChecksum = t.Version, t.GridBlockChecksum
+
+	// Check the sections are within the file, after the signature.
+	section := func(name string, offset, size int64) ([]byte, error) {
+		data, ok := sliceSection(buf, uint64(offset), uint64(size))
+		if !ok || (size > 0 && offset < int64(len(FileSignature))) {
+			return nil, fmt.Errorf("%q: %s out of bounds: %w", ifile.name, name, ErrInvalidIndexFile)
+		}
+		return data, nil
+	}
+	mblkData, err := section("measurement block", t.MeasurementBlock.Offset, t.MeasurementBlock.Size)
 	if err != nil {
 		return err
 	}
+	ifile.gridBlock = buf[:t.MeasurementBlock.Offset]
+
+	// Unmarshal into a block.
+	if err := ifile.mblk.unmarshalBinary(mblkData, t.Version); err != nil {
+		return fmt.Errorf("%q: measurement block: %v: %w", ifile.name, err, ErrInvalidIndexFile)
+	}
+
+	// Slice the sketches.
+	if ifile.sketchData, err = section("series sketch", t.SeriesSketch.Offset, t.SeriesSketch.Size); err != nil {
+		return err
+	} else if ifile.tSketchData, err = section("tombstone series sketch", t.TombstoneSeriesSketch.Offset, t.TombstoneSeriesSketch.Size); err != nil {
+		return err
+	} else if ifile.mSketchData, err = section("measurement sketch", t.MeasurementSketch.Offset, t.MeasurementSketch.Size); err != nil {
+		return err
+	} else if ifile.mTSketchData, err = section("tombstone measurement sketch", t.TombstoneMeasurementSketch.Offset, t.TombstoneMeasurementSketch.Size); err != nil {
+		return err
+	}
+
+	// Check the sketches can be decoded.
+	for _, sketch := range []struct {
+		name string
+		data []byte
+	}{
+		{"series sketch", ifile.sketchData},
+		{"tombstone series sketch", ifile.tSketchData},
+		{"measurement sketch", ifile.mSketchData},
+		{"tombstone measurement sketch", ifile.mTSketchData},
+	} {
+		if err := checkSketchData(sketch.data); err != nil {
+			return fmt.Errorf("%q: %s: %v: %w", ifile.name, sketch.name, err, ErrInvalidIndexFile)
+		}
+	}
+
+	// Unmarshal tombstone series id set.
+	if t.TombstoneSeriesIDSet.Size != 0 {
+		data, err := section("tombstones", t.TombstoneSeriesIDSet.Offset, t.TombstoneSeriesIDSet.Size)
+		if err != nil {
+			return err
+		} else if err := ifile.tombstones.UnmarshalBinary(data); err != nil {
+			return fmt.Errorf("%q: tombstones: %v: %w", ifile.name, err, ErrInvalidIndexFile)
+		}
+	}
+
+	return nil
+}
+
+// Close unmaps the data of the file. The file must not be used afterwards.
+// The index closes the files it replaces under its write lock, and nothing
+// returned by a file references its data.
+func (ifile *IndexFile) Close() error {
+	ifile.gridCache = newGridCache(0)
+	ifile.dictMu.Lock()
+	ifile.dictionaries = nil
+	ifile.dictMu.Unlock()
+	ifile.mblk = MeasurementBlock{}
+	ifile.gridBlock = nil
+	ifile.sketchData, ifile.tSketchData = nil, nil
+	ifile.mSketchData, ifile.mTSketchData = nil, nil
+	if ifile.data == nil {
+		return nil
+	}
+	data := ifile.data
+	ifile.data = nil
+	return mmap.Unmap(data)
+}
+
+// bytes estimates the memory footprint of the index file, in bytes.
+// The mmap'd data of the file is not counted, the cached grids are.
+func (ifile *IndexFile) bytes() int {
+	var b int
+	b += int(unsafe.Sizeof(ifile.name)) + len(ifile.name)
+	b += int(unsafe.Sizeof(ifile.size))
+	b += int(unsafe.Sizeof(ifile.data))
+	b += int(unsafe.Sizeof(ifile.gridBlock))
+	b += int(unsafe.Sizeof(ifile.mblk))
+	b += int(unsafe.Sizeof(ifile.gridCache)) + ifile.gridCache.bytes()
+	b += int(unsafe.Sizeof(ifile.tombstones)) + ifile.tombstones.Bytes()
+	// The sketches are sliced from the file data.
+	b += int(unsafe.Sizeof(ifile.sketchData)) + int(unsafe.Sizeof(ifile.tSketchData))
+	b += int(unsafe.Sizeof(ifile.mSketchData)) + int(unsafe.Sizeof(ifile.mTSketchData))
+	b += int(unsafe.Sizeof(ifile.layout))
+	return b
+}
+
+// Path returns the path of the index file.
+func (ifile *IndexFile) Path() string { return ifile.name }
+
+// ID returns the file sequence identifier.
+func (ifile *IndexFile) ID() int {
+	_, id := ParseFilename(ifile.name)
+	return id
+}
+
+// IDLayout returns the layout of the series ids of the file.
+func (ifile *IndexFile) IDLayout() IDLayout { return ifile.layout }
+
+// Size returns the size of the file, in bytes.
+func (ifile *IndexFile) Size() int64 { return ifile.size }
+
+// Level returns the compaction level of the file.
+func (ifile *IndexFile) Level() int {
+	level, _ := ParseFilename(ifile.name)
+	return level
+}
+
+// MeasurementIterator returns an iterator over the measurements in the file.
+func (ifile *IndexFile) MeasurementIterator() *MeasurementBlockIterator {
+	return ifile.mblk.Iterator()
+}
+
+// TombstoneSeriesIDSet returns the ids of the series dropped from the files
+// written before this one.
+func (ifile *IndexFile) TombstoneSeriesIDSet() *tsdb.SeriesIDSet {
+	return ifile.tombstones
+}
+
+// SeriesSketches returns existence and tombstone sketches for series.
+func (ifile *IndexFile) SeriesSketches() (sketch, tSketch estimator.Sketch, err error) {
+	return unmarshalSketches(ifile.sketchData, ifile.tSketchData)
+}
 
+// MeasurementsSketches returns existence and tombstone sketches for measurements.
+func (ifile *IndexFile) MeasurementsSketches() (sketch, tSketch estimator.Sketch, err error) {
+	return unmarshalSketches(ifile.mSketchData, ifile.mTSketchData)
+}
+
+// unmarshalSketches decodes a pair of sketches.
+// Files of version 1 have no sketches, empty ones are returned for them.
+func unmarshalSketches(data, tData []byte) (sketch, tSketch estimator.Sketch, err error) {
+	sketch, tSketch = hll.NewDefaultPlus(), hll.NewDefaultPlus()
+	if len(data) != 0 {
+		if err := sketch.UnmarshalBinary(data); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(tData) != 0 {
+		if err := tSketch.UnmarshalBinary(tData); err != nil {
+			return nil, nil, err
+		}
+	}
+	return sketch, tSketch, nil
+}
+
+// checkSketchData checks data holds a whole hll.Plus sketch, as the sketch
+// does not check the sizes of its lists when it is decoded or used.
+// Files of version 1 have empty sketch data.
+func checkSketchData(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	} else if len(data) < 12 {
+		return fmt.Errorf("%d bytes: %w", len(data), io.ErrShortBuffer)
+	}
+	p := data[1]
+	if p < 4 || p > 18 {
+		return fmt.Errorf("invalid precision %d", p)
+	}
+	sparse, size := data[2] == 1, uint64(binary.BigEndian.Uint32(data[3:7]))
+	data = data[7:]
+
+	// Dense sketches hold a register per bucket.
+	if !sparse {
+		if size != 1<<p || uint64(len(data)) != size {
+			return fmt.Errorf("%d registers in %d bytes with precision %d", size, len(data), p)
+		}
+		return nil
+	}
+
+	// Sparse sketches hold a temporary set of 4 byte values, then the count,
+	// last value and size of the list of varints.
+	if uint64(len(data)) < 4*size+12 {
+		return fmt.Errorf("temporary set of %d values: %w", size, io.ErrShortBuffer)
+	}
+	data = data[4*size:]
+	count, size := binary.BigEndian.Uint32(data[0:4]), uint64(binary.BigEndian.Uint32(data[8:12]))
+	if data = data[12:]; uint64(len(data)) != size {
+		return fmt.Errorf("sparse list of %d bytes in %d bytes", size, len(data))
+	}
+	var n uint32
+	for i := range data {
+		if data[i]&0x80 == 0 {
+			n++
+		}
+	}
+	if len(data) != 0 && data[len(data)-1]&0x80 != 0 {
+		return fmt.Errorf("sparse list: %w", io.ErrShortBuffer)
+	} else if n != count {
+		return fmt.Errorf("sparse list of %d values has %d", count, n)
+	}
 	return nil
 }
 
+// writeSketchesTo writes the series and measurement sketches to w, and sets
+// their offsets and sizes on the trailer.
+func writeSketchesTo(w io.Writer, t *IndexFileTrailer, sSketch, sTSketch, mSketch, mTSketch estimator.Sketch, n *int64) (err error) {
+	if t.SeriesSketch.Offset, t.SeriesSketch.Size, err = writeSketchTo(w, sSketch, n); err != nil {
+		return err
+	} else if t.TombstoneSeriesSketch.Offset, t.TombstoneSeriesSketch.Size, err = writeSketchTo(w, sTSketch, n); err != nil {
+		return err
+	} else if t.MeasurementSketch.Offset, t.MeasurementSketch.Size, err = writeSketchTo(w, mSketch, n); err != nil {
+		return err
+	} else if t.TombstoneMeasurementSketch.Offset, t.TombstoneMeasurementSketch.Size, err = writeSketchTo(w, mTSketch, n); err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeSketchTo writes the sketch to w, and returns its offset and size.
+func writeSketchTo(w io.Writer, s estimator.Sketch, n *int64) (offset, size int64, err error) {
+	data, err := s.MarshalBinary()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	offset = *n
+	if err := writeTo(w, data, n); err != nil {
+		return 0, 0, err
+	}
+	return offset, int64(len(data)), nil
+}
+
+// hasSeriesID returns true if the measurement holds the series id within its grids.
+func (ifile *IndexFile) hasSeriesID(name []byte, id uint64) bool {
+	e, ok := ifile.mblk.Elem(name)
+	return ok && e.SeriesIDSet().Contains(id)
+}
+
+// Series returns the name and tags of the series id, decoded from the
+// coordinates of the id in its grid. Returns a nil name if the file does not
+// hold the series.
+func (ifile *IndexFile) Series(id uint64) ([]byte, models.Tags, error) {
+	measurementID, indexID := ifile.layout.splitSeriesID(id)
+	itr := ifile.MeasurementIterator()
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		if e.ID() != measurementID {
+			continue
+		}
+		tags, ok, err := ifile.seriesTags(e.Name(), indexID)
+		if err != nil || !ok {
+			return nil, nil, err
+		}
+		// The name of the element references the file data.
+		return append([]byte(nil), e.Name()...), tags, nil
+	}
+	return nil, nil, nil
+}
+
+// seriesTags returns the tags of a series of the measurement, by its id
+// within the grids. Returns false if the measurement does not hold it.
+func (ifile *IndexFile) seriesTags(name []byte, id uint64) (models.Tags, bool, error) {
+	if !ifile.hasSeriesID(name, id) {
+		return nil, false, nil
+	}
+	_, grids, err := ifile.grids(name)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, g := range grids {
+		if g.seriesIDSet.Contains(id) {
+			tags := g.tagsForID(id)
+			return tags, tags != nil, nil
+		}
+	}
+	return nil, false, nil
+}
+
 func (ifile *IndexFile) SeriesIDSet(name []byte) *tsdb.SeriesIDSet {
 	resSet := tsdb.NewSeriesIDSet()
 	e, ok := ifile.mblk.Elem(name)
@@ -240,75 +785,359 @@ func (ifile *IndexFile) SeriesIDSet(name []byte) *tsdb.SeriesIDSet {
 		return resSet
 	}
 	e.SeriesIDSet().ForEachNoLock(func(id uint64) {
-		if v, ok := e.FormatIdWithMeasurementID(id); ok {
-			resSet.AddNoLock(v)
-		}
+		resSet.AddNoLock(ifile.layout.seriesID(e.ID(), id))
 	})
-	return e.SeriesIDSet()
+	return resSet
 }
 
-func (ifile *IndexFile) SeriesIDSetForTagKey(name, key []byte) *tsdb.SeriesIDSet {
-	resSet := tsdb.NewSeriesIDSet()
+// grids returns the grids of a measurement, which are decoded unless they
+// are cached. Returns no grids if the file does not hold the measurement.
+func (ifile *IndexFile) grids(name []byte) (MeasurementBlockElem, []*Grid, error) {
+	return ifile.gridsFor(name, nil)
+}
 
+// gridsFor returns the grids of a measurement selected by sel from its tag
+// block, or all grids if sel is nil, does not restrict them, or the file has
+// no tag blocks.
+func (ifile *IndexFile) gridsFor(name []byte, sel func(blk *TagBlock) ([]int, bool, error)) (MeasurementBlockElem, []*Grid, error) {
 	e, ok := ifile.mblk.Elem(name)
 	if !ok {
-		return resSet
+		return e, nil, nil
 	}
 
-	// todo(vinland): can judge first
-	grids, err := DecodeGrids(ifile.gridBlock, e)
-	if err != nil {
-		log.Fatalf("fail to decode grids")
-		return resSet
+	var indexes []int
+	restricted := false
+	if sel != nil {
+		blk, ok, err := ifile.tagBlock(e)
+		if err != nil {
+			return e, nil, err
+		} else if ok {
+			if indexes, restricted, err = sel(blk); err != nil {
+				return e, nil, fmt.Errorf("%q: measurement %q: %w", ifile.name, name, err)
+			}
+		}
 	}
-	for _, g := range grids {
-		if g.HasTagKey(string(key)) {
-			idsSet := g.GetSeriesIDSetForTags(nil)
-			idsSet.ForEachNoLock(func(id uint64) {
-				if v, ok := e.FormatIdWithMeasurementID(id); ok {
-					resSet.AddNoLock(v)
-				}
-			})
+	if !restricted {
+		indexes = make([]int, len(e.grids))
+		for i := range indexes {
+			indexes[i] = i
 		}
 	}
-	return resSet
+
+	grids := make([]*Grid, 0, len(indexes))
+	for _, i := range indexes {
+		if i >= len(e.grids) {
+			return e, nil, fmt.Errorf("%q: measurement %q: %w", ifile.name, name, ErrInvalidTagBlock)
+		}
+		g, err := ifile.grid(e, i)
+		if err != nil {
+			return e, nil, fmt.Errorf("%q: measurement %q: %w", ifile.name, name, err)
+		}
+		grids = append(grids, g)
+	}
+	return e, grids, nil
 }
 
-func (ifile *IndexFile) SeriesIDSetForTagValue(name, key, value []byte) *tsdb.SeriesIDSet {
-	resSet := tsdb.NewSeriesIDSet()
+// tagBlock returns the tag block of the grids of the measurement.
+// Returns false if the file was written before tag blocks.
+func (ifile *IndexFile) tagBlock(e MeasurementBlockElem) (*TagBlock, bool, error) {
+	if e.tagBlock.size == 0 {
+		return nil, false, nil
+	}
+	var blk TagBlock
+	data, ok := sliceSection(ifile.gridBlock, uint64(e.tagBlock.offset), uint64(e.tagBlock.size))
+	if !ok {
+		return nil, false, fmt.Errorf("%q: measurement %q: %w", ifile.name, e.name, ErrInvalidTagBlock)
+	} else if err := blk.UnmarshalBinary(data); err != nil {
+		return nil, false, fmt.Errorf("%q: measurement %q: %w", ifile.name, e.name, err)
+	}
+	return &blk, true, nil
+}
 
+// measurementTagBlock returns the tag block of the measurement, or false if
+// the file does not hold the measurement or has no tag blocks.
+func (ifile *IndexFile) measurementTagBlock(name []byte) (*TagBlock, bool, error) {
 	e, ok := ifile.mblk.Elem(name)
 	if !ok {
-		return resSet
+		return nil, false, nil
 	}
+	return ifile.tagBlock(e)
+}
 
-	// todo(vinland): can judge first
-	grids, err := DecodeGrids(ifile.gridBlock, e)
+// grid returns the i-th grid of the measurement, from the cache if it was
+// decoded before.
+func (ifile *IndexFile) grid(e MeasurementBlockElem, i int) (*Grid, error) {
+	offset, size := e.grids[i].offset, e.grids[i].size
+	if g := ifile.gridCache.get(offset); g != nil {
+		return g, nil
+	}
+	if offset < 0 || size < 0 || offset+size > int64(len(ifile.gridBlock)) {
+		return nil, ErrInvalidGrid
+	}
+	dict, err := ifile.dictionary(e)
 	if err != nil {
-		log.Fatalf("fail to decode grids")
-		return resSet
+		return nil, err
+	}
+	g, err := DecodeGrid(ifile.gridBlock[offset:offset+size], dict)
+	if err != nil {
+		return nil, err
+	}
+	ifile.gridCache.put(offset, g)
+	return g, nil
+}
+
+// dictionary returns the dictionary of the grids of the measurement, or nil
+// if the file was written before dictionaries.
+func (ifile *IndexFile) dictionary(e MeasurementBlockElem) (*GridDictionary, error) {
+	if e.dictionary.size == 0 {
+		return nil, nil
+	}
+
+	ifile.dictMu.Lock()
+	defer ifile.dictMu.Unlock()
+	if dict := ifile.dictionaries[e.dictionary.offset]; dict != nil {
+		return dict, nil
+	}
+	dict, err := decodeGridDictionary(ifile.gridBlock, e)
+	if err != nil {
+		return nil, err
+	}
+	if ifile.dictionaries == nil {
+		ifile.dictionaries = map[int64]*GridDictionary{}
+	}
+	ifile.dictionaries[e.dictionary.offset] = dict
+	return dict, nil
+}
+
+// HasTagKey returns true if a grid of the measurement has the tag key.
+func (ifile *IndexFile) HasTagKey(name, key []byte) (bool, error) {
+	if blk, ok, err := ifile.measurementTagBlock(name); err != nil {
+		return false, err
+	} else if ok {
+		_, ok, err := blk.TagKeyGrids(key)
+		return ok, err
+	}
+
+	_, grids, err := ifile.grids(name)
+	if err != nil {
+		return false, err
+	}
+	for _, g := range grids {
+		if g.HasTagKey(string(key)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// HasTagValue returns true if a grid of the measurement has the tag value.
+func (ifile *IndexFile) HasTagValue(name, key, value []byte) (bool, error) {
+	if len(value) == 0 {
+		return false, nil
+	} else if blk, ok, err := ifile.measurementTagBlock(name); err != nil {
+		return false, err
+	} else if ok {
+		_, ok, err := blk.TagValueGrids(key, value)
+		return ok, err
+	}
+
+	_, grids, err := ifile.grids(name)
+	if err != nil {
+		return false, err
 	}
 	for _, g := range grids {
 		if g.HasTagValue(string(key), string(value)) {
-			idsSet := g.GetSeriesIDSetForTags(models.NewTags(
-				map[string]string{
-					string(key): string(value),
-				},
-			))
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// TagKeys returns the tag keys of the measurement.
+func (ifile *IndexFile) TagKeys(name []byte) (map[string]struct{}, error) {
+	res := map[string]struct{}{}
+	if blk, ok, err := ifile.measurementTagBlock(name); err != nil {
+		return nil, err
+	} else if ok {
+		return res, blk.ForEachTagKey(func(key []byte) {
+			res[string(key)] = struct{}{}
+		})
+	}
+
+	_, grids, err := ifile.grids(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range grids {
+		res = unionStringSets2(res, g.tagKeyToIndex)
+	}
+	return res, nil
+}
+
+// TagValues returns the values of the tag key of the measurement, without
+// the empty value of the series lacking the key.
+func (ifile *IndexFile) TagValues(name, key []byte) (map[string]struct{}, error) {
+	res := map[string]struct{}{}
+	if blk, ok, err := ifile.measurementTagBlock(name); err != nil {
+		return nil, err
+	} else if ok {
+		err := blk.ForEachTagValue(key, func(value []byte) {
+			res[string(value)] = struct{}{}
+		})
+		delete(res, "")
+		return res, err
+	}
+
+	_, grids, err := ifile.grids(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range grids {
+		if index, ok := g.tagKeyToIndex[string(key)]; ok {
+			res = unionStringSets2(res, g.tagValuesSlice[index].valueToIndex)
+		}
+	}
+	delete(res, "")
+	return res, nil
+}
+
+// addTagValuesTo adds the values of each tag key of the measurement to sets,
+// including the empty value of the series lacking the key.
+func (ifile *IndexFile) addTagValuesTo(name []byte, sets map[string]map[string]struct{}) error {
+	if blk, ok, err := ifile.measurementTagBlock(name); err != nil {
+		return err
+	} else if ok {
+		var keys [][]byte
+		if err := blk.ForEachTagKey(func(key []byte) {
+			keys = append(keys, key)
+		}); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			values := tagValueSet(sets, string(key))
+			if err := blk.ForEachTagValue(key, func(value []byte) {
+				values[string(value)] = struct{}{}
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	_, grids, err := ifile.grids(name)
+	if err != nil {
+		return err
+	}
+	for _, g := range grids {
+		g.addTagValuesTo(sets)
+	}
+	return nil
+}
+
+func (ifile *IndexFile) SeriesIDSetForTagKey(name, key []byte) (*tsdb.SeriesIDSet, error) {
+	sel := func(blk *TagBlock) ([]int, bool, error) {
+		grids, _, err := blk.TagKeyGrids(key)
+		return grids, true, err
+	}
+	return ifile.seriesIDSetForGrids(name, sel, func(g *Grid) *tsdb.SeriesIDSet {
+		if !g.HasTagKey(string(key)) {
+			return nil
+		}
+		return g.GetSeriesIDSetForTagKey(string(key))
+	})
+}
+
+func (ifile *IndexFile) SeriesIDSetForTagValue(name, key, value []byte) (*tsdb.SeriesIDSet, error) {
+	// The empty value matches the grids without the key.
+	var sel func(blk *TagBlock) ([]int, bool, error)
+	if len(value) != 0 {
+		sel = func(blk *TagBlock) ([]int, bool, error) {
+			grids, _, err := blk.TagValueGrids(key, value)
+			return grids, true, err
+		}
+	}
+	return ifile.seriesIDSetForGrids(name, sel, func(g *Grid) *tsdb.SeriesIDSet {
+		if len(value) != 0 && !g.HasTagValue(string(key), string(value)) {
+			return nil
+		}
+		return g.GetSeriesIDSetForTagValue(string(key), string(value))
+	})
+}
+
+// SeriesIDSetForTagValueSet returns the ids of the series of the measurement
+// matching the tag value set.
+func (ifile *IndexFile) SeriesIDSetForTagValueSet(name []byte, set TagValueSet) (*tsdb.SeriesIDSet, error) {
+	sel := func(blk *TagBlock) ([]int, bool, error) {
+		return blk.tagValueSetGrids(set)
+	}
+	return ifile.seriesIDSetForGrids(name, sel, func(g *Grid) *tsdb.SeriesIDSet {
+		return g.GetSeriesIDSetForTagValueSet(set)
+	})
+}
+
+// SeriesIDSetForTagValueFunc returns the ids of the series of the measurement
+// whose value of the tag key satisfies fn.
+func (ifile *IndexFile) SeriesIDSetForTagValueFunc(name, key []byte, fn func(value string) bool) (*tsdb.SeriesIDSet, error) {
+	// Only the grids with the key match unless the empty value does.
+	var sel func(blk *TagBlock) ([]int, bool, error)
+	if !fn("") {
+		sel = func(blk *TagBlock) ([]int, bool, error) {
+			grids, _, err := blk.TagKeyGrids(key)
+			return grids, true, err
+		}
+	}
+	return ifile.seriesIDSetForGrids(name, sel, func(g *Grid) *tsdb.SeriesIDSet {
+		return g.GetSeriesIDSetForTagValueFunc(string(key), fn)
+	})
+}
+
+// SeriesIDSetForTagValueNotEqual returns the ids of the series of the
+// measurement whose value of the tag key is not value.
+func (ifile *IndexFile) SeriesIDSetForTagValueNotEqual(name, key, value []byte) (*tsdb.SeriesIDSet, error) {
+	// Only the grids with the key have values other than the empty value.
+	var sel func(blk *TagBlock) ([]int, bool, error)
+	if len(value) == 0 {
+		sel = func(blk *TagBlock) ([]int, bool, error) {
+			grids, _, err := blk.TagKeyGrids(key)
+			return grids, true, err
+		}
+	}
+	return ifile.seriesIDSetForGrids(name, sel, func(g *Grid) *tsdb.SeriesIDSet {
+		return g.GetSeriesIDSetForTagValueNotEqual(string(key), string(value))
+	})
+}
+
+// seriesIDSetForGrids returns the series ids of the ids returned by fn for
+// each grid of the measurement selected by sel. fn returns nil to skip a grid.
+func (ifile *IndexFile) seriesIDSetForGrids(name []byte, sel func(blk *TagBlock) ([]int, bool, error), fn func(g *Grid) *tsdb.SeriesIDSet) (*tsdb.SeriesIDSet, error) {
+	resSet := tsdb.NewSeriesIDSet()
+
+	e, grids, err := ifile.gridsFor(name, sel)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range grids {
+		if idsSet := fn(g); idsSet != nil {
 			idsSet.ForEachNoLock(func(id uint64) {
-				if v, ok := e.FormatIdWithMeasurementID(id); ok {
-					resSet.AddNoLock(v)
-				}
+				resSet.AddNoLock(ifile.layout.seriesID(e.ID(), id))
 			})
 		}
 	}
-	return resSet
+	return resSet, nil
 }
 
+// DecodeGrids decodes the grids of the measurement from the data of the file.
 func DecodeGrids(buf []byte, e MeasurementBlockElem) ([]*Grid, error) {
+	dict, err := decodeGridDictionary(buf, e)
+	if err != nil {
+		return nil, err
+	}
 	grids := make([]*Grid, 0, len(e.grids))
 	for _, gridInfo := range e.grids {
-		grid, err := DecodeGrid(buf[gridInfo.offset : gridInfo.offset+gridInfo.size])
+		if gridInfo.offset < 0 || gridInfo.size < 0 || gridInfo.offset+gridInfo.size > int64(len(buf)) {
+			return nil, ErrInvalidGrid
+		}
+		grid, err := DecodeGrid(buf[gridInfo.offset:gridInfo.offset+gridInfo.size], dict)
 		if err != nil {
 			return nil, err
 		}
@@ -317,46 +1146,210 @@ func DecodeGrids(buf []byte, e MeasurementBlockElem) ([]*Grid, error) {
 	return grids, nil
 }
 
-func DecodeGrid(buf []byte) (*Grid, error) {
-	offset, buf := uint64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+// decodeGridDictionary returns the dictionary of the grids of the
+// measurement, or nil if the grids are encoded without dictionary.
+func decodeGridDictionary(buf []byte, e MeasurementBlockElem) (*GridDictionary, error) {
+	if e.dictionary.size == 0 {
+		return nil, nil
+	}
+	data, ok := sliceSection(buf, uint64(e.dictionary.offset), uint64(e.dictionary.size))
+	if !ok {
+		return nil, ErrInvalidGrid
+	}
+	var dict GridDictionary
+	if err := dict.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return &dict, nil
+}
+
+// DecodeGrid decodes a grid of any version. The tag keys and values of
+// grids of version 2 are read from dict. The grid does not reference buf or
+// dict, which may be unmapped afterwards. Returns ErrInvalidGrid if buf is
+// truncated, malformed or fails its checksum.
+func DecodeGrid(buf []byte, dict *GridDictionary) (*Grid, error) {
+	if len(buf) > 0 && buf[0] == GridBlockVersion {
+		return decodeGridV2(buf, dict)
+	}
+	return decodeGridV1(buf)
+}
+
+// decodeGridV2 decodes a grid of version 2.
+func decodeGridV2(buf []byte, dict *GridDictionary) (*Grid, error) {
+	if dict == nil || len(buf) < 1+GridChecksumSize {
+		return nil, ErrInvalidGrid
+	}
+	data, checksum := buf[:len(buf)-GridChecksumSize], buf[len(buf)-GridChecksumSize:]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(checksum) {
+		return nil, ErrInvalidGrid
+	}
+
+	d := gridDecoder{buf: data[1:], dict: dict}
+	offset := d.uvarint()
+
+	// Each key takes at least 3 bytes: its index, capacity and value count.
+	keyNum := d.uvarintCount(3)
+	keys := make([]string, 0, keyNum)
+	valuesSlice := make([]*TagValues, 0, keyNum)
+	for i := uint64(0); i < keyNum && d.err == nil; i++ {
+		keys = append(keys, d.string())
+		values := newTagValues(d.uvarint())
+		valuesNum := d.uvarintCount(1)
+		for j := uint64(0); j < valuesNum && d.err == nil; j++ {
+			if value := d.string(); d.err == nil && !values.SetValue(value) {
+				return nil, ErrInvalidGrid
+			}
+		}
+		valuesSlice = append(valuesSlice, values)
+	}
+
+	// Parse data block.
+	data = d.uvarintBytes()
+	if d.err != nil {
+		return nil, d.err
+	}
 
-	keyNum, buf := uint64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+	ss := tsdb.NewSeriesIDSet()
+	if err := ss.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidGrid, err)
+	}
+	return NewGridWithKeysAndValuesSlice(offset, keys, valuesSlice, ss), nil
+}
+
+// decodeGridV1 decodes a grid of version 1, whose lengths and counts are
+// big-endian uint64s and which holds its keys and values.
+func decodeGridV1(buf []byte) (*Grid, error) {
+	d := gridDecoder{buf: buf}
+	offset := d.uint64()
+
+	keyNum := d.count(8)
 	keys := make([]string, 0, keyNum)
-	var sz uint64
-	for i := uint64(0); i < keyNum; i++ {
-		sz, buf = uint64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
-		value := buf[0:sz]
-		keys = append(keys, string(value))
-		buf = buf[sz:]
+	for i := uint64(0); i < keyNum && d.err == nil; i++ {
+		keys = append(keys, string(d.bytes()))
 	}
 
-	valueSliceNum, buf := uint64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+	valueSliceNum := d.count(16)
+	if d.err == nil && valueSliceNum != keyNum {
+		return nil, ErrInvalidGrid
+	}
 	valuesSlice := make([]*TagValues, 0, valueSliceNum)
-	var capacity uint64
-	var valuesNum uint64
-	for i := uint64(0); i < valueSliceNum; i++ {
-		capacity, buf = uint64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
-		values := newTagValues(capacity)
-		valuesNum, buf = uint64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
-		for j := uint64(0); j < valuesNum; j++ {
-			sz, buf = uint64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
-			value := buf[0:sz]
-			buf = buf[sz:]
-			values.SetValue(string(value))
+	for i := uint64(0); i < valueSliceNum && d.err == nil; i++ {
+		values := newTagValues(d.uint64())
+		valuesNum := d.count(8)
+		for j := uint64(0); j < valuesNum && d.err == nil; j++ {
+			if value := d.bytes(); d.err == nil && !values.SetValue(string(value)) {
+				return nil, ErrInvalidGrid
+			}
 		}
 		valuesSlice = append(valuesSlice, values)
 	}
 
-	// Parse data block size.
-	sz, buf = uint64(binary.BigEndian.Uint64(buf[0:8])), buf[8:]
+	// Parse data block.
+	data := d.bytes()
+	if d.err != nil {
+		return nil, d.err
+	}
 
 	ss := tsdb.NewSeriesIDSet()
-	err := ss.UnmarshalBinaryUnsafe(buf[:sz])
-	if err != nil {
-		return nil, err
+	if err := ss.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidGrid, err)
 	}
 
 	// fmt.Printf("offset: %v\nkeys:%+v\nvaluesSlice:%+v\n", offset, keys, valuesSlice)
 	grid := NewGridWithKeysAndValuesSlice(offset, keys, valuesSlice, ss)
 	return grid, nil
 }
+
+// gridDecoder reads the fields of an encoded grid, and records
+// ErrInvalidGrid once a field overruns the buffer.
+type gridDecoder struct {
+	buf  []byte
+	dict *GridDictionary
+	err  error
+}
+
+func (d *gridDecoder) uint64() uint64 {
+	if d.err != nil {
+		return 0
+	} else if len(d.buf) < 8 {
+		d.err = ErrInvalidGrid
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.buf[0:8])
+	d.buf = d.buf[8:]
+	return v
+}
+
+// count reads a number of items taking at least size bytes each.
+func (d *gridDecoder) count(size uint64) uint64 {
+	n := d.uint64()
+	if d.err == nil && n > uint64(len(d.buf))/size {
+		d.err = ErrInvalidGrid
+		return 0
+	}
+	return n
+}
+
+// bytes reads a size prefixed field.
+func (d *gridDecoder) bytes() []byte {
+	sz := d.uint64()
+	if d.err == nil && sz > uint64(len(d.buf)) {
+		d.err = ErrInvalidGrid
+	}
+	if d.err != nil {
+		return nil
+	}
+	v := d.buf[0:sz]
+	d.buf = d.buf[sz:]
+	return v
+}
+
+func (d *gridDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrInvalidGrid
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// uvarintCount reads a number of items taking at least size bytes each.
+func (d *gridDecoder) uvarintCount(size uint64) uint64 {
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(d.buf))/size {
+		d.err = ErrInvalidGrid
+		return 0
+	}
+	return n
+}
+
+// uvarintBytes reads a uvarint size prefixed field.
+func (d *gridDecoder) uvarintBytes() []byte {
+	sz := d.uvarint()
+	if d.err == nil && sz > uint64(len(d.buf)) {
+		d.err = ErrInvalidGrid
+	}
+	if d.err != nil {
+		return nil
+	}
+	v := d.buf[0:sz]
+	d.buf = d.buf[sz:]
+	return v
+}
+
+// string reads the index of a string of the dictionary.
+func (d *gridDecoder) string() string {
+	i := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	s, ok := d.dict.String(i)
+	if !ok {
+		d.err = ErrInvalidGrid
+	}
+	return s
+}
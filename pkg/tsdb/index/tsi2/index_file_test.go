@@ -49,7 +49,7 @@ func BenchmarkIndexFile_WriteTo_Full_Permutation(b *testing.B) {
 			// Compact log file.
 			for i := 0; i < b.N; i++ {
 				buf := bytes.NewBuffer(make([]byte, 0, 4*len(tagsSlice)))
-				if _, err := idx.CompactTo(buf); err != nil {
+				if _, err := idx.PartitionAt(0).CompactTo(buf); err != nil {
 					b.Fatal(err)
 				}
 				if i == 0 {
@@ -94,7 +94,7 @@ func BenchmarkIndexFile_ReadFrom_Full_Permutation(b *testing.B) {
 		}
 
 		// read
-		filename := filepath.Join(tsi2.IndexFilePath, tsi2.FormatIndexFileName(id, 1))
+		filename := filepath.Join(idx.PartitionAt(0).Path(), tsi2.FormatIndexFileName(id, 1))
 		defer os.Remove(filename)
 
 		b.ResetTimer()
@@ -113,10 +113,13 @@ func BenchmarkIndexFile_ReadFrom_Full_Permutation(b *testing.B) {
 				rand.Seed(time.Now().UnixNano())
 				index := rand.Intn(len(tagsSlice))
 				keyIndex := rand.Intn(tagKeyNum)
-				idsSet := ifile.SeriesIDSetForTagValue([]byte("test"), []byte(tagsSlice[index][keyIndex].Key), []byte(tagsSlice[index][keyIndex].Value))
-				if idsSet.Cardinality() != tsi2.PowUint64(tagValueNum, tagKeyNum-1) {
+				idsSet, err := ifile.SeriesIDSetForTagValue([]byte("test"), []byte(tagsSlice[index][keyIndex].Key), []byte(tagsSlice[index][keyIndex].Value))
+				if err != nil {
+					b.Fatal(err)
+				} else if idsSet.Cardinality() != tsi2.PowUint64(tagValueNum, tagKeyNum-1) {
 					b.Fatal()
 				}
+				ifile.Close()
 			}
 		})
 	}
@@ -148,27 +151,31 @@ func TestIndexFile_Num(t *testing.T) {
 	}
 
 	// read
-	filename := filepath.Join(tsi2.IndexFilePath, tsi2.FormatIndexFileName(id, 1))
+	filename := filepath.Join(idx.PartitionAt(0).Path(), tsi2.FormatIndexFileName(id, 1))
 	defer os.Remove(filename)
 
 	ifile := tsi2.NewIndexFile(filename)
 	err := ifile.Restore()
 	assert.Nil(t, err)
+	defer ifile.Close()
 
 	rand.Seed(time.Now().UnixNano())
 	index := rand.Intn(len(tagsSlice))
 	keyIndex := rand.Intn(tagKeyNum)
-	idsSet := ifile.SeriesIDSetForTagValue([]byte("test"), []byte(tagsSlice[index][keyIndex].Key), []byte(tagsSlice[index][keyIndex].Value))
+	idsSet, err := ifile.SeriesIDSetForTagValue([]byte("test"), []byte(tagsSlice[index][keyIndex].Key), []byte(tagsSlice[index][keyIndex].Value))
+	assert.Nil(t, err)
 	assert.Equal(t, tsi2.PowUint64(tagValueNum, tagKeyNum-1), idsSet.Cardinality())
 
 	ifile = tsi2.NewIndexFile(filename)
 	err = ifile.Restore()
 	assert.Nil(t, err)
+	defer ifile.Close()
 
 	rand.Seed(time.Now().UnixNano())
 	index = rand.Intn(len(tagsSlice))
 	keyIndex = rand.Intn(tagKeyNum)
-	idsSet = ifile.SeriesIDSetForTagValue([]byte("test"), []byte(tagsSlice[index][keyIndex].Key), []byte(tagsSlice[index][keyIndex].Value))
+	idsSet, err = ifile.SeriesIDSetForTagValue([]byte("test"), []byte(tagsSlice[index][keyIndex].Key), []byte(tagsSlice[index][keyIndex].Value))
+	assert.Nil(t, err)
 	assert.Equal(t, tsi2.PowUint64(tagValueNum, tagKeyNum-1), idsSet.Cardinality())
 
 }
@@ -205,22 +212,73 @@ func TestIndexFile_Get(t *testing.T) {
 	err := idx.Compact(id)
 	assert.Nil(t, err)
 
-	filename := filepath.Join(tsi2.IndexFilePath, tsi2.FormatIndexFileName(id, 1))
+	filename := filepath.Join(idx.PartitionAt(0).Path(), tsi2.FormatIndexFileName(id, 1))
 	defer os.Remove(filename)
 
 	indexFile := tsi2.NewIndexFile(filename)
-	indexFile.Restore()
+	assert.NoError(t, indexFile.Restore())
+	defer indexFile.Close()
 	// SeriesIDSet
 	idsSet := indexFile.SeriesIDSet([]byte("disk"))
 	assert.Equal(t, uint64(40), idsSet.Cardinality())
 	// SeriesIDSetForTagKey
-	idsSet = indexFile.SeriesIDSetForTagKey([]byte("disk"), []byte("region"))
+	idsSet, err = indexFile.SeriesIDSetForTagKey([]byte("disk"), []byte("region"))
+	assert.NoError(t, err)
 	assert.Equal(t, uint64(40), idsSet.Cardinality())
-	idsSet = indexFile.SeriesIDSetForTagKey([]byte("disk"), []byte("wrong_key"))
+	idsSet, err = indexFile.SeriesIDSetForTagKey([]byte("disk"), []byte("wrong_key"))
+	assert.NoError(t, err)
 	assert.Equal(t, uint64(0), idsSet.Cardinality())
 	// SeriesIDSetForTagValue
-	idsSet = indexFile.SeriesIDSetForTagValue([]byte("disk"), []byte("region"), []byte("region_1"))
+	idsSet, err = indexFile.SeriesIDSetForTagValue([]byte("disk"), []byte("region"), []byte("region_1"))
+	assert.NoError(t, err)
 	assert.Equal(t, uint64(1), idsSet.Cardinality())
-	idsSet = indexFile.SeriesIDSetForTagValue([]byte("disk"), []byte("region"), []byte("wrong_value"))
+	idsSet, err = indexFile.SeriesIDSetForTagValue([]byte("disk"), []byte("region"), []byte("wrong_value"))
+	assert.NoError(t, err)
 	assert.Equal(t, uint64(0), idsSet.Cardinality())
 }
+
+// Ensure the trailers of the current and previous index file versions can be read.
+func TestReadIndexFileTrailer(t *testing.T) {
+	var tl tsi2.IndexFileTrailer
+	tl.MeasurementBlock.Offset, tl.MeasurementBlock.Size = 4, 20
+	tl.TombstoneSeriesIDSet.Offset, tl.TombstoneSeriesIDSet.Size = 24, 8
+	tl.SeriesSketch.Offset, tl.SeriesSketch.Size = 32, 16
+	tl.TombstoneMeasurementSketch.Offset, tl.TombstoneMeasurementSketch.Size = 48, 16
+	tl.IDLayout = tsi2.IDLayout{MeasurementBits: 12, SeriesBits: 20}
+	tl.GridBlockChecksum, tl.Checksum = 0x01020304, 0x05060708
+
+	var buf bytes.Buffer
+	_, err := tl.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, tsi2.IndexFileTrailerSize, buf.Len())
+
+	got, err := tsi2.ReadIndexFileTrailer(buf.Bytes())
+	assert.NoError(t, err)
+	tl.Version = tsi2.IndexFileVersion
+	assert.Equal(t, tl, got)
+
+	// Versions 3 to 5 have the same trailer, without checksums.
+	tl.GridBlockChecksum, tl.Checksum = 0, 0
+	for _, version := range []int{5, 4, 3} {
+		old := append([]byte(nil), buf.Bytes()[:buf.Len()-tsi2.IndexFileVersionSize-2*tsi2.IndexFileChecksumSize]...)
+		old = append(old, 0, byte(version))
+		got, err = tsi2.ReadIndexFileTrailer(old)
+		assert.NoError(t, err)
+		tl.Version = version
+		assert.Equal(t, tl, got)
+	}
+
+	// Version 1 has no tombstones or sketches.
+	v1 := []byte{0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 20, 0, 1}
+	got, err = tsi2.ReadIndexFileTrailer(v1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, got.Version)
+	assert.Equal(t, int64(4), got.MeasurementBlock.Offset)
+	assert.Equal(t, int64(20), got.MeasurementBlock.Size)
+	assert.Equal(t, int64(0), got.TombstoneSeriesIDSet.Size)
+	assert.Equal(t, int64(0), got.SeriesSketch.Size)
+	assert.Equal(t, tsi2.DefaultIDLayout, got.IDLayout)
+
+	_, err = tsi2.ReadIndexFileTrailer([]byte{0, 9})
+	assert.ErrorIs(t, err, tsi2.ErrUnsupportedIndexFileVersion)
+}
@@ -0,0 +1,315 @@
+package tsi2
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/influxdata/influxdb/v2/pkg/estimator"
+	"github.com/influxdata/influxdb/v2/pkg/estimator/hll"
+
+	"cycledb/pkg/tsdb"
+)
+
+// IndexFiles represents a layered set of index files.
+type IndexFiles []*IndexFile
+
+// IDs returns the ids for all index files.
+func (p IndexFiles) IDs() []int {
+	a := make([]int, len(p))
+	for i, f := range p {
+		a[i] = f.ID()
+	}
+	return a
+}
+
+// contains returns true if f is one of the files.
+func (p IndexFiles) contains(f *IndexFile) bool {
+	for _, other := range p {
+		if other == f {
+			return true
+		}
+	}
+	return false
+}
+
+// Size returns the total size of the files, in bytes.
+func (p IndexFiles) Size() int64 {
+	var n int64
+	for _, f := range p {
+		n += f.Size()
+	}
+	return n
+}
+
+// MeasurementNames returns a sorted list of the measurement names in the files.
+func (p IndexFiles) MeasurementNames() []string {
+	m := map[string]struct{}{}
+	for _, f := range p {
+		itr := f.MeasurementIterator()
+		for e := itr.Next(); e != nil; e = itr.Next() {
+			m[string(e.Name())] = struct{}{}
+		}
+	}
+
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SeriesSketches returns the merged series sketches of the files.
+func (p IndexFiles) SeriesSketches() (sketch, tSketch estimator.Sketch, err error) {
+	sketch, tSketch = hll.NewDefaultPlus(), hll.NewDefaultPlus()
+	for _, f := range p {
+		if s, t, err := f.SeriesSketches(); err != nil {
+			return nil, nil, err
+		} else if err := sketch.Merge(s); err != nil {
+			return nil, nil, err
+		} else if err := tSketch.Merge(t); err != nil {
+			return nil, nil, err
+		}
+	}
+	return sketch, tSketch, nil
+}
+
+// MeasurementsSketches returns the merged measurement sketches of the files.
+func (p IndexFiles) MeasurementsSketches() (sketch, tSketch estimator.Sketch, err error) {
+	sketch, tSketch = hll.NewDefaultPlus(), hll.NewDefaultPlus()
+	for _, f := range p {
+		if s, t, err := f.MeasurementsSketches(); err != nil {
+			return nil, nil, err
+		} else if err := sketch.Merge(s); err != nil {
+			return nil, nil, err
+		} else if err := tSketch.Merge(t); err != nil {
+			return nil, nil, err
+		}
+	}
+	return sketch, tSketch, nil
+}
+
+// IDLayout returns the id layout shared by the files, or an error if
+// they were written with different layouts.
+func (p IndexFiles) IDLayout() (IDLayout, error) {
+	if len(p) == 0 {
+		return DefaultIDLayout, nil
+	}
+	layout := p[0].IDLayout()
+	for _, f := range p[1:] {
+		if f.IDLayout() != layout {
+			return layout, fmt.Errorf("%q: %s: %w", f.Path(), f.IDLayout(), ErrIncompatibleIDLayout)
+		}
+	}
+	return layout, nil
+}
+
+// CompactTo merges all index files and writes them to w.
+// The grids keep their offsets, so their ids do not change, and are
+// re-encoded with the dictionary of the merged measurement.
+// Only the measurements for which keep returns true are written, and the
+// series in tombstones are removed from their grids. The tombstones of the
+// files are dropped along with their measurements.
+func (p IndexFiles) CompactTo(w io.Writer, keep func(name []byte, id uint64) bool, tombstones *tsdb.SeriesIDSet) (n int64, err error) {
+	layout, err := p.IDLayout()
+	if err != nil {
+		return 0, err
+	}
+	cw := newChecksumWriter(w)
+	bw := bufio.NewWriterSize(cw, indexFileBufferSize)
+
+	t := IndexFileTrailer{IDLayout: layout}
+	info := NewIndexFileCompactInfo()
+	seriesIDSets := map[string]*tsdb.SeriesIDSet{}
+
+	// Group tombstones by measurement, with ids within the grid index.
+	dropped := map[uint64]*tsdb.SeriesIDSet{}
+	tombstones.ForEach(func(id uint64) {
+		measurementID, indexID := layout.splitSeriesID(id)
+		if dropped[measurementID] == nil {
+			dropped[measurementID] = tsdb.NewSeriesIDSet()
+		}
+		dropped[measurementID].Add(indexID)
+	})
+
+	// Ids of all series in the files. The tombstones of the files are
+	// only kept for the series in other files.
+	merged := tsdb.NewSeriesIDSet()
+
+	// Ids of the measurements which are not written.
+	skipped := map[uint64]bool{}
+
+	// Write magic number.
+	if err := writeTo(bw, []byte(FileSignature), &n); err != nil {
+		return n, err
+	}
+
+	// Write grid blocks in measurement order.
+	names := p.MeasurementNames()
+	for _, name := range names {
+		mmInfo := &IndexFileMeasurementCompactInfo{Offset: n}
+		ss := tsdb.NewSeriesIDSet()
+		var grids []*Grid
+		for _, f := range p {
+			e, ok := f.mblk.Elem([]byte(name))
+			if !ok {
+				continue
+			}
+			e.SeriesIDSet().ForEach(func(id uint64) {
+				merged.Add(layout.seriesID(e.ID(), id))
+			})
+			if !keep(e.Name(), e.ID()) {
+				skipped[e.ID()] = true
+				continue
+			}
+			mmInfo.MeasurementID = e.ID()
+
+			for i := range e.grids {
+				g, err := f.grid(e, i)
+				if err != nil {
+					return n, fmt.Errorf("%q: measurement %q: %w", f.Path(), name, err)
+				}
+				if ids := dropped[e.ID()]; ids != nil {
+					if g = removeGridSeriesIDs(g, ids); g == nil {
+						continue // all series of the grid were dropped
+					}
+				}
+				grids = append(grids, g)
+			}
+			if ids := dropped[e.ID()]; ids != nil {
+				ss.MergeInPlace(e.SeriesIDSet().AndNot(ids))
+			} else {
+				ss.MergeInPlace(e.SeriesIDSet())
+			}
+		}
+		if len(grids) == 0 {
+			continue
+		}
+
+		// Write the dictionary of the grids, then the grids encoded with it,
+		// as the grids of each file refer to the dictionary of the file.
+		dw := NewGridDictionaryWriter()
+		tw := NewTagBlockWriter()
+		for _, g := range grids {
+			dw.AddGrid(g)
+			tw.AddGrid(g)
+		}
+		mmInfo.dictionary.offset = n
+		nn, err := dw.WriteTo(bw)
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		mmInfo.dictionary.size = n - mmInfo.dictionary.offset
+
+		enc := NewGridBlockEncoder(bw, dw)
+		for _, g := range grids {
+			gridInfo := &GridCompactInfo{offset: n + enc.N()}
+			if err := enc.EncodeGrid(g); err != nil {
+				return n, err
+			}
+			gridInfo.size = n + enc.N() - gridInfo.offset
+			mmInfo.gridInfos = append(mmInfo.gridInfos, gridInfo)
+		}
+		n += enc.N()
+
+		// Write the tag block of the grids.
+		mmInfo.tagBlock.offset = n
+		nn, err = tw.WriteTo(bw)
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		mmInfo.tagBlock.size = n - mmInfo.tagBlock.offset
+		mmInfo.Size = n - mmInfo.Offset
+		info.Mms[name] = mmInfo
+		seriesIDSets[name] = ss
+	}
+
+	// Checksum the signature and the grid block.
+	if err := bw.Flush(); err != nil {
+		return n, err
+	}
+	t.GridBlockChecksum = cw.reset()
+
+	// Write measurement block.
+	t.MeasurementBlock.Offset = n
+	mw := NewMeasurementBlockWriter()
+	for _, name := range names {
+		if mmInfo, ok := info.Mms[name]; ok {
+			mw.Add([]byte(name), mmInfo, seriesIDSets[name])
+		}
+	}
+	nn, err := mw.WriteTo(bw)
+	n += nn
+	if err != nil {
+		return n, err
+	}
+	t.MeasurementBlock.Size = n - t.MeasurementBlock.Offset
+
+	// Write the tombstones of the series in other files.
+	ts := tsdb.NewSeriesIDSet()
+	for _, f := range p {
+		ts.MergeInPlace(f.TombstoneSeriesIDSet())
+	}
+	kept := tsdb.NewSeriesIDSet()
+	ts.AndNot(merged).ForEach(func(id uint64) {
+		if measurementID, _ := layout.splitSeriesID(id); !skipped[measurementID] {
+			kept.Add(id)
+		}
+	})
+	t.TombstoneSeriesIDSet.Offset = n
+	nn, err = kept.WriteTo(bw)
+	n += nn
+	if err != nil {
+		return n, err
+	}
+	t.TombstoneSeriesIDSet.Size = n - t.TombstoneSeriesIDSet.Offset
+
+	// Write the merged sketches.
+	sSketch, sTSketch, err := p.SeriesSketches()
+	if err != nil {
+		return n, err
+	}
+	mSketch, mTSketch, err := p.MeasurementsSketches()
+	if err != nil {
+		return n, err
+	}
+	if err := writeSketchesTo(bw, &t, sSketch, sTSketch, mSketch, mTSketch, &n); err != nil {
+		return n, err
+	}
+
+	// Write trailer, with the checksum of the file since the grid block.
+	if err := bw.Flush(); err != nil {
+		return n, err
+	}
+	t.Checksum = t.checksum(cw.reset())
+	nn, err = t.WriteTo(bw)
+	n += nn
+	if err != nil {
+		return n, err
+	}
+
+	// Flush buffer.
+	if err := bw.Flush(); err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
+
+// removeGridSeriesIDs returns the grid without the series of ids, or nil if
+// it holds no series afterwards. Returns g if it does not hold any of ids.
+// Dropping series does not change the keys and values of the grid.
+func removeGridSeriesIDs(g *Grid, ids *tsdb.SeriesIDSet) *Grid {
+	if !g.seriesIDSet.Intersects(ids) {
+		return g
+	}
+	ss := g.seriesIDSet.AndNot(ids)
+	if ss.Cardinality() == 0 {
+		return nil
+	}
+	return NewGridWithKeysAndValuesSlice(g.offset, g.tagKeys, g.tagValuesSlice, ss)
+}
@@ -2,10 +2,12 @@ package tsi2_test
 
 import (
 	"compress/gzip"
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -15,9 +17,12 @@ import (
 	"time"
 
 	"cycledb/pkg/tsdb"
+	_ "cycledb/pkg/tsdb/engine"
 	"cycledb/pkg/tsdb/index/tsi2"
 
+	"github.com/influxdata/influxdb/v2/influxql/query"
 	"github.com/influxdata/influxdb/v2/models"
+	"github.com/influxdata/influxql"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,6 +35,7 @@ type SeriesFile struct {
 type Index struct {
 	*tsi2.Index
 	SeriesFile *SeriesFile
+	options    []tsi2.IndexOption
 }
 
 // Open opens the underlying tsi1.Index and tsdb.SeriesFile
@@ -52,9 +58,26 @@ func (idx *Index) Close() error {
 	return nil
 }
 
+// Reopen closes and reopens the index and the series file, the index is
+// rebuilt from the files under its path.
+func (idx *Index) Reopen() error {
+	if err := idx.Close(); err != nil {
+		return err
+	}
+
+	idx.SeriesFile = &SeriesFile{SeriesFile: tsdb.NewSeriesFile(idx.SeriesFile.Path())}
+	idx.Index = tsi2.NewIndex(idx.SeriesFile.SeriesFile, idx.Database(), idx.options...)
+	return idx.Open()
+}
+
 // MustOpenIndex returns a new, open index. Panic on error.
 func MustOpenDefaultIndex(tb testing.TB) *Index {
-	idx := NewIndex(tb)
+	return MustOpenIndex(tb)
+}
+
+// MustOpenIndex returns a new, open index with options. Panic on error.
+func MustOpenIndex(tb testing.TB, options ...tsi2.IndexOption) *Index {
+	idx := NewIndex(tb, options...)
 	if err := idx.SeriesFile.Open(); err != nil {
 		panic(err)
 	}
@@ -65,9 +88,11 @@ func MustOpenDefaultIndex(tb testing.TB) *Index {
 }
 
 // NewIndex returns a new instance of Index at a temporary path.
-func NewIndex(tb testing.TB) *Index {
+func NewIndex(tb testing.TB, options ...tsi2.IndexOption) *Index {
 	idx := &Index{SeriesFile: NewSeriesFile(tb)}
-	idx.Index = tsi2.NewIndex(idx.SeriesFile.SeriesFile, "db0", tsi2.WithPath(tb.TempDir()))
+	// The tests read the files of a single partition, in the path of the index.
+	idx.options = append([]tsi2.IndexOption{tsi2.WithPath(tb.TempDir()), tsi2.WithPartitionN(1)}, options...)
+	idx.Index = tsi2.NewIndex(idx.SeriesFile.SeriesFile, "db0", idx.options...)
 	return idx
 }
 
@@ -80,6 +105,8 @@ func TestInterface(t *testing.T) {
 	var index tsdb.Index
 	index = &tsi2.Index{}
 	assert.NotNil(t, index)
+	var matcher tsdb.TagValueMatcher = &tsi2.Index{}
+	assert.NotNil(t, matcher)
 }
 
 // Series represents name/tagset pairs that are used in testing.
@@ -130,31 +157,23 @@ func (idx *Index) RunStateAware(t *testing.T, fn func(t *testing.T, state int))
 	// Invoke immediately.
 	t.Run("state=initial", curryState(Initial, fn))
 
-	// // Reopen and invoke again.
-	// if err := idx.Reopen(tsdb.DefaultMaxIndexLogFileSize); err != nil {
-	// 	t.Fatalf("reopen error: %s", err)
-	// }
-	// t.Run("state=reopen", curryState(Reopen, fn))
-
-	// // Reopen requiring a full compaction of the TSL files and invoke again.
-	// idx.Reopen(1)
-	// for {
-	// 	needsCompaction := false
-	// 	for i := 0; i < int(idx.PartitionN); i++ {
-	// 		needsCompaction = needsCompaction || idx.PartitionAt(i).NeedsCompaction(false)
-	// 	}
-	// 	if !needsCompaction {
-	// 		break
-	// 	}
-	// 	time.Sleep(10 * time.Millisecond)
-	// }
-	// t.Run("state=post-compaction", curryState(PostCompaction, fn))
+	// Reopen and invoke again.
+	if err := idx.Reopen(); err != nil {
+		t.Fatalf("reopen error: %s", err)
+	}
+	t.Run("state=reopen", curryState(Reopen, fn))
 
-	// // Reopen and invoke again.
-	// if err := idx.Reopen(tsdb.DefaultMaxIndexLogFileSize); err != nil {
-	// 	t.Fatalf("post-compaction reopen error: %s", err)
-	// }
-	// t.Run("state=post-compaction-reopen", curryState(PostCompactionReopen, fn))
+	// Compact the grids to an index file and invoke again.
+	if err := idx.Compact(time.Now().Nanosecond()); err != nil {
+		t.Fatalf("compaction error: %s", err)
+	}
+	t.Run("state=post-compaction", curryState(PostCompaction, fn))
+
+	// Reopen and invoke again.
+	if err := idx.Reopen(); err != nil {
+		t.Fatalf("post-compaction reopen error: %s", err)
+	}
+	t.Run("state=post-compaction-reopen", curryState(PostCompactionReopen, fn))
 }
 
 func curryState(state int, f func(t *testing.T, state int)) func(t *testing.T) {
@@ -167,6 +186,87 @@ func TestSeriesFile(t *testing.T) {
 
 }
 
+// Ensure the grid index is registered and selectable through configuration.
+func TestIndex_Registered(t *testing.T) {
+	c := tsdb.NewConfig()
+	c.Dir = "/var/lib/influxdb/data"
+	c.WALDir = "/var/lib/influxdb/wal"
+	c.Index = tsi2.IndexName
+	assert.NoError(t, c.Validate())
+
+	sfile := MustOpenSeriesFile(t)
+	idx, err := tsdb.NewIndex(0, "db0", t.TempDir(), tsdb.NewSeriesIDSet(), sfile.SeriesFile, tsdb.EngineOptions{IndexVersion: tsi2.IndexName})
+	assert.NoError(t, err)
+	assert.Equal(t, tsi2.IndexName, idx.Type())
+
+	// An existing tsi1 index is never reopened as a grid index.
+	path := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(path, "0"), 0777))
+	assert.NoError(t, os.WriteFile(filepath.Join(path, "0", "L0-00000001.tsl"), nil, 0666))
+	idx, err = tsdb.NewIndex(0, "db0", path, tsdb.NewSeriesIDSet(), sfile.SeriesFile, tsdb.EngineOptions{IndexVersion: tsi2.IndexName})
+	assert.NoError(t, err)
+	assert.Equal(t, tsdb.TSI1IndexName, idx.Type())
+
+	// Nor is an existing grid index reopened as a tsi1 index.
+	path = t.TempDir()
+	idx, err = tsdb.NewIndex(0, "db0", path, tsdb.NewSeriesIDSet(), sfile.SeriesFile, tsdb.EngineOptions{IndexVersion: tsi2.IndexName})
+	assert.NoError(t, err)
+	assert.NoError(t, idx.Open())
+	assert.NoError(t, idx.Close())
+	idx, err = tsdb.NewIndex(0, "db0", path, tsdb.NewSeriesIDSet(), sfile.SeriesFile, tsdb.EngineOptions{IndexVersion: tsdb.TSI1IndexName})
+	assert.NoError(t, err)
+	assert.Equal(t, tsi2.IndexName, idx.Type())
+}
+
+// Ensure a shard configured with the grid index opens and writes on it.
+func TestIndex_Shard(t *testing.T) {
+	dir := t.TempDir()
+	sfile := MustOpenSeriesFile(t)
+
+	opt := tsdb.NewEngineOptions()
+	opt.IndexVersion = tsi2.IndexName
+	opt.Config.WALDir = filepath.Join(dir, "wal")
+
+	sh := tsdb.NewShard(0, filepath.Join(dir, "shard"), filepath.Join(dir, "wal"), sfile.SeriesFile, opt)
+	if err := sh.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer sh.Close()
+
+	points, err := models.ParsePoints([]byte("cpu,host=a,region=west v=1 1\ncpu,host=b,region=west v=2 2\nmem,host=a v=3 3"))
+	assert.NoError(t, err)
+	assert.NoError(t, sh.WritePoints(context.Background(), points))
+
+	idx, err := sh.Index()
+	assert.NoError(t, err)
+	assert.Equal(t, tsi2.IndexName, idx.Type())
+
+	for _, name := range []string{"cpu", "mem"} {
+		ok, err := sh.MeasurementExists([]byte(name))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	// The grids are replayed from the log when the shard is reopened.
+	assert.NoError(t, sh.Close())
+	assert.NoError(t, sh.Open(context.Background()))
+	for _, name := range []string{"cpu", "mem"} {
+		ok, err := sh.MeasurementExists([]byte(name))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+}
+
+// MustOpenSeriesFile returns a new, open series file which is closed on cleanup.
+func MustOpenSeriesFile(tb testing.TB) *SeriesFile {
+	sfile := NewSeriesFile(tb)
+	if err := sfile.Open(); err != nil {
+		panic(err)
+	}
+	tb.Cleanup(func() { sfile.Close() })
+	return sfile
+}
+
 // Ensure index can iterate over all measurement names.
 func TestIndex_ForEachMeasurementName(t *testing.T) {
 	idx := MustOpenDefaultIndex(t)
@@ -372,28 +472,152 @@ func TestIndex_DropMeasurement(t *testing.T) {
 	})
 }
 
+// Ensure series can be dropped from grids in memory and in index files.
+func TestIndex_DropSeries(t *testing.T) {
+	idx := MustOpenIndex(t, tsi2.WithMaxLevelFileN(2))
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "north"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "west"})},
+	}))
+	seriesIDs := func(name, key, value string) []uint64 {
+		itr, err := idx.TagValueSeriesIDIterator([]byte(name), []byte(key), []byte(value))
+		assert.NoError(t, err)
+		return tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet().Slice()
+	}
+	east, west, north := seriesIDs("cpu", "region", "east"), seriesIDs("cpu", "region", "west"), seriesIDs("cpu", "region", "north")
+	assert.Len(t, east, 1)
+	assert.Len(t, west, 1)
+	assert.Len(t, north, 1)
+
+	// Drop a series held in memory.
+	assert.NoError(t, idx.DropSeries(east[0], nil, false))
+	idx.Run(t, func(t *testing.T) {
+		assert.Empty(t, seriesIDs("cpu", "region", "east"))
+		assert.Equal(t, west, seriesIDs("cpu", "region", "west"))
+	})
+
+	// Drop a series held in an index file, the tombstone is written to the next one.
+	assert.NoError(t, idx.DropSeries(west[0], nil, true))
+	idx.Run(t, func(t *testing.T) {
+		assert.Empty(t, seriesIDs("cpu", "region", "west"))
+		assert.Equal(t, north, seriesIDs("cpu", "region", "north"))
+		assert.Len(t, seriesIDs("mem", "region", "west"), 1)
+	})
+
+	// The tombstoned series is removed by merging the index files.
+	m, _, err := tsi2.ReadManifestFile(idx.PartitionAt(0).ManifestPath())
+	assert.NoError(t, err)
+	assert.Len(t, m.Files, 2)
+	level, _ := tsi2.ParseFilename(m.Files[0])
+	assert.Equal(t, 2, level)
+	f := tsi2.NewIndexFile(filepath.Join(idx.PartitionAt(0).Path(), m.Files[0]))
+	assert.NoError(t, f.Restore())
+	defer f.Close()
+	assert.Equal(t, uint64(0), f.TombstoneSeriesIDSet().Cardinality())
+	assert.Equal(t, north, f.SeriesIDSet([]byte("cpu")).Slice())
+
+	// The measurement is dropped with its last series.
+	ok, err := idx.DropMeasurementIfSeriesNotExist([]byte("cpu"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoError(t, idx.DropSeries(north[0], nil, true))
+	idx.Run(t, func(t *testing.T) {
+		ok, err := idx.MeasurementExists([]byte("cpu"))
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		ok, err = idx.MeasurementExists([]byte("mem"))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+}
+
+// Ensure a dropped series gets a new id when it is written again, as the
+// series file does not give a deleted id to a recreated series.
+func TestIndex_DropSeries_Recreate(t *testing.T) {
+	idx := MustOpenDefaultIndex(t)
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	s := Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})}
+	key := models.MakeKey(s.Name, s.Tags)
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{s}))
+	id := idx.SeriesFile.SeriesID(s.Name, s.Tags, nil)
+	assert.NotEqual(t, uint64(0), id)
+
+	assert.NoError(t, idx.DropSeries(id, key, false))
+	assert.NoError(t, idx.SeriesFile.DeleteSeriesID(id))
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{s}))
+
+	newID := idx.SeriesFile.SeriesID(s.Name, s.Tags, nil)
+	assert.NotEqual(t, uint64(0), newID)
+	assert.NotEqual(t, id, newID)
+	assert.True(t, idx.SeriesFile.HasSeries(s.Name, s.Tags, nil))
+	seriesIDs := func() []uint64 {
+		itr, err := idx.TagValueSeriesIDIterator(s.Name, []byte("region"), []byte("east"))
+		assert.NoError(t, err)
+		return tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet().Slice()
+	}
+	assert.Equal(t, []uint64{newID}, seriesIDs())
+
+	// The dropped coordinate is retired again when the log is replayed.
+	assert.NoError(t, idx.Reopen())
+	assert.Equal(t, []uint64{newID}, seriesIDs())
+	assert.NoError(t, idx.DropSeries(newID, key, false))
+	assert.NoError(t, idx.SeriesFile.DeleteSeriesID(newID))
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{s}))
+	lastID := idx.SeriesFile.SeriesID(s.Name, s.Tags, nil)
+	assert.NotContains(t, []uint64{0, id, newID}, lastID)
+	assert.Equal(t, []uint64{lastID}, seriesIDs())
+}
+
+// Ensure the disk size is the size of the index and log files of the partitions.
+func TestIndex_DiskSizeBytes(t *testing.T) {
+	idx := MustOpenDefaultIndex(t)
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	// size returns the size of the files in the manifests of the partitions.
+	size := func() int64 {
+		var n int64
+		for i := 0; i < idx.PartitionN(); i++ {
+			p := idx.PartitionAt(i)
+			m, _, err := tsi2.ReadManifestFile(p.ManifestPath())
+			assert.NoError(t, err)
+			for _, filename := range m.Files {
+				fi, err := os.Stat(filepath.Join(p.Path(), filename))
+				assert.NoError(t, err)
+				n += fi.Size()
+			}
+		}
+		return n
+	}
+	assert.Equal(t, size(), idx.DiskSizeBytes())
+
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "web-1", "region": "east"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"host": "web-2"})},
+	}))
+	logged := idx.DiskSizeBytes()
+	assert.Greater(t, logged, int64(0))
+	assert.Equal(t, size(), logged)
+
+	assert.NoError(t, idx.Compact(1))
+	assert.Greater(t, idx.DiskSizeBytes(), logged)
+	assert.Equal(t, size(), idx.DiskSizeBytes())
+}
+
 func TestIndex_Open(t *testing.T) {
 	t.Run("open new index", func(t *testing.T) {
 		// Opening a fresh index should set the MANIFEST version to current version.
 		idx := MustOpenDefaultIndex(t)
 		t.Cleanup(func() { assert.NoError(t, idx.Close()) })
 
-		// 	// Check version set appropriately.
-		// 	for i := 0; uint64(i) < tsi1.DefaultPartitionN; i++ {
-		// 		partition := idx.PartitionAt(i)
-
-		// 		if got, exp := partition.Manifest().Version, 1; got != exp {
-		// 			t.Fatalf("got index version %d, expected %d", got, exp)
-		// 		}
-		// 	}
-
-		// 	for i := 0; i < int(idx.PartitionN); i++ {
-		// 		p := idx.PartitionAt(i)
-
-		// 		if got, exp := p.NeedsCompaction(false), false; got != exp {
-		// 			t.Fatalf("got needs compaction %v, expected %v", got, exp)
-		// 		}
-		// 	}
+		m, _, err := tsi2.ReadManifestFile(idx.PartitionAt(0).ManifestPath())
+		assert.NoError(t, err)
+		assert.Equal(t, tsi2.Version, m.Version)
+		assert.Len(t, m.Files, 1)
 	})
 
 	// Reopening an open index should return an error.
@@ -414,41 +638,642 @@ func TestIndex_Open(t *testing.T) {
 		}
 	})
 
-	// // Opening an incompatible index should return an error.
-	// incompatibleVersions := []int{-1, 0, 2}
-	// for _, v := range incompatibleVersions {
-	// 	t.Run(fmt.Sprintf("incompatible index version: %d", v), func(t *testing.T) {
-	// 		idx := NewDefaultIndex(t)
-
-	// 		// Manually create a MANIFEST file for an incompatible index version.
-	// 		// under one of the partitions.
-	// 		partitionPath := filepath.Join(idx.Path(), "2")
-	// 		os.MkdirAll(partitionPath, 0777)
-
-	// 		mpath := filepath.Join(partitionPath, tsi1.ManifestFileName)
-	// 		m := tsi1.NewManifest(mpath)
-	// 		m.Levels = nil
-	// 		m.Version = v // Set example MANIFEST version.
-	// 		if _, err := m.Write(); err != nil {
-	// 			t.Fatal(err)
-	// 		}
-
-	// 		// Log the MANIFEST file.
-	// 		data, err := os.ReadFile(mpath)
-	// 		if err != nil {
-	// 			panic(err)
-	// 		}
-	// 		t.Logf("Incompatible MANIFEST: %s", data)
-
-	// 		// Opening this index should return an error because the MANIFEST has an
-	// 		// incompatible version.
-	// 		err = idx.Open()
-	// 		t.Cleanup(func() { assert.NoError(t, idx.Close()) })
-	// 		if !errors.Is(err, tsi1.ErrIncompatibleVersion) {
-	// 			t.Fatalf("got error %v, expected %v", err, tsi1.ErrIncompatibleVersion)
-	// 		}
-	// 	})
-	// }
+	// Reopening a closed index should rebuild the grids from the log.
+	t.Run("replay log", func(t *testing.T) {
+		idx := MustOpenDefaultIndex(t)
+		t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+		var series []Series
+		for i := 0; i < 40; i++ {
+			for _, name := range []string{"cpu", "mem", "disk"} {
+				series = append(series, Series{Name: []byte(name), Tags: models.NewTags(map[string]string{
+					"region": fmt.Sprintf("region_%d", i%7),
+					"server": fmt.Sprintf("server_%d", i),
+				})})
+			}
+		}
+		assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series))
+		assert.NoError(t, idx.DropMeasurement([]byte("mem")))
+
+		ids := func(name, key, value string) []uint64 {
+			itr, err := idx.TagValueSeriesIDIterator([]byte(name), []byte(key), []byte(value))
+			assert.NoError(t, err)
+			return tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet().Slice()
+		}
+		exp := ids("cpu", "region", "region_3")
+		assert.Len(t, exp, 6)
+
+		assert.NoError(t, idx.Reopen())
+		assert.Equal(t, exp, ids("cpu", "region", "region_3"))
+		assert.Equal(t, []string{"cpu", "disk"}, idx.MeasurementNames())
+
+		// The series file holds the same ids as the grids.
+		for _, id := range exp {
+			name, tags := idx.SeriesFile.Series(id)
+			assert.Equal(t, "cpu", string(name))
+			assert.Equal(t, "region_3", tags.GetString("region"))
+		}
+
+		// New series are assigned after the replayed ones.
+		s := Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "region_3", "server": "server_new"})}
+		assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{s}))
+		got := ids("cpu", "region", "region_3")
+		assert.Len(t, got, 7)
+		assert.Subset(t, got, exp)
+	})
+
+	// Reopening a compacted index should answer from its index files.
+	t.Run("reopen index files", func(t *testing.T) {
+		idx := MustOpenDefaultIndex(t)
+		t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+		var series []Series
+		for i := 0; i < 30; i++ {
+			series = append(series, Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{
+				"region": fmt.Sprintf("region_%d", i%3),
+				"server": fmt.Sprintf("server_%d", i),
+			})})
+		}
+		assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series[:20]))
+		assert.NoError(t, idx.Compact(10))
+		assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series[20:]))
+
+		ids := func(key, value string) []uint64 {
+			itr, err := idx.TagValueSeriesIDIterator([]byte("cpu"), []byte(key), []byte(value))
+			assert.NoError(t, err)
+			return tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet().Slice()
+		}
+		exp := ids("region", "region_1")
+		assert.Len(t, exp, 10)
+
+		assert.NoError(t, idx.Compact(20))
+		m, _, err := tsi2.ReadManifestFile(idx.PartitionAt(0).ManifestPath())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{tsi2.FormatIndexFileName(10, 1), tsi2.FormatIndexFileName(20, 1), tsi2.FormatLogFileName(21)}, m.Files)
+
+		assert.NoError(t, idx.Reopen())
+		assert.Equal(t, exp, ids("region", "region_1"))
+		assert.Len(t, ids("server", "server_25"), 1)
+
+		ok, err := idx.HasTagValue([]byte("cpu"), []byte("server"), []byte("server_3"))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		// The series file holds the same ids as the index files.
+		for _, id := range exp {
+			name, tags := idx.SeriesFile.Series(id)
+			assert.Equal(t, "cpu", string(name))
+			assert.Equal(t, "region_1", tags.GetString("region"))
+		}
+
+		// New series are assigned after the flushed ones.
+		s := Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "region_1", "server": "server_new"})}
+		assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{s}))
+		got := ids("region", "region_1")
+		assert.Len(t, got, 11)
+		assert.Subset(t, got, exp)
+	})
+
+	// Opening an incompatible index should return an error.
+	for _, v := range []int{-1, 0, 2} {
+		t.Run(fmt.Sprintf("incompatible index version: %d", v), func(t *testing.T) {
+			idx := NewIndex(t)
+			assert.NoError(t, os.MkdirAll(idx.Path(), 0777))
+
+			// Manually create a MANIFEST file for an incompatible index version.
+			m := tsi2.NewManifest(filepath.Join(idx.Path(), tsi2.ManifestFileName))
+			m.Version = v
+			if _, err := m.Write(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Opening this index should return an error because the MANIFEST has an
+			// incompatible version.
+			err := idx.Open()
+			t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+			if !errors.Is(err, tsi2.ErrIncompatibleVersion) {
+				t.Fatalf("got error %v, expected %v", err, tsi2.ErrIncompatibleVersion)
+			}
+		})
+	}
+}
+
+// Ensure index files are merged into the next level once a level is full.
+func TestIndex_CompactLevels(t *testing.T) {
+	series := func(name string, n int) []Series {
+		var a []Series
+		for i := 0; i < n; i++ {
+			a = append(a, Series{Name: []byte(name), Tags: models.NewTags(map[string]string{
+				"region": fmt.Sprintf("region_%d", i%4),
+				"server": fmt.Sprintf("%s_%d", name, i),
+			})})
+		}
+		return a
+	}
+	ids := func(idx *Index, name, key, value string) []uint64 {
+		itr, err := idx.TagValueSeriesIDIterator([]byte(name), []byte(key), []byte(value))
+		assert.NoError(t, err)
+		return tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet().Slice()
+	}
+	levels := func(idx *Index) []int {
+		m, _, err := tsi2.ReadManifestFile(idx.PartitionAt(0).ManifestPath())
+		assert.NoError(t, err)
+		var a []int
+		for _, filename := range m.Files {
+			if filepath.Ext(filename) == tsi2.IndexFileExt {
+				level, _ := tsi2.ParseFilename(filename)
+				a = append(a, level)
+			}
+		}
+		return a
+	}
+
+	t.Run("file count", func(t *testing.T) {
+		idx := MustOpenIndex(t, tsi2.WithMaxLevelFileN(2))
+		t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+		for i, name := range []string{"cpu", "mem", "cpu", "disk"} {
+			assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series(name, 8*(i+1))))
+			assert.NoError(t, idx.Compact(i+1))
+		}
+		assert.NoError(t, idx.DropMeasurement([]byte("disk")))
+
+		// Two merges to level 2, which are then merged to level 3.
+		assert.Equal(t, []int{3}, levels(idx))
+		exp := ids(idx, "cpu", "region", "region_1")
+		assert.Len(t, exp, 6)
+		assert.Len(t, ids(idx, "mem", "region", "region_1"), 4)
+
+		// Dropped measurements are removed by the next merge.
+		assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series("mem", 40)))
+		assert.NoError(t, idx.Compact(5))
+		assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series("mem", 48)))
+		assert.NoError(t, idx.Compact(6))
+		assert.Equal(t, []int{3, 2}, levels(idx))
+
+		assert.NoError(t, idx.Reopen())
+		assert.Equal(t, exp, ids(idx, "cpu", "region", "region_1"))
+		assert.Len(t, ids(idx, "mem", "region", "region_1"), 12)
+		ok, err := idx.MeasurementExists([]byte("disk"))
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("file size", func(t *testing.T) {
+		idx := MustOpenIndex(t, tsi2.WithMaxLevelSize(1))
+		t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+		assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series("cpu", 8)))
+		assert.NoError(t, idx.Compact(1))
+		assert.Equal(t, []int{1}, levels(idx))
+
+		assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series("cpu", 16)))
+		assert.NoError(t, idx.Compact(2))
+		assert.Equal(t, []int{2}, levels(idx))
+		assert.Len(t, ids(idx, "cpu", "region", "region_1"), 4)
+	})
+}
+
+// Ensure the grids are flushed to an index file once they take too much memory.
+func TestIndex_Cardinality(t *testing.T) {
+	idx := MustOpenDefaultIndex(t)
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})},
+		{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"region": "east"})},
+	}))
+	itr, err := idx.TagValueSeriesIDIterator([]byte("cpu"), []byte("region"), []byte("west"))
+	assert.NoError(t, err)
+	west := tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet().Slice()
+	assert.Len(t, west, 1)
+
+	assert.NoError(t, idx.DropSeries(west[0], models.MakeKey([]byte("cpu"), models.NewTags(map[string]string{"region": "west"})), false))
+	assert.NoError(t, idx.DropMeasurement([]byte("disk")))
+
+	idx.Run(t, func(t *testing.T) {
+		assert.Equal(t, int64(2), idx.SeriesN())
+		assert.Equal(t, uint64(2), idx.SeriesIDSet().Cardinality())
+		assert.False(t, idx.SeriesIDSet().Contains(west[0]))
+
+		s, ts, err := idx.SeriesSketches()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(4), s.Count())
+		assert.Equal(t, uint64(1), ts.Count())
+
+		m, tm, err := idx.MeasurementsSketches()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(3), m.Count())
+		assert.Equal(t, uint64(1), tm.Count())
+	})
+}
+
+func TestIndex_TagKeyCardinality(t *testing.T) {
+	idx := MustOpenDefaultIndex(t)
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	// The values are spread over several grids, in an index file and in memory.
+	var series []Series
+	for i := 0; i < 100; i++ {
+		series = append(series, Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{
+			"region": fmt.Sprintf("region_%d", i%4),
+			"server": fmt.Sprintf("server_%d", i),
+		})})
+	}
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series[:60]))
+	assert.NoError(t, idx.Compact(1))
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series[60:]))
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "a"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "region_9"})},
+	}))
+
+	idx.Run(t, func(t *testing.T) {
+		assert.Equal(t, 4, idx.TagKeyCardinality([]byte("cpu"), []byte("region")))
+		assert.Equal(t, 100, idx.TagKeyCardinality([]byte("cpu"), []byte("server")))
+		assert.Equal(t, 1, idx.TagKeyCardinality([]byte("cpu"), []byte("host")))
+		assert.Equal(t, 1, idx.TagKeyCardinality([]byte("mem"), []byte("region")))
+		assert.Zero(t, idx.TagKeyCardinality([]byte("cpu"), []byte("zone")))
+		assert.Zero(t, idx.TagKeyCardinality([]byte("disk"), []byte("region")))
+
+		n, err := idx.TagValueN([]byte("cpu"))
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"host": 1, "region": 4, "server": 100}, n)
+
+		n, err = idx.TagValueN([]byte("disk"))
+		assert.NoError(t, err)
+		assert.Nil(t, n)
+	})
+}
+
+func TestIndex_IDLayout(t *testing.T) {
+	layout := tsi2.IDLayout{MeasurementBits: 2, SeriesBits: 12}
+	idx := MustOpenIndex(t, tsi2.WithIDLayout(layout))
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	var series []Series
+	for _, name := range []string{"cpu", "mem", "disk", "net"} {
+		series = append(series, Series{Name: []byte(name), Tags: models.NewTags(map[string]string{"region": "east"})})
+	}
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series))
+
+	// The fifth measurement does not fit in 2 bits.
+	err := idx.CreateSeriesSliceIfNotExists([]Series{{Name: []byte("swap"), Tags: models.NewTags(map[string]string{"region": "east"})}})
+	assert.ErrorIs(t, err, tsi2.ErrMeasurementIDOverflow)
+
+	idx.Run(t, func(t *testing.T) {
+		itr, err := idx.TagValueSeriesIDIterator([]byte("net"), []byte("region"), []byte("east"))
+		assert.NoError(t, err)
+		ids := tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet()
+		assert.Equal(t, []uint64{3<<12 | 1}, ids.Slice())
+		ok, err := idx.MeasurementExists([]byte("swap"))
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	// The layout is recorded in the manifest and the index files.
+	m, _, err := tsi2.ReadManifestFile(idx.PartitionAt(0).ManifestPath())
+	assert.NoError(t, err)
+	assert.Equal(t, layout, m.Layout())
+	f := tsi2.NewIndexFile(filepath.Join(idx.PartitionAt(0).Path(), m.Files[0]))
+	assert.NoError(t, f.Restore())
+	assert.Equal(t, layout, f.IDLayout())
+	assert.NoError(t, f.Close())
+
+	// The index can not be opened with another layout.
+	other := tsi2.NewIndex(nil, "db0", tsi2.WithPath(idx.Path()))
+	assert.ErrorIs(t, other.Open(), tsi2.ErrIncompatibleIDLayout)
+}
+
+func TestIndex_GridOptimizer(t *testing.T) {
+	idx := MustOpenIndex(t, tsi2.WithGridOptimizer(tsdb.StatisticsGridOptimizer))
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	series := make([]Series, 0, 300)
+	for i := 0; i < cap(series); i++ {
+		series = append(series, Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{
+			"region": fmt.Sprintf("region_%d", i%4),
+			"server": fmt.Sprintf("server_%d", i),
+		})})
+	}
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series))
+
+	idx.Run(t, func(t *testing.T) {
+		assert.Equal(t, int64(300), idx.SeriesN())
+		itr, err := idx.TagValueSeriesIDIterator([]byte("cpu"), []byte("region"), []byte("region_1"))
+		assert.NoError(t, err)
+		ids := tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet()
+		assert.Equal(t, uint64(75), ids.Cardinality())
+	})
+
+	// An unknown optimizer is rejected.
+	other := tsi2.NewIndex(nil, "db0", tsi2.WithPath(t.TempDir()), tsi2.WithGridOptimizer("foo"))
+	assert.ErrorIs(t, other.Open(), tsi2.ErrUnknownGridOptimizer)
+}
+
+func TestIndex_Repack(t *testing.T) {
+	idx := MustOpenDefaultIndex(t)
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	var cpu []Series
+	for i := 0; i < 200; i++ {
+		cpu = append(cpu, Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{
+			"region": fmt.Sprintf("region_%d", i%4),
+			"server": fmt.Sprintf("server_%d", i),
+		})})
+	}
+	cpu = append(cpu, Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"server": "server_x"})})
+	mem := []Series{{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "region_1"})}}
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists(cpu))
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists(mem))
+	assert.NoError(t, idx.Compact(1))
+
+	// Drop a series flushed to the index file.
+	dropped := cpu[0]
+	cpu = cpu[1:]
+	droppedID := idx.SeriesFile.SeriesID(dropped.Name, dropped.Tags, nil)
+	assert.NoError(t, idx.DropSeries(droppedID, models.MakeKey(dropped.Name, dropped.Tags), false))
+
+	oldIDs := make([]uint64, len(cpu))
+	var maxID uint64
+	for i, s := range cpu {
+		oldIDs[i] = idx.SeriesFile.SeriesID(s.Name, s.Tags, nil)
+		if oldIDs[i] > maxID {
+			maxID = oldIDs[i]
+		}
+	}
+	memID := idx.SeriesFile.SeriesID(mem[0].Name, mem[0].Tags, nil)
+
+	remap, err := idx.Repack([]byte("cpu"))
+	assert.NoError(t, err)
+	assert.Len(t, remap, len(cpu))
+
+	// The series of cpu take the first ids of a new measurement id, and
+	// their previous ids are deleted from the series file.
+	newIDs := make([]uint64, len(cpu))
+	minID := uint64(math.MaxUint64)
+	for i, id := range oldIDs {
+		newIDs[i] = remap[id]
+		assert.Greater(t, newIDs[i], maxID)
+		assert.True(t, idx.SeriesFile.IsDeleted(id))
+		if newIDs[i] < minID {
+			minID = newIDs[i]
+		}
+	}
+	for _, id := range newIDs {
+		assert.Less(t, id-minID, uint64(len(cpu)))
+	}
+
+	idx.Run(t, func(t *testing.T) {
+		assert.Equal(t, int64(len(cpu)+1), idx.SeriesN())
+		for i, s := range cpu {
+			assert.Equal(t, newIDs[i], idx.SeriesFile.SeriesID(s.Name, s.Tags, nil))
+		}
+		assert.Equal(t, memID, idx.SeriesFile.SeriesID(mem[0].Name, mem[0].Tags, nil))
+
+		itr, err := idx.TagValueSeriesIDIterator([]byte("cpu"), []byte("region"), []byte("region_1"))
+		assert.NoError(t, err)
+		ids := tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet()
+		assert.Equal(t, uint64(50), ids.Cardinality())
+		assert.True(t, ids.Contains(newIDs[0]))
+
+		itr, err = idx.TagValueSeriesIDIterator([]byte("cpu"), []byte("region"), nil)
+		assert.NoError(t, err)
+		ids = tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet()
+		assert.Equal(t, []uint64{newIDs[len(newIDs)-1]}, ids.Slice())
+
+		itr, err = idx.TagValueSeriesIDIterator([]byte("mem"), []byte("region"), []byte("region_1"))
+		assert.NoError(t, err)
+		ids = tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet()
+		assert.Equal(t, []uint64{memID}, ids.Slice())
+	})
+
+	// New series take ids after the repacked ones.
+	assert.NoError(t, idx.SeriesFile.DeleteSeriesID(droppedID))
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{dropped}))
+	id := idx.SeriesFile.SeriesID(dropped.Name, dropped.Tags, nil)
+	assert.Greater(t, id, minID+uint64(len(cpu)-1))
+	assert.Equal(t, int64(len(cpu)+2), idx.SeriesN())
+}
+
+func TestIndex_RepackReusesMeasurementIDs(t *testing.T) {
+	layout := tsi2.IDLayout{MeasurementBits: 3, SeriesBits: 12}
+	idx := MustOpenIndex(t, tsi2.WithIDLayout(layout))
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	var cpu []Series
+	for i := 0; i < 10; i++ {
+		cpu = append(cpu, Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{
+			"region": fmt.Sprintf("region_%d", i%2),
+			"server": fmt.Sprintf("server_%d", i),
+		})})
+	}
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists(cpu))
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"region": "east"})}}))
+
+	compactSeriesFile := func() {
+		for _, p := range idx.SeriesFile.Partitions() {
+			assert.NoError(t, tsdb.NewSeriesPartitionCompactor().Compact(p))
+		}
+	}
+	measurementIDs := func() map[uint64]struct{} {
+		ids := map[uint64]struct{}{}
+		for _, s := range cpu {
+			ids[idx.SeriesFile.SeriesID(s.Name, s.Tags, nil)>>layout.SeriesBits] = struct{}{}
+		}
+		return ids
+	}
+
+	// With the series file compacted between repacks, the released
+	// measurement ids are given again.
+	for i := 0; i < 20; i++ {
+		remap, err := idx.Repack([]byte("cpu"))
+		assert.NoError(t, err)
+		assert.Len(t, remap, len(cpu))
+		assert.Len(t, measurementIDs(), 1)
+		for id := range measurementIDs() {
+			assert.Contains(t, []uint64{0, 2}, id)
+		}
+		compactSeriesFile()
+	}
+	assert.NoError(t, idx.Reopen())
+
+	// Without compaction, the deleted series keep the released ids, so that
+	// after the id released by the last repack above, repacks take new ids
+	// until only those left to new measurements remain.
+	var n int
+	for {
+		remap, err := idx.Repack([]byte("cpu"))
+		assert.NoError(t, err)
+		if len(remap) == 0 {
+			break
+		}
+		n++
+		assert.Less(t, n, 8)
+	}
+	assert.Equal(t, 5, n)
+	for id := range measurementIDs() {
+		assert.Equal(t, uint64(6), id)
+	}
+
+	idx.Run(t, func(t *testing.T) {
+		itr, err := idx.TagValueSeriesIDIterator([]byte("cpu"), []byte("region"), []byte("region_1"))
+		assert.NoError(t, err)
+		ids := tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet()
+		assert.Equal(t, uint64(5), ids.Cardinality())
+	})
+
+	// A new measurement takes the last id.
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{{Name: []byte("disk"), Tags: models.NewTags(map[string]string{"region": "east"})}}))
+	id := idx.SeriesFile.SeriesID([]byte("disk"), models.NewTags(map[string]string{"region": "east"}), nil)
+	assert.Equal(t, uint64(7), id>>layout.SeriesBits)
+
+	// Once the series file is compacted, a repack takes a released id.
+	compactSeriesFile()
+	remap, err := idx.Repack([]byte("cpu"))
+	assert.NoError(t, err)
+	assert.Len(t, remap, len(cpu))
+	for id := range measurementIDs() {
+		assert.Less(t, id, uint64(6))
+	}
+}
+
+func TestIndex_SeriesByID(t *testing.T) {
+	idx := MustOpenDefaultIndex(t)
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	series := []Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "web-1", "region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "web-2", "region": "west"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "north"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"host": "web-1"})},
+		{Name: []byte("mem"), Tags: nil},
+	}
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series))
+	ids := make([]uint64, len(series))
+	for i, s := range series {
+		ids[i] = idx.SeriesFile.SeriesID(s.Name, s.Tags, nil)
+	}
+	assert.NoError(t, idx.DropSeries(ids[1], models.MakeKey(series[1].Name, series[1].Tags), false))
+
+	idx.Run(t, func(t *testing.T) {
+		for i, s := range series {
+			name, tags, err := idx.SeriesByID(ids[i])
+			assert.NoError(t, err)
+			if i == 1 {
+				assert.Nil(t, name)
+				continue
+			}
+			assert.Equal(t, string(s.Name), string(name))
+			assert.Equal(t, s.Tags.String(), tags.String())
+		}
+		name, _, err := idx.SeriesByID(ids[0] + 1000)
+		assert.NoError(t, err)
+		assert.Nil(t, name)
+
+		// The tag sets are built from the decoded tags.
+		fs, err := tsdb.NewMeasurementFieldSet(filepath.Join(t.TempDir(), "fields.idx"), nil)
+		assert.NoError(t, err)
+		idx.SetFieldSet(fs)
+		is := tsdb.IndexSet{Indexes: []tsdb.Index{idx.Index}, SeriesFile: idx.SeriesFile.SeriesFile}
+		tagSets, err := is.TagSets(idx.SeriesFile.SeriesFile, []byte("cpu"), query.IteratorOptions{Dimensions: []string{"region"}})
+		assert.NoError(t, err)
+		var keys []string
+		for _, tagSet := range tagSets {
+			keys = append(keys, tagSet.SeriesKeys...)
+		}
+		assert.Equal(t, []string{"cpu,host=web-1,region=east", "cpu,region=north"}, keys)
+	})
+
+	// Index files decode the series of their grids.
+	m, _, err := tsi2.ReadManifestFile(idx.PartitionAt(0).ManifestPath())
+	assert.NoError(t, err)
+	f := tsi2.NewIndexFile(filepath.Join(idx.PartitionAt(0).Path(), m.Files[len(m.Files)-2]))
+	assert.NoError(t, f.Restore())
+	name, tags, err := f.Series(ids[3])
+	assert.NoError(t, err)
+	assert.Equal(t, "mem", string(name))
+	assert.Equal(t, series[3].Tags.String(), tags.String())
+	assert.NoError(t, f.Close())
+	assert.Equal(t, "mem", string(name))
+}
+
+// Ensure a grid which can not be decoded fails the queries reading it,
+// instead of the process.
+func TestIndex_CorruptGrid(t *testing.T) {
+	idx := MustOpenDefaultIndex(t)
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "web-1", "region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "web-2", "region": "west"})},
+	}))
+	assert.NoError(t, idx.Compact(1))
+	m, _, err := tsi2.ReadManifestFile(idx.PartitionAt(0).ManifestPath())
+	assert.NoError(t, err)
+	var path string
+	for _, filename := range m.Files {
+		if filepath.Ext(filename) == tsi2.IndexFileExt {
+			path = filepath.Join(idx.PartitionAt(0).Path(), filename)
+		}
+	}
+
+	// Overwrite the dictionary of the grids, after the signature.
+	assert.NoError(t, idx.Close())
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 4)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.NoError(t, idx.Reopen())
+
+	_, err = idx.TagValueSeriesIDIterator([]byte("cpu"), []byte("region"), []byte("east"))
+	assert.ErrorIs(t, err, tsi2.ErrInvalidGrid)
+	_, err = idx.TagKeySeriesIDIterator([]byte("cpu"), []byte("region"))
+	assert.ErrorIs(t, err, tsi2.ErrInvalidGrid)
+
+	// The tag block answers without decoding the grid.
+	ok, err := idx.HasTagKey([]byte("cpu"), []byte("region"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestIndex_FlushInMemory(t *testing.T) {
+	series := make([]Series, 0, 256)
+	for i := 0; i < cap(series); i++ {
+		series = append(series, Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{
+			"region": fmt.Sprintf("region_%d", i%8),
+			"server": fmt.Sprintf("server_%d", i),
+		})})
+	}
+
+	idx := MustOpenIndex(t, tsi2.WithMaxInMemorySize(4<<10))
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series[:4]))
+	small := idx.Bytes()
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series[4:128]))
+	assert.Greater(t, idx.Bytes(), small)
+
+	// Wait for the flush started by the write.
+	idx.Wait()
+	m, _, err := tsi2.ReadManifestFile(idx.PartitionAt(0).ManifestPath())
+	assert.NoError(t, err)
+	assert.Len(t, m.Files, 2)
+	assert.Equal(t, tsi2.IndexFileExt, filepath.Ext(m.Files[0]))
+
+	// Series are still found after the grids are released.
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series[128:]))
+	assert.NoError(t, idx.Reopen())
+	itr, err := idx.TagValueSeriesIDIterator([]byte("cpu"), []byte("region"), []byte("region_3"))
+	assert.NoError(t, err)
+	ids := tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet()
+	assert.Equal(t, uint64(32), ids.Cardinality())
+	ok, err := idx.HasTagValue([]byte("cpu"), []byte("server"), []byte("server_255"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
 }
 
 func TestIndex_TagValueSeriesIDIterator(t *testing.T) {
@@ -613,6 +1438,320 @@ func TestIndex_TagValueSeriesIDIterator(t *testing.T) {
 	})
 }
 
+// Ensure the cached series id sets follow the changes of the series.
+func TestIndex_TagValueSeriesIDCache(t *testing.T) {
+	idx := MustOpenIndex(t, tsi2.WithSeriesIDSetCacheSize(8))
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	seriesIDs := func(name, key, value string) []uint64 {
+		itr, err := idx.TagValueSeriesIDIterator([]byte(name), []byte(key), []byte(value))
+		assert.NoError(t, err)
+		return tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet().Slice()
+	}
+	seriesID := func(s Series) uint64 {
+		return idx.SeriesFile.SeriesID(s.Name, s.Tags, nil)
+	}
+
+	a := Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west", "server": "a"})}
+	b := Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west", "server": "b"})}
+	c := Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"server": "c"})}
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{a}))
+	assert.Equal(t, []uint64{seriesID(a)}, seriesIDs("cpu", "region", "west"))
+	assert.Empty(t, seriesIDs("cpu", "region", ""))
+
+	// New series in memory.
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{b, c}))
+	assert.Equal(t, []uint64{seriesID(a), seriesID(b)}, seriesIDs("cpu", "region", "west"))
+	assert.Equal(t, []uint64{seriesID(c)}, seriesIDs("cpu", "region", ""))
+
+	// Flushed series, and series dropped from the index file.
+	assert.NoError(t, idx.Compact(1))
+	assert.Equal(t, []uint64{seriesID(a), seriesID(b)}, seriesIDs("cpu", "region", "west"))
+	aID := seriesID(a)
+	assert.NoError(t, idx.DropSeries(aID, models.MakeKey(a.Name, a.Tags), false))
+	assert.Equal(t, []uint64{seriesID(b)}, seriesIDs("cpu", "region", "west"))
+	assert.NoError(t, idx.DropSeries(seriesID(c), models.MakeKey(c.Name, c.Tags), false))
+	assert.Empty(t, seriesIDs("cpu", "region", ""))
+
+	// Repacked series.
+	_, err := idx.Repack([]byte("cpu"))
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{seriesID(b)}, seriesIDs("cpu", "region", "west"))
+
+	// A recreated measurement.
+	assert.NoError(t, idx.DropMeasurement([]byte("cpu")))
+	assert.Empty(t, seriesIDs("cpu", "region", "west"))
+	assert.NoError(t, idx.SeriesFile.DeleteSeriesID(aID))
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{a}))
+	assert.Equal(t, []uint64{seriesID(a)}, seriesIDs("cpu", "region", "west"))
+}
+
+func TestIndex_TagValueSetSeriesIDIterator(t *testing.T) {
+	idx := MustOpenDefaultIndex(t)
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	var series []Series
+	for i := 0; i < 40; i++ {
+		series = append(series, Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{
+			"host":   fmt.Sprintf("host%d", i%10),
+			"region": fmt.Sprintf("region%d", i%4),
+			"rack":   fmt.Sprintf("rack%d", i),
+		})})
+	}
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series))
+
+	seriesIDSet := func(itr tsdb.SeriesIDIterator, err error) *tsdb.SeriesIDSet {
+		assert.NoError(t, err)
+		return tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet()
+	}
+
+	idx.Run(t, func(t *testing.T) {
+		// host IN ('host1', 'host2', 'host3', 'host9') AND region = 'region1'
+		set := tsi2.TagValueSet{"host": {"host1", "host2", "host3", "host9"}, "region": {"region1"}}
+		got := seriesIDSet(idx.TagValueSetSeriesIDIterator([]byte("cpu"), set))
+
+		// The same series are found by a lookup for each value.
+		exp := tsdb.NewSeriesIDSet()
+		for _, host := range set["host"] {
+			exp.Merge(seriesIDSet(idx.TagValueSeriesIDIterator([]byte("cpu"), []byte("host"), []byte(host))))
+		}
+		exp = exp.And(seriesIDSet(idx.TagValueSeriesIDIterator([]byte("cpu"), []byte("region"), []byte("region1"))))
+		assert.Equal(t, exp.Slice(), got.Slice())
+		assert.Equal(t, uint64(6), got.Cardinality())
+
+		got = seriesIDSet(idx.TagValueSetSeriesIDIterator([]byte("cpu"), tsi2.TagValueSet{"host": {"host0", "host5"}}))
+		assert.Equal(t, uint64(8), got.Cardinality())
+
+		got = seriesIDSet(idx.TagValueSetSeriesIDIterator([]byte("mem"), tsi2.TagValueSet{"host": {"host0"}}))
+		assert.Equal(t, uint64(0), got.Cardinality())
+	})
+}
+
+func TestIndex_MatchTagValueSeriesIDIterator(t *testing.T) {
+	idx := MustOpenDefaultIndex(t)
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "web-1", "region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "web-2", "region": "west"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "db-1", "region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "north"})},
+	}))
+
+	seriesIDSet := func(itr tsdb.SeriesIDIterator, err error) *tsdb.SeriesIDSet {
+		assert.NoError(t, err)
+		defer itr.Close()
+		ss := tsdb.NewSeriesIDSet()
+		for e, err := itr.Next(); e.SeriesID != 0; e, err = itr.Next() {
+			assert.NoError(t, err)
+			ss.Add(e.SeriesID)
+		}
+		return ss
+	}
+	regionIDs := func(region string) *tsdb.SeriesIDSet {
+		return seriesIDSet(idx.TagValueSeriesIDIterator([]byte("cpu"), []byte("region"), []byte(region)))
+	}
+
+	idx.Run(t, func(t *testing.T) {
+		east, west, north := regionIDs("east"), regionIDs("west"), regionIDs("north")
+		web := west.Clone()
+		web.Merge(seriesIDSet(idx.TagValueSeriesIDIterator([]byte("cpu"), []byte("host"), []byte("web-1"))))
+		notWeb := east.AndNot(web)
+		notWeb.Merge(north)
+
+		is := tsdb.IndexSet{Indexes: []tsdb.Index{idx.Index}, SeriesFile: idx.SeriesFile.SeriesFile}
+		for _, tt := range []struct {
+			re      string
+			matches bool
+			exp     *tsdb.SeriesIDSet
+		}{
+			{`web-.*`, true, web},
+			{`web-.*`, false, notWeb},
+			{`^$`, true, north},
+			{`^$`, false, seriesIDSet(idx.TagKeySeriesIDIterator([]byte("cpu"), []byte("host")))},
+			{`.*`, true, seriesIDSet(idx.MeasurementSeriesIDIterator([]byte("cpu")))},
+		} {
+			re := regexp.MustCompile(tt.re)
+			got := seriesIDSet(idx.MatchTagValueSeriesIDIterator([]byte("cpu"), []byte("host"), re, tt.matches))
+			assert.Equal(t, tt.exp.Slice(), got.Slice(), "host =~ /%s/ is %v", tt.re, tt.matches)
+
+			// The index set asks the index to match the values.
+			got = seriesIDSet(is.MatchTagValueSeriesIDIterator([]byte("cpu"), []byte("host"), re, tt.matches))
+			assert.Equal(t, tt.exp.Slice(), got.Slice(), "host =~ /%s/ is %v", tt.re, tt.matches)
+		}
+	})
+}
+
+func TestIndex_TagValueNotEqualSeriesIDIterator(t *testing.T) {
+	idx := MustOpenDefaultIndex(t)
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "web-1", "region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "web-2", "region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "web-1", "region": "west"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "north"})},
+	}))
+
+	seriesIDSet := func(itr tsdb.SeriesIDIterator, err error) *tsdb.SeriesIDSet {
+		assert.NoError(t, err)
+		defer itr.Close()
+		ss := tsdb.NewSeriesIDSet()
+		for e, err := itr.Next(); e.SeriesID != 0; e, err = itr.Next() {
+			assert.NoError(t, err)
+			ss.Add(e.SeriesID)
+		}
+		return ss
+	}
+
+	idx.Run(t, func(t *testing.T) {
+		all := seriesIDSet(idx.MeasurementSeriesIDIterator([]byte("cpu")))
+		web1 := seriesIDSet(idx.TagValueSeriesIDIterator([]byte("cpu"), []byte("host"), []byte("web-1")))
+		got := seriesIDSet(idx.TagValueNotEqualSeriesIDIterator([]byte("cpu"), []byte("host"), []byte("web-1")))
+		assert.Equal(t, all.AndNot(web1).Slice(), got.Slice())
+		assert.Equal(t, uint64(2), got.Cardinality())
+
+		// The index set asks the index for the negations.
+		fs, err := tsdb.NewMeasurementFieldSet(filepath.Join(t.TempDir(), "fields.idx"), nil)
+		assert.NoError(t, err)
+		idx.SetFieldSet(fs)
+		is := tsdb.IndexSet{Indexes: []tsdb.Index{idx.Index}, SeriesFile: idx.SeriesFile.SeriesFile}
+		for _, tt := range []struct {
+			expr string
+			exp  *tsdb.SeriesIDSet
+		}{
+			{`host != 'web-1'`, all.AndNot(web1)},
+			{`host !~ /web-1/`, all.AndNot(web1)},
+			{`host != 'db'`, all},
+		} {
+			expr, err := influxql.ParseExpr(tt.expr)
+			assert.NoError(t, err)
+			got := seriesIDSet(is.MeasurementSeriesByExprIterator([]byte("cpu"), expr))
+			assert.Equal(t, tt.exp.Slice(), got.Slice(), tt.expr)
+		}
+	})
+}
+
+// Ensure series lacking some tag keys share the grids of the other series,
+// and that the empty tag value matches them.
+func TestIndex_SparseSeries(t *testing.T) {
+	idx := MustOpenDefaultIndex(t)
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "web-1", "region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "web-2"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west"})},
+	}))
+
+	seriesIDSet := func(itr tsdb.SeriesIDIterator, err error) *tsdb.SeriesIDSet {
+		assert.NoError(t, err)
+		defer itr.Close()
+		ss := tsdb.NewSeriesIDSet()
+		for e, err := itr.Next(); e.SeriesID != 0; e, err = itr.Next() {
+			assert.NoError(t, err)
+			ss.Add(e.SeriesID)
+		}
+		return ss
+	}
+
+	idx.Run(t, func(t *testing.T) {
+		all := seriesIDSet(idx.MeasurementSeriesIDIterator([]byte("cpu")))
+		assert.Equal(t, uint64(3), all.Cardinality())
+
+		region := seriesIDSet(idx.TagKeySeriesIDIterator([]byte("cpu"), []byte("region")))
+		noRegion := seriesIDSet(idx.TagValueSeriesIDIterator([]byte("cpu"), []byte("region"), nil))
+		assert.Equal(t, uint64(2), region.Cardinality())
+		assert.Equal(t, all.AndNot(region).Slice(), noRegion.Slice())
+
+		itr, err := idx.TagValueIterator([]byte("cpu"), []byte("region"))
+		assert.NoError(t, err)
+		var values []string
+		for v, err := itr.Next(); v != nil; v, err = itr.Next() {
+			assert.NoError(t, err)
+			values = append(values, string(v))
+		}
+		assert.ElementsMatch(t, []string{"east", "west"}, values)
+
+		fs, err := tsdb.NewMeasurementFieldSet(filepath.Join(t.TempDir(), "fields.idx"), nil)
+		assert.NoError(t, err)
+		idx.SetFieldSet(fs)
+		is := tsdb.IndexSet{Indexes: []tsdb.Index{idx.Index}, SeriesFile: idx.SeriesFile.SeriesFile}
+		for _, tt := range []struct {
+			expr string
+			exp  *tsdb.SeriesIDSet
+		}{
+			{`region = ''`, noRegion},
+			{`region != ''`, region},
+			{`host = '' OR region = ''`, all.AndNot(region.And(seriesIDSet(idx.TagKeySeriesIDIterator([]byte("cpu"), []byte("host")))))},
+		} {
+			expr, err := influxql.ParseExpr(tt.expr)
+			assert.NoError(t, err)
+			got := seriesIDSet(is.MeasurementSeriesByExprIterator([]byte("cpu"), expr))
+			assert.Equal(t, tt.exp.Slice(), got.Slice(), tt.expr)
+		}
+	})
+}
+
+func TestIndex_MeasurementTagKeysByExpr(t *testing.T) {
+	idx := MustOpenDefaultIndex(t)
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	// The keys are split between an index file and the grids in memory.
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"region": "west", "server": "a"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"zone": "z"})},
+	}))
+	assert.NoError(t, idx.Compact(1))
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "h", "region": "east"})},
+	}))
+
+	idx.Run(t, func(t *testing.T) {
+		for _, tt := range []struct {
+			expr string
+			exp  []string
+		}{
+			{``, []string{"host", "region", "server"}},
+			{`_tagKey = 'region'`, []string{"region"}},
+			{`_tagKey = 'zone'`, []string{}},
+			{`_tagKey != 'region'`, []string{"host", "server"}},
+			{`_tagKey =~ /^(host|server)$/`, []string{"host", "server"}},
+			{`_tagKey !~ /^h/`, []string{"region", "server"}},
+			{`_tagKey = 'host' OR _tagKey = 'server'`, []string{"host", "server"}},
+			{`_tagKey =~ /o/ AND (_tagKey != 'host' OR _tagKey = 'server')`, []string{"region"}},
+			{`_tagKey = 'host' AND region = 'west'`, []string{"host"}},
+			{`region = 'west'`, nil},
+		} {
+			var expr influxql.Expr
+			if tt.expr != "" {
+				var err error
+				expr, err = influxql.ParseExpr(tt.expr)
+				assert.NoError(t, err)
+			}
+			keys, err := idx.MeasurementTagKeysByExpr([]byte("cpu"), expr)
+			assert.NoError(t, err, tt.expr)
+			if tt.exp == nil {
+				assert.Nil(t, keys, tt.expr)
+				continue
+			}
+			got := make([]string, 0, len(keys))
+			for k := range keys {
+				got = append(got, k)
+			}
+			sort.Strings(got)
+			assert.Equal(t, tt.exp, got, tt.expr)
+		}
+
+		keys, err := idx.MeasurementTagKeysByExpr([]byte("disk"), nil)
+		assert.NoError(t, err)
+		assert.Empty(t, keys)
+
+		_, err = idx.MeasurementTagKeysByExpr([]byte("cpu"), influxql.MustParseExpr(`_tagKey = 1`))
+		assert.Error(t, err)
+	})
+}
+
 func TestIndex_WriteGridBlock(t *testing.T) {
 	idx := MustOpenDefaultIndex(t) // Uses the batch series creation method CreateSeriesListIfNotExists
 	defer idx.Close()
@@ -665,11 +1804,16 @@ func TestIndex_WriteGridBlock(t *testing.T) {
 
 	n := int64(0)
 	info := tsi2.NewIndexFileCompactInfo()
-	err = idx.WriteGridBlockTo(f, names, info, &n)
+	err = idx.PartitionAt(0).WriteGridBlockTo(f, names, info, &n)
 	assert.Nil(t, err)
 	// fmt.Printf("info:\n %+v\n", info.Show())
 	assert.Equal(t, len(info.Mms), 3)
 
+	// The measurement block locates the grids and their dictionary.
+	offset := n
+	err = idx.PartitionAt(0).WriteMeasurementBlockTo(f, names, info, &n)
+	assert.Nil(t, err)
+
 	f.Close()
 	f, err = os.Open(f.Name())
 	assert.Nil(t, err)
@@ -678,10 +1822,15 @@ func TestIndex_WriteGridBlock(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Greater(t, len(buf), 0)
 
-	for _, mm := range info.Mms {
-		g, err := tsi2.DecodeGrid(buf[mm.Offset : mm.Size+mm.Offset])
+	var blk tsi2.MeasurementBlock
+	err = blk.UnmarshalBinary(buf[offset:n])
+	assert.Nil(t, err)
+	for _, name := range names {
+		e, ok := blk.Elem([]byte(name))
+		assert.True(t, ok)
+		grids, err := tsi2.DecodeGrids(buf, e)
 		assert.Nil(t, err)
-		assert.NotNil(t, g)
+		assert.Greater(t, len(grids), 0)
 	}
 
 	// g, err := tsi2.DecodeGrid(buf[0:204])
@@ -725,11 +1874,16 @@ func TestIndex_WriteGridBlock_MultiGrids(t *testing.T) {
 
 	n := int64(0)
 	info := tsi2.NewIndexFileCompactInfo()
-	err = idx.WriteGridBlockTo(f, names, info, &n)
+	err = idx.PartitionAt(0).WriteGridBlockTo(f, names, info, &n)
 	assert.Nil(t, err)
 	// fmt.Printf("info:\n %+v\n", info.Show())
 	assert.Equal(t, len(info.Mms), 1)
 
+	// The measurement block locates the grids and their dictionary.
+	offset := n
+	err = idx.PartitionAt(0).WriteMeasurementBlockTo(f, names, info, &n)
+	assert.Nil(t, err)
+
 	f.Close()
 	f, err = os.Open(f.Name())
 	assert.Nil(t, err)
@@ -738,10 +1892,15 @@ func TestIndex_WriteGridBlock_MultiGrids(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Greater(t, len(buf), 0)
 
-	for _, mm := range info.Mms {
-		g, err := tsi2.DecodeGrid(buf[mm.Offset : mm.Size+mm.Offset])
+	var blk tsi2.MeasurementBlock
+	err = blk.UnmarshalBinary(buf[offset:n])
+	assert.Nil(t, err)
+	for _, name := range names {
+		e, ok := blk.Elem([]byte(name))
+		assert.True(t, ok)
+		grids, err := tsi2.DecodeGrids(buf, e)
 		assert.Nil(t, err)
-		assert.NotNil(t, g)
+		assert.Greater(t, len(grids), 0)
 	}
 }
 
@@ -777,16 +1936,15 @@ func TestIndex_CompactTo(t *testing.T) {
 	err := idx.Compact(id)
 	assert.Nil(t, err)
 
-	filename := filepath.Join(tsi2.IndexFilePath, tsi2.FormatIndexFileName(id, 1))
+	filename := filepath.Join(idx.PartitionAt(0).Path(), tsi2.FormatIndexFileName(id, 1))
 	defer os.Remove(filename)
 
 	buf, err := ioutil.ReadFile(filename)
 	assert.Nil(t, err)
-	fileSize := len(buf)
 
-	var tl tsi2.IndexFileTrailer
-	tl.MeasurementBlock.Size = int64(binary.BigEndian.Uint64(buf[fileSize-10 : fileSize-2]))
-	tl.MeasurementBlock.Offset = int64(binary.BigEndian.Uint64(buf[fileSize-18 : fileSize-10]))
+	tl, err := tsi2.ReadIndexFileTrailer(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, tsi2.IndexFileVersion, tl.Version)
 	// fmt.Printf("index file trailer: %+v\n", tl)
 	// assert.Equal(t, tl.MeasurementBlock.Offset, int64(5560))
 	// assert.Equal(t, tl.MeasurementBlock.Size, int64(644))
@@ -3,26 +3,26 @@ package tsi2
 import "cycledb/pkg/tsdb"
 
 type MeasurementIterator struct {
-	ms   *Measurements
-	curr int
+	measurements []*Measurement
 }
 
+// NewMeasurementsIterator returns an iterator over the measurements of the
+// current snapshot of the registry, which later changes do not affect.
 func NewMeasurementsIterator(m *Measurements) tsdb.MeasurementIterator {
 	return &MeasurementIterator{
-		ms:   m,
-		curr: 0,
+		measurements: m.snapshot().measurements,
 	}
 }
 
 func (itr *MeasurementIterator) Close() (err error) { return nil }
 
 func (itr *MeasurementIterator) Next() ([]byte, error) {
-	for itr.curr < len(itr.ms.measurements) {
-		if itr.ms.measurements[itr.curr] != nil {
-			itr.curr++
-			return []byte(itr.ms.measurements[itr.curr].name), nil
+	for len(itr.measurements) != 0 {
+		m := itr.measurements[0]
+		itr.measurements = itr.measurements[1:]
+		if m != nil {
+			return []byte(m.name), nil
 		}
-		itr.curr++
 	}
 	return nil, nil
 }
@@ -0,0 +1,48 @@
+package tsi2
+
+import "fmt"
+
+// MaxIDLayoutBits is the number of bits of a series id which can be split
+// between the measurement and the grid index, as series id sets hold 32-bit ids.
+const MaxIDLayoutBits = 32
+
+// DefaultIDLayout is the layout of the files written before the layout was
+// configurable: 8 bits of measurement id and 24 bits of id within the grids.
+var DefaultIDLayout = IDLayout{MeasurementBits: 8, SeriesBits: 24}
+
+// IDLayout describes how a series id is packed: the measurement id in the
+// high bits, then the id within the grid index of the measurement.
+type IDLayout struct {
+	MeasurementBits uint8 `json:"measurementBits"`
+	SeriesBits      uint8 `json:"seriesBits"`
+}
+
+// Validate returns an error if the layout does not fit in a series id.
+func (l IDLayout) Validate() error {
+	if l.MeasurementBits == 0 || l.SeriesBits == 0 || int(l.MeasurementBits)+int(l.SeriesBits) > MaxIDLayoutBits {
+		return fmt.Errorf("%s: %w", l, ErrInvalidIDLayout)
+	}
+	return nil
+}
+
+// String returns a string representation of the layout.
+func (l IDLayout) String() string {
+	return fmt.Sprintf("%d+%d bits", l.MeasurementBits, l.SeriesBits)
+}
+
+// MaxMeasurementID returns the highest measurement id of the layout.
+func (l IDLayout) MaxMeasurementID() uint64 { return 1<<l.MeasurementBits - 1 }
+
+// MaxIndexID returns the highest id within the grid index of a measurement.
+func (l IDLayout) MaxIndexID() uint64 { return 1<<l.SeriesBits - 1 }
+
+// seriesID packs the measurement id and the id within its grid index.
+func (l IDLayout) seriesID(measurementID, indexID uint64) uint64 {
+	return measurementID<<l.SeriesBits | indexID
+}
+
+// splitSeriesID returns the measurement id and the id within the grid index
+// of a series id.
+func (l IDLayout) splitSeriesID(id uint64) (measurementID, indexID uint64) {
+	return id >> l.SeriesBits, id & l.MaxIndexID()
+}
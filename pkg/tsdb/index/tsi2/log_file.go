@@ -0,0 +1,444 @@
+package tsi2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// Log errors.
+var (
+	ErrLogEntryChecksumMismatch = errors.New("log entry checksum mismatch")
+	ErrLogEntryUnknownFlag      = errors.New("log entry has unknown flag")
+	ErrInvalidLogEntry          = errors.New("log entry does not match the grid index")
+)
+
+// Log entry flag constants.
+const (
+	LogEntryMeasurementInsertFlag    = 0x01
+	LogEntryMeasurementTombstoneFlag = 0x02
+	LogEntryGridInsertFlag           = 0x04
+	LogEntryTagValueInsertFlag       = 0x08
+	LogEntrySeriesIDInsertFlag       = 0x10
+	LogEntrySeriesTombstoneFlag      = 0x20
+)
+
+// LogFileExt is the extension of the write-ahead log files.
+var LogFileExt = ".tsl2"
+
+// defaultLogFileBufferSize is the buffer size of the LogFile's buffered writer.
+const defaultLogFileBufferSize = 4096
+
+// LogFile represents an on-disk write-ahead log file.
+// It records how the grid indexes are changed, so that they can be rebuilt
+// exactly as they were, including the offsets and capacities of the grids.
+type LogFile struct {
+	mu   sync.Mutex
+	id   int    // file sequence identifier
+	path string // on-disk path
+
+	file *os.File      // writer
+	w    *bufio.Writer // buffered writer
+	buf  []byte        // marshaling buffer
+	size int64         // tracks current file size
+}
+
+// NewLogFile returns a new instance of LogFile.
+func NewLogFile(path string) *LogFile {
+	return &LogFile{
+		path: path,
+	}
+}
+
+// Open reads the log from a file, validates all the checksums and replays
+// every entry through fn. A partially written entry at the end of the file
+// is truncated.
+func (f *LogFile) Open(fn func(e *LogEntry) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.open(fn); err != nil {
+		f.close()
+		return err
+	}
+	return nil
+}
+
+func (f *LogFile) open(fn func(e *LogEntry) error) error {
+	_, f.id = ParseFilename(f.path)
+
+	// Open file for appending.
+	file, err := os.OpenFile(f.path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.w = bufio.NewWriterSize(f.file, defaultLogFileBufferSize)
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	// Read log entries. Stop at partial writes.
+	var n int64
+	for buf := data; len(buf) > 0; {
+		var e LogEntry
+		if err := e.UnmarshalBinary(buf); errors.Is(err, io.ErrShortBuffer) || errors.Is(err, ErrLogEntryChecksumMismatch) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%q: %w", f.path, err)
+		}
+
+		if err := fn(&e); err != nil {
+			return fmt.Errorf("%q: %w", f.path, err)
+		}
+
+		n += int64(e.Size)
+		buf = buf[e.Size:]
+	}
+
+	// Drop the partial entry and move to the end of the file.
+	if n < int64(len(data)) {
+		if err := file.Truncate(n); err != nil {
+			return err
+		}
+	}
+	f.size = n
+	_, err = file.Seek(n, io.SeekStart)
+	return err
+}
+
+// Close flushes buffered data and closes the file handle.
+func (f *LogFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.close()
+}
+
+func (f *LogFile) close() error {
+	var err error
+	if f.w != nil {
+		err = f.w.Flush()
+		f.w = nil
+	}
+
+	if f.file != nil {
+		if e := f.file.Close(); err == nil {
+			err = e
+		}
+		f.file = nil
+	}
+	return err
+}
+
+// ID returns the file sequence identifier.
+func (f *LogFile) ID() int { return f.id }
+
+// Path returns the file path.
+func (f *LogFile) Path() string { return f.path }
+
+// Size returns the size of the file, in bytes.
+func (f *LogFile) Size() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.size
+}
+
+// AppendEntries writes entries to the end of the file, then flushes and
+// fsyncs the file.
+func (f *LogFile) AppendEntries(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := range entries {
+		if err := f.appendEntry(&entries[i]); err != nil {
+			return err
+		}
+	}
+	return f.flushAndSync()
+}
+
+// appendEntry adds a log entry to the end of the file.
+func (f *LogFile) appendEntry(e *LogEntry) error {
+	// Marshal entry to the local buffer.
+	f.buf = appendLogEntry(f.buf[:0], e)
+
+	// Save the size of the record.
+	e.Size = len(f.buf)
+
+	// Write record to file.
+	n, err := f.w.Write(f.buf)
+	if err != nil {
+		// Move position backwards over partial entry.
+		// Log should be reopened if seeking cannot be completed.
+		if n > 0 {
+			f.w.Reset(f.file)
+			if _, err := f.file.Seek(int64(-n), io.SeekCurrent); err != nil {
+				f.close()
+			}
+		}
+		return err
+	}
+
+	f.size += int64(n)
+	return nil
+}
+
+// flushAndSync flushes buffered data to disk and then fsyncs the underlying file.
+func (f *LogFile) flushAndSync() error {
+	if f.w != nil {
+		if err := f.w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Sync()
+}
+
+// LogEntry represents a single log entry in the write-ahead log.
+// Which of the fields are set depends on the flag:
+//
+//	measurement insert: Name, MeasurementID, Offset
+//	measurement tombstone: Name
+//	grid insert: Name, Grid, Offset, Keys, Capacities
+//	tag value insert: Name, Grid, Dim, Value
+//	series id insert: Name, Grid, SeriesID, Key
+//	series tombstone: Name, SeriesID, Key
+type LogEntry struct {
+	Flag          byte     // flag
+	Name          []byte   // measurement name
+	MeasurementID uint64   // measurement id
+	Grid          int      // position of the grid in the grid index
+	Offset        uint64   // offset of the new grid, or of the measurement's next grid
+	Keys          [][]byte // tag keys of the new grid
+	Capacities    []uint64 // capacity of each dimension of the new grid
+	Dim           int      // dimension of the new tag value
+	Value         []byte   // new tag value
+	SeriesID      uint64   // series id within the grid index, or of the dropped series
+	Key           []byte   // series key
+	Checksum      uint32   // checksum of the entry.
+	Size          int      // total size of record, in bytes.
+}
+
+// UnmarshalBinary unmarshals data into e.
+func (e *LogEntry) UnmarshalBinary(data []byte) error {
+	var v uint64
+	var err error
+
+	orig := data
+	start := len(data)
+
+	// Parse flag data.
+	if len(data) < 1 {
+		return io.ErrShortBuffer
+	}
+	e.Flag, data = data[0], data[1:]
+
+	// Parse name.
+	if e.Name, data, err = readBytes(data); err != nil {
+		return err
+	}
+
+	switch e.Flag {
+	case LogEntryMeasurementInsertFlag:
+		if e.MeasurementID, data, err = readUvarint(data); err != nil {
+			return err
+		}
+		if e.Offset, data, err = readUvarint(data); err != nil {
+			return err
+		}
+
+	case LogEntryMeasurementTombstoneFlag:
+
+	case LogEntryGridInsertFlag:
+		if v, data, err = readUvarint(data); err != nil {
+			return err
+		}
+		e.Grid = int(v)
+		if e.Offset, data, err = readUvarint(data); err != nil {
+			return err
+		}
+		var dims uint64
+		if dims, data, err = readUvarint(data); err != nil {
+			return err
+		} else if dims > uint64(len(data)) {
+			return io.ErrShortBuffer
+		}
+		e.Keys = make([][]byte, dims)
+		e.Capacities = make([]uint64, dims)
+		for i := range e.Keys {
+			if e.Keys[i], data, err = readBytes(data); err != nil {
+				return err
+			}
+			if e.Capacities[i], data, err = readUvarint(data); err != nil {
+				return err
+			}
+		}
+
+	case LogEntryTagValueInsertFlag:
+		if v, data, err = readUvarint(data); err != nil {
+			return err
+		}
+		e.Grid = int(v)
+		if v, data, err = readUvarint(data); err != nil {
+			return err
+		}
+		e.Dim = int(v)
+		if e.Value, data, err = readBytes(data); err != nil {
+			return err
+		}
+
+	case LogEntrySeriesIDInsertFlag:
+		if v, data, err = readUvarint(data); err != nil {
+			return err
+		}
+		e.Grid = int(v)
+		if e.SeriesID, data, err = readUvarint(data); err != nil {
+			return err
+		}
+		if e.Key, data, err = readBytes(data); err != nil {
+			return err
+		}
+
+	case LogEntrySeriesTombstoneFlag:
+		if e.SeriesID, data, err = readUvarint(data); err != nil {
+			return err
+		}
+		if e.Key, data, err = readBytes(data); err != nil {
+			return err
+		}
+
+	default:
+		return ErrLogEntryUnknownFlag
+	}
+
+	// Compute checksum.
+	chk := crc32.ChecksumIEEE(orig[:start-len(data)])
+
+	// Parse checksum.
+	if len(data) < 4 {
+		return io.ErrShortBuffer
+	}
+	e.Checksum, data = binary.BigEndian.Uint32(data[:4]), data[4:]
+
+	// Verify checksum.
+	if chk != e.Checksum {
+		return ErrLogEntryChecksumMismatch
+	}
+
+	// Save length of elem.
+	e.Size = start - len(data)
+
+	return nil
+}
+
+// appendLogEntry appends to dst and returns the new buffer.
+// This updates the checksum on the entry.
+func appendLogEntry(dst []byte, e *LogEntry) []byte {
+	start := len(dst)
+
+	// Append flag and name.
+	dst = append(dst, e.Flag)
+	dst = appendBytes(dst, e.Name)
+
+	switch e.Flag {
+	case LogEntryMeasurementInsertFlag:
+		dst = appendUvarint(dst, e.MeasurementID)
+		dst = appendUvarint(dst, e.Offset)
+
+	case LogEntryGridInsertFlag:
+		dst = appendUvarint(dst, uint64(e.Grid))
+		dst = appendUvarint(dst, e.Offset)
+		dst = appendUvarint(dst, uint64(len(e.Keys)))
+		for i, key := range e.Keys {
+			dst = appendBytes(dst, key)
+			dst = appendUvarint(dst, e.Capacities[i])
+		}
+
+	case LogEntryTagValueInsertFlag:
+		dst = appendUvarint(dst, uint64(e.Grid))
+		dst = appendUvarint(dst, uint64(e.Dim))
+		dst = appendBytes(dst, e.Value)
+
+	case LogEntrySeriesIDInsertFlag:
+		dst = appendUvarint(dst, uint64(e.Grid))
+		dst = appendUvarint(dst, e.SeriesID)
+		dst = appendBytes(dst, e.Key)
+
+	case LogEntrySeriesTombstoneFlag:
+		dst = appendUvarint(dst, e.SeriesID)
+		dst = appendBytes(dst, e.Key)
+	}
+
+	// Calculate checksum.
+	e.Checksum = crc32.ChecksumIEEE(dst[start:])
+
+	// Append checksum.
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], e.Checksum)
+	return append(dst, buf[:]...)
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(dst, buf[:n]...)
+}
+
+func appendBytes(dst, v []byte) []byte {
+	dst = appendUvarint(dst, uint64(len(v)))
+	return append(dst, v...)
+}
+
+func readUvarint(data []byte) (uint64, []byte, error) {
+	v, n, err := uvarint(data)
+	if err != nil {
+		return 0, data, err
+	}
+	return v, data[n:], nil
+}
+
+func readBytes(data []byte) ([]byte, []byte, error) {
+	sz, data, err := readUvarint(data)
+	if err != nil {
+		return nil, data, err
+	} else if uint64(len(data)) < sz {
+		return nil, data, io.ErrShortBuffer
+	}
+	return data[:sz], data[sz:], nil
+}
+
+// FormatLogFileName generates a log filename for the given index.
+func FormatLogFileName(id int) string {
+	return fmt.Sprintf("L0-%08d%s", id, LogFileExt)
+}
+
+var fileIDRegex = regexp.MustCompile(`^L(\d+)-(\d+)\..+$`)
+
+// ParseFilename extracts the level and numeric id from a log or index file path.
+// Returns 0 if it cannot be parsed.
+func ParseFilename(name string) (level, id int) {
+	a := fileIDRegex.FindStringSubmatch(filepath.Base(name))
+	if a == nil {
+		return 0, 0
+	}
+
+	level, _ = strconv.Atoi(a[1])
+	id, _ = strconv.Atoi(a[2])
+	return level, id
+}
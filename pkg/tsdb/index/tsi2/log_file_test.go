@@ -0,0 +1,83 @@
+package tsi2_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cycledb/pkg/tsdb/index/tsi2"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensure log entries can be written and replayed in order.
+func TestLogFile_AppendEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), tsi2.FormatLogFileName(3))
+	entries := []tsi2.LogEntry{
+		{Flag: tsi2.LogEntryMeasurementInsertFlag, Name: []byte("cpu"), MeasurementID: 2},
+		{Flag: tsi2.LogEntryGridInsertFlag, Name: []byte("cpu"), Grid: 0, Offset: 1, Keys: [][]byte{[]byte("host"), []byte("region")}, Capacities: []uint64{10, 20}},
+		{Flag: tsi2.LogEntryTagValueInsertFlag, Name: []byte("cpu"), Grid: 0, Dim: 1, Value: []byte("west")},
+		{Flag: tsi2.LogEntrySeriesIDInsertFlag, Name: []byte("cpu"), Grid: 0, SeriesID: 11, Key: []byte("cpu,region=west")},
+		{Flag: tsi2.LogEntrySeriesTombstoneFlag, Name: []byte("cpu"), SeriesID: 2<<24 | 11, Key: []byte("cpu,region=west")},
+		{Flag: tsi2.LogEntryMeasurementTombstoneFlag, Name: []byte("cpu")},
+	}
+
+	f := tsi2.NewLogFile(path)
+	assert.NoError(t, f.Open(func(e *tsi2.LogEntry) error { return nil }))
+	assert.Equal(t, 3, f.ID())
+	assert.NoError(t, f.AppendEntries(entries))
+	assert.NoError(t, f.Close())
+
+	var got []tsi2.LogEntry
+	f = tsi2.NewLogFile(path)
+	assert.NoError(t, f.Open(func(e *tsi2.LogEntry) error {
+		got = append(got, *e)
+		return nil
+	}))
+	defer f.Close()
+
+	assert.Equal(t, len(entries), len(got))
+	for i := range entries {
+		assert.Equal(t, entries[i], got[i])
+	}
+}
+
+// Ensure a partially written entry is truncated on open.
+func TestLogFile_Open_Truncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), tsi2.FormatLogFileName(1))
+
+	f := tsi2.NewLogFile(path)
+	assert.NoError(t, f.Open(func(e *tsi2.LogEntry) error { return nil }))
+	assert.NoError(t, f.AppendEntries([]tsi2.LogEntry{
+		{Flag: tsi2.LogEntryMeasurementInsertFlag, Name: []byte("cpu"), MeasurementID: 0},
+		{Flag: tsi2.LogEntryMeasurementInsertFlag, Name: []byte("mem"), MeasurementID: 1},
+	}))
+	size := f.Size()
+	assert.NoError(t, f.Close())
+
+	// Cut the last entry in half.
+	assert.NoError(t, os.Truncate(path, size-3))
+
+	var names []string
+	f = tsi2.NewLogFile(path)
+	assert.NoError(t, f.Open(func(e *tsi2.LogEntry) error {
+		names = append(names, string(e.Name))
+		return nil
+	}))
+	defer f.Close()
+	assert.Equal(t, []string{"cpu"}, names)
+
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, f.Size(), fi.Size())
+}
+
+func TestParseFilename(t *testing.T) {
+	level, id := tsi2.ParseFilename(filepath.Join("index", tsi2.FormatIndexFileName(12, 3)))
+	assert.Equal(t, 3, level)
+	assert.Equal(t, 12, id)
+
+	level, id = tsi2.ParseFilename(tsi2.FormatLogFileName(7))
+	assert.Equal(t, 0, level)
+	assert.Equal(t, 7, id)
+}
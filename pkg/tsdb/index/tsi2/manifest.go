@@ -0,0 +1,130 @@
+package tsi2
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	errors2 "github.com/influxdata/influxdb/v2/pkg/errors"
+)
+
+// ManifestFileName is the name of the index manifest file.
+const ManifestFileName = "MANIFEST"
+
+// Manifest represents the list of log & index files that make up the index.
+// The files are listed in time order, not necessarily ID order.
+type Manifest struct {
+	Files []string `json:"files,omitempty"`
+
+	// Version should be updated whenever the TSI2 format has changed.
+	Version int `json:"version,omitempty"`
+
+	// IDLayout is the layout of the series ids in the files.
+	// Manifests written without it use DefaultIDLayout.
+	IDLayout IDLayout `json:"idLayout"`
+
+	// Reassign is the file of the series ids given by a repack, which the
+	// series file is given on open. See Partition.Repack.
+	Reassign string `json:"reassign,omitempty"`
+
+	path string // location on disk of the manifest.
+}
+
+// NewManifest returns a new instance of Manifest.
+func NewManifest(path string) *Manifest {
+	return &Manifest{
+		Version: Version,
+		path:    path,
+	}
+}
+
+// HasFile returns true if name is listed in the log files or index files.
+func (m *Manifest) HasFile(name string) bool {
+	for _, filename := range m.Files {
+		if filename == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Layout returns the id layout of the files.
+func (m *Manifest) Layout() IDLayout {
+	if m.IDLayout == (IDLayout{}) {
+		return DefaultIDLayout
+	}
+	return m.IDLayout
+}
+
+// Validate checks if the Manifest's version is compatible with this version
+// of the tsi2 index.
+func (m *Manifest) Validate() error {
+	if m.Version != Version {
+		return fmt.Errorf("%q: %w", m.path, ErrIncompatibleVersion)
+	}
+	return nil
+}
+
+// Write writes the manifest file to its path, returning the number of bytes
+// written and an error, if any.
+func (m *Manifest) Write() (int64, error) {
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return 0, fmt.Errorf("failed marshaling %q: %w", m.path, err)
+	}
+	buf = append(buf, '\n')
+
+	f, err := os.CreateTemp(filepath.Dir(m.path), ManifestFileName)
+	if err != nil {
+		return 0, err
+	}
+	tmp := f.Name()
+
+	// In correct operation, Remove() should fail because the file was renamed
+	defer os.Remove(tmp)
+
+	err = func() (rErr error) {
+		// Close() before rename for Windows
+		defer errors2.Capture(&rErr, f.Close)()
+
+		if err = f.Chmod(0666); err != nil {
+			return fmt.Errorf("failed setting permissions on manifest file %q: %w", tmp, err)
+		}
+		if _, err = f.Write(buf); err != nil {
+			return fmt.Errorf("failed writing temporary manifest file %q: %w", tmp, err)
+		}
+		if err = f.Sync(); err != nil {
+			return fmt.Errorf("failed syncing temporary manifest file to disk %q: %w", tmp, err)
+		}
+		return nil
+	}()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = os.Rename(tmp, m.path); err != nil {
+		return 0, err
+	}
+
+	return int64(len(buf)), nil
+}
+
+// ReadManifestFile reads a manifest from a file path and returns the Manifest,
+// the size of the manifest on disk, and any error if appropriate.
+func ReadManifestFile(path string) (*Manifest, int64, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Decode manifest.
+	var m Manifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, 0, fmt.Errorf("failed unmarshaling %q: %w", path, err)
+	}
+
+	// Set the path of the manifest.
+	m.path = path
+	return &m, int64(len(buf)), nil
+}
@@ -35,12 +35,19 @@ type MeasurementBlock struct {
 	// // Measurement sketch and tombstone sketch for cardinality estimation.
 	// sketchData, tSketchData []byte
 
-	// version int // block version
+	version int // version of the index file
 }
 
 // UnmarshalBinary unpacks data into the block. Block is not copied so data
 // should be retained and unchanged after being passed into this function.
 func (blk *MeasurementBlock) UnmarshalBinary(data []byte) error {
+	return blk.unmarshalBinary(data, IndexFileVersion)
+}
+
+// unmarshalBinary unpacks data of an index file of the given version into the block.
+func (blk *MeasurementBlock) unmarshalBinary(data []byte, version int) error {
+	blk.version = version
+
 	// Read trailer.
 	t, err := ReadMeasurementBlockTrailer(data)
 	if err != nil {
@@ -48,12 +55,19 @@ func (blk *MeasurementBlock) UnmarshalBinary(data []byte) error {
 	}
 
 	// Save data section.
-	blk.data = data[t.Data.Offset:]
-	blk.data = blk.data[:t.Data.Size]
+	var ok bool
+	if blk.data, ok = sliceSection(data, uint64(t.Data.Offset), uint64(t.Data.Size)); !ok {
+		return io.ErrShortBuffer
+	}
 
-	// Save hash index block.
-	blk.hashData = data[t.HashIndex.Offset:]
-	blk.hashData = blk.hashData[:t.HashIndex.Size]
+	// Save hash index block, which holds the number of slots then their offsets.
+	if blk.hashData, ok = sliceSection(data, uint64(t.HashIndex.Offset), uint64(t.HashIndex.Size)); !ok {
+		return io.ErrShortBuffer
+	} else if len(blk.hashData) < MeasurementNSize {
+		return io.ErrShortBuffer
+	} else if n := binary.BigEndian.Uint64(blk.hashData[:MeasurementNSize]); n == 0 || n > uint64(len(blk.hashData)-MeasurementNSize)/MeasurementOffsetSize {
+		return io.ErrShortBuffer
+	}
 
 	// // Initialise sketch data.
 	// blk.sketchData = data[t.Sketch.Offset:][:t.Sketch.Size]
@@ -81,7 +95,11 @@ func (blk *MeasurementBlock) Elem(name []byte) (e MeasurementBlockElem, ok bool)
 		if offset > 0 {
 			// Parse into element.
 			var e MeasurementBlockElem
-			e.UnmarshalBinary(blk.data[offset:])
+			if offset >= uint64(len(blk.data)) {
+				return MeasurementBlockElem{}, false
+			} else if err := e.unmarshalBinary(blk.data[offset:], blk.version); err != nil {
+				return MeasurementBlockElem{}, false
+			}
 
 			// Return if name match.
 			if bytes.Equal(e.name, name) {
@@ -104,6 +122,39 @@ func (blk *MeasurementBlock) Elem(name []byte) (e MeasurementBlockElem, ok bool)
 	}
 }
 
+// Iterator returns an iterator over all measurements.
+func (blk *MeasurementBlock) Iterator() *MeasurementBlockIterator {
+	if len(blk.data) == 0 {
+		return &MeasurementBlockIterator{version: blk.version}
+	}
+	return &MeasurementBlockIterator{data: blk.data[1:], version: blk.version}
+}
+
+// MeasurementBlockIterator iterates over a list of measurements in a block.
+type MeasurementBlockIterator struct {
+	data    []byte
+	version int
+}
+
+// Next returns the next measurement. Returns nil when iterator is complete.
+func (itr *MeasurementBlockIterator) Next() *MeasurementBlockElem {
+	// Return nil when we run out of data.
+	if len(itr.data) == 0 {
+		return nil
+	}
+
+	// Unmarshal the element at the current position.
+	var e MeasurementBlockElem
+	if err := e.unmarshalBinary(itr.data, itr.version); err != nil {
+		return nil
+	}
+
+	// Move the data forward past the record.
+	itr.data = itr.data[e.size:]
+
+	return &e
+}
+
 type MeasurementBlockElem struct {
 	// flag byte   // flag
 	name []byte // measurement name
@@ -119,6 +170,18 @@ type MeasurementBlockElem struct {
 		size   int64
 	}
 
+	// tag block of the grids, empty in files of version 3 and before
+	tagBlock struct {
+		offset int64
+		size   int64
+	}
+
+	// string dictionary of the grids, empty in files of version 4 and before
+	dictionary struct {
+		offset int64
+		size   int64
+	}
+
 	series struct {
 		n    uint64 // series count
 		data []byte // serialized series data
@@ -139,12 +202,29 @@ func (e *MeasurementBlockElem) GridBlockOffset() int64 { return e.gridsBlock.off
 // TagBlockSize returns the size of the measurement's tag block.
 func (e *MeasurementBlockElem) GridBlockSize() int64 { return e.gridsBlock.size }
 
+// TagBlockOffset returns the offset of the tag block of the grids, in the file.
+func (e *MeasurementBlockElem) TagBlockOffset() int64 { return e.tagBlock.offset }
+
+// TagBlockSize returns the size of the tag block of the grids, or zero if
+// the file has no tag blocks.
+func (e *MeasurementBlockElem) TagBlockSize() int64 { return e.tagBlock.size }
+
+// DictionaryOffset returns the offset of the string dictionary of the grids, in the file.
+func (e *MeasurementBlockElem) DictionaryOffset() int64 { return e.dictionary.offset }
+
+// DictionarySize returns the size of the string dictionary of the grids, or
+// zero if the grids of the file are encoded without dictionaries.
+func (e *MeasurementBlockElem) DictionarySize() int64 { return e.dictionary.size }
+
 // SeriesData returns the raw series data.
 func (e *MeasurementBlockElem) SeriesData() []byte { return e.series.data }
 
 // SeriesN returns the number of series associated with the measurement.
 func (e *MeasurementBlockElem) SeriesN() uint64 { return e.series.n }
 
+// ID returns the measurement id.
+func (e *MeasurementBlockElem) ID() uint64 { return e.id }
+
 func (e *MeasurementBlockElem) SeriesIDSet() *tsdb.SeriesIDSet { return e.seriesIDSet }
 
 // uvarint is a wrapper around binary.Uvarint.
@@ -162,8 +242,22 @@ func uvarint(data []byte) (value uint64, n int, err error) {
 
 // UnmarshalBinary unmarshals data into e.
 func (e *MeasurementBlockElem) UnmarshalBinary(data []byte) error {
+	return e.unmarshalBinary(data, IndexFileVersion)
+}
+
+// unmarshalBinary unmarshals data of an index file of the given version into e.
+func (e *MeasurementBlockElem) unmarshalBinary(data []byte, version int) error {
 	start := len(data)
 
+	// Check the size of the fields before the name.
+	if len(data) < 4*8 {
+		return io.ErrShortBuffer
+	} else if gridsNum := binary.BigEndian.Uint64(data[24:32]); gridsNum > uint64(len(data)-4*8)/16 {
+		return io.ErrShortBuffer
+	} else if size := 4*8 + 16*int(gridsNum) + measurementElemSectionsSize(version); len(data) < size {
+		return io.ErrShortBuffer
+	}
+
 	// Parse tag block offset.
 	e.gridsBlock.offset, data = int64(binary.BigEndian.Uint64(data)), data[8:]
 	e.gridsBlock.size, data = int64(binary.BigEndian.Uint64(data)), data[8:]
@@ -184,10 +278,24 @@ func (e *MeasurementBlockElem) UnmarshalBinary(data []byte) error {
 		}{offset: offset, size: size})
 	}
 
+	// Parse tag block offset and size.
+	if version >= 4 {
+		e.tagBlock.offset, data = int64(binary.BigEndian.Uint64(data)), data[8:]
+		e.tagBlock.size, data = int64(binary.BigEndian.Uint64(data)), data[8:]
+	}
+
+	// Parse dictionary offset and size.
+	if version >= 5 {
+		e.dictionary.offset, data = int64(binary.BigEndian.Uint64(data)), data[8:]
+		e.dictionary.size, data = int64(binary.BigEndian.Uint64(data)), data[8:]
+	}
+
 	// Parse name.
 	sz, n, err := uvarint(data)
 	if err != nil {
 		return err
+	} else if sz > uint64(len(data)-n) {
+		return io.ErrShortBuffer
 	}
 	e.name, data = data[n:n+int(sz)], data[n+int(sz):]
 
@@ -202,6 +310,8 @@ func (e *MeasurementBlockElem) UnmarshalBinary(data []byte) error {
 	sz, n, err = uvarint(data)
 	if err != nil {
 		return err
+	} else if sz > uint64(len(data)-n) {
+		return io.ErrShortBuffer
 	}
 	data = data[n:]
 
@@ -233,8 +343,17 @@ func (e *MeasurementBlockElem) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
-func (e *MeasurementBlockElem) FormatIdWithMeasurementID(id uint64) (uint64, bool) {
-	return (e.id << 24) | id, true
+// measurementElemSectionsSize returns the size of the offsets and sizes of
+// the sections of an element after its grids, in files of the version.
+func measurementElemSectionsSize(version int) int {
+	switch {
+	case version >= 5:
+		return 8 + 8 + 8 + 8 // tag block, dictionary
+	case version >= 4:
+		return 8 + 8 // tag block
+	default:
+		return 0
+	}
 }
 
 // MeasurementBlockWriter writes a measurement block.
@@ -256,6 +375,10 @@ func (mw *MeasurementBlockWriter) Add(name []byte, mmInfo *IndexFileMeasurementC
 	mm.gridBlock.offset = mmInfo.Offset
 	mm.gridBlock.size = mmInfo.Size
 	mm.id = mmInfo.MeasurementID
+	mm.tagBlock.offset = mmInfo.tagBlock.offset
+	mm.tagBlock.size = mmInfo.tagBlock.size
+	mm.dictionary.offset = mmInfo.dictionary.offset
+	mm.dictionary.size = mmInfo.dictionary.size
 
 	for _, grid := range mmInfo.gridInfos {
 		mm.grids = append(mm.grids, struct {
@@ -395,6 +518,20 @@ func (mw *MeasurementBlockWriter) writeMeasurementTo(w io.Writer, name []byte, m
 		}
 	}
 
+	// Write tag block offset and size.
+	if err := writeUint64To(w, uint64(mm.tagBlock.offset), n); err != nil {
+		return err
+	} else if err := writeUint64To(w, uint64(mm.tagBlock.size), n); err != nil {
+		return err
+	}
+
+	// Write dictionary offset and size.
+	if err := writeUint64To(w, uint64(mm.dictionary.offset), n); err != nil {
+		return err
+	} else if err := writeUint64To(w, uint64(mm.dictionary.size), n); err != nil {
+		return err
+	}
+
 	// Write measurement name.
 	if err := writeUvarintTo(w, uint64(len(name)), n); err != nil {
 		return err
@@ -492,6 +629,14 @@ type CompactedMeasurement struct {
 		offset int64
 		size   int64
 	}
+	tagBlock struct {
+		offset int64
+		size   int64
+	}
+	dictionary struct {
+		offset int64
+		size   int64
+	}
 	seriesIDSet *tsdb.SeriesIDSet
 	offset      int64
 	id          uint64
@@ -537,6 +682,9 @@ func ReadMeasurementBlockTrailer(data []byte) (MeasurementBlockTrailer, error) {
 	// }
 
 	// Slice trailer data.
+	if len(data) < MeasurementTrailerSize {
+		return t, io.ErrShortBuffer
+	}
 	buf := data[len(data)-MeasurementTrailerSize:]
 
 	// Read data section info.
@@ -50,7 +50,8 @@ func TestMeasurementBlockWriter(t *testing.T) {
 	// Write the measurements to writer.
 	mw := NewMeasurementBlockWriter()
 	for i, m := range ms {
-		mw.Add(m.Name, &IndexFileMeasurementCompactInfo{Offset: m.Offset, Size: m.Size, gridInfos: grids[i], MeasurementID: uint64(i)}, m.idsSet)
+		tagBlock := GridCompactInfo{offset: m.Offset + m.Size - 5, size: 5}
+		mw.Add(m.Name, &IndexFileMeasurementCompactInfo{Offset: m.Offset, Size: m.Size, gridInfos: grids[i], MeasurementID: uint64(i), tagBlock: tagBlock}, m.idsSet)
 	}
 
 	// Encode into buffer.
@@ -78,6 +79,8 @@ func TestMeasurementBlockWriter(t *testing.T) {
 		t.Fatalf("unexpected grids: %+v", e.grids)
 	} else if e.id != 0 {
 		t.Fatalf("unexpected id: %+v", e.id)
+	} else if e.TagBlockOffset() != 105 || e.TagBlockSize() != 5 {
+		t.Fatalf("unexpected tag block offset/size: %v/%v", e.TagBlockOffset(), e.TagBlockSize())
 	}
 
 	if e, ok := blk.Elem([]byte("bar")); !ok {
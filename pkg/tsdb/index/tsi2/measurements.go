@@ -2,8 +2,14 @@ package tsi2
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
 
 	"github.com/influxdata/influxdb/v2/models"
+	"github.com/influxdata/influxql"
 
 	"cycledb/pkg/tsdb"
 )
@@ -13,8 +19,17 @@ type Measurement struct {
 	name          string
 	gIndex        *GridIndex
 
-	// fileSet: index files' names
-	indexFiles []IndexFile
+	// index files holding the grids flushed from gIndex
+	indexFiles []*IndexFile
+
+	// ids of the series dropped from the index files
+	tombstones *tsdb.SeriesIDSet
+
+	layout IDLayout
+
+	// cache holds the series id sets of the tag values of the measurement,
+	// which are invalidated when its series change.
+	cache *TagValueSeriesIDCache
 }
 
 func NewMeasurement(i *GridIndex, name string, id uint64) *Measurement {
@@ -22,9 +37,26 @@ func NewMeasurement(i *GridIndex, name string, id uint64) *Measurement {
 		gIndex:        i,
 		name:          name,
 		measurementID: id,
+		tombstones:    tsdb.NewSeriesIDSet(),
+		layout:        DefaultIDLayout,
+		cache:         NewTagValueSeriesIDCache(0),
 	}
 }
 
+// bytes estimates the memory footprint of the measurement, in bytes.
+// The index files are not counted, they are shared by the measurements.
+func (m *Measurement) bytes() int {
+	var b int
+	b += int(unsafe.Sizeof(m.measurementID))
+	b += int(unsafe.Sizeof(m.name)) + len(m.name)
+	b += int(unsafe.Sizeof(m.gIndex)) + m.gIndex.bytes()
+	b += int(unsafe.Sizeof(m.indexFiles)) + len(m.indexFiles)*int(unsafe.Sizeof(&IndexFile{}))
+	b += int(unsafe.Sizeof(m.tombstones)) + m.tombstones.Bytes()
+	b += int(unsafe.Sizeof(m.layout))
+	b += int(unsafe.Sizeof(m.cache))
+	return b
+}
+
 func (m *Measurement) CacheSeriesIDSet() *tsdb.SeriesIDSet {
 	idsSet := m.gIndex.SeriesIDSet()
 	resSet := tsdb.NewSeriesIDSet()
@@ -43,22 +75,28 @@ func (m *Measurement) SeriesIDSet() *tsdb.SeriesIDSet {
 	for _, indexFile := range m.indexFiles {
 		resSet.MergeInPlace(indexFile.SeriesIDSet([]byte(m.name)))
 	}
+	resSet = resSet.AndNot(m.tombstones)
 	return resSet
 }
 
-func (m *Measurement) SeriesIDSetForTagKey(key []byte) *tsdb.SeriesIDSet {
+func (m *Measurement) SeriesIDSetForTagKey(key []byte) (*tsdb.SeriesIDSet, error) {
 	idsSet := m.gIndex.SeriesIDSetForTagKey(string(key))
 	resSet := tsdb.NewSeriesIDSet()
 	idsSet.ForEach(func(id uint64) {
 		resSet.Add(m.FormatIdWithMeasurementID(id))
 	})
 	for _, indexFile := range m.indexFiles {
-		resSet.MergeInPlace(indexFile.SeriesIDSetForTagKey([]byte(m.name), key))
+		ss, err := indexFile.SeriesIDSetForTagKey([]byte(m.name), key)
+		if err != nil {
+			return nil, err
+		}
+		resSet.MergeInPlace(ss)
 	}
-	return resSet
+	resSet = resSet.AndNot(m.tombstones)
+	return resSet, nil
 }
 
-func (m *Measurement) SeriesIDSetForTagValue(key, value []byte) *tsdb.SeriesIDSet {
+func (m *Measurement) SeriesIDSetForTagValue(key, value []byte) (*tsdb.SeriesIDSet, error) {
 	idsSet := m.gIndex.SeriesIDSetForTagValue(string(key), string(value))
 	resSet := tsdb.NewSeriesIDSet()
 	idsSet.ForEach(func(id uint64) {
@@ -66,73 +104,847 @@ func (m *Measurement) SeriesIDSetForTagValue(key, value []byte) *tsdb.SeriesIDSe
 		resSet.Add(m.FormatIdWithMeasurementID(id))
 	})
 	for _, indexFile := range m.indexFiles {
-		resSet.MergeInPlace(indexFile.SeriesIDSetForTagValue([]byte(m.name), key, value))
+		ss, err := indexFile.SeriesIDSetForTagValue([]byte(m.name), key, value)
+		if err != nil {
+			return nil, err
+		}
+		resSet.MergeInPlace(ss)
 	}
-	// fmt.Printf("Measurement.SeriesIDSetForTagValue: resSet: %v\n", resSet)
-	return resSet
+	resSet = resSet.AndNot(m.tombstones)
+	return resSet, nil
+}
+
+// SeriesIDSetForTagValueSet returns the ids of the series matching the tag value set.
+func (m *Measurement) SeriesIDSetForTagValueSet(set TagValueSet) (*tsdb.SeriesIDSet, error) {
+	resSet := tsdb.NewSeriesIDSet()
+	m.gIndex.GetSeriesIDsForTagValueSet(set).ForEach(func(id uint64) {
+		resSet.Add(m.FormatIdWithMeasurementID(id))
+	})
+	for _, indexFile := range m.indexFiles {
+		ss, err := indexFile.SeriesIDSetForTagValueSet([]byte(m.name), set)
+		if err != nil {
+			return nil, err
+		}
+		resSet.MergeInPlace(ss)
+	}
+	return resSet.AndNot(m.tombstones), nil
+}
+
+// SeriesIDSetForTagValueFunc returns the ids of the series whose value of the
+// tag key satisfies fn. Series without the key have an empty value.
+// fn is evaluated once per distinct value.
+func (m *Measurement) SeriesIDSetForTagValueFunc(key []byte, fn func(value string) bool) (*tsdb.SeriesIDSet, error) {
+	results := map[string]bool{}
+	cached := func(value string) bool {
+		ok, found := results[value]
+		if !found {
+			ok = fn(value)
+			results[value] = ok
+		}
+		return ok
+	}
+
+	resSet := tsdb.NewSeriesIDSet()
+	m.gIndex.GetSeriesIDsForTagValueFunc(string(key), cached).ForEach(func(id uint64) {
+		resSet.Add(m.FormatIdWithMeasurementID(id))
+	})
+	for _, indexFile := range m.indexFiles {
+		ss, err := indexFile.SeriesIDSetForTagValueFunc([]byte(m.name), key, cached)
+		if err != nil {
+			return nil, err
+		}
+		resSet.MergeInPlace(ss)
+	}
+	return resSet.AndNot(m.tombstones), nil
+}
+
+// SeriesIDSetForTagValueNotEqual returns the ids of the series whose value of
+// the tag key is not value. Series without the key have an empty value.
+func (m *Measurement) SeriesIDSetForTagValueNotEqual(key, value []byte) (*tsdb.SeriesIDSet, error) {
+	resSet := tsdb.NewSeriesIDSet()
+	m.gIndex.GetSeriesIDsForTagValueNotEqual(string(key), string(value)).ForEach(func(id uint64) {
+		resSet.Add(m.FormatIdWithMeasurementID(id))
+	})
+	for _, indexFile := range m.indexFiles {
+		ss, err := indexFile.SeriesIDSetForTagValueNotEqual([]byte(m.name), key, value)
+		if err != nil {
+			return nil, err
+		}
+		resSet.MergeInPlace(ss)
+	}
+	return resSet.AndNot(m.tombstones), nil
+}
+
+// HasTagKey returns true if the tag key exists in memory or in the index files.
+func (m *Measurement) HasTagKey(key []byte) (bool, error) {
+	if m.gIndex.HasTagKey(string(key)) {
+		return true, nil
+	}
+	for _, indexFile := range m.indexFiles {
+		if ok, err := indexFile.HasTagKey([]byte(m.name), key); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// HasTagValue returns true if the tag value exists in memory or in the index files.
+func (m *Measurement) HasTagValue(key, value []byte) (bool, error) {
+	if m.gIndex.HasTagValue(string(key), string(value)) {
+		return true, nil
+	}
+	for _, indexFile := range m.indexFiles {
+		if ok, err := indexFile.HasTagValue([]byte(m.name), key, value); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (m *Measurement) TagKeyIterator() (*TagKeyIterator, error) {
+	keys, err := m.tagKeys()
+	if err != nil {
+		return nil, err
+	}
+	return &TagKeyIterator{keys: mapToSlice(keys)}, nil
+}
+
+// tagKeys returns the union of the tag keys of the grids in memory and in
+// the index files.
+func (m *Measurement) tagKeys() (map[string]struct{}, error) {
+	keys := m.gIndex.tagKeys()
+	for _, indexFile := range m.indexFiles {
+		fileKeys, err := indexFile.TagKeys([]byte(m.name))
+		if err != nil {
+			return nil, err
+		}
+		for key := range fileKeys {
+			keys[key] = struct{}{}
+		}
+	}
+	return keys, nil
+}
+
+// TagKeysByExpr returns the tag keys matching the _tagKey conditions of the
+// expression, or all tag keys if expr is nil. Returns nil if the expression
+// has no _tagKey condition.
+func (m *Measurement) TagKeysByExpr(expr influxql.Expr) (map[string]struct{}, error) {
+	if expr == nil {
+		return m.tagKeys()
+	}
+
+	switch e := expr.(type) {
+	case *influxql.BinaryExpr:
+		switch e.Op {
+		case influxql.EQ, influxql.NEQ, influxql.EQREGEX, influxql.NEQREGEX:
+			tag, ok := e.LHS.(*influxql.VarRef)
+			if !ok {
+				return nil, fmt.Errorf("left side of '%s' must be a tag key", e.Op.String())
+			} else if tag.Val != "_tagKey" {
+				return nil, nil
+			}
+
+			if influxql.IsRegexOp(e.Op) {
+				re, ok := e.RHS.(*influxql.RegexLiteral)
+				if !ok {
+					return nil, fmt.Errorf("right side of '%s' must be a regular expression", e.Op.String())
+				}
+				return m.tagKeysByFilter(e.Op, "", re.Val)
+			}
+
+			s, ok := e.RHS.(*influxql.StringLiteral)
+			if !ok {
+				return nil, fmt.Errorf("right side of '%s' must be a tag value string", e.Op.String())
+			}
+			return m.tagKeysByFilter(e.Op, s.Val, nil)
+
+		case influxql.AND, influxql.OR:
+			lhs, err := m.TagKeysByExpr(e.LHS)
+			if err != nil {
+				return nil, err
+			}
+
+			rhs, err := m.TagKeysByExpr(e.RHS)
+			if err != nil {
+				return nil, err
+			}
+
+			if lhs != nil && rhs != nil {
+				if e.Op == influxql.OR {
+					return unionStringSets(lhs, rhs), nil
+				}
+				return intersectStringSets(lhs, rhs), nil
+			} else if lhs != nil {
+				return lhs, nil
+			} else if rhs != nil {
+				return rhs, nil
+			}
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("invalid operator for tag keys by expression")
+		}
+
+	case *influxql.ParenExpr:
+		return m.TagKeysByExpr(e.Expr)
+	}
+
+	return nil, fmt.Errorf("invalid measurement tag keys expression: %#v", expr)
+}
+
+// tagKeysByFilter returns the tag keys equal to val, or matching regex,
+// depending on op.
+func (m *Measurement) tagKeysByFilter(op influxql.Token, val string, regex *regexp.Regexp) (map[string]struct{}, error) {
+	keys, err := m.tagKeys()
+	if err != nil {
+		return nil, err
+	}
+	for key := range keys {
+		var matched bool
+		switch op {
+		case influxql.EQ:
+			matched = key == val
+		case influxql.NEQ:
+			matched = key != val
+		case influxql.EQREGEX:
+			matched = regex.MatchString(key)
+		case influxql.NEQREGEX:
+			matched = !regex.MatchString(key)
+		}
+		if !matched {
+			delete(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (m *Measurement) TagValueIterator(key []byte) (*TagValueIterator, error) {
+	values, err := m.tagValues(key)
+	if err != nil {
+		return nil, err
+	}
+	return &TagValueIterator{values: mapToSlice(values)}, nil
+}
+
+// tagValues returns the union of the values of the tag key in the grids in
+// memory and in the index files, without the empty value.
+func (m *Measurement) tagValues(key []byte) (map[string]struct{}, error) {
+	values := m.gIndex.tagValues(string(key))
+	for _, indexFile := range m.indexFiles {
+		fileValues, err := indexFile.TagValues([]byte(m.name), key)
+		if err != nil {
+			return nil, err
+		}
+		for value := range fileValues {
+			values[value] = struct{}{}
+		}
+	}
+	return values, nil
+}
+
+// TagKeyCardinality returns the number of distinct values of the tag key.
+func (m *Measurement) TagKeyCardinality(key []byte) (int, error) {
+	values, err := m.tagValues(key)
+	return len(values), err
+}
+
+// TagValueN returns the number of distinct values of each tag key, in the
+// grids in memory and in the index files. The grids keep the values of the
+// dropped series until they are repacked.
+func (m *Measurement) TagValueN() (map[string]int, error) {
+	sets := map[string]map[string]struct{}{}
+	m.gIndex.addTagValuesTo(sets)
+	for _, indexFile := range m.indexFiles {
+		if err := indexFile.addTagValuesTo([]byte(m.name), sets); err != nil {
+			return nil, err
+		}
+	}
+	n := make(map[string]int, len(sets))
+	for key, values := range sets {
+		delete(values, "")
+		n[key] = len(values)
+	}
+	return n, nil
+}
+
+func (m *Measurement) SetTags(tags models.Tags) (uint64, bool, error) {
+	id, entries, err := m.setTags(tags)
+	return id, len(entries) != 0, err
+}
+
+// setTags works as SetTags, and also returns the log entries of the change,
+// or nil if the tags already exist.
+func (m *Measurement) setTags(tags models.Tags) (uint64, []LogEntry, error) {
+	id, entries, err := m.gIndex.setTags(tags)
+	if err != nil {
+		return 0, nil, fmt.Errorf("measurement %q: %w", m.name, err)
+	}
+	for i := range entries {
+		entries[i].Name = []byte(m.name)
+	}
+	if len(entries) != 0 {
+		m.cache.invalidateSeries([]byte(m.name), tags)
+	}
+	return m.FormatIdWithMeasurementID(id), entries, nil
+}
+
+func (m *Measurement) FormatIdWithMeasurementID(indexId uint64) uint64 {
+	return m.layout.seriesID(m.measurementID, indexId)
+}
+
+// hasSeries returns true if any series of the measurement exists.
+func (m *Measurement) hasSeries() bool {
+	if m.gIndex.SeriesIDSet().Cardinality() != 0 {
+		return true
+	}
+	for _, indexFile := range m.indexFiles {
+		if indexFile.SeriesIDSet([]byte(m.name)).AndNot(m.tombstones).Cardinality() != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSeriesID returns true if the series exists in memory or in the index files.
+func (m *Measurement) hasSeriesID(id uint64) bool {
+	measurementID, indexID := m.layout.splitSeriesID(id)
+	if measurementID != m.measurementID || m.tombstones.Contains(id) {
+		return false
+	}
+	if m.gIndex.hasSeriesID(indexID) {
+		return true
+	}
+	for _, indexFile := range m.indexFiles {
+		if indexFile.hasSeriesID([]byte(m.name), indexID) {
+			return true
+		}
+	}
+	return false
+}
+
+// seriesTags returns the tags of the series, decoded from its grid in memory
+// or in the index files. Returns false if the series does not exist.
+func (m *Measurement) seriesTags(id uint64) (models.Tags, bool, error) {
+	measurementID, indexID := m.layout.splitSeriesID(id)
+	if measurementID != m.measurementID || m.tombstones.Contains(id) {
+		return nil, false, nil
+	}
+	if tags, ok := m.gIndex.SeriesTags(indexID); ok {
+		return tags, true, nil
+	}
+	for _, indexFile := range m.indexFiles {
+		if tags, ok, err := indexFile.seriesTags([]byte(m.name), indexID); err != nil || ok {
+			return tags, ok, err
+		}
+	}
+	return nil, false, nil
+}
+
+// invalidateSeriesID removes the cached sets of the series, before it is
+// dropped. All sets of the measurement are removed if its tags are unknown.
+func (m *Measurement) invalidateSeriesID(id uint64) {
+	name := []byte(m.name)
+	if !m.cache.hasMeasurement(name) {
+		return
+	}
+	if tags, ok, err := m.seriesTags(id); err == nil && ok {
+		m.cache.invalidateSeries(name, tags)
+		return
+	}
+	m.cache.invalidateMeasurement(name)
+}
+
+// measurementIDs allocates the measurement ids of the partitions of an index,
+// so that the series ids of the partitions do not collide. It records the
+// partition of each id, to find the partition of a series from its id.
+type measurementIDs struct {
+	mu         sync.RWMutex
+	partitions []int // partition of each id, or -1 if unused
+}
+
+func newMeasurementIDs() *measurementIDs {
+	return &measurementIDs{}
 }
 
-func (m *Measurement) SetTags(tags models.Tags) (uint64, bool) {
-	id, success := m.gIndex.SetTags(tags)
-	id = m.FormatIdWithMeasurementID(id)
-	if !success {
-		// fmt.Printf("set tag pair set fails: tags: %v\n", tags)
+// next allocates the next id to partition p. Returns false if the id
+// is greater than max.
+func (a *measurementIDs) next(p int, max uint64) (uint64, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id := uint64(len(a.partitions))
+	if id > max {
 		return id, false
 	}
-	// fmt.Printf("m.SetTags: id: %+v\n", id)
+	a.partitions = append(a.partitions, p)
 	return id, true
 }
 
-func (m *Measurement) FormatIdWithMeasurementID(indexId uint64) uint64 {
-	return (m.measurementID << 24) | (indexId)
+// reserve records that partition p has the id, which is not allocated again.
+// This is done on replay of the log of the partition.
+func (a *measurementIDs) reserve(id uint64, p int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for uint64(len(a.partitions)) <= id {
+		a.partitions = append(a.partitions, -1)
+	}
+	if other := a.partitions[id]; other != -1 && other != p {
+		return fmt.Errorf("measurement id %d of partition %d belongs to partition %d", id, p, other)
+	}
+	a.partitions[id] = p
+	return nil
 }
 
-// one measurement map to one grid index
-// 2-byte to address measurement, then 4-byte to address id in gIndex within, combined as series id
-type Measurements struct {
+// nextFree allocates to partition p the lowest id which is unused and
+// accepted by ok, or else the next id if it is at most max. Rejected new ids
+// stay unused, to be accepted later. Returns false if no id is accepted.
+func (a *measurementIDs) nextFree(p int, max uint64, ok func(id uint64) bool) (uint64, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, other := range a.partitions {
+		if other == -1 && ok(uint64(id)) {
+			a.partitions[id] = p
+			return uint64(id), true
+		}
+	}
+	for id := uint64(len(a.partitions)); id <= max; id++ {
+		if ok(id) {
+			a.partitions = append(a.partitions, p)
+			return id, true
+		}
+		a.partitions = append(a.partitions, -1)
+	}
+	return 0, false
+}
+
+// release records that partition p no longer has the id, which can then be
+// allocated again by nextFree.
+func (a *measurementIDs) release(id uint64, p int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if id < uint64(len(a.partitions)) && a.partitions[id] == p {
+		a.partitions[id] = -1
+	}
+}
+
+// bytes estimates the memory footprint of the ids, in bytes.
+func (a *measurementIDs) bytes() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var b int
+	b += 24 // mu RWMutex is 24 bytes
+	b += int(unsafe.Sizeof(a.partitions)) + cap(a.partitions)*int(unsafe.Sizeof(int(0)))
+	return b
+}
+
+// partition returns the partition of the id, or false if it is unused.
+func (a *measurementIDs) partition(id uint64) (int, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if id >= uint64(len(a.partitions)) || a.partitions[id] == -1 {
+		return 0, false
+	}
+	return a.partitions[id], true
+}
+
+// measurementsSnapshot is an immutable view of the registry of measurements.
+// The slot of a measurement in measurements is its id.
+type measurementsSnapshot struct {
 	// no contribution to id, since the seriesid conversion happens in measurement
 	measurementId map[string]uint64
 	measurements  []*Measurement
 }
 
-func NewMeasurements() *Measurements {
-	return &Measurements{
+// clone returns a copy of the snapshot, which a writer can modify.
+func (s *measurementsSnapshot) clone() *measurementsSnapshot {
+	other := &measurementsSnapshot{
+		measurementId: make(map[string]uint64, len(s.measurementId)+1),
+		measurements:  make([]*Measurement, len(s.measurements), len(s.measurements)+1),
+	}
+	for name, id := range s.measurementId {
+		other.measurementId[name] = id
+	}
+	copy(other.measurements, s.measurements)
+	return other
+}
+
+// one measurement map to one grid index
+// 2-byte to address measurement, then 4-byte to address id in gIndex within, combined as series id
+//
+// The registry of measurements is copied on write: readers load the current
+// snapshot without locking, while writers are serialized by mu and replace
+// the snapshot with a modified copy.
+type Measurements struct {
+	mu       sync.Mutex
+	registry atomic.Value // *measurementsSnapshot
+
+	// ids of the series dropped from the index files since the last flush,
+	// which are written to the next index file
+	tombstones *tsdb.SeriesIDSet
+
+	layout IDLayout
+
+	// optimizer is the name of the optimizer of the grids of new measurements.
+	optimizer string
+
+	// ids allocates the ids of new measurements, and may be shared with the
+	// measurements of other partitions, which are given as partition.
+	ids       *measurementIDs
+	partition int
+
+	// cache holds the series id sets of the tag values, and may be shared
+	// with the measurements of other partitions.
+	cache *TagValueSeriesIDCache
+}
+
+func NewMeasurements(layout IDLayout) *Measurements {
+	ms := &Measurements{
+		tombstones: tsdb.NewSeriesIDSet(),
+		layout:     layout,
+		ids:        newMeasurementIDs(),
+		cache:      NewTagValueSeriesIDCache(tsdb.DefaultSeriesIDSetCacheSize),
+	}
+	ms.registry.Store(&measurementsSnapshot{
 		measurementId: map[string]uint64{},
 		measurements:  []*Measurement{},
+	})
+	return ms
+}
+
+// snapshot returns the current registry of measurements, which must not be modified.
+func (ms *Measurements) snapshot() *measurementsSnapshot {
+	return ms.registry.Load().(*measurementsSnapshot)
+}
+
+// Names returns the sorted names of the measurements.
+func (ms *Measurements) Names() []string {
+	s := ms.snapshot()
+	a := make([]string, 0, len(s.measurementId))
+	for name := range s.measurementId {
+		a = append(a, name)
 	}
+	sort.Strings(a)
+	return a
+}
+
+// bytes estimates the memory footprint of the measurements, in bytes.
+func (ms *Measurements) bytes() int {
+	s := ms.snapshot()
+	var b int
+	b += 8 // mu Mutex is 8 bytes
+	b += int(unsafe.Sizeof(ms.registry))
+	b += int(unsafe.Sizeof(s.measurementId))
+	for name, id := range s.measurementId {
+		b += int(unsafe.Sizeof(name)) + len(name) + int(unsafe.Sizeof(id))
+	}
+	b += int(unsafe.Sizeof(s.measurements))
+	for _, m := range s.measurements {
+		b += int(unsafe.Sizeof(m))
+		if m != nil {
+			b += m.bytes()
+		}
+	}
+	b += int(unsafe.Sizeof(ms.tombstones)) + ms.tombstones.Bytes()
+	b += int(unsafe.Sizeof(ms.layout))
+	b += int(unsafe.Sizeof(ms.optimizer)) + len(ms.optimizer)
+	b += int(unsafe.Sizeof(ms.ids))
+	b += int(unsafe.Sizeof(ms.partition))
+	b += int(unsafe.Sizeof(ms.cache))
+	return b
 }
 
 func (ms *Measurements) MeasurementByName(name []byte) (*Measurement, error) {
-	id, exist := ms.measurementId[string(name)]
+	s := ms.snapshot()
+	id, exist := s.measurementId[string(name)]
 	if !exist {
 		return nil, nil
 	}
-	if len(ms.measurements) <= int(id) {
+	if len(s.measurements) <= int(id) {
 		return nil, fmt.Errorf("inconsistent between measurementId and measurements")
 	}
-	return ms.measurements[id], nil
+	return s.measurements[id], nil
+}
+
+// MeasurementBySeriesID returns the measurement of the series id, or nil if
+// the measurement does not exist.
+func (ms *Measurements) MeasurementBySeriesID(id uint64) *Measurement {
+	measurementID, _ := ms.layout.splitSeriesID(id)
+	s := ms.snapshot()
+	if measurementID >= uint64(len(s.measurements)) {
+		return nil
+	}
+	return s.measurements[measurementID]
+}
+
+// DropSeriesID removes the series from its grid in memory, or tombstones it
+// if the grid was flushed to an index file.
+func (ms *Measurements) DropSeriesID(m *Measurement, id uint64) {
+	_, indexID := ms.layout.splitSeriesID(id)
+	m.invalidateSeriesID(id)
+	if m.gIndex.dropSeriesID(indexID) {
+		return
+	}
+	m.tombstones.Add(id)
+	ms.tombstones.Add(id)
+}
+
+// SeriesIDSet returns the ids of all series of the measurements.
+func (ms *Measurements) SeriesIDSet() *tsdb.SeriesIDSet {
+	ss := tsdb.NewSeriesIDSet()
+	for _, m := range ms.snapshot().measurements {
+		if m != nil {
+			ss.MergeInPlace(m.SeriesIDSet())
+		}
+	}
+	return ss
+}
+
+// tombstoneSeriesIDSet returns the ids of all series dropped from the index files.
+func (ms *Measurements) tombstoneSeriesIDSet() *tsdb.SeriesIDSet {
+	ss := tsdb.NewSeriesIDSet()
+	for _, m := range ms.snapshot().measurements {
+		if m != nil {
+			ss.MergeInPlace(m.tombstones)
+		}
+	}
+	return ss
 }
 
 func (ms *Measurements) DropMeasurement(name []byte) error {
-	if id, ok := ms.measurementId[string(name)]; ok {
-		delete(ms.measurementId, string(name))
-		ms.measurements[id] = nil
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if id, ok := ms.snapshot().measurementId[string(name)]; ok {
+		s := ms.snapshot().clone()
+		delete(s.measurementId, string(name))
+		s.measurements[id] = nil
+		ms.registry.Store(s)
+		ms.cache.invalidateMeasurement(name)
 	}
 	return nil
 }
 
-func (ms *Measurements) AppendMeasurement(name []byte) error {
-	measurementId := uint64(len(ms.measurements))
-	m := NewMeasurement(NewGridIndex(NewMultiplierOptimizer(10, 2)), string(name), measurementId)
-	ms.measurementId[string(name)] = measurementId
-	ms.measurements = append(ms.measurements, m)
+// AttachIndexFile adds the index file to the measurements it holds grids for,
+// and its tombstones to the measurements of the dropped series.
+// Measurements recreated with a new id after being dropped are skipped.
+func (ms *Measurements) AttachIndexFile(f *IndexFile) error {
+	if f.IDLayout() != ms.layout {
+		return fmt.Errorf("%q: %s: %w", f.Path(), f.IDLayout(), ErrIncompatibleIDLayout)
+	}
+
+	f.TombstoneSeriesIDSet().ForEach(func(id uint64) {
+		if m := ms.MeasurementBySeriesID(id); m != nil {
+			m.tombstones.Add(id)
+		}
+	})
+
+	itr := f.MeasurementIterator()
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		m, err := ms.MeasurementByName(e.Name())
+		if err != nil {
+			return err
+		}
+		if m != nil && m.measurementID == e.ID() && len(e.grids) != 0 {
+			m.indexFiles = append(m.indexFiles, f)
+		}
+	}
 	return nil
 }
 
-func (ms *Measurements) SetTags(name []byte, tags models.Tags) (uint64, bool) {
+// ReplaceIndexFiles replaces the files merged by a compaction with the new file.
+func (ms *Measurements) ReplaceIndexFiles(files IndexFiles, f *IndexFile) error {
+	for _, m := range ms.snapshot().measurements {
+		if m == nil {
+			continue
+		}
+		indexFiles := make([]*IndexFile, 0, len(m.indexFiles))
+		for _, indexFile := range m.indexFiles {
+			if !files.contains(indexFile) {
+				indexFiles = append(indexFiles, indexFile)
+			}
+		}
+		m.indexFiles = indexFiles
+	}
+	return ms.AttachIndexFile(f)
+}
+
+// hasMeasurement returns true if the measurement exists with the id.
+func (ms *Measurements) hasMeasurement(name []byte, id uint64) bool {
 	m, err := ms.MeasurementByName(name)
-	if err != nil || m == nil {
-		return 0, false
+	return err == nil && m != nil && m.measurementID == id
+}
+
+// gridBytes estimates the memory footprint of the grids in memory, in bytes.
+func (ms *Measurements) gridBytes() int {
+	var b int
+	for _, m := range ms.snapshot().measurements {
+		if m != nil {
+			b += m.gIndex.gridBytes()
+		}
+	}
+	return b
+}
+
+// sealedGrids are the grids of a measurement sealed for a flush.
+type sealedGrids struct {
+	m     *Measurement
+	grids []*Grid
+}
+
+// seal seals the grids in memory of the measurements for a flush, and
+// returns them by measurement name, along with the tombstones to write
+// with them. The series are added to new grids in the meantime.
+func (ms *Measurements) seal() (map[string]sealedGrids, *tsdb.SeriesIDSet) {
+	s := ms.snapshot()
+	sealed := make(map[string]sealedGrids, len(s.measurementId))
+	for _, m := range s.measurements {
+		if m != nil {
+			sealed[m.name] = sealedGrids{m: m, grids: m.gIndex.seal()}
+		}
+	}
+	return sealed, ms.tombstones.Clone()
+}
+
+// releaseSealed drops the sealed grids from memory once they are flushed to
+// an index file, along with the tombstones written to it.
+func (ms *Measurements) releaseSealed(sealed map[string]sealedGrids, tombstones *tsdb.SeriesIDSet) {
+	for _, s := range sealed {
+		s.m.gIndex.releaseSealed()
+	}
+	ms.tombstones.Diff(tombstones)
+}
+
+// LogEntries returns the entries which recreate the measurements,
+// to start a new log file after the grids are flushed.
+// The id of a trailing dropped measurement is kept by an insert without name.
+func (ms *Measurements) LogEntries() []LogEntry {
+	s := ms.snapshot()
+	entries := make([]LogEntry, 0, len(s.measurementId)+1)
+	for id, m := range s.measurements {
+		if m != nil {
+			m.gIndex.mu.RLock()
+			entries = append(entries, LogEntry{Flag: LogEntryMeasurementInsertFlag, Name: []byte(m.name), MeasurementID: m.measurementID, Offset: m.gIndex.nextOffset()})
+			m.gIndex.mu.RUnlock()
+		} else if id == len(s.measurements)-1 {
+			entries = append(entries, LogEntry{Flag: LogEntryMeasurementInsertFlag, MeasurementID: uint64(id)})
+		}
+	}
+	return entries
+}
+
+func (ms *Measurements) AppendMeasurement(name []byte) error {
+	_, created, err := ms.CreateMeasurementIfNotExists(name)
+	if err == nil && !created {
+		return fmt.Errorf("measurement %q already exists", name)
+	}
+	return err
+}
+
+// CreateMeasurementIfNotExists returns the measurement, after creating it
+// with the next id if it does not exist. Returns true if it was created.
+func (ms *Measurements) CreateMeasurementIfNotExists(name []byte) (*Measurement, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if m, err := ms.MeasurementByName(name); err != nil || m != nil {
+		return m, false, err
+	}
+	measurementId, ok := ms.ids.next(ms.partition, ms.layout.MaxMeasurementID())
+	if !ok {
+		return nil, false, fmt.Errorf("measurement %q with id %d: %w", name, measurementId, ErrMeasurementIDOverflow)
+	}
+	m, err := ms.appendMeasurementWithID(name, measurementId)
+	return m, err == nil, err
+}
+
+// appendMeasurementWithID appends a measurement with the id it had before.
+// Ids of dropped measurements are not reused by CreateMeasurementIfNotExists,
+// their slots stay nil. The slots of the ids of other partitions stay nil too.
+// A repack may give a measurement the id of a nil slot.
+// Must be called with the lock held.
+func (ms *Measurements) appendMeasurementWithID(name []byte, measurementId uint64) (*Measurement, error) {
+	s := ms.snapshot()
+	if _, ok := s.measurementId[string(name)]; ok || (measurementId < uint64(len(s.measurements)) && s.measurements[measurementId] != nil) {
+		return nil, fmt.Errorf("measurement %q with id %d already exists", name, measurementId)
+	} else if measurementId > ms.layout.MaxMeasurementID() {
+		return nil, fmt.Errorf("measurement %q with id %d: %w", name, measurementId, ErrMeasurementIDOverflow)
+	} else if err := ms.ids.reserve(measurementId, ms.partition); err != nil {
+		return nil, err
+	}
+	optimizer, err := NewOptimizer(ms.optimizer)
+	if err != nil {
+		return nil, err
+	}
+	gi := NewGridIndex(optimizer)
+	gi.maxID = ms.layout.MaxIndexID()
+	m := NewMeasurement(gi, string(name), measurementId)
+	m.layout = ms.layout
+	m.cache = ms.cache
+
+	s = s.clone()
+	for uint64(len(s.measurements)) <= measurementId {
+		s.measurements = append(s.measurements, nil)
+	}
+	s.measurementId[string(name)] = measurementId
+	s.measurements[measurementId] = m
+	ms.registry.Store(s)
+	return m, nil
+}
+
+// ExecEntry applies a log entry to the measurements.
+// This is done on replay of the log.
+func (ms *Measurements) ExecEntry(e *LogEntry) error {
+	switch e.Flag {
+	case LogEntryMeasurementInsertFlag:
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+		if len(e.Name) == 0 {
+			if err := ms.ids.reserve(e.MeasurementID, ms.partition); err != nil {
+				return err
+			}
+			s := ms.snapshot().clone()
+			for uint64(len(s.measurements)) <= e.MeasurementID {
+				s.measurements = append(s.measurements, nil)
+			}
+			ms.registry.Store(s)
+			return nil
+		}
+		// A log started by a flush begins with the measurements. Those
+		// replayed from the previous log have their grids sealed, as the
+		// grid positions of the new log start after them.
+		if m, err := ms.MeasurementByName(e.Name); err != nil {
+			return err
+		} else if m != nil && m.measurementID == e.MeasurementID {
+			m.gIndex.seal()
+			return nil
+		}
+		m, err := ms.appendMeasurementWithID(e.Name, e.MeasurementID)
+		if err != nil {
+			return err
+		}
+		if e.Offset != 0 {
+			m.gIndex.offset = e.Offset
+		}
+		return nil
+	case LogEntryMeasurementTombstoneFlag:
+		return ms.DropMeasurement(e.Name)
+	}
+
+	m, err := ms.MeasurementByName(e.Name)
+	if err != nil {
+		return err
+	} else if m == nil {
+		return ErrMeasurementNotFound
+	}
+	if e.Flag == LogEntrySeriesTombstoneFlag {
+		ms.DropSeriesID(m, e.SeriesID)
+		return nil
+	}
+	return m.gIndex.execEntry(e)
+}
+
+func (ms *Measurements) SetTags(name []byte, tags models.Tags) (uint64, bool, error) {
+	m, err := ms.MeasurementByName(name)
+	if err != nil {
+		return 0, false, err
+	} else if m == nil {
+		return 0, false, ErrMeasurementNotFound
 	}
 	return m.SetTags(tags)
 }
@@ -142,7 +954,7 @@ func (ms *Measurements) HasTagKey(name, key []byte) (bool, error) {
 	if err != nil || m == nil {
 		return false, err
 	}
-	return m.gIndex.HasTagKey(string(key)), nil
+	return m.HasTagKey(key)
 }
 
 func (ms *Measurements) HasTagValue(name, key, value []byte) (bool, error) {
@@ -150,7 +962,7 @@ func (ms *Measurements) HasTagValue(name, key, value []byte) (bool, error) {
 	if err != nil || m == nil {
 		return false, err
 	}
-	return m.gIndex.HasTagValue(string(key), string(value)), nil
+	return m.HasTagValue(key, value)
 }
 
 func (ms *Measurements) MeasurementSeriesIDIterator(name []byte) (tsdb.SeriesIDIterator, error) {
@@ -166,7 +978,11 @@ func (ms *Measurements) TagKeySeriesIDIterator(name, key []byte) (tsdb.SeriesIDS
 	if err != nil || m == nil {
 		return nil, err
 	}
-	return NewSeriesIDSetIterator(m.SeriesIDSetForTagKey(key)), nil
+	ss, err := m.SeriesIDSetForTagKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return NewSeriesIDSetIterator(ss), nil
 }
 
 func (ms *Measurements) TagValueSeriesIDIterator(name, key, value []byte) (tsdb.SeriesIDSetIterator, error) {
@@ -177,5 +993,68 @@ func (ms *Measurements) TagValueSeriesIDIterator(name, key, value []byte) (tsdb.
 	if m == nil {
 		return NewSeriesIDSetIterator(tsdb.NewSeriesIDSet()), nil
 	}
-	return NewSeriesIDSetIterator(m.SeriesIDSetForTagValue(key, value)), nil
+	// Return clones, the cached sets must not be modified.
+	if ss := ms.cache.Get(name, key, value); ss != nil {
+		return NewSeriesIDSetIterator(ss.Clone()), nil
+	}
+	ss, err := m.SeriesIDSetForTagValue(key, value)
+	if err != nil {
+		return nil, err
+	}
+	ms.cache.Put(name, key, value, ss)
+	return NewSeriesIDSetIterator(ss.Clone()), nil
+}
+
+// TagValueSetSeriesIDIterator returns an iterator over the series of the
+// measurement matching the tag value set.
+func (ms *Measurements) TagValueSetSeriesIDIterator(name []byte, set TagValueSet) (tsdb.SeriesIDSetIterator, error) {
+	m, err := ms.MeasurementByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return NewSeriesIDSetIterator(tsdb.NewSeriesIDSet()), nil
+	}
+	ss, err := m.SeriesIDSetForTagValueSet(set)
+	if err != nil {
+		return nil, err
+	}
+	return NewSeriesIDSetIterator(ss), nil
+}
+
+// MatchTagValueSeriesIDIterator returns an iterator over the series of the
+// measurement whose value of the tag key matches the regex, or does not match
+// it if matches is false.
+func (ms *Measurements) MatchTagValueSeriesIDIterator(name, key []byte, value *regexp.Regexp, matches bool) (tsdb.SeriesIDSetIterator, error) {
+	m, err := ms.MeasurementByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return NewSeriesIDSetIterator(tsdb.NewSeriesIDSet()), nil
+	}
+	ss, err := m.SeriesIDSetForTagValueFunc(key, func(v string) bool {
+		return value.MatchString(v) == matches
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewSeriesIDSetIterator(ss), nil
+}
+
+// TagValueNotEqualSeriesIDIterator returns an iterator over the series of the
+// measurement whose value of the tag key is not value.
+func (ms *Measurements) TagValueNotEqualSeriesIDIterator(name, key, value []byte) (tsdb.SeriesIDSetIterator, error) {
+	m, err := ms.MeasurementByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return NewSeriesIDSetIterator(tsdb.NewSeriesIDSet()), nil
+	}
+	ss, err := m.SeriesIDSetForTagValueNotEqual(key, value)
+	if err != nil {
+		return nil, err
+	}
+	return NewSeriesIDSetIterator(ss), nil
 }
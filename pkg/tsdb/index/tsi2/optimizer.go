@@ -1,10 +1,50 @@
 package tsi2
 
-import "github.com/influxdata/influxdb/v2/models"
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"cycledb/pkg/tsdb"
+
+	"github.com/influxdata/influxdb/v2/models"
+	"github.com/influxdata/influxdb/v2/pkg/estimator"
+	"github.com/influxdata/influxdb/v2/pkg/estimator/hll"
+)
 
 type Optimizer interface {
 	// To Generate a new grid with information of GridIndex
 	NewOptimizedGrid(*GridIndex, models.Tags) *Grid
+	// Observe is called with the tags of each new series of the GridIndex,
+	// before it is inserted.
+	Observe(models.Tags)
+}
+
+// Defaults of the optimizers created by NewOptimizer.
+const (
+	DefaultBasicNum   = 10
+	DefaultMultiplier = 2
+
+	// DefaultSeriesPerGrid is the number of series a grid sized by the
+	// StatisticsOptimizer is meant to hold.
+	DefaultSeriesPerGrid = 1024
+
+	// DefaultMinObservedSeriesN is the number of series the StatisticsOptimizer
+	// observes before sizing grids from its statistics.
+	DefaultMinObservedSeriesN = 100
+)
+
+// NewOptimizer returns a new optimizer for the grids of a measurement from
+// its name in the configuration. An empty name is the default optimizer.
+func NewOptimizer(name string) (Optimizer, error) {
+	switch name {
+	case "", tsdb.MultiplierGridOptimizer:
+		return NewMultiplierOptimizer(DefaultBasicNum, DefaultMultiplier), nil
+	case tsdb.StatisticsGridOptimizer:
+		fallback := NewMultiplierOptimizer(DefaultBasicNum, DefaultMultiplier)
+		return NewStatisticsOptimizer(DefaultSeriesPerGrid, DefaultMinObservedSeriesN, fallback), nil
+	}
+	return nil, fmt.Errorf("%q: %w", name, ErrUnknownGridOptimizer)
 }
 
 // If in the previous grids, the tag key `K` is filled up n times,
@@ -27,13 +67,7 @@ func NewMultiplierOptimizer(basicNum, multiplier int) *MultiplierOptimizer {
 }
 
 func (a *MultiplierOptimizer) NewOptimizedGrid(gi *GridIndex, tags models.Tags) *Grid {
-	// so that the id begins at 1, not 0
-	offset := uint64(1)
-	if len(gi.grids) != 0 {
-		lastGrid := gi.grids[len(gi.grids)-1]
-		lastGridLength := lastGrid.getCapacityOfIDs()
-		offset = lastGrid.offset + uint64(lastGridLength)
-	}
+	offset := gi.nextOffset()
 
 	tagValuess := make([]*TagValues, 0, len(tags))
 	for i := 0; i < len(tags); i++ {
@@ -45,3 +79,167 @@ func (a *MultiplierOptimizer) NewOptimizedGrid(gi *GridIndex, tags models.Tags)
 	grid := NewGridWithSingleTags(offset, tags, tagValuess)
 	return grid
 }
+
+// Observe does nothing, the grids filled up are counted instead.
+func (a *MultiplierOptimizer) Observe(tags models.Tags) {}
+
+// StatisticsOptimizer sizes the dimensions of new grids from the series
+// observed in the measurement: how often a series brings a new value of a
+// tag key, and which tag keys occur together.
+//
+// A key for which most series bring a new value grows with the series, its
+// dimension is sized by the number of series a grid is meant to hold. Other
+// keys get room for the values seen so far and a few more, so that the grid
+// does not fill up on them. Keys occurring in most series having the keys of
+// the new series are added to the grid, with the empty value, so that these
+// series share it. Until enough series are observed, grids are sized by the
+// fallback optimizer.
+//
+// The statistics are those of the series created since the index was opened.
+type StatisticsOptimizer struct {
+	seriesN uint64 // series observed
+	keys    map[string]*tagKeyStats
+
+	seriesPerGrid uint64
+	minSeriesN    uint64
+	fallback      Optimizer
+}
+
+// tagKeyStats holds the statistics of a tag key.
+type tagKeyStats struct {
+	seriesN      uint64            // series with the key
+	values       estimator.Sketch  // distinct values of the key
+	cooccurrence map[string]uint64 // series with the key and another key
+}
+
+// NewStatisticsOptimizer returns a StatisticsOptimizer sizing grids to hold
+// about seriesPerGrid series, once minSeriesN series were observed.
+func NewStatisticsOptimizer(seriesPerGrid, minSeriesN uint64, fallback Optimizer) *StatisticsOptimizer {
+	return &StatisticsOptimizer{
+		keys:          map[string]*tagKeyStats{},
+		seriesPerGrid: seriesPerGrid,
+		minSeriesN:    minSeriesN,
+		fallback:      fallback,
+	}
+}
+
+// Observe adds the series to the statistics. Tags with the empty value are
+// missing from the series.
+func (o *StatisticsOptimizer) Observe(tags models.Tags) {
+	o.seriesN++
+	o.fallback.Observe(tags)
+	for _, tag := range tags {
+		if len(tag.Value) == 0 {
+			continue
+		}
+		s := o.keys[string(tag.Key)]
+		if s == nil {
+			// A low precision is enough to tell the keys apart, and keeps the sketches small.
+			sketch, _ := hll.NewPlus(10)
+			s = &tagKeyStats{values: sketch, cooccurrence: map[string]uint64{}}
+			o.keys[string(tag.Key)] = s
+		}
+		s.seriesN++
+		s.values.Add(tag.Value)
+		for _, other := range tags {
+			if len(other.Value) != 0 && string(other.Key) != string(tag.Key) {
+				s.cooccurrence[string(other.Key)]++
+			}
+		}
+	}
+}
+
+// NewOptimizedGrid returns a grid for the tags sized from the statistics.
+func (o *StatisticsOptimizer) NewOptimizedGrid(gi *GridIndex, tags models.Tags) *Grid {
+	if o.seriesN < o.minSeriesN {
+		return o.fallback.NewOptimizedGrid(gi, tags)
+	}
+
+	keys := o.gridKeys(tags)
+	offset := gi.nextOffset()
+
+	// Keys growing with the series share the series of a grid, as each of
+	// their values is mostly used by a single series.
+	var growing int
+	for _, tag := range keys {
+		if o.growing(string(tag.Key)) {
+			growing++
+		}
+	}
+	growingCapacity := o.seriesPerGrid
+	if growing > 1 {
+		growingCapacity = uint64(math.Pow(float64(o.seriesPerGrid), 1/float64(growing)))
+	}
+
+	tagValuesSlice := make([]*TagValues, 0, len(keys))
+	for _, tag := range keys {
+		capacity := growingCapacity
+		s := o.keys[string(tag.Key)]
+		if !o.growing(string(tag.Key)) {
+			n := s.values.Count()
+			capacity = n + n/4 + 1
+		}
+		if s == nil || s.seriesN < o.seriesN {
+			// A slot for the series without the key.
+			capacity++
+		}
+		if capacity < 2 {
+			capacity = 2
+		}
+		tagValues := newTagValues(capacity)
+		tagValues.SetValue(string(tag.Value))
+		tagValuesSlice = append(tagValuesSlice, tagValues)
+	}
+
+	// Shrink the largest dimensions until the grid fits the remaining ids.
+	for !gi.fits(offset, tagValuesSlice) {
+		largest := 0
+		for i, tagValues := range tagValuesSlice {
+			if tagValues.capacity > tagValuesSlice[largest].capacity {
+				largest = i
+			}
+		}
+		if tagValuesSlice[largest].capacity <= 1 {
+			break
+		}
+		tagValuesSlice[largest].capacity /= 2
+	}
+
+	return NewGridWithSingleTags(offset, keys, tagValuesSlice)
+}
+
+// growing returns true if most series with the key bring a new value of it.
+func (o *StatisticsOptimizer) growing(key string) bool {
+	s := o.keys[key]
+	return s != nil && s.values.Count()*2 >= s.seriesN
+}
+
+// gridKeys returns the tags with a value, and the keys occurring in most
+// series having all of them with the empty value, sorted by key.
+func (o *StatisticsOptimizer) gridKeys(tags models.Tags) models.Tags {
+	keys := make(models.Tags, 0, len(tags))
+	for _, tag := range tags {
+		if len(tag.Value) != 0 {
+			keys = append(keys, tag)
+		}
+	}
+	if len(keys) == 0 {
+		return keys
+	}
+
+	for key := range o.keys {
+		if keys.Get([]byte(key)) != nil {
+			continue
+		}
+		frequent := true
+		for _, tag := range keys {
+			s := o.keys[string(tag.Key)]
+			frequent = frequent && s != nil && s.cooccurrence[key]*2 >= s.seriesN
+		}
+		if frequent {
+			keys = append(keys, models.NewTag([]byte(key), nil))
+		}
+	}
+	sort.Sort(keys)
+	return keys
+}
@@ -0,0 +1,75 @@
+package tsi2
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/influxdata/influxdb/v2/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensure the statistics optimizer sizes a growing key by the series of a
+// grid, other keys by their values, and adds the keys occurring in most
+// series to the grid.
+func TestStatisticsOptimizer_NewOptimizedGrid(t *testing.T) {
+	gi := NewGridIndex(NewStatisticsOptimizer(64, 10, NewMultiplierOptimizer(2, 1)))
+	tags := func(i int) models.Tags {
+		m := map[string]string{"host": fmt.Sprintf("h%d", i), "region": fmt.Sprintf("r%d", i%3)}
+		if i%4 != 0 {
+			m["zone"] = fmt.Sprintf("z%d", i%2)
+		}
+		return models.NewTags(m)
+	}
+
+	// The grids of the first series are sized by the fallback optimizer.
+	for i := 0; i < 9; i++ {
+		_, _, err := gi.SetTags(tags(i))
+		assert.NoError(t, err)
+	}
+	fallbackN := len(gi.grids)
+	for _, g := range gi.grids {
+		assert.Equal(t, uint64(2), g.tagValuesSlice[0].capacity)
+	}
+
+	for i := 9; i < 60; i++ {
+		_, _, err := gi.SetTags(tags(i))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, fallbackN+1, len(gi.grids))
+	g := gi.grids[len(gi.grids)-1]
+	assert.Equal(t, []string{"host", "region", "zone"}, g.tagKeys)
+	// One slot of zone is left for the series without it.
+	var capacities []uint64
+	for _, tagValues := range g.tagValuesSlice {
+		capacities = append(capacities, tagValues.capacity)
+	}
+	assert.Equal(t, []uint64{64, 4, 4}, capacities)
+
+	// All series are found.
+	for i := 0; i < 60; i++ {
+		_, ok := gi.GetStrictlyMatchedSeriesIDForTags(tags(i))
+		assert.True(t, ok, i)
+	}
+}
+
+// Ensure a grid is shrunk to the remaining ids of the grid index.
+func TestStatisticsOptimizer_NewOptimizedGrid_Fits(t *testing.T) {
+	o := NewStatisticsOptimizer(1<<20, 1, NewMultiplierOptimizer(2, 1))
+	gi := NewGridIndex(o)
+	gi.maxID = 1000
+	for i := 0; i < 4; i++ {
+		o.Observe(models.NewTags(map[string]string{"a": fmt.Sprintf("a%d", i), "b": fmt.Sprintf("b%d", i)}))
+	}
+	g := o.NewOptimizedGrid(gi, models.NewTags(map[string]string{"a": "a0", "b": "b0"}))
+	assert.True(t, gi.fits(g.offset, g.tagValuesSlice))
+	assert.LessOrEqual(t, g.getCapacityOfIDs(), uint64(1000))
+}
+
+func TestNewOptimizer(t *testing.T) {
+	for _, name := range []string{"", "multiplier", "statistics"} {
+		_, err := NewOptimizer(name)
+		assert.NoError(t, err, name)
+	}
+	_, err := NewOptimizer("foo")
+	assert.ErrorIs(t, err, ErrUnknownGridOptimizer)
+}
@@ -0,0 +1,1422 @@
+package tsi2
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/influxdata/influxdb/pkg/bytesutil"
+	"github.com/influxdata/influxdb/v2/logger"
+	"github.com/influxdata/influxdb/v2/models"
+	"github.com/influxdata/influxdb/v2/pkg/estimator"
+	"github.com/influxdata/influxdb/v2/pkg/estimator/hll"
+	"github.com/influxdata/influxql"
+	"go.uber.org/zap"
+
+	"cycledb/pkg/tsdb"
+)
+
+// Partition holds the grids of a subset of the measurements of an index,
+// with its own lock, log file, index files and compactions.
+type Partition struct {
+	mu sync.RWMutex
+
+	// compactMu serializes the flushes and compactions, which only hold mu
+	// to seal the grids and to swap the files. It is acquired before mu.
+	compactMu sync.Mutex
+
+	// id is the position of the partition in the index.
+	id int
+
+	measurements *Measurements
+
+	// ids allocates the measurement ids shared by the partitions of the index.
+	ids *measurementIDs
+
+	// tagValueCache holds the series id sets of the tag values, shared by
+	// the partitions of the index.
+	tagValueCache *TagValueSeriesIDCache
+
+	// logFile records the changes of measurements before they are applied
+	// to the series file, and is replayed on open.
+	logFile *LogFile
+
+	// sealedLogFiles hold the grids sealed for a flush in progress, and are
+	// removed once the flush is written to an index file.
+	sealedLogFiles []*LogFile
+
+	// indexFiles hold the grids flushed by Compact, in the order they were written.
+	indexFiles []*IndexFile
+	seq        int // file id sequence
+
+	// compaction thresholds of a level
+	maxLevelFileN int
+	maxLevelSize  int64
+
+	// The grids in memory are flushed to an index file in the background
+	// once their estimated size reaches maxInMemorySize.
+	maxInMemorySize int64
+	compacting      bool           // a flush is pending or in progress
+	wg              sync.WaitGroup // background flushes
+
+	logger *zap.Logger
+
+	sfile *tsdb.SeriesFile // series lookup file
+
+	// Cached sketches, updated with the log entries.
+	mSketch, mTSketch estimator.Sketch // Measurement sketches
+	sSketch, sTSketch estimator.Sketch // Series sketches
+
+	// ids of all series in memory and in the index files
+	seriesIDSet *tsdb.SeriesIDSet
+
+	// idLayout splits the series ids between measurements and grids.
+	// It is recorded in the manifest and the index files.
+	idLayout IDLayout
+
+	// gridOptimizer is the name of the optimizer sizing the new grids.
+	gridOptimizer string
+
+	path string // Directory of the partition.
+
+	// failed is the error of the log append which left the grids in memory
+	// ahead of the log. The partition refuses writes and flushes until it
+	// is reopened, which replays the log.
+	failed error
+
+	opened bool
+}
+
+// NewPartition returns a new instance of Partition.
+func NewPartition(sfile *tsdb.SeriesFile, path string) *Partition {
+	return &Partition{
+		ids:           newMeasurementIDs(),
+		tagValueCache: NewTagValueSeriesIDCache(tsdb.DefaultSeriesIDSetCacheSize),
+		logger:        zap.NewNop(),
+		sfile:         sfile,
+		path:          path,
+		maxLevelFileN: DefaultMaxLevelFileN,
+		maxLevelSize:  DefaultMaxLevelSize,
+
+		maxInMemorySize: tsdb.DefaultMaxIndexLogFileSize,
+
+		mSketch:     hll.NewDefaultPlus(),
+		mTSketch:    hll.NewDefaultPlus(),
+		sSketch:     hll.NewDefaultPlus(),
+		sTSketch:    hll.NewDefaultPlus(),
+		seriesIDSet: tsdb.NewSeriesIDSet(),
+		idLayout:    DefaultIDLayout,
+	}
+}
+
+func (p *Partition) Open() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.opened {
+		return errors.New("partition already open")
+	}
+	return p.open()
+}
+
+// open opens the files of the manifest. Must be called with the lock held.
+func (p *Partition) open() (rErr error) {
+	p.failed = nil
+	if err := p.idLayout.Validate(); err != nil {
+		return err
+	}
+	if _, err := NewOptimizer(p.gridOptimizer); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(p.path, 0777); err != nil {
+		return err
+	}
+
+	// Read manifest file.
+	m, _, err := ReadManifestFile(p.ManifestPath())
+	if os.IsNotExist(err) {
+		m = NewManifest(p.ManifestPath())
+		m.IDLayout = p.idLayout
+	} else if err != nil {
+		return err
+	}
+
+	// Check to see if the MANIFEST file is compatible with the current Partition.
+	if err := m.Validate(); err != nil {
+		return err
+	} else if m.Layout() != p.idLayout {
+		return fmt.Errorf("%q: %s: %w", p.ManifestPath(), m.Layout(), ErrIncompatibleIDLayout)
+	}
+
+	defer func() {
+		if rErr != nil {
+			p.closeFiles()
+		}
+	}()
+
+	// The log files hold the measurements and are replayed first,
+	// then the index files are attached to the measurements.
+	p.mSketch, p.mTSketch = hll.NewDefaultPlus(), hll.NewDefaultPlus()
+	p.sSketch, p.sTSketch = hll.NewDefaultPlus(), hll.NewDefaultPlus()
+	p.measurements = NewMeasurements(p.idLayout)
+	p.measurements.optimizer = p.gridOptimizer
+	p.measurements.ids, p.measurements.partition = p.ids, p.id
+	p.measurements.cache = p.tagValueCache
+	for _, filename := range m.Files {
+		if filepath.Ext(filename) != LogFileExt {
+			continue
+		}
+		f := NewLogFile(filepath.Join(p.path, filename))
+		if err := f.Open(p.execEntry); err != nil {
+			return err
+		}
+		// The grids of the earlier logs were sealed by a flush which did
+		// not complete, they are flushed again with the next one.
+		if p.logFile != nil {
+			p.sealedLogFiles = append(p.sealedLogFiles, p.logFile)
+		}
+		p.logFile = f
+		p.seq = maxInt(p.seq, f.ID())
+	}
+
+	for _, filename := range m.Files {
+		if filepath.Ext(filename) != IndexFileExt {
+			continue
+		}
+		f := NewIndexFile(filepath.Join(p.path, filename))
+		if err := f.Restore(); err != nil {
+			return err
+		}
+		p.indexFiles = append(p.indexFiles, f)
+		if err := p.measurements.AttachIndexFile(f); err != nil {
+			return err
+		}
+		p.seq = maxInt(p.seq, f.ID())
+	}
+
+	// Merge the sketches of the index files, the sketches of the
+	// log files are updated on replay.
+	if s, t, err := IndexFiles(p.indexFiles).SeriesSketches(); err != nil {
+		return err
+	} else if err := p.sSketch.Merge(s); err != nil {
+		return err
+	} else if err := p.sTSketch.Merge(t); err != nil {
+		return err
+	}
+	if s, t, err := IndexFiles(p.indexFiles).MeasurementsSketches(); err != nil {
+		return err
+	} else if err := p.mSketch.Merge(s); err != nil {
+		return err
+	} else if err := p.mTSketch.Merge(t); err != nil {
+		return err
+	}
+	p.seriesIDSet = p.measurements.SeriesIDSet()
+
+	// Delete any files not in the manifest.
+	if err := p.deleteNonManifestFiles(m); err != nil {
+		return err
+	}
+
+	// Complete a repack which was interrupted.
+	if err := p.reassignSeriesIDs(m); err != nil {
+		return err
+	}
+
+	// Ensure a log file exists.
+	if p.logFile == nil {
+		f, err := p.newLogFile(nil)
+		if err != nil {
+			return err
+		}
+		p.logFile = f
+		if _, err := p.manifest().Write(); err != nil {
+			return fmt.Errorf("manifest write failed for %q: %w", p.ManifestPath(), err)
+		}
+	}
+
+	p.opened = true
+
+	// Flush grids replayed from the log if there are too many of them.
+	p.checkInMemorySize()
+	return nil
+}
+
+// execEntry applies a log entry on replay of the log.
+func (p *Partition) execEntry(e *LogEntry) error {
+	if err := p.measurements.ExecEntry(e); err != nil {
+		return err
+	}
+	p.updateSketches(e)
+	return nil
+}
+
+// updateSketches adds the measurement or series of a log entry to the sketches.
+func (p *Partition) updateSketches(e *LogEntry) {
+	switch e.Flag {
+	case LogEntryMeasurementInsertFlag:
+		if len(e.Name) != 0 {
+			p.mSketch.Add(e.Name)
+		}
+	case LogEntryMeasurementTombstoneFlag:
+		p.mTSketch.Add(e.Name)
+	case LogEntrySeriesIDInsertFlag:
+		p.sSketch.Add(e.Key)
+	case LogEntrySeriesTombstoneFlag:
+		p.sTSketch.Add(e.Key)
+	}
+}
+
+// newLogFile creates the next log file, starting with entries.
+func (p *Partition) newLogFile(entries []LogEntry) (*LogFile, error) {
+	f := NewLogFile(filepath.Join(p.path, FormatLogFileName(p.nextSequence())))
+	if err := f.Open(func(e *LogEntry) error { return nil }); err != nil {
+		return nil, err
+	}
+	if err := f.AppendEntries(entries); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// manifest returns a manifest for the current index files and log files.
+func (p *Partition) manifest() *Manifest {
+	m := NewManifest(p.ManifestPath())
+	m.IDLayout = p.idLayout
+	for _, f := range p.indexFiles {
+		m.Files = append(m.Files, filepath.Base(f.Path()))
+	}
+	for _, f := range p.sealedLogFiles {
+		m.Files = append(m.Files, filepath.Base(f.Path()))
+	}
+	if p.logFile != nil {
+		m.Files = append(m.Files, filepath.Base(p.logFile.Path()))
+	}
+	return m
+}
+
+// ManifestPath returns the path to the partition's manifest file.
+func (p *Partition) ManifestPath() string {
+	return filepath.Join(p.path, ManifestFileName)
+}
+
+// deleteNonManifestFiles removes the index and log files not in the manifest.
+func (p *Partition) deleteNonManifestFiles(m *Manifest) error {
+	fis, err := os.ReadDir(p.path)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range fis {
+		filename := fi.Name()
+		if ext := filepath.Ext(filename); (ext != IndexFileExt && ext != LogFileExt) || m.HasFile(filename) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(p.path, filename)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wait blocks until all outstanding flushes have completed.
+func (p *Partition) Wait() {
+	p.wg.Wait()
+}
+
+func (p *Partition) Close() error {
+	// Wait for background flushes, which are skipped once the partition is closed.
+	p.mu.Lock()
+	p.opened = false
+	p.mu.Unlock()
+	p.wg.Wait()
+
+	// Wait for a flush or compaction in progress.
+	p.compactMu.Lock()
+	defer p.compactMu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closeFiles()
+}
+
+func (p *Partition) closeFiles() error {
+	var err error
+	if p.logFile != nil {
+		err = p.logFile.Close()
+		p.logFile = nil
+	}
+	for _, f := range p.sealedLogFiles {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	p.sealedLogFiles = nil
+	for _, f := range p.indexFiles {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	p.indexFiles = nil
+	p.seq = 0
+	return err
+}
+
+// Path returns the path of the partition.
+func (p *Partition) Path() string { return p.path }
+
+// MeasurementExists reads the registry of the measurements without locking.
+func (p *Partition) MeasurementExists(name []byte) (bool, error) {
+	gIndex, err := p.measurements.MeasurementByName(name)
+	if err != nil {
+		return false, err
+	}
+	if gIndex == nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// MeasurementNamesByRegex returns the names of the measurements matching re.
+// The names are read from the registry of the measurements without locking.
+func (p *Partition) MeasurementNamesByRegex(re *regexp.Regexp) ([][]byte, error) {
+	var res [][]byte
+	for _, m := range p.measurements.Names() {
+		if re.MatchString(m) {
+			// Clone bytes since they will be used after the fileset is released.
+			res = append(res, bytesutil.Clone([]byte(m)))
+		}
+	}
+	return res, nil
+}
+
+func (p *Partition) DropMeasurement(name []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dropMeasurement(name)
+}
+
+func (p *Partition) dropMeasurement(name []byte) error {
+	if err := p.checkFailed(); err != nil {
+		return err
+	}
+	m, err := p.measurements.MeasurementByName(name)
+	if err != nil || m == nil {
+		return err
+	}
+	entry := LogEntry{Flag: LogEntryMeasurementTombstoneFlag, Name: name}
+	if err := p.logFile.AppendEntries([]LogEntry{entry}); err != nil {
+		return err
+	}
+	p.updateSketches(&entry)
+	p.seriesIDSet.Diff(m.SeriesIDSet())
+	return p.measurements.DropMeasurement(name)
+}
+
+// createSeriesListIfNotExists adds the series of the measurements of the
+// partition to their grids, then to the series file with their grid ids.
+func (p *Partition) createSeriesListIfNotExists(keys, names [][]byte, tagsSlice []models.Tags) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.checkFailed(); err != nil {
+		return err
+	}
+
+	newIDs := make([]uint64, 0)
+	newNames := make([][]byte, 0)
+	newTagsSlice := make([]models.Tags, 0)
+	var entries []LogEntry
+	// An error stops the batch, the series created before it are still
+	// logged and added to the series file, as they are in the grids.
+	var batchErr error
+	for index := range names {
+		buf := make([]byte, 1024)
+		// 1. check if this seriesKey already exists in seriesFile
+		// todo(vinland): series file and index could have inconsistent series
+		if exist := p.sfile.HasSeries(names[index], tagsSlice[index], buf); !exist {
+			// 2. if not. add to grid index
+			m, created, err := p.measurements.CreateMeasurementIfNotExists(names[index])
+			if err != nil {
+				batchErr = err
+				break
+			}
+			if created {
+				entries = append(entries, LogEntry{Flag: LogEntryMeasurementInsertFlag, Name: names[index], MeasurementID: m.measurementID, Offset: m.gIndex.offset})
+			}
+			// The id is passed to the series file even if the grid holds it already,
+			// as the log could have been written without the series file.
+			id, es, err := m.setTags(tagsSlice[index])
+			if err != nil {
+				batchErr = err
+				break
+			}
+			for j := range es {
+				if es[j].Flag == LogEntrySeriesIDInsertFlag {
+					es[j].Key = keys[index]
+				}
+			}
+			entries = append(entries, es...)
+			newIDs = append(newIDs, id)
+			newTagsSlice = append(newTagsSlice, tagsSlice[index])
+			newNames = append(newNames, names[index])
+		}
+	}
+
+	// 3. write ahead to log file. The grids hold the series already, so
+	// that they would not be logged again on retry.
+	if err := p.logFile.AppendEntries(entries); err != nil {
+		p.failed = err
+		p.logger.Error("Cannot append to log file, refusing writes until reopened", zap.Error(err))
+		return err
+	}
+
+	for j := range entries {
+		p.updateSketches(&entries[j])
+	}
+
+	// 4. add to seriesFile
+	_, err := p.sfile.CreateSeriesListIfNotExistsWithDesignatedIDs(newNames, newTagsSlice, newIDs)
+	if err != nil {
+		return err
+	}
+	p.seriesIDSet.AddMany(newIDs...)
+
+	if len(entries) != 0 {
+		p.checkInMemorySize()
+	}
+	return batchErr
+}
+
+// checkFailed returns ErrPartitionFailed if the grids in memory are ahead of
+// the log. Must be called with the lock held.
+func (p *Partition) checkFailed() error {
+	if p.failed != nil {
+		return fmt.Errorf("partition %d: %w: %v", p.id, ErrPartitionFailed, p.failed)
+	}
+	return nil
+}
+
+// DropSeries removes the series from its grid in memory, or tombstones it if
+// the grid was flushed to an index file. With cascade, the measurement is
+// dropped along with its last series.
+func (p *Partition) DropSeries(seriesID uint64, key []byte, cascade bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.checkFailed(); err != nil {
+		return err
+	}
+	m := p.measurements.MeasurementBySeriesID(seriesID)
+	if m == nil || !m.hasSeriesID(seriesID) {
+		return nil
+	}
+	entry := LogEntry{Flag: LogEntrySeriesTombstoneFlag, Name: []byte(m.name), SeriesID: seriesID, Key: key}
+	if err := p.logFile.AppendEntries([]LogEntry{entry}); err != nil {
+		return err
+	}
+	p.updateSketches(&entry)
+	p.measurements.DropSeriesID(m, seriesID)
+	p.seriesIDSet.Remove(seriesID)
+
+	if !cascade || m.hasSeries() {
+		return nil
+	}
+	return p.dropMeasurement([]byte(m.name))
+}
+
+// DropMeasurementIfSeriesNotExist drops a measurement only if there are no more
+// series for the measurement.
+func (p *Partition) DropMeasurementIfSeriesNotExist(name []byte) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, err := p.measurements.MeasurementByName(name)
+	if err != nil || m == nil || m.hasSeries() {
+		return false, err
+	}
+	if err := p.dropMeasurement(name); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// MeasurementsSketches returns the two measurement sketches for the partition.
+func (p *Partition) MeasurementsSketches() (estimator.Sketch, estimator.Sketch, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.mSketch.Clone(), p.mTSketch.Clone(), nil
+}
+
+// SeriesSketches returns the two series sketches for the partition.
+func (p *Partition) SeriesSketches() (estimator.Sketch, estimator.Sketch, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.sSketch.Clone(), p.sTSketch.Clone(), nil
+}
+
+// SeriesIDSet returns the ids of all series in the partition.
+func (p *Partition) SeriesIDSet() *tsdb.SeriesIDSet {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.seriesIDSet.Clone()
+}
+
+// SeriesN returns the number of series in the partition.
+func (p *Partition) SeriesN() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return int64(p.seriesIDSet.Cardinality())
+}
+
+// SeriesByID returns the name and tags of the series, decoded from the
+// coordinates of its id in its grid, without reading the series file.
+// Returns a nil name if the series does not exist.
+func (p *Partition) SeriesByID(id uint64) ([]byte, models.Tags, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	m := p.measurements.MeasurementBySeriesID(id)
+	if m == nil {
+		return nil, nil, nil
+	}
+	tags, ok, err := m.seriesTags(id)
+	if err != nil || !ok {
+		return nil, nil, err
+	}
+	return []byte(m.name), tags, nil
+}
+
+func (p *Partition) HasTagKey(name, key []byte) (bool, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.measurements.HasTagKey(name, key)
+}
+func (p *Partition) HasTagValue(name, key, value []byte) (bool, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.measurements.HasTagValue(name, key, value)
+}
+
+// MeasurementTagKeysByExpr extracts the tag keys of the measurement wanted by the expression.
+func (p *Partition) MeasurementTagKeysByExpr(name []byte, expr influxql.Expr) (map[string]struct{}, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	m, err := p.measurements.MeasurementByName(name)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	return m.TagKeysByExpr(expr)
+}
+
+// TagKeyCardinality returns the number of distinct values of the tag key of
+// the measurement, or zero if it cannot be read.
+func (p *Partition) TagKeyCardinality(name, key []byte) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	m, err := p.measurements.MeasurementByName(name)
+	if err != nil || m == nil {
+		return 0
+	}
+	n, err := m.TagKeyCardinality(key)
+	if err != nil {
+		p.logger.Error("Cannot count tag values", zap.ByteString("measurement", name), zap.Error(err))
+		return 0
+	}
+	return n
+}
+
+// TagValueN returns the number of distinct values of each tag key of the measurement.
+func (p *Partition) TagValueN(name []byte) (map[string]int, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	m, err := p.measurements.MeasurementByName(name)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	return m.TagValueN()
+}
+
+func (p *Partition) TagKeyIterator(name []byte) (tsdb.TagKeyIterator, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	m, err := p.measurements.MeasurementByName(name)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	itr, err := m.TagKeyIterator()
+	if err != nil {
+		return nil, err
+	}
+	return itr, nil
+}
+
+func (p *Partition) TagValueIterator(name, key []byte) (tsdb.TagValueIterator, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	m, err := p.measurements.MeasurementByName(name)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	itr, err := m.TagValueIterator(key)
+	if err != nil {
+		return nil, err
+	}
+	return itr, nil
+}
+
+func (p *Partition) MeasurementSeriesIDIterator(name []byte) (tsdb.SeriesIDIterator, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.measurements.MeasurementSeriesIDIterator(name)
+}
+
+func (p *Partition) TagKeySeriesIDIterator(name, key []byte) (tsdb.SeriesIDIterator, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.measurements.TagKeySeriesIDIterator(name, key)
+}
+
+// TagValueSeriesIDIterator returns an iterator over the series of the
+// measurement whose value of the tag key is value. An empty value matches
+// the series without the key.
+func (p *Partition) TagValueSeriesIDIterator(name, key, value []byte) (tsdb.SeriesIDIterator, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.measurements.TagValueSeriesIDIterator(name, key, value)
+}
+
+// TagValueSetSeriesIDIterator returns an iterator over the series of the
+// measurement whose value of each key of set is one of the values of the key,
+// as in `host IN ('a', 'b') AND region = 'x'`. The disjunctions are computed
+// by the grids, without a lookup and a union for each value.
+func (p *Partition) TagValueSetSeriesIDIterator(name []byte, set TagValueSet) (tsdb.SeriesIDIterator, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.measurements.TagValueSetSeriesIDIterator(name, set)
+}
+
+// MatchTagValueSeriesIDIterator returns an iterator over the series of the
+// measurement whose value of the tag key matches the regex, or does not match
+// it if matches is false. Series without the key have an empty value.
+// Each grid filters the values of the key, then computes the matching
+// series at once, without a lookup and a merge for each value.
+func (p *Partition) MatchTagValueSeriesIDIterator(name, key []byte, value *regexp.Regexp, matches bool) (tsdb.SeriesIDIterator, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.measurements.MatchTagValueSeriesIDIterator(name, key, value, matches)
+}
+
+// TagValueNotEqualSeriesIDIterator returns an iterator over the series of the
+// measurement whose value of the tag key is not value, including the series
+// without the key. Each grid subtracts the coordinates of the value from its
+// series, instead of the series of the value being subtracted from all series
+// of the measurement.
+func (p *Partition) TagValueNotEqualSeriesIDIterator(name, key, value []byte) (tsdb.SeriesIDIterator, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.measurements.TagValueNotEqualSeriesIDIterator(name, key, value)
+}
+
+// Bytes estimates the memory footprint of this Partition, in bytes.
+func (p *Partition) Bytes() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var b int
+	b += 24 // mu RWMutex is 24 bytes
+	b += int(unsafe.Sizeof(p.id))
+	b += int(unsafe.Sizeof(p.measurements))
+	if p.measurements != nil {
+		b += p.measurements.bytes()
+	}
+	// Do not count ids because they are shared by the partitions of the index.
+	b += int(unsafe.Sizeof(p.ids))
+	// Nor tagValueCache.
+	b += int(unsafe.Sizeof(p.tagValueCache))
+	b += 8 // compactMu Mutex is 8 bytes
+	b += int(unsafe.Sizeof(p.logFile))
+	b += int(unsafe.Sizeof(p.sealedLogFiles))
+	b += int(unsafe.Sizeof(p.indexFiles))
+	for _, f := range p.indexFiles {
+		b += int(unsafe.Sizeof(f)) + f.bytes()
+	}
+	b += int(unsafe.Sizeof(p.seq))
+	b += int(unsafe.Sizeof(p.maxLevelFileN))
+	b += int(unsafe.Sizeof(p.maxLevelSize))
+	b += int(unsafe.Sizeof(p.maxInMemorySize))
+	b += int(unsafe.Sizeof(p.compacting))
+	b += 16 // wg WaitGroup is 16 bytes
+	b += int(unsafe.Sizeof(p.mSketch)) + p.mSketch.Bytes()
+	b += int(unsafe.Sizeof(p.mTSketch)) + p.mTSketch.Bytes()
+	b += int(unsafe.Sizeof(p.sSketch)) + p.sSketch.Bytes()
+	b += int(unsafe.Sizeof(p.sTSketch)) + p.sTSketch.Bytes()
+	b += int(unsafe.Sizeof(p.seriesIDSet)) + p.seriesIDSet.Bytes()
+	b += int(unsafe.Sizeof(p.logger))
+	// Do not count SeriesFile because it belongs to the code that constructed this Partition.
+	b += int(unsafe.Sizeof(p.sfile))
+	b += int(unsafe.Sizeof(p.idLayout))
+	b += int(unsafe.Sizeof(p.gridOptimizer)) + len(p.gridOptimizer)
+	b += int(unsafe.Sizeof(p.path)) + len(p.path)
+	b += int(unsafe.Sizeof(p.opened))
+	return b
+}
+
+// DiskSizeBytes returns the size of the index files and log files of the
+// partition, in bytes.
+func (p *Partition) DiskSizeBytes() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	n := IndexFiles(p.indexFiles).Size()
+	for _, f := range p.sealedLogFiles {
+		n += f.Size()
+	}
+	if p.logFile != nil {
+		n += p.logFile.Size()
+	}
+	return n
+}
+
+// Compact flushes the grids in memory to a new index file of level 1.
+// The grids are released from memory afterwards and the log file is
+// replaced by a new one, which starts with the measurements.
+func (p *Partition) Compact(id int) error {
+	p.compactMu.Lock()
+	defer p.compactMu.Unlock()
+	return p.compact(id)
+}
+
+// checkInMemorySize starts a flush in the background once the grids in
+// memory reach maxInMemorySize. Must be called with the lock held.
+func (p *Partition) checkInMemorySize() {
+	if p.compacting || p.maxInMemorySize <= 0 || int64(p.measurements.gridBytes()) < p.maxInMemorySize {
+		return
+	}
+
+	p.compacting = true
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		p.compactMu.Lock()
+		defer p.compactMu.Unlock()
+
+		p.mu.Lock()
+		p.compacting = false
+		// The partition could be closed, or flushed by hand, in the meantime.
+		if !p.opened || int64(p.measurements.gridBytes()) < p.maxInMemorySize {
+			p.mu.Unlock()
+			return
+		}
+		id := p.nextSequence()
+		p.mu.Unlock()
+
+		if err := p.compact(id); err != nil {
+			p.logger.Error("Cannot flush grids to index file", zap.Error(err))
+		}
+	}()
+}
+
+// compact flushes the grids in memory to a new index file, then compacts the
+// levels of index files. The lock is only held to seal the grids and to swap
+// the files, the files are written without it.
+// Must be called with compactMu held, and without the lock.
+func (p *Partition) compact(id int) error {
+	start := time.Now()
+
+	log, logEnd := logger.NewOperation(context.TODO(), p.logger, "TSI2 compaction", "tsi2_compact", zap.Int("tsi2_id", id))
+	defer logEnd()
+
+	p.mu.Lock()
+	s, err := p.sealGrids(id)
+	p.mu.Unlock()
+	if err != nil {
+		log.Error("Cannot seal grids", zap.Error(err))
+		return err
+	}
+
+	ifile, n, err := p.writeIndexFile(s, log)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	err = p.commitFlush(s, ifile, log)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	elapsed := time.Since(start)
+	log.Info("index compacted",
+		logger.DurationLiteral("elapsed", elapsed),
+		zap.Int64("bytes", n),
+		zap.Int("kb_per_sec", int(float64(n)/elapsed.Seconds())/1024),
+	)
+
+	return p.compactLevels()
+}
+
+// flush works as compact, without compacting the levels, while holding the
+// lock throughout. Must be called with compactMu and the lock held.
+func (p *Partition) flush(id int) error {
+	log, logEnd := logger.NewOperation(context.TODO(), p.logger, "TSI2 compaction", "tsi2_compact", zap.Int("tsi2_id", id))
+	defer logEnd()
+
+	s, err := p.sealGrids(id)
+	if err != nil {
+		log.Error("Cannot seal grids", zap.Error(err))
+		return err
+	}
+	ifile, _, err := p.writeIndexFile(s, log)
+	if err != nil {
+		return err
+	}
+	return p.commitFlush(s, ifile, log)
+}
+
+// sealGrids seals the grids in memory for a flush to the index file id, and
+// starts a new log file for the series added in the meantime. The manifest
+// keeps the log files of the sealed grids until they are flushed, so that
+// they are replayed if the flush does not complete.
+// Must be called with the lock held.
+func (p *Partition) sealGrids(id int) (*gridSnapshot, error) {
+	// The grids in memory of a failed partition must not outlive the log.
+	if err := p.checkFailed(); err != nil {
+		return nil, err
+	}
+	p.seq = maxInt(p.seq, id)
+
+	// Start a new log file with the measurements.
+	logFile, err := p.newLogFile(p.measurements.LogEntries())
+	if err != nil {
+		return nil, err
+	}
+	p.sealedLogFiles = append(p.sealedLogFiles, p.logFile)
+	p.logFile = logFile
+	if _, err := p.manifest().Write(); err != nil {
+		p.logFile = p.sealedLogFiles[len(p.sealedLogFiles)-1]
+		p.sealedLogFiles = p.sealedLogFiles[:len(p.sealedLogFiles)-1]
+		logFile.Close()
+		os.Remove(logFile.Path())
+		return nil, err
+	}
+
+	s := p.snapshot()
+	s.id = id
+	s.measurements, s.tombstones = p.measurements.seal()
+	return s, nil
+}
+
+// writeIndexFile writes the sealed grids to a new index file, and opens it.
+// The lock is not needed.
+func (p *Partition) writeIndexFile(s *gridSnapshot, log *zap.Logger) (*IndexFile, int64, error) {
+	path := filepath.Join(p.path, FormatIndexFileName(s.id, 1))
+	f, err := os.Create(path)
+	if err != nil {
+		log.Error("Cannot create index file", zap.Error(err))
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	n, err := s.writeTo(f)
+	if err != nil {
+		log.Error("Cannot compact index", zap.Error(err))
+		os.Remove(path)
+		return nil, n, err
+	}
+
+	if err = f.Sync(); err != nil {
+		log.Error("Cannot sync index file", zap.Error(err))
+		os.Remove(path)
+		return nil, n, err
+	}
+
+	// Close file.
+	if err := f.Close(); err != nil {
+		log.Error("Cannot close index file", zap.Error(err))
+		os.Remove(path)
+		return nil, n, err
+	}
+
+	// Reopen as an index file.
+	ifile := NewIndexFile(path)
+	if err := ifile.Restore(); err != nil {
+		log.Error("Cannot open new index file", zap.Error(err))
+		os.Remove(path)
+		return nil, n, err
+	}
+	return ifile, n, nil
+}
+
+// commitFlush adds the index file of the sealed grids to the manifest, in
+// place of the log files of the sealed grids, and releases the grids.
+// Must be called with the lock held.
+func (p *Partition) commitFlush(s *gridSnapshot, ifile *IndexFile, log *zap.Logger) error {
+	logFiles := p.sealedLogFiles
+	p.sealedLogFiles = nil
+	p.indexFiles = append(p.indexFiles, ifile)
+	if _, err := p.manifest().Write(); err != nil {
+		log.Error("Cannot write manifest", zap.Error(err))
+		p.sealedLogFiles = logFiles
+		p.indexFiles = p.indexFiles[:len(p.indexFiles)-1]
+		ifile.Close()
+		os.Remove(ifile.Path())
+		return err
+	}
+
+	// The grids are served by the index file from now on.
+	p.measurements.releaseSealed(s.measurements, s.tombstones)
+	if err := p.measurements.AttachIndexFile(ifile); err != nil {
+		return err
+	}
+
+	for _, f := range logFiles {
+		if err := f.Close(); err != nil {
+			log.Error("Cannot close log file", zap.Error(err))
+			return err
+		} else if err := os.Remove(f.Path()); err != nil {
+			log.Error("Cannot remove log file", zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// compactLevels merges the index files of each level into the next level,
+// when there are too many of them or they are too large. The files are
+// merged without the lock. Must be called with compactMu held, and without
+// the lock.
+func (p *Partition) compactLevels() error {
+	for level := 1; level < MaxIndexFileLevel; level++ {
+		p.mu.Lock()
+		files := p.levelFiles(level)
+		if len(files) < 2 {
+			p.mu.Unlock()
+			continue
+		} else if len(files) < p.maxLevelFileN && files.Size() < p.maxLevelSize<<(2*(level-1)) {
+			p.mu.Unlock()
+			continue
+		}
+		id, tombstones := p.nextSequence(), p.measurements.tombstoneSeriesIDSet()
+		p.mu.Unlock()
+
+		log, logEnd := logger.NewOperation(context.TODO(), p.logger, "TSI2 level compaction", "tsi2_compact_to_level", zap.Int("tsi2_level", level+1))
+		start := time.Now()
+		file, n, err := p.writeLevelFile(files, level+1, id, tombstones, log)
+		if err == nil {
+			p.mu.Lock()
+			err = p.commitLevelFile(files, file, log)
+			p.mu.Unlock()
+		}
+		if err == nil {
+			p.logLevelCompaction(log, file, n, start)
+		}
+		logEnd()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// levelFiles returns the index files of the level. Must be called with the lock held.
+func (p *Partition) levelFiles(level int) IndexFiles {
+	var files IndexFiles
+	for _, f := range p.indexFiles {
+		if f.Level() == level {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// compactToLevel merges files into a new index file of the given level.
+// Must be called with compactMu and the lock held.
+func (p *Partition) compactToLevel(files IndexFiles, level int) error {
+	// Build a logger for this compaction.
+	log, logEnd := logger.NewOperation(context.TODO(), p.logger, "TSI2 level compaction", "tsi2_compact_to_level", zap.Int("tsi2_level", level))
+	defer logEnd()
+
+	// Track time to compact.
+	start := time.Now()
+
+	file, n, err := p.writeLevelFile(files, level, p.nextSequence(), p.measurements.tombstoneSeriesIDSet(), log)
+	if err != nil {
+		return err
+	} else if err := p.commitLevelFile(files, file, log); err != nil {
+		return err
+	}
+	p.logLevelCompaction(log, file, n, start)
+	return nil
+}
+
+// writeLevelFile merges files into the new index file id of the given level,
+// dropping the deleted measurements and series. The lock is not needed.
+func (p *Partition) writeLevelFile(files IndexFiles, level, id int, tombstones *tsdb.SeriesIDSet, log *zap.Logger) (*IndexFile, int64, error) {
+	// Create new index file.
+	path := filepath.Join(p.path, FormatIndexFileName(id, level))
+	f, err := os.Create(path)
+	if err != nil {
+		log.Error("Cannot create compaction files", zap.Error(err))
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	log.Info("Performing full compaction",
+		zap.Ints("src", files.IDs()),
+		zap.String("dst", path),
+	)
+
+	// Compact all index files to new index file, dropping deleted measurements and series.
+	n, err := files.CompactTo(f, p.measurements.hasMeasurement, tombstones)
+	if err != nil {
+		log.Error("Cannot compact index files", zap.Error(err))
+		os.Remove(path)
+		return nil, n, err
+	}
+
+	if err = f.Sync(); err != nil {
+		log.Error("Error sync index file", zap.Error(err))
+		os.Remove(path)
+		return nil, n, err
+	}
+
+	// Close file.
+	if err := f.Close(); err != nil {
+		log.Error("Error closing index file", zap.Error(err))
+		os.Remove(path)
+		return nil, n, err
+	}
+
+	// Reopen as an index file.
+	file := NewIndexFile(path)
+	if err := file.Restore(); err != nil {
+		log.Error("Cannot open new index file", zap.Error(err))
+		os.Remove(path)
+		return nil, n, err
+	}
+	return file, n, nil
+}
+
+// commitLevelFile replaces files with the merged index file, in place of the
+// first one. Must be called with the lock held.
+func (p *Partition) commitLevelFile(files IndexFiles, file *IndexFile, log *zap.Logger) error {
+	prev := p.indexFiles
+	p.indexFiles = make([]*IndexFile, 0, len(prev)-len(files)+1)
+	for _, f := range prev {
+		if f == files[0] {
+			p.indexFiles = append(p.indexFiles, file)
+		} else if !files.contains(f) {
+			p.indexFiles = append(p.indexFiles, f)
+		}
+	}
+
+	// Write new manifest.
+	if _, err := p.manifest().Write(); err != nil {
+		log.Error("Cannot write manifest", zap.Error(err))
+		p.indexFiles = prev
+		file.Close()
+		os.Remove(file.Path())
+		return err
+	}
+
+	if err := p.measurements.ReplaceIndexFiles(files, file); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err := f.Close(); err != nil {
+			log.Error("Cannot close index file", zap.Error(err))
+			return err
+		} else if err := os.Remove(f.Path()); err != nil {
+			log.Error("Cannot remove index file", zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// logLevelCompaction logs the completion of a level compaction.
+func (p *Partition) logLevelCompaction(log *zap.Logger, file *IndexFile, n int64, start time.Time) {
+	elapsed := time.Since(start)
+	log.Info("Full compaction complete",
+		zap.String("path", file.Path()),
+		logger.DurationLiteral("elapsed", elapsed),
+		zap.Int64("bytes", n),
+		zap.Int("kb_per_sec", int(float64(n)/elapsed.Seconds())/1024),
+	)
+}
+
+// nextSequence returns the next file identifier.
+func (p *Partition) nextSequence() int {
+	p.seq++
+	return p.seq
+}
+
+// gridSnapshot holds what a flush writes to an index file: the grids in
+// memory, sealed so that they do not change while the file is written
+// without the lock, the tombstones and a copy of the sketches.
+type gridSnapshot struct {
+	id     int // file id
+	layout IDLayout
+
+	measurements map[string]sealedGrids
+	tombstones   *tsdb.SeriesIDSet
+
+	sSketch, sTSketch estimator.Sketch
+	mSketch, mTSketch estimator.Sketch
+}
+
+// snapshot returns a snapshot of the partition without grids.
+// Must be called with the lock held.
+func (p *Partition) snapshot() *gridSnapshot {
+	return &gridSnapshot{
+		layout:   p.idLayout,
+		sSketch:  p.sSketch.Clone(),
+		sTSketch: p.sTSketch.Clone(),
+		mSketch:  p.mSketch.Clone(),
+		mTSketch: p.mTSketch.Clone(),
+	}
+}
+
+// CompactTo compacts the in-memory index and writes it to w.
+func (p *Partition) CompactTo(w io.Writer) (n int64, err error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	s, err := p.memorySnapshot()
+	if err != nil {
+		return 0, err
+	}
+	return s.writeTo(w)
+}
+
+// memorySnapshot returns a snapshot of all grids in memory, without sealing
+// them. Must be called with the lock held.
+func (p *Partition) memorySnapshot() (*gridSnapshot, error) {
+	s := p.snapshot()
+	s.measurements = map[string]sealedGrids{}
+	for _, name := range p.measurements.Names() {
+		m, err := p.measurements.MeasurementByName([]byte(name))
+		if err != nil {
+			return nil, err
+		} else if m == nil {
+			continue
+		}
+		s.measurements[name] = sealedGrids{m: m, grids: m.gIndex.allGrids()}
+	}
+	s.tombstones = p.measurements.tombstones
+	return s, nil
+}
+
+// writeTo writes the snapshot to w in the index file format.
+func (s *gridSnapshot) writeTo(w io.Writer) (n int64, err error) {
+	// Checksum the file as it is written.
+	cw := newChecksumWriter(w)
+
+	// Wrap in bufferred writer with a buffer equivalent to the LogFile size.
+	bw := bufio.NewWriterSize(cw, indexFileBufferSize) // 128K
+
+	// Setup compaction offset tracking data.
+	t := IndexFileTrailer{IDLayout: s.layout}
+	info := NewIndexFileCompactInfo()
+
+	// Write magic number.
+	if err := writeTo(bw, []byte(FileSignature), &n); err != nil {
+		return n, err
+	}
+
+	// Retreve measurement names in order.
+	names := make([]string, 0, len(s.measurements))
+	for name := range s.measurements {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Flush buffer & mmap series block.
+	// todo(vinland): series block?
+	if err := bw.Flush(); err != nil {
+		return n, err
+	}
+
+	// Write grid blocks in measurement order.
+	if err := s.writeGridBlockTo(bw, names, info, &n); err != nil {
+		return n, err
+	}
+
+	// Checksum the signature and the grid block.
+	if err := bw.Flush(); err != nil {
+		return n, err
+	}
+	t.GridBlockChecksum = cw.reset()
+
+	// Write measurement block.
+	t.MeasurementBlock.Offset = n
+	if err := s.writeMeasurementBlockTo(bw, names, info, &n); err != nil {
+		return n, err
+	}
+	t.MeasurementBlock.Size = n - t.MeasurementBlock.Offset
+
+	// Write the tombstones of the series dropped since the last flush.
+	t.TombstoneSeriesIDSet.Offset = n
+	nn, err := s.tombstones.WriteTo(bw)
+	n += nn
+	if err != nil {
+		return n, err
+	}
+	t.TombstoneSeriesIDSet.Size = n - t.TombstoneSeriesIDSet.Offset
+
+	// Write the sketches of the whole partition.
+	if err := writeSketchesTo(bw, &t, s.sSketch, s.sTSketch, s.mSketch, s.mTSketch, &n); err != nil {
+		return n, err
+	}
+
+	// Write trailer, with the checksum of the file since the grid block.
+	if err := bw.Flush(); err != nil {
+		return n, err
+	}
+	t.Checksum = t.checksum(cw.reset())
+	nn, err = t.WriteTo(bw)
+	n += nn
+	if err != nil {
+		return n, err
+	}
+
+	// Flush buffer.
+	if err := bw.Flush(); err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
+
+// MeasurementNames returns the sorted names of the measurements of the partition.
+// The names are read from the registry of the measurements without locking.
+func (p *Partition) MeasurementNames() []string {
+	return p.measurements.Names()
+}
+
+// WriteGridBlockTo writes the grids in memory of the measurements to w.
+func (p *Partition) WriteGridBlockTo(w io.Writer, names []string, info *IndexFileCompactInfo, n *int64) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	s, err := p.memorySnapshot()
+	if err != nil {
+		return err
+	}
+	return s.writeGridBlockTo(w, names, info, n)
+}
+
+func (s *gridSnapshot) writeGridBlockTo(w io.Writer, names []string, info *IndexFileCompactInfo, n *int64) error {
+	for _, name := range names {
+		if err := s.writeGridsForMeasurementTo(w, name, info, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeGridsForMeasurementTo writes a single tagset to w and saves the tagset offset.
+func (s *gridSnapshot) writeGridsForMeasurementTo(w io.Writer, name string, info *IndexFileCompactInfo, n *int64) error {
+	mm, ok := s.measurements[name]
+	if !ok {
+		return ErrMeasurementNotFound
+	}
+
+	// Save tagset offset to measurement.
+	offset := *n
+
+	// Write the dictionary of the tag keys and values of the grids.
+	dw := NewGridDictionaryWriter()
+	for _, grid := range mm.grids {
+		dw.AddGrid(grid)
+	}
+	dictionary := GridCompactInfo{offset: *n}
+	nn, err := dw.WriteTo(w)
+	*n += nn
+	if err != nil {
+		return err
+	}
+	dictionary.size = *n - dictionary.offset
+
+	enc := NewGridBlockEncoder(w, dw)
+	tw := NewTagBlockWriter()
+	gridInfos := make([]*GridCompactInfo, 0, len(mm.grids))
+	for _, grid := range mm.grids {
+		gridInfo := &GridCompactInfo{offset: *n + enc.n}
+		err = enc.EncodeGrid(grid)
+		if err != nil {
+			return err
+		}
+		gridInfo.size = *n + enc.n - gridInfo.offset
+		gridInfos = append(gridInfos, gridInfo)
+		tw.AddGrid(grid)
+	}
+	*n += enc.N()
+
+	// Write the tag block of the grids.
+	tagBlock := GridCompactInfo{offset: *n}
+	nn, err = tw.WriteTo(w)
+	*n += nn
+	if err != nil {
+		return err
+	}
+	tagBlock.size = *n - tagBlock.offset
+
+	// Save tagset offset to measurement.
+	size := *n - offset
+
+	info.Mms[name] = &IndexFileMeasurementCompactInfo{Offset: offset, Size: size, gridInfos: gridInfos, MeasurementID: mm.m.measurementID, tagBlock: tagBlock, dictionary: dictionary}
+
+	return nil
+}
+
+// WriteMeasurementBlockTo writes the measurement block locating the grids
+// written by WriteGridBlockTo to w.
+func (p *Partition) WriteMeasurementBlockTo(w io.Writer, names []string, info *IndexFileCompactInfo, n *int64) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	s, err := p.memorySnapshot()
+	if err != nil {
+		return err
+	}
+	return s.writeMeasurementBlockTo(w, names, info, n)
+}
+
+func (s *gridSnapshot) writeMeasurementBlockTo(w io.Writer, names []string, info *IndexFileCompactInfo, n *int64) error {
+	mw := NewMeasurementBlockWriter()
+
+	// Add measurement data.
+	for _, name := range names {
+		mmInfo := info.Mms[name]
+		if mmInfo == nil {
+			return ErrMeasurementNotFound
+		}
+		// The ids of the series in the grids, without the measurement id.
+		seriesIDSet := tsdb.NewSeriesIDSet()
+		for _, grid := range s.measurements[name].grids {
+			seriesIDSet.MergeInPlace(grid.GetSeriesIDSetForTags(nil))
+		}
+		mw.Add([]byte(name), mmInfo, seriesIDSet)
+	}
+
+	// Flush data to writer.
+	nn, err := mw.WriteTo(w)
+	*n += nn
+	return err
+}
@@ -0,0 +1,337 @@
+package tsi2
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/influxdata/influxdb/v2/models"
+	"github.com/stretchr/testify/assert"
+
+	"cycledb/pkg/tsdb"
+)
+
+// Ensure a partition whose log cannot be written refuses writes until it is
+// reopened, and does not lose the series it could not log.
+func TestPartition_FailedLogAppend(t *testing.T) {
+	sfile := tsdb.NewSeriesFile(t.TempDir())
+	assert.NoError(t, sfile.Open())
+	t.Cleanup(func() { sfile.Close() })
+
+	p := NewPartition(sfile, t.TempDir())
+	assert.NoError(t, p.Open())
+	t.Cleanup(func() { p.Close() })
+
+	create := func(name string, m map[string]string) error {
+		tags := models.NewTags(m)
+		return p.createSeriesListIfNotExists([][]byte{models.MakeKey([]byte(name), tags)}, [][]byte{[]byte(name)}, []models.Tags{tags})
+	}
+	assert.NoError(t, create("cpu", map[string]string{"host": "a"}))
+
+	// Break the log file underneath the partition.
+	assert.NoError(t, p.logFile.file.Close())
+	assert.Error(t, create("cpu", map[string]string{"host": "b"}))
+	assert.ErrorIs(t, create("cpu", map[string]string{"host": "b"}), ErrPartitionFailed)
+	assert.ErrorIs(t, p.DropMeasurement([]byte("cpu")), ErrPartitionFailed)
+	assert.ErrorIs(t, p.Compact(p.nextSequence()), ErrPartitionFailed)
+	assert.False(t, sfile.HasSeries([]byte("cpu"), models.NewTags(map[string]string{"host": "b"}), nil))
+
+	// Reopening replays the log, and the series can be written again.
+	p.Close()
+	p = NewPartition(sfile, p.Path())
+	assert.NoError(t, p.Open())
+	assert.NoError(t, create("cpu", map[string]string{"host": "b"}))
+	assert.Equal(t, int64(2), p.SeriesN())
+	assert.True(t, sfile.HasSeries([]byte("cpu"), models.NewTags(map[string]string{"host": "b"}), nil))
+}
+
+// Ensure a series dropped from a sealed grid gets a new id when it is written
+// again before the flush completes.
+func TestPartition_RecreateSealedSeries(t *testing.T) {
+	sfile := tsdb.NewSeriesFile(t.TempDir())
+	assert.NoError(t, sfile.Open())
+	t.Cleanup(func() { sfile.Close() })
+
+	p := NewPartition(sfile, t.TempDir())
+	assert.NoError(t, p.Open())
+	t.Cleanup(func() { p.Close() })
+
+	name, tags := []byte("cpu"), models.NewTags(map[string]string{"host": "a"})
+	key := models.MakeKey(name, tags)
+	create := func() uint64 {
+		assert.NoError(t, p.createSeriesListIfNotExists([][]byte{key}, [][]byte{name}, []models.Tags{tags}))
+		return sfile.SeriesID(name, tags, nil)
+	}
+	id := create()
+
+	p.mu.Lock()
+	s, err := p.sealGrids(p.nextSequence())
+	p.mu.Unlock()
+	assert.NoError(t, err)
+	assert.NoError(t, p.DropSeries(id, key, false))
+	assert.NoError(t, sfile.DeleteSeriesID(id))
+	newID := create()
+	assert.NotContains(t, []uint64{0, id}, newID)
+
+	ifile, _, err := p.writeIndexFile(s, p.logger)
+	assert.NoError(t, err)
+	p.mu.Lock()
+	assert.NoError(t, p.commitFlush(s, ifile, p.logger))
+	p.mu.Unlock()
+	assert.Equal(t, newID, create())
+	assert.Equal(t, []uint64{newID}, p.seriesIDSet.Slice())
+}
+
+// Ensure the series written while a flush is in progress are kept, whether
+// the flush completes or the partition is closed before it does.
+func TestPartition_SealedGrids(t *testing.T) {
+	sfile := tsdb.NewSeriesFile(t.TempDir())
+	assert.NoError(t, sfile.Open())
+	t.Cleanup(func() { sfile.Close() })
+
+	p := NewPartition(sfile, t.TempDir())
+	assert.NoError(t, p.Open())
+	t.Cleanup(func() { p.Close() })
+
+	create := func(name string, m map[string]string) {
+		tags := models.NewTags(m)
+		assert.NoError(t, p.createSeriesListIfNotExists([][]byte{models.MakeKey([]byte(name), tags)}, [][]byte{[]byte(name)}, []models.Tags{tags}))
+	}
+	seriesIDs := func(name string) []uint64 {
+		itr, err := p.MeasurementSeriesIDIterator([]byte(name))
+		assert.NoError(t, err)
+		var ids []uint64
+		for e, err := itr.Next(); e.SeriesID != 0; e, err = itr.Next() {
+			assert.NoError(t, err)
+			ids = append(ids, e.SeriesID)
+		}
+		return ids
+	}
+	create("cpu", map[string]string{"host": "a"})
+	create("cpu", map[string]string{"host": "b"})
+
+	// Seal the grids as a flush does, then write while the file is not written.
+	seal := func() *gridSnapshot {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		s, err := p.sealGrids(p.nextSequence())
+		assert.NoError(t, err)
+		return s
+	}
+	s := seal()
+	create("cpu", map[string]string{"host": "c"})
+	create("mem", map[string]string{"host": "a"})
+	assert.NoError(t, p.DropSeries(seriesIDs("cpu")[0], models.MakeKey([]byte("cpu"), models.NewTags(map[string]string{"host": "a"})), false))
+	cpu, mem := seriesIDs("cpu"), seriesIDs("mem")
+	assert.Len(t, cpu, 2)
+	assert.Len(t, mem, 1)
+
+	// The partition is closed before the flush completes, the logs of the
+	// sealed grids are replayed.
+	assert.NoError(t, p.Close())
+	p = NewPartition(sfile, p.Path())
+	assert.NoError(t, p.Open())
+	assert.Len(t, p.sealedLogFiles, 1)
+	assert.Equal(t, cpu, seriesIDs("cpu"))
+	assert.Equal(t, mem, seriesIDs("mem"))
+	create("cpu", map[string]string{"host": "d"})
+	cpu = seriesIDs("cpu")
+	assert.Len(t, cpu, 3)
+
+	// A completed flush serves the sealed grids from the index file.
+	s = seal()
+	create("cpu", map[string]string{"host": "e"})
+	ifile, _, err := p.writeIndexFile(s, p.logger)
+	assert.NoError(t, err)
+	p.mu.Lock()
+	assert.NoError(t, p.commitFlush(s, ifile, p.logger))
+	p.mu.Unlock()
+	assert.Empty(t, p.sealedLogFiles)
+	cpu = seriesIDs("cpu")
+	assert.Len(t, cpu, 4)
+	assert.Equal(t, mem, seriesIDs("mem"))
+
+	assert.NoError(t, p.Close())
+	p = NewPartition(sfile, p.Path())
+	assert.NoError(t, p.Open())
+	assert.Equal(t, cpu, seriesIDs("cpu"))
+	assert.Equal(t, mem, seriesIDs("mem"))
+	assert.NoError(t, p.Compact(p.nextSequence()))
+	assert.Equal(t, cpu, seriesIDs("cpu"))
+	assert.Equal(t, mem, seriesIDs("mem"))
+}
+
+// Ensure series can be written and queried while a flush is written.
+func TestPartition_CompactConcurrentWrites(t *testing.T) {
+	sfile := tsdb.NewSeriesFile(t.TempDir())
+	assert.NoError(t, sfile.Open())
+	t.Cleanup(func() { sfile.Close() })
+
+	p := NewPartition(sfile, t.TempDir())
+	assert.NoError(t, p.Open())
+	t.Cleanup(func() { p.Close() })
+
+	create := func(name string, i int) error {
+		tags := models.NewTags(map[string]string{"host": fmt.Sprint(i), "region": fmt.Sprint(i % 3)})
+		return p.createSeriesListIfNotExists([][]byte{models.MakeKey([]byte(name), tags)}, [][]byte{[]byte(name)}, []models.Tags{tags})
+	}
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, create("cpu", i))
+	}
+
+	done := make(chan error)
+	go func() {
+		for j := 0; j < 5; j++ {
+			if err := p.Compact(1000 + j); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 100; i < 300; i++ {
+		assert.NoError(t, create("cpu", i))
+		assert.NoError(t, create("mem", i))
+		_, err := p.TagValueIterator([]byte("cpu"), []byte("host"))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, <-done)
+	assert.NoError(t, p.Compact(2000))
+	assert.Equal(t, int64(500), p.SeriesN())
+
+	assert.NoError(t, p.Close())
+	p = NewPartition(sfile, p.Path())
+	assert.NoError(t, p.Open())
+	assert.Equal(t, int64(500), p.SeriesN())
+}
+
+// Ensure a repack gives its series ids which no series of the series file
+// had, when the series file is shared with another index.
+func TestIndex_RepackSharedSeriesFile(t *testing.T) {
+	sfile := tsdb.NewSeriesFile(t.TempDir())
+	assert.NoError(t, sfile.Open())
+	t.Cleanup(func() { sfile.Close() })
+
+	open := func(path string) *Index {
+		idx := NewIndex(sfile, "db0", WithPath(path), WithPartitionN(1))
+		assert.NoError(t, idx.Open())
+		return idx
+	}
+	a, b := open(t.TempDir()), open(t.TempDir())
+	t.Cleanup(func() { a.Close(); b.Close() })
+
+	create := func(idx *Index, name string, n int) []models.Tags {
+		var keys, names [][]byte
+		var tagsSlice []models.Tags
+		for i := 0; i < n; i++ {
+			tags := models.NewTags(map[string]string{"host": fmt.Sprint(i), "region": fmt.Sprint(i % 2)})
+			keys = append(keys, models.MakeKey([]byte(name), tags))
+			names = append(names, []byte(name))
+			tagsSlice = append(tagsSlice, tags)
+		}
+		assert.NoError(t, idx.CreateSeriesListIfNotExists(keys, names, tagsSlice))
+		return tagsSlice
+	}
+	seriesIDs := func(name string, tagsSlice []models.Tags) []uint64 {
+		ids := make([]uint64, len(tagsSlice))
+		for i, tags := range tagsSlice {
+			ids[i] = sfile.SeriesID([]byte(name), tags, nil)
+			assert.NotZero(t, ids[i])
+		}
+		return ids
+	}
+
+	// The series of b take the measurement id which a would give to cpu next.
+	cpu := create(a, "cpu", 20)
+	_, ok := b.ids.next(0, b.idLayout.MaxMeasurementID())
+	assert.True(t, ok)
+	mem := create(b, "mem", 10)
+	cpuIDs, memIDs := seriesIDs("cpu", cpu), seriesIDs("mem", mem)
+
+	remap, err := a.Repack([]byte("cpu"))
+	assert.NoError(t, err)
+	assert.Len(t, remap, len(cpu))
+
+	// The new ids were never given, and the previous ones are deleted.
+	newIDs := seriesIDs("cpu", cpu)
+	for i, id := range cpuIDs {
+		assert.Equal(t, remap[id], newIDs[i])
+		assert.NotContains(t, memIDs, newIDs[i])
+		assert.NotContains(t, cpuIDs, newIDs[i])
+		assert.True(t, sfile.IsDeleted(id))
+	}
+
+	// The series of b are left as they are.
+	check := func() {
+		t.Helper()
+		assert.Equal(t, memIDs, seriesIDs("mem", mem))
+		itr, err := b.MeasurementSeriesIDIterator([]byte("mem"))
+		assert.NoError(t, err)
+		ids := tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet()
+		assert.Equal(t, tsdb.NewSeriesIDSet(memIDs...).Slice(), ids.Slice())
+
+		itr, err = a.MeasurementSeriesIDIterator([]byte("cpu"))
+		assert.NoError(t, err)
+		ids = tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet()
+		assert.Equal(t, tsdb.NewSeriesIDSet(newIDs...).Slice(), ids.Slice())
+	}
+	check()
+
+	assert.NoError(t, a.Close())
+	assert.NoError(t, b.Close())
+	a, b = open(a.Path()), open(b.Path())
+	check()
+}
+
+// Ensure a repack interrupted once the manifest lists the new files gives
+// the series file the new ids when the partition is opened again.
+func TestPartition_RepackRecovery(t *testing.T) {
+	sfile := tsdb.NewSeriesFile(t.TempDir())
+	assert.NoError(t, sfile.Open())
+	t.Cleanup(func() { sfile.Close() })
+
+	p := NewPartition(sfile, t.TempDir())
+	assert.NoError(t, p.Open())
+	t.Cleanup(func() { p.Close() })
+
+	var keys, names [][]byte
+	var tagsSlice []models.Tags
+	for i := 0; i < 20; i++ {
+		tags := models.NewTags(map[string]string{"host": fmt.Sprint(i)})
+		keys = append(keys, models.MakeKey([]byte("cpu"), tags))
+		names = append(names, []byte("cpu"))
+		tagsSlice = append(tagsSlice, tags)
+	}
+	assert.NoError(t, p.createSeriesListIfNotExists(keys, names, tagsSlice))
+	oldIDs := make([]uint64, len(tagsSlice))
+	for i, tags := range tagsSlice {
+		oldIDs[i] = sfile.SeriesID([]byte("cpu"), tags, nil)
+	}
+
+	// The series file cannot be given the new ids.
+	assert.NoError(t, sfile.Close())
+	_, err := p.Repack()
+	assert.ErrorIs(t, err, tsdb.ErrSeriesPartitionClosed)
+	assert.ErrorIs(t, p.Compact(p.nextSequence()), ErrPartitionFailed)
+	assert.FileExists(t, filepath.Join(p.Path(), ReassignFileName))
+
+	assert.NoError(t, sfile.Open())
+	assert.NoError(t, p.Close())
+	p = NewPartition(sfile, p.Path())
+	assert.NoError(t, p.Open())
+	assert.NoFileExists(t, filepath.Join(p.Path(), ReassignFileName))
+	m, _, err := ReadManifestFile(p.ManifestPath())
+	assert.NoError(t, err)
+	assert.Empty(t, m.Reassign)
+
+	itr, err := p.MeasurementSeriesIDIterator([]byte("cpu"))
+	assert.NoError(t, err)
+	ids := tsdb.NewSeriesIDSetIterators([]tsdb.SeriesIDIterator{itr})[0].SeriesIDSet()
+	assert.Equal(t, uint64(len(tagsSlice)), ids.Cardinality())
+	for i, tags := range tagsSlice {
+		id := sfile.SeriesID([]byte("cpu"), tags, nil)
+		assert.True(t, ids.Contains(id))
+		assert.NotEqual(t, oldIDs[i], id)
+		assert.True(t, sfile.IsDeleted(oldIDs[i]))
+	}
+}
@@ -0,0 +1,144 @@
+package tsi2_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"cycledb/pkg/tsdb"
+	"cycledb/pkg/tsdb/index/tsi2"
+
+	"github.com/influxdata/influxdb/v2/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndex_Partitions(t *testing.T) {
+	idx := MustOpenIndex(t, tsi2.WithPartitionN(4))
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+	assert.Equal(t, 4, idx.PartitionN())
+
+	var series []Series
+	for i := 0; i < 16; i++ {
+		for j := 0; j < 3; j++ {
+			series = append(series, Series{
+				Name: []byte(fmt.Sprintf("m%02d", i)),
+				Tags: models.NewTags(map[string]string{"host": fmt.Sprintf("host-%d", j)}),
+			})
+		}
+	}
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists(series))
+
+	idx.Run(t, func(t *testing.T) {
+		// Each partition has its own directory and manifest.
+		for j := 0; j < idx.PartitionN(); j++ {
+			p := idx.PartitionAt(j)
+			assert.Equal(t, filepath.Join(idx.Path(), strconv.Itoa(j)), p.Path())
+			_, err := os.Stat(p.ManifestPath())
+			assert.NoError(t, err)
+		}
+
+		// The series ids are unique across partitions.
+		ids := map[uint64]bool{}
+		for _, s := range series {
+			id := idx.SeriesFile.SeriesID(s.Name, s.Tags, nil)
+			assert.False(t, ids[id], "duplicate series id %d", id)
+			ids[id] = true
+
+			name, tags, err := idx.SeriesByID(id)
+			assert.NoError(t, err)
+			assert.Equal(t, string(s.Name), string(name))
+			assert.Equal(t, s.Tags.String(), tags.String())
+		}
+		assert.Equal(t, int64(len(series)), idx.SeriesN())
+		assert.Equal(t, uint64(len(series)), idx.SeriesIDSet().Cardinality())
+
+		names := idx.MeasurementNames()
+		assert.Len(t, names, 16)
+		assert.Equal(t, "m00", names[0])
+		assert.Equal(t, "m15", names[15])
+
+		itr, err := idx.TagValueSeriesIDIterator([]byte("m07"), []byte("host"), []byte("host-1"))
+		assert.NoError(t, err)
+		e, err := itr.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, idx.SeriesFile.SeriesID([]byte("m07"), series[22].Tags, nil), e.SeriesID)
+	})
+
+	// The ids of a dropped measurement are not given to new measurements,
+	// whichever partition they are in.
+	id := idx.SeriesFile.SeriesID(series[0].Name, series[0].Tags, nil)
+	assert.NoError(t, idx.DropMeasurement(series[0].Name))
+	assert.NoError(t, idx.Reopen())
+	for i := 0; i < 8; i++ {
+		s := Series{Name: []byte(fmt.Sprintf("new%d", i)), Tags: series[0].Tags}
+		assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{s}))
+		assert.NotEqual(t, id, idx.SeriesFile.SeriesID(s.Name, s.Tags, nil))
+	}
+	name, _, err := idx.SeriesByID(id)
+	assert.NoError(t, err)
+	assert.Nil(t, name)
+}
+
+// Ensure an index created with a single partition keeps it.
+func TestIndex_Partitions_SinglePartition(t *testing.T) {
+	idx := MustOpenIndex(t)
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+	s := Series{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "a"})}
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{s}))
+	assert.NoError(t, idx.Close())
+
+	other := tsi2.NewIndex(idx.SeriesFile.SeriesFile, "db0", tsi2.WithPath(idx.Path()), tsi2.WithPartitionN(4))
+	assert.NoError(t, idx.SeriesFile.Open())
+	assert.NoError(t, other.Open())
+	idx.Index = other
+	assert.Equal(t, 1, other.PartitionN())
+	assert.Equal(t, idx.Path(), other.PartitionAt(0).Path())
+	assert.Equal(t, []string{"cpu"}, other.MeasurementNames())
+}
+
+// Ensure concurrent writes to the partitions create every series once.
+func TestIndex_Partitions_ConcurrentWrites(t *testing.T) {
+	idx := MustOpenIndex(t, tsi2.WithPartitionN(4), tsi2.WithMaxInMemorySize(1<<10))
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	const writers, batches = 8, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for b := 0; b < batches; b++ {
+				var batch []Series
+				for m := 0; m < 4; m++ {
+					batch = append(batch, Series{
+						Name: []byte(fmt.Sprintf("m%d", (w+m)%6)),
+						Tags: models.NewTags(map[string]string{"host": fmt.Sprintf("host-%d", b), "writer": strconv.Itoa(w)}),
+					})
+				}
+				if err := idx.CreateSeriesSliceIfNotExists(batch); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	idx.Wait()
+
+	assert.Equal(t, int64(writers*batches*4), idx.SeriesN())
+	ss := tsdb.NewSeriesIDSet()
+	itr := idx.SeriesFile.SeriesIDIterator()
+	for e, err := itr.Next(); e.SeriesID != 0; e, err = itr.Next() {
+		assert.NoError(t, err)
+		ss.Add(e.SeriesID)
+	}
+	assert.True(t, ss.Equals(idx.SeriesIDSet()))
+}
@@ -0,0 +1,532 @@
+package tsi2
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/v2/logger"
+	"github.com/influxdata/influxdb/v2/models"
+	"github.com/influxdata/influxdb/v2/pkg/estimator/hll"
+	"go.uber.org/zap"
+
+	"cycledb/pkg/tsdb"
+)
+
+// ReassignFileName is the name of the file recording the series ids given by
+// a repack, until the series file has them.
+const ReassignFileName = "REASSIGN"
+
+// Repack rebuilds the grids of the measurements with tight capacities, and
+// gives their series new ids from the grids, under a new measurement id.
+// All measurements are repacked if no name is given.
+//
+// The grids are grouped by the tag keys of the series, and a group is split
+// by the values of a tag key while this at least halves the ids reserved for
+// it. The new measurement ids are chosen so that no new series id was given
+// to a series of the series file, which is shared by the shards. The
+// previous ids of the series are deleted from the series file, and the
+// previous measurement ids are released once the repack completes. They are
+// given again once the series file has forgotten the deleted series, after
+// it is compacted. A measurement is not repacked if no id is free, and new
+// measurement ids are only taken while an eighth of the ids stay free for
+// new measurements. The TSM files address series by key, they do not need
+// to be rewritten.
+//
+// The new files are written along with a record of the new ids, then the
+// manifest lists them and the record, and the partition is reopened from
+// them. Opening gives the series file the new ids of the record, so that a
+// repack interrupted after the manifest is written completes on the next
+// open, and one interrupted before leaves the partition as it was.
+//
+// Returns the new id of each series of the repacked measurements, by old id.
+func (p *Partition) Repack(names ...[]byte) (map[uint64]uint64, error) {
+	p.compactMu.Lock()
+	defer p.compactMu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	log, logEnd := logger.NewOperation(context.TODO(), p.logger, "TSI2 repack", "tsi2_repack")
+	defer logEnd()
+	start := time.Now()
+
+	// Flush the grids in memory and merge all index files, so that the grids
+	// of each measurement are in a single file, without the dropped series.
+	if err := p.flush(p.nextSequence()); err != nil {
+		return nil, err
+	} else if err := p.compactToLevel(p.indexFiles, MaxIndexFileLevel); err != nil {
+		return nil, err
+	}
+	f := p.indexFiles[0]
+
+	if len(names) == 0 {
+		for _, name := range p.measurements.Names() {
+			names = append(names, []byte(name))
+		}
+	}
+
+	// Repack the grids of the measurements. The ids taken for them are
+	// released if the repack fails before the manifest lists the new files.
+	repacked := map[string]sealedGrids{}
+	remap := map[uint64]uint64{}
+	var keys [][]byte
+	var newIDs, oldMeasurementIDs []uint64
+	committed := false
+	defer func() {
+		if !committed {
+			for _, s := range repacked {
+				p.ids.release(s.m.measurementID, p.id)
+			}
+		}
+	}()
+	for _, name := range names {
+		m, err := p.measurements.MeasurementByName(name)
+		if err != nil {
+			return nil, err
+		} else if _, ok := repacked[string(name)]; m == nil || ok {
+			continue
+		}
+		_, grids, err := f.grids(name)
+		if err != nil {
+			return nil, err
+		} else if len(grids) == 0 {
+			continue // no series left
+		}
+
+		var ids []uint64
+		var series []models.Tags
+		for _, g := range grids {
+			for _, id := range g.seriesIDSet.Slice() {
+				tags := g.tagsForID(id)
+				if tags == nil {
+					return nil, fmt.Errorf("%q: series id %d is not in its grid", name, id)
+				}
+				ids = append(ids, id)
+				series = append(series, tags)
+			}
+		}
+
+		gi, packedIDs, err := repackGridIndex(m.gIndex, series)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", name, err)
+		}
+		packed, ok := p.newRepackedMeasurement(m, gi, packedIDs)
+		if !ok {
+			log.Warn("No free measurement id, measurement not repacked", zap.ByteString("name", name))
+			continue
+		}
+		repacked[string(name)] = sealedGrids{m: packed, grids: gi.grids}
+		oldMeasurementIDs = append(oldMeasurementIDs, m.measurementID)
+		for j := range ids {
+			oldID, newID := m.FormatIdWithMeasurementID(ids[j]), packed.FormatIdWithMeasurementID(packedIDs[j])
+			remap[oldID] = newID
+			keys = append(keys, tsdb.AppendSeriesKey(nil, name, series[j]))
+			newIDs = append(newIDs, newID)
+		}
+	}
+	if len(repacked) == 0 {
+		return remap, nil
+	}
+
+	// Write the grids of the other measurements, and of the repacked ones,
+	// to new files, along with a log of the measurements and the record of
+	// the new ids.
+	var paths []string
+	remove := func() {
+		for _, path := range paths {
+			os.Remove(path)
+		}
+	}
+	m := NewManifest(p.ManifestPath())
+	m.IDLayout = p.idLayout
+	m.Reassign = ReassignFileName
+
+	path := filepath.Join(p.path, FormatIndexFileName(p.nextSequence(), MaxIndexFileLevel))
+	paths = append(paths, path)
+	if err := func() error {
+		w, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+
+		keep := func(name []byte, id uint64) bool {
+			_, ok := repacked[string(name)]
+			return !ok && p.measurements.hasMeasurement(name, id)
+		}
+		if _, err := (IndexFiles{f}).CompactTo(w, keep, tsdb.NewSeriesIDSet()); err != nil {
+			return err
+		} else if err := w.Sync(); err != nil {
+			return err
+		}
+		return w.Close()
+	}(); err != nil {
+		log.Error("Cannot write index file", zap.Error(err))
+		remove()
+		return nil, err
+	}
+	m.Files = append(m.Files, filepath.Base(path))
+
+	s := &gridSnapshot{
+		id:           p.nextSequence(),
+		layout:       p.idLayout,
+		measurements: repacked,
+		tombstones:   tsdb.NewSeriesIDSet(),
+		sSketch:      hll.NewDefaultPlus(),
+		sTSketch:     hll.NewDefaultPlus(),
+		mSketch:      hll.NewDefaultPlus(),
+		mTSketch:     hll.NewDefaultPlus(),
+	}
+	file, _, err := p.writeIndexFile(s, log)
+	if err != nil {
+		remove()
+		return nil, err
+	}
+	file.Close()
+	paths = append(paths, file.Path())
+	m.Files = append(m.Files, filepath.Base(file.Path()))
+
+	logFile, err := p.newLogFile(p.repackedLogEntries(repacked))
+	if err != nil {
+		log.Error("Cannot create log file", zap.Error(err))
+		remove()
+		return nil, err
+	}
+	logFile.Close()
+	paths = append(paths, logFile.Path())
+	m.Files = append(m.Files, filepath.Base(logFile.Path()))
+
+	paths = append(paths, filepath.Join(p.path, ReassignFileName))
+	if err := writeReassignFile(filepath.Join(p.path, ReassignFileName), keys, newIDs); err != nil {
+		log.Error("Cannot write series ids", zap.Error(err))
+		remove()
+		return nil, err
+	} else if _, err := m.Write(); err != nil {
+		log.Error("Cannot write manifest", zap.Error(err))
+		remove()
+		return nil, err
+	}
+	committed = true
+
+	// Reopen the partition from the new files, which gives the series file
+	// the new ids. The previous files are removed as they are not listed.
+	for name := range repacked {
+		p.tagValueCache.invalidateMeasurement([]byte(name))
+	}
+	p.opened = false
+	if err := p.closeFiles(); err != nil {
+		log.Error("Cannot close files", zap.Error(err))
+	}
+	if err := p.open(); err != nil {
+		log.Error("Cannot reopen repacked partition", zap.Error(err))
+		p.failed = err
+		return nil, err
+	}
+
+	// The series file has the new ids, the previous measurement ids are free.
+	for _, id := range oldMeasurementIDs {
+		p.ids.release(id, p.id)
+	}
+
+	log.Info("Repack complete",
+		zap.Int("measurements", len(repacked)),
+		zap.Int("series", len(remap)),
+		logger.DurationLiteral("elapsed", time.Since(start)),
+	)
+	return remap, nil
+}
+
+// newRepackedMeasurement returns the measurement m under a new measurement
+// id, with the repacked grid index gi. The id is chosen so that none of the
+// series ids of ids in gi was given to a series of the series file. A free id
+// is taken first, and new ids only up to repackMaxMeasurementID. Returns false
+// if no id can be taken.
+func (p *Partition) newRepackedMeasurement(m *Measurement, gi *GridIndex, ids []uint64) (*Measurement, bool) {
+	id, ok := p.ids.nextFree(p.id, repackMaxMeasurementID(p.idLayout), func(id uint64) bool {
+		for _, indexID := range ids {
+			if p.sfile.HasSeriesID(m.layout.seriesID(id, indexID)) {
+				return false
+			}
+		}
+		return true
+	})
+	if !ok {
+		return nil, false
+	}
+	packed := NewMeasurement(gi, m.name, id)
+	packed.layout = m.layout
+	return packed, true
+}
+
+// repackMaxMeasurementID returns the highest new measurement id a repack
+// takes, so that an eighth of the ids are left to new measurements.
+func repackMaxMeasurementID(layout IDLayout) uint64 {
+	max := layout.MaxMeasurementID()
+	return max - (max+1)/8
+}
+
+// repackedLogEntries returns the entries which recreate the measurements,
+// with the repacked ones under their new ids. Must be called with the lock held.
+func (p *Partition) repackedLogEntries(repacked map[string]sealedGrids) []LogEntry {
+	var entries []LogEntry
+	for _, e := range p.measurements.LogEntries() {
+		if _, ok := repacked[string(e.Name)]; !ok {
+			entries = append(entries, e)
+		}
+	}
+
+	// The new ids may be lower than those of the other measurements, when
+	// they were released by a previous repack.
+	packed := make([]*Measurement, 0, len(repacked))
+	for _, s := range repacked {
+		packed = append(packed, s.m)
+	}
+	sort.Slice(packed, func(i, j int) bool { return packed[i].measurementID < packed[j].measurementID })
+	for _, m := range packed {
+		entries = append(entries, LogEntry{Flag: LogEntryMeasurementInsertFlag, Name: []byte(m.name), MeasurementID: m.measurementID, Offset: m.gIndex.nextOffset()})
+	}
+	return entries
+}
+
+// reassignSeriesIDs gives the series file the ids recorded by a repack, if
+// the manifest lists the record, then removes the record. A record which is
+// not listed was left by a repack interrupted before the manifest was written.
+func (p *Partition) reassignSeriesIDs(m *Manifest) error {
+	path := filepath.Join(p.path, ReassignFileName)
+	if m.Reassign == "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	keys, ids, err := readReassignFile(filepath.Join(p.path, m.Reassign))
+	if err != nil {
+		return err
+	}
+	names := make([][]byte, len(keys))
+	tagsSlice := make([]models.Tags, len(keys))
+	for i, key := range keys {
+		names[i], tagsSlice[i] = tsdb.ParseSeriesKey(key)
+	}
+	if err := p.sfile.ReassignSeriesIDs(names, tagsSlice, ids); err != nil {
+		return err
+	}
+
+	m.Reassign = ""
+	if _, err := m.Write(); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(p.path, ReassignFileName))
+}
+
+// writeReassignFile writes the series keys and their new ids to path.
+func writeReassignFile(path string, keys [][]byte, ids []uint64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	var buf [8]byte
+	for i, key := range keys {
+		binary.BigEndian.PutUint64(buf[:], ids[i])
+		if _, err := w.Write(key); err != nil {
+			return err
+		} else if _, err := w.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readReassignFile reads the series keys and their new ids written by writeReassignFile.
+func readReassignFile(path string) ([][]byte, []uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var keys [][]byte
+	var ids []uint64
+	for len(data) != 0 {
+		if sz, rem := tsdb.ReadSeriesKeyLen(data); sz == 0 || len(rem) < sz+8 {
+			return nil, nil, fmt.Errorf("%q: truncated series ids", path)
+		}
+		var key []byte
+		key, data = tsdb.ReadSeriesKey(data)
+		keys = append(keys, key)
+		ids = append(ids, binary.BigEndian.Uint64(data))
+		data = data[8:]
+	}
+	return keys, ids, nil
+}
+
+// repackGridIndex returns a grid index holding the series in grids with
+// tight capacities, and the id of each series in it.
+func repackGridIndex(gi *GridIndex, series []models.Tags) (*GridIndex, []uint64, error) {
+	packed := NewGridIndex(gi.optimizer)
+	packed.maxID = gi.maxID
+
+	// Group the series by their tag keys.
+	groups := map[string][]int{}
+	for j, tags := range series {
+		set := tagKeySet(tags)
+		groups[set] = append(groups[set], j)
+	}
+	sets := make([]string, 0, len(groups))
+	for set := range groups {
+		sets = append(sets, set)
+	}
+	sort.Strings(sets)
+
+	ids := make([]uint64, len(series))
+	for _, set := range sets {
+		for _, group := range splitSeriesGroup(series, groups[set]) {
+			if err := packed.appendPackedGrid(series, group, ids); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return packed, ids, nil
+}
+
+// appendPackedGrid appends a grid holding exactly the values of the series
+// of the group, which have the same tag keys, and sets their ids.
+func (gi *GridIndex) appendPackedGrid(series []models.Tags, group []int, ids []uint64) error {
+	values := groupTagValues(series, group)
+	keys := make([]string, 0, len(series[group[0]]))
+	tagValuesSlice := make([]*TagValues, 0, len(series[group[0]]))
+	for _, tag := range series[group[0]] {
+		keys = append(keys, string(tag.Key))
+		tagValues := newTagValues(uint64(len(values[string(tag.Key)])))
+		for _, value := range values[string(tag.Key)] {
+			tagValues.SetValue(value)
+		}
+		tagValuesSlice = append(tagValuesSlice, tagValues)
+	}
+
+	offset := gi.nextOffset()
+	if !gi.fits(offset, tagValuesSlice) {
+		return ErrSeriesIDOverflow
+	}
+	grid := NewGridWithKeysAndValuesSlice(offset, keys, tagValuesSlice, tsdb.NewSeriesIDSet())
+	for _, j := range group {
+		id, ok := grid.SetTags(series[j])
+		if !ok {
+			return ErrFailToSetSeriesKey
+		}
+		ids[j] = id
+	}
+	gi.grids = append(gi.grids, grid)
+	return nil
+}
+
+// splitSeriesGroup splits a group of series with the same tag keys by the
+// values of the key with the fewest values, as long as the ids reserved by
+// the grids of the parts are at most half of those of the group.
+func splitSeriesGroup(series []models.Tags, group []int) [][]int {
+	capacity := groupCapacity(series, group)
+	if capacity <= 2*uint64(len(group)) {
+		return [][]int{group}
+	}
+
+	var key string
+	var n int
+	for k, values := range groupTagValues(series, group) {
+		if len(values) > 1 && (n == 0 || len(values) < n || (len(values) == n && k < key)) {
+			key, n = k, len(values)
+		}
+	}
+	if n == 0 {
+		return [][]int{group}
+	}
+
+	parts := map[string][]int{}
+	for _, j := range group {
+		value := string(series[j].Get([]byte(key)))
+		parts[value] = append(parts[value], j)
+	}
+	var partsCapacity uint64
+	for _, part := range parts {
+		partsCapacity = saturatingAdd(partsCapacity, groupCapacity(series, part))
+	}
+	if partsCapacity > capacity/2 {
+		return [][]int{group}
+	}
+
+	values := make([]string, 0, len(parts))
+	for value := range parts {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	var groups [][]int
+	for _, value := range values {
+		groups = append(groups, splitSeriesGroup(series, parts[value])...)
+	}
+	return groups
+}
+
+// groupCapacity returns the ids reserved by a grid holding exactly the
+// values of the series of the group.
+func groupCapacity(series []models.Tags, group []int) uint64 {
+	capacity := uint64(1)
+	for _, values := range groupTagValues(series, group) {
+		if n := uint64(len(values)); capacity > math.MaxUint64/n {
+			return math.MaxUint64
+		} else {
+			capacity *= n
+		}
+	}
+	return capacity
+}
+
+// groupTagValues returns the sorted values of each tag key in the series of the group.
+func groupTagValues(series []models.Tags, group []int) map[string][]string {
+	sets := map[string]map[string]struct{}{}
+	for _, j := range group {
+		for _, tag := range series[j] {
+			if sets[string(tag.Key)] == nil {
+				sets[string(tag.Key)] = map[string]struct{}{}
+			}
+			sets[string(tag.Key)][string(tag.Value)] = struct{}{}
+		}
+	}
+	values := make(map[string][]string, len(sets))
+	for key, set := range sets {
+		for value := range set {
+			values[key] = append(values[key], value)
+		}
+		sort.Strings(values[key])
+	}
+	return values
+}
+
+// tagKeySet returns the tag keys of the tags as a single string.
+func tagKeySet(tags models.Tags) string {
+	keys := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		keys = append(keys, string(tag.Key))
+	}
+	return strings.Join(keys, "\x00")
+}
+
+func saturatingAdd(x, y uint64) uint64 {
+	if x > math.MaxUint64-y {
+		return math.MaxUint64
+	}
+	return x + y
+}
@@ -0,0 +1,162 @@
+package tsi2_test
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"cycledb/pkg/tsdb"
+	"cycledb/pkg/tsdb/index/tsi2"
+
+	"github.com/influxdata/influxdb/v2/models"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sync/errgroup"
+)
+
+// TestIndex_Stress runs concurrent writes, queries and drops against a
+// partitioned index, which flushes and compacts its grids in the background.
+// Run it with -race to check the synchronization of the index.
+func TestIndex_Stress(t *testing.T) {
+	idx := MustOpenIndex(t,
+		tsi2.WithPartitionN(4),
+		tsi2.WithMaxInMemorySize(4<<10),
+		tsi2.WithMaxLevelFileN(2),
+	)
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	const writers, readers, measurementN = 4, 4, 8
+	iterations := 100
+	if testing.Short() {
+		iterations = 20
+	}
+
+	var g errgroup.Group
+
+	// The writers race to create the same measurements.
+	for w := 0; w < writers; w++ {
+		w := w
+		g.Go(func() error {
+			for i := 0; i < iterations; i++ {
+				var batch []Series
+				for j := 0; j < measurementN; j++ {
+					batch = append(batch, Series{
+						Name: []byte(fmt.Sprintf("m%d", (i+j)%measurementN)),
+						Tags: models.NewTags(map[string]string{"host": fmt.Sprintf("host-%d", i), "writer": strconv.Itoa(w)}),
+					})
+				}
+				if err := idx.CreateSeriesSliceIfNotExists(batch); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	// The dropper drops series and measurements, which it recreates.
+	g.Go(func() error {
+		name := []byte("tmp")
+		for i := 0; i < iterations; i++ {
+			series := []Series{
+				{Name: name, Tags: models.NewTags(map[string]string{"host": fmt.Sprintf("host-%d", i)})},
+				{Name: name, Tags: models.NewTags(map[string]string{"host": fmt.Sprintf("host-%d", i), "region": "east"})},
+			}
+			if err := idx.CreateSeriesSliceIfNotExists(series); err != nil {
+				return err
+			}
+			for _, s := range series {
+				id := idx.SeriesFile.SeriesID(s.Name, s.Tags, nil)
+				if err := idx.DropSeries(id, models.MakeKey(s.Name, s.Tags), true); err != nil {
+					return err
+				}
+			}
+			if i%5 == 0 {
+				if err := idx.DropMeasurement(name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	// The readers query the measurements while they are written and dropped.
+	re := regexp.MustCompile(`^m[0-3]$`)
+	for r := 0; r < readers; r++ {
+		r := r
+		g.Go(func() error {
+			for i := 0; i < iterations; i++ {
+				name := []byte(fmt.Sprintf("m%d", (i+r)%measurementN))
+				if _, err := idx.MeasurementExists(name); err != nil {
+					return err
+				} else if _, err := idx.MeasurementNamesByRegex(re); err != nil {
+					return err
+				}
+				idx.MeasurementNames()
+
+				itr, err := idx.TagValueSeriesIDIterator(name, []byte("writer"), []byte(strconv.Itoa(r)))
+				if err != nil {
+					return err
+				}
+				for e, err := itr.Next(); e.SeriesID != 0; e, err = itr.Next() {
+					if err != nil {
+						return err
+					}
+					if n, _, err := idx.SeriesByID(e.SeriesID); err != nil {
+						return err
+					} else if n != nil && string(n) != string(name) {
+						return fmt.Errorf("series %d of %q belongs to %q", e.SeriesID, name, n)
+					}
+				}
+
+				if err := drainTagKeys(idx.TagKeyIterator([]byte("tmp"))); err != nil {
+					return err
+				}
+				mitr, err := idx.MeasurementIterator()
+				if err != nil {
+					return err
+				}
+				for n, err := mitr.Next(); n != nil; n, err = mitr.Next() {
+					if err != nil {
+						return err
+					}
+				}
+				if _, _, err := idx.SeriesSketches(); err != nil {
+					return err
+				}
+				idx.SeriesIDSet()
+				idx.Bytes()
+			}
+			return nil
+		})
+	}
+
+	assert.NoError(t, g.Wait())
+	idx.Wait()
+
+	// Every series written is in the index once, and the dropped ones are gone.
+	assert.Equal(t, int64(writers*iterations*measurementN), idx.SeriesN())
+	ss := tsdb.NewSeriesIDSet()
+	for j := 0; j < measurementN; j++ {
+		itr, err := idx.MeasurementSeriesIDIterator([]byte(fmt.Sprintf("m%d", j)))
+		assert.NoError(t, err)
+		for e, err := itr.Next(); e.SeriesID != 0; e, err = itr.Next() {
+			assert.NoError(t, err)
+			ss.Add(e.SeriesID)
+		}
+	}
+	assert.True(t, ss.Equals(idx.SeriesIDSet()))
+}
+
+// drainTagKeys reads all keys of the iterator, which may be nil.
+func drainTagKeys(itr tsdb.TagKeyIterator, err error) error {
+	if err != nil || itr == nil {
+		return err
+	}
+	defer itr.Close()
+	for key, err := itr.Next(); key != nil; key, err = itr.Next() {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
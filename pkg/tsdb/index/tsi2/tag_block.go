@@ -0,0 +1,492 @@
+package tsi2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/influxdata/influxdb/pkg/rhh"
+)
+
+// Tag block field size constants.
+const (
+	// Tag key entry fields, after the key.
+	TagKeyValuesSize = 0 +
+		8 + 8 + // value data offset/size
+		8 + 8 // value hash index offset/size
+
+	// TagBlockTrailerSize is the size of the trailer of a tag block.
+	TagBlockTrailerSize = 0 +
+		8 + 8 + // key data offset/size
+		8 + 8 // key hash index offset/size
+)
+
+// TagBlock maps the tag keys and values of the grids of a measurement to the
+// indexes of the grids holding them, so that a query only decodes the grids
+// which can match it.
+//
+// Each key has a section of values, each followed by its grid indexes, and a
+// hash index of the values. The key section holds the keys, each followed by
+// the offsets of its values and its grid indexes, and a hash index of the
+// keys. All offsets are relative to the block.
+type TagBlock struct {
+	data     []byte
+	keyData  []byte
+	hashData []byte
+}
+
+// UnmarshalBinary unpacks data into the block. Block is not copied so data
+// should be retained and unchanged after being passed into this function.
+func (blk *TagBlock) UnmarshalBinary(data []byte) error {
+	if len(data) < TagBlockTrailerSize {
+		return ErrInvalidTagBlock
+	}
+	buf := data[len(data)-TagBlockTrailerSize:]
+	keyOffset, buf := binary.BigEndian.Uint64(buf[0:8]), buf[8:]
+	keySize, buf := binary.BigEndian.Uint64(buf[0:8]), buf[8:]
+	hashOffset, buf := binary.BigEndian.Uint64(buf[0:8]), buf[8:]
+	hashSize := binary.BigEndian.Uint64(buf[0:8])
+
+	var ok bool
+	if blk.keyData, ok = sliceSection(data, keyOffset, keySize); !ok {
+		return ErrInvalidTagBlock
+	} else if blk.hashData, ok = sliceSection(data, hashOffset, hashSize); !ok {
+		return ErrInvalidTagBlock
+	}
+	blk.data = data
+	return nil
+}
+
+// TagKeyGrids returns the indexes of the grids with the tag key, in order.
+// Returns false if no grid has the key.
+func (blk *TagBlock) TagKeyGrids(key []byte) ([]int, bool, error) {
+	e, ok, err := blk.keyElem(key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return e.grids, true, nil
+}
+
+// TagValueGrids returns the indexes of the grids with the tag value, in order.
+// Returns false if no grid has the value.
+func (blk *TagBlock) TagValueGrids(key, value []byte) ([]int, bool, error) {
+	e, ok, err := blk.keyElem(key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	offset, ok, err := findHashIndex(blk.data, e.valueHashData, value)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	var ve tagBlockElem
+	if _, err := ve.unmarshalBinary(blk.data[offset:]); err != nil {
+		return nil, false, err
+	}
+	return ve.grids, true, nil
+}
+
+// tagValueSetGrids returns the indexes of the grids which may hold series
+// matching the tag value set. Returns false if any grid may hold them, as
+// the empty value also matches the grids without the key.
+func (blk *TagBlock) tagValueSetGrids(set TagValueSet) ([]int, bool, error) {
+	var res []int
+	var restricted bool
+	for key, values := range set {
+		if containsString(values, "") {
+			continue
+		}
+		var grids []int
+		for _, value := range values {
+			valueGrids, _, err := blk.TagValueGrids([]byte(key), []byte(value))
+			if err != nil {
+				return nil, false, err
+			}
+			grids = unionInts(grids, valueGrids)
+		}
+		if !restricted {
+			res, restricted = grids, true
+		} else {
+			res = intersectInts(res, grids)
+		}
+	}
+	return res, restricted, nil
+}
+
+// ForEachTagKey calls fn for each tag key of the grids, in order.
+func (blk *TagBlock) ForEachTagKey(fn func(key []byte)) error {
+	for data := blk.keyData; len(data) != 0; {
+		var e tagBlockKeyElem
+		n, err := e.unmarshalBinary(blk.data, data)
+		if err != nil {
+			return err
+		}
+		fn(e.key)
+		data = data[n:]
+	}
+	return nil
+}
+
+// ForEachTagValue calls fn for each value of the tag key in the grids, in
+// order, including the empty value of the series lacking the key.
+func (blk *TagBlock) ForEachTagValue(key []byte, fn func(value []byte)) error {
+	e, ok, err := blk.keyElem(key)
+	if err != nil || !ok {
+		return err
+	}
+	for data := e.valueData; len(data) != 0; {
+		var ve tagBlockElem
+		n, err := ve.unmarshalBinary(data)
+		if err != nil {
+			return err
+		}
+		fn(ve.key)
+		data = data[n:]
+	}
+	return nil
+}
+
+// keyElem returns the entry of the tag key.
+func (blk *TagBlock) keyElem(key []byte) (tagBlockKeyElem, bool, error) {
+	var e tagBlockKeyElem
+	offset, ok, err := findHashIndex(blk.data, blk.hashData, key)
+	if err != nil || !ok {
+		return e, false, err
+	}
+	_, err = e.unmarshalBinary(blk.data, blk.data[offset:])
+	return e, err == nil, err
+}
+
+// tagBlockElem is a tag value, or a tag key, with the indexes of its grids.
+type tagBlockElem struct {
+	key   []byte
+	grids []int
+}
+
+// unmarshalBinary unmarshals data into e, and returns the size of the entry.
+func (e *tagBlockElem) unmarshalBinary(data []byte) (int, error) {
+	start := len(data)
+
+	sz, n, err := uvarint(data)
+	if err != nil || uint64(len(data)-n) < sz {
+		return 0, ErrInvalidTagBlock
+	}
+	e.key, data = data[n:n+int(sz)], data[n+int(sz):]
+
+	var rest []byte
+	if e.grids, rest, err = readGridIndexes(data); err != nil {
+		return 0, err
+	}
+	return start - len(rest), nil
+}
+
+// tagBlockKeyElem is a tag key, with its values and the indexes of its grids.
+type tagBlockKeyElem struct {
+	tagBlockElem
+	valueData, valueHashData []byte
+}
+
+// unmarshalBinary unmarshals the key entry at the start of data, in the
+// block blk, and returns the size of the entry.
+func (e *tagBlockKeyElem) unmarshalBinary(blk, data []byte) (int, error) {
+	start := len(data)
+
+	sz, n, err := uvarint(data)
+	if err != nil || uint64(len(data)-n) < sz+TagKeyValuesSize {
+		return 0, ErrInvalidTagBlock
+	}
+	e.key, data = data[n:n+int(sz)], data[n+int(sz):]
+
+	valueOffset, data := binary.BigEndian.Uint64(data[0:8]), data[8:]
+	valueSize, data := binary.BigEndian.Uint64(data[0:8]), data[8:]
+	hashOffset, data := binary.BigEndian.Uint64(data[0:8]), data[8:]
+	hashSize, data := binary.BigEndian.Uint64(data[0:8]), data[8:]
+	var ok bool
+	if e.valueData, ok = sliceSection(blk, valueOffset, valueSize); !ok {
+		return 0, ErrInvalidTagBlock
+	} else if e.valueHashData, ok = sliceSection(blk, hashOffset, hashSize); !ok {
+		return 0, ErrInvalidTagBlock
+	}
+
+	if e.grids, data, err = readGridIndexes(data); err != nil {
+		return 0, err
+	}
+	return start - len(data), nil
+}
+
+// readGridIndexes reads a count of grid indexes followed by the indexes.
+func readGridIndexes(data []byte) ([]int, []byte, error) {
+	count, n, err := uvarint(data)
+	if err != nil || count > uint64(len(data)-n) {
+		return nil, nil, ErrInvalidTagBlock
+	}
+	data = data[n:]
+
+	grids := make([]int, 0, count)
+	for i := uint64(0); i < count; i++ {
+		v, n, err := uvarint(data)
+		if err != nil {
+			return nil, nil, ErrInvalidTagBlock
+		}
+		grids = append(grids, int(v))
+		data = data[n:]
+	}
+	return grids, data, nil
+}
+
+// findHashIndex returns the offset in data of the entry of key, looked up in
+// the hash index. The entries start with their key.
+func findHashIndex(data, hashData, key []byte) (uint64, bool, error) {
+	if len(hashData) < 8 {
+		return 0, false, ErrInvalidTagBlock
+	}
+	n := int64(binary.BigEndian.Uint64(hashData[:8]))
+	if n <= 0 || int64(len(hashData)-8)/8 < n {
+		return 0, false, ErrInvalidTagBlock
+	}
+	hash := rhh.HashKey(key)
+	pos := hash % n
+
+	// Track current distance
+	var d int64
+	for {
+		// Find offset of the entry.
+		offset := binary.BigEndian.Uint64(hashData[8+(pos*8):])
+		if offset == 0 {
+			return 0, false, nil
+		} else if offset >= uint64(len(data)) {
+			return 0, false, ErrInvalidTagBlock
+		}
+
+		// Evaluate the key of the entry.
+		sz, nn, err := uvarint(data[offset:])
+		if err != nil || uint64(len(data[offset:])-nn) < sz {
+			return 0, false, ErrInvalidTagBlock
+		}
+		entryKey := data[offset+uint64(nn) : offset+uint64(nn)+sz]
+		if bytes.Equal(entryKey, key) {
+			return offset, true, nil
+		}
+
+		// Check if we've exceeded the probe distance.
+		if d > rhh.Dist(rhh.HashKey(entryKey), pos, n) {
+			return 0, false, nil
+		}
+
+		// Move position forward.
+		pos = (pos + 1) % n
+		d++
+
+		if d > n {
+			return 0, false, nil
+		}
+	}
+}
+
+// sliceSection returns the section of data at offset, if it is in data.
+func sliceSection(data []byte, offset, size uint64) ([]byte, bool) {
+	if offset > uint64(len(data)) || size > uint64(len(data))-offset {
+		return nil, false
+	}
+	return data[offset : offset+size], true
+}
+
+// TagBlockWriter writes the tag block of the grids of a measurement.
+type TagBlockWriter struct {
+	keys  map[string]*tagBlockKey
+	grids int
+}
+
+type tagBlockKey struct {
+	grids  []int
+	values map[string][]int
+}
+
+// NewTagBlockWriter returns a new TagBlockWriter.
+func NewTagBlockWriter() *TagBlockWriter {
+	return &TagBlockWriter{keys: make(map[string]*tagBlockKey)}
+}
+
+// AddGrid adds the tag keys and values of the next grid of the measurement.
+func (tw *TagBlockWriter) AddGrid(g *Grid) {
+	for i, key := range g.tagKeys {
+		k := tw.keys[key]
+		if k == nil {
+			k = &tagBlockKey{values: make(map[string][]int)}
+			tw.keys[key] = k
+		}
+		k.grids = append(k.grids, tw.grids)
+		for _, value := range g.tagValuesSlice[i].values {
+			k.values[value] = append(k.values[value], tw.grids)
+		}
+	}
+	tw.grids++
+}
+
+// WriteTo encodes the tag block to w.
+func (tw *TagBlockWriter) WriteTo(w io.Writer) (n int64, err error) {
+	// Write padding byte so no offsets are zero.
+	if err := writeUint8To(w, 0, &n); err != nil {
+		return n, err
+	}
+
+	keys := make([]string, 0, len(tw.keys))
+	for key := range tw.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Write the values of each key, followed by their hash index.
+	type valueSection struct {
+		offset, size         int64
+		hashOffset, hashSize int64
+	}
+	sections := make([]valueSection, len(keys))
+	for i, key := range keys {
+		k := tw.keys[key]
+		values := make([]string, 0, len(k.values))
+		for value := range k.values {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+
+		offsets := make(map[string]int64, len(values))
+		sections[i].offset = n
+		for _, value := range values {
+			offsets[value] = n
+			if err := writeTagBlockElemTo(w, []byte(value), k.values[value], &n); err != nil {
+				return n, err
+			}
+		}
+		sections[i].size = n - sections[i].offset
+
+		sections[i].hashOffset = n
+		if err := writeHashIndexTo(w, offsets, &n); err != nil {
+			return n, err
+		}
+		sections[i].hashSize = n - sections[i].hashOffset
+	}
+
+	// Write the keys, followed by their hash index.
+	var t struct{ keyOffset, keySize, hashOffset, hashSize int64 }
+	offsets := make(map[string]int64, len(keys))
+	t.keyOffset = n
+	for i, key := range keys {
+		offsets[key] = n
+		if err := writeUvarintTo(w, uint64(len(key)), &n); err != nil {
+			return n, err
+		} else if err := writeTo(w, []byte(key), &n); err != nil {
+			return n, err
+		}
+		s := sections[i]
+		for _, v := range []int64{s.offset, s.size, s.hashOffset, s.hashSize} {
+			if err := writeUint64To(w, uint64(v), &n); err != nil {
+				return n, err
+			}
+		}
+		if err := writeGridIndexesTo(w, tw.keys[key].grids, &n); err != nil {
+			return n, err
+		}
+	}
+	t.keySize = n - t.keyOffset
+
+	t.hashOffset = n
+	if err := writeHashIndexTo(w, offsets, &n); err != nil {
+		return n, err
+	}
+	t.hashSize = n - t.hashOffset
+
+	// Write trailer.
+	for _, v := range []int64{t.keyOffset, t.keySize, t.hashOffset, t.hashSize} {
+		if err := writeUint64To(w, uint64(v), &n); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// writeTagBlockElemTo writes a key or value with the indexes of its grids.
+func writeTagBlockElemTo(w io.Writer, key []byte, grids []int, n *int64) error {
+	if err := writeUvarintTo(w, uint64(len(key)), n); err != nil {
+		return err
+	} else if err := writeTo(w, key, n); err != nil {
+		return err
+	}
+	return writeGridIndexesTo(w, grids, n)
+}
+
+// writeGridIndexesTo writes a count of grid indexes followed by the indexes.
+func writeGridIndexesTo(w io.Writer, grids []int, n *int64) error {
+	if err := writeUvarintTo(w, uint64(len(grids)), n); err != nil {
+		return err
+	}
+	for _, i := range grids {
+		if err := writeUvarintTo(w, uint64(i), n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHashIndexTo writes a hash index of the offsets of the entries by key.
+func writeHashIndexTo(w io.Writer, offsets map[string]int64, n *int64) error {
+	m := rhh.NewHashMap(rhh.Options{
+		Capacity:   int64(len(offsets)),
+		LoadFactor: LoadFactor,
+	})
+	for key, offset := range offsets {
+		m.Put([]byte(key), offset)
+	}
+
+	// Encode hash map length.
+	if err := writeUint64To(w, uint64(m.Cap()), n); err != nil {
+		return err
+	}
+
+	// Encode hash map offset entries.
+	for i := int64(0); i < m.Cap(); i++ {
+		_, v := m.Elem(i)
+
+		var offset int64
+		if tmpOffset, ok := v.(int64); ok {
+			offset = tmpOffset
+		}
+		if err := writeUint64To(w, uint64(offset), n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unionInts returns the union of two sorted slices.
+func unionInts(a, b []int) []int {
+	res := make([]int, 0, len(a)+len(b))
+	for len(a) != 0 && len(b) != 0 {
+		switch {
+		case a[0] < b[0]:
+			res, a = append(res, a[0]), a[1:]
+		case a[0] > b[0]:
+			res, b = append(res, b[0]), b[1:]
+		default:
+			res, a, b = append(res, a[0]), a[1:], b[1:]
+		}
+	}
+	res = append(res, a...)
+	return append(res, b...)
+}
+
+// intersectInts returns the intersection of two sorted slices.
+func intersectInts(a, b []int) []int {
+	var res []int
+	for len(a) != 0 && len(b) != 0 {
+		switch {
+		case a[0] < b[0]:
+			a = a[1:]
+		case a[0] > b[0]:
+			b = b[1:]
+		default:
+			res, a, b = append(res, a[0]), a[1:], b[1:]
+		}
+	}
+	return res
+}
@@ -0,0 +1,98 @@
+package tsi2
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"cycledb/pkg/tsdb"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTagBlockTestGrid(keys []string, values ...[]string) *Grid {
+	tagValuesSlice := make([]*TagValues, 0, len(values))
+	for _, vs := range values {
+		tagValues := newTagValues(uint64(len(vs)))
+		for _, v := range vs {
+			tagValues.SetValue(v)
+		}
+		tagValuesSlice = append(tagValuesSlice, tagValues)
+	}
+	return NewGridWithKeysAndValuesSlice(0, keys, tagValuesSlice, tsdb.NewSeriesIDSet())
+}
+
+// Ensure tag blocks can be written and opened.
+func TestTagBlock(t *testing.T) {
+	tw := NewTagBlockWriter()
+	tw.AddGrid(newTagBlockTestGrid([]string{"host", "region"}, []string{"a", "b"}, []string{"east", "west"}))
+	tw.AddGrid(newTagBlockTestGrid([]string{"region"}, []string{"north", "east"}))
+	tw.AddGrid(newTagBlockTestGrid([]string{"host", "region"}, []string{"c", ""}, []string{"west"}))
+
+	var buf bytes.Buffer
+	_, err := tw.WriteTo(&buf)
+	assert.NoError(t, err)
+	var blk TagBlock
+	assert.NoError(t, blk.UnmarshalBinary(buf.Bytes()))
+
+	grids, ok, err := blk.TagKeyGrids([]byte("host"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []int{0, 2}, grids)
+	_, ok, err = blk.TagKeyGrids([]byte("zone"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	grids, ok, err = blk.TagValueGrids([]byte("region"), []byte("east"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []int{0, 1}, grids)
+	grids, _, err = blk.TagValueGrids([]byte("host"), []byte(""))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2}, grids)
+	_, ok, err = blk.TagValueGrids([]byte("region"), []byte("south"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	var keys, values []string
+	assert.NoError(t, blk.ForEachTagKey(func(key []byte) { keys = append(keys, string(key)) }))
+	assert.Equal(t, []string{"host", "region"}, keys)
+	assert.NoError(t, blk.ForEachTagValue([]byte("region"), func(value []byte) { values = append(values, string(value)) }))
+	assert.Equal(t, []string{"east", "north", "west"}, values)
+
+	// The grids of a set hold a value of each key, unless the empty value is allowed.
+	grids, ok, err = blk.tagValueSetGrids(TagValueSet{"region": {"west", "north"}, "host": {"a", "c"}})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []int{0, 2}, grids)
+	grids, ok, err = blk.tagValueSetGrids(TagValueSet{"region": {"north"}, "host": {"a", ""}})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []int{1}, grids)
+	_, ok, err = blk.tagValueSetGrids(TagValueSet{"host": {""}})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+// Ensure truncated tag blocks return errors.
+func TestTagBlock_Truncated(t *testing.T) {
+	tw := NewTagBlockWriter()
+	tw.AddGrid(newTagBlockTestGrid([]string{"host", "region"}, []string{"a", "b"}, []string{"east", "west"}))
+	var buf bytes.Buffer
+	_, err := tw.WriteTo(&buf)
+	assert.NoError(t, err)
+
+	for n := 0; n < buf.Len(); n++ {
+		var blk TagBlock
+		err := blk.UnmarshalBinary(buf.Bytes()[:n])
+		if err == nil {
+			_, _, err = blk.TagValueGrids([]byte("region"), []byte("west"))
+		}
+		if err == nil {
+			err = blk.ForEachTagKey(func([]byte) {})
+		}
+		if !errors.Is(err, ErrInvalidTagBlock) {
+			t.Fatalf("truncated to %d bytes: unexpected error: %v", n, err)
+		}
+	}
+}
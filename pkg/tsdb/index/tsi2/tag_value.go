@@ -1,5 +1,7 @@
 package tsi2
 
+import "unsafe"
+
 type TagValues struct {
 	capacity uint64
 	// TODO(vinland-avalon): any
@@ -39,3 +41,19 @@ func (tvs *TagValues) GetValueIndex(value string) int {
 		return index
 	}
 }
+
+// bytes estimates the memory footprint of the tag values, in bytes.
+func (tvs *TagValues) bytes() int {
+	var b int
+	b += int(unsafe.Sizeof(tvs.capacity))
+	b += int(unsafe.Sizeof(tvs.values))
+	for _, v := range tvs.values {
+		b += int(unsafe.Sizeof(v)) + len(v)
+	}
+	// The keys share their data with values.
+	b += int(unsafe.Sizeof(tvs.valueToIndex))
+	for v, index := range tvs.valueToIndex {
+		b += int(unsafe.Sizeof(v)) + int(unsafe.Sizeof(index))
+	}
+	return b
+}
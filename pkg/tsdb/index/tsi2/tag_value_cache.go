@@ -0,0 +1,161 @@
+package tsi2
+
+import (
+	"container/list"
+	"sync"
+	"unsafe"
+
+	"github.com/influxdata/influxdb/v2/models"
+
+	"cycledb/pkg/tsdb"
+)
+
+// TagValueSeriesIDCache is an LRU cache of the series id sets of the
+// {name, key, value} tuples, which spares merging the sets of the grids in
+// memory and in the index files on every query. When more than capacity
+// sets are added, the least recently used set is evicted.
+//
+// The sets of a measurement are invalidated when one of its grids gains or
+// loses a series, so that a cached set is always the one computed from the
+// current grids.
+type TagValueSeriesIDCache struct {
+	mu      sync.Mutex
+	cache   map[string]map[string]map[string]*list.Element
+	evictor *list.List
+
+	capacity int
+}
+
+type tagValueCacheElement struct {
+	name, key, value string
+	ss               *tsdb.SeriesIDSet
+}
+
+// NewTagValueSeriesIDCache returns a TagValueSeriesIDCache holding up to c sets.
+func NewTagValueSeriesIDCache(c int) *TagValueSeriesIDCache {
+	return &TagValueSeriesIDCache{
+		cache:    map[string]map[string]map[string]*list.Element{},
+		evictor:  list.New(),
+		capacity: c,
+	}
+}
+
+// Get returns the set of the {name, key, value} tuple, or nil if it is not
+// cached. The set must not be modified.
+func (c *TagValueSeriesIDCache) Get(name, key, value []byte) *tsdb.SeriesIDSet {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ele, ok := c.cache[string(name)][string(key)][string(value)]; ok {
+		c.evictor.MoveToFront(ele) // This now becomes most recently used.
+		return ele.Value.(*tagValueCacheElement).ss
+	}
+	return nil
+}
+
+// Put caches the set of the {name, key, value} tuple, evicting the least
+// recently used set if the cache is full. The set must not be modified
+// afterwards.
+func (c *TagValueSeriesIDCache) Put(name, key, value []byte, ss *tsdb.SeriesIDSet) {
+	if c.capacity <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ele, ok := c.cache[string(name)][string(key)][string(value)]; ok {
+		c.evictor.MoveToFront(ele)
+		ele.Value.(*tagValueCacheElement).ss = ss
+		return
+	}
+
+	mmap, ok := c.cache[string(name)]
+	if !ok {
+		mmap = map[string]map[string]*list.Element{}
+		c.cache[string(name)] = mmap
+	}
+	tkmap, ok := mmap[string(key)]
+	if !ok {
+		tkmap = map[string]*list.Element{}
+		mmap[string(key)] = tkmap
+	}
+	tkmap[string(value)] = c.evictor.PushFront(&tagValueCacheElement{
+		name:  string(name),
+		key:   string(key),
+		value: string(value),
+		ss:    ss,
+	})
+
+	if c.evictor.Len() > c.capacity {
+		c.remove(c.evictor.Back())
+	}
+}
+
+// remove removes the element from the evictor and the maps.
+// Must be called with the lock held.
+func (c *TagValueSeriesIDCache) remove(ele *list.Element) {
+	e := ele.Value.(*tagValueCacheElement)
+	c.evictor.Remove(ele)
+	delete(c.cache[e.name][e.key], e.value)
+
+	// Drop the maps of the tag key and the measurement once they are empty.
+	if len(c.cache[e.name][e.key]) == 0 {
+		delete(c.cache[e.name], e.key)
+	}
+	if len(c.cache[e.name]) == 0 {
+		delete(c.cache, e.name)
+	}
+}
+
+// hasMeasurement returns true if any set of the measurement is cached.
+func (c *TagValueSeriesIDCache) hasMeasurement(name []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.cache[string(name)]
+	return ok
+}
+
+// invalidateSeries removes the sets of the measurement which contain, or
+// would contain, the series with the tags: the set of each cached key with
+// the value of the series for this key, which is empty if the series does
+// not have the key.
+func (c *TagValueSeriesIDCache) invalidateSeries(name []byte, tags models.Tags) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, tkmap := range c.cache[string(name)] {
+		if ele, ok := tkmap[string(tags.Get([]byte(key)))]; ok {
+			c.remove(ele)
+		}
+	}
+}
+
+// invalidateMeasurement removes all sets of the measurement.
+func (c *TagValueSeriesIDCache) invalidateMeasurement(name []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tkmap := range c.cache[string(name)] {
+		for _, ele := range tkmap {
+			c.remove(ele)
+		}
+	}
+}
+
+// Len returns the number of cached sets.
+func (c *TagValueSeriesIDCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evictor.Len()
+}
+
+// bytes estimates the memory footprint of the cached sets, in bytes.
+func (c *TagValueSeriesIDCache) bytes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var b int
+	for e := c.evictor.Front(); e != nil; e = e.Next() {
+		ele := e.Value.(*tagValueCacheElement)
+		b += int(unsafe.Sizeof(*e)) + int(unsafe.Sizeof(*ele))
+		b += len(ele.name) + len(ele.key) + len(ele.value)
+		b += ele.ss.Bytes()
+	}
+	return b
+}
@@ -0,0 +1,85 @@
+package tsi2
+
+import (
+	"testing"
+
+	"github.com/influxdata/influxdb/v2/models"
+	"github.com/stretchr/testify/assert"
+
+	"cycledb/pkg/tsdb"
+)
+
+func TestTagValueSeriesIDCache(t *testing.T) {
+	c := NewTagValueSeriesIDCache(2)
+	s1, s2, s3 := tsdb.NewSeriesIDSet(1), tsdb.NewSeriesIDSet(2), tsdb.NewSeriesIDSet(3)
+	c.Put([]byte("cpu"), []byte("region"), []byte("west"), s1)
+	c.Put([]byte("cpu"), []byte("region"), []byte("east"), s2)
+	assert.Same(t, s1, c.Get([]byte("cpu"), []byte("region"), []byte("west")))
+
+	// The least recently used set is evicted.
+	c.Put([]byte("mem"), []byte("host"), []byte("a"), s3)
+	assert.Equal(t, 2, c.Len())
+	assert.Nil(t, c.Get([]byte("cpu"), []byte("region"), []byte("east")))
+	assert.Same(t, s1, c.Get([]byte("cpu"), []byte("region"), []byte("west")))
+	assert.Same(t, s3, c.Get([]byte("mem"), []byte("host"), []byte("a")))
+
+	// A series invalidates the sets of its values, and of the empty value
+	// of the keys it does not have.
+	c = NewTagValueSeriesIDCache(4)
+	c.Put([]byte("cpu"), []byte("region"), []byte("west"), s1)
+	c.Put([]byte("cpu"), []byte("region"), []byte("east"), s2)
+	c.Put([]byte("cpu"), []byte("host"), []byte(""), s3)
+	c.Put([]byte("mem"), []byte("region"), []byte("west"), s1)
+	c.invalidateSeries([]byte("cpu"), models.NewTags(map[string]string{"region": "west"}))
+	assert.Nil(t, c.Get([]byte("cpu"), []byte("region"), []byte("west")))
+	assert.Nil(t, c.Get([]byte("cpu"), []byte("host"), []byte("")))
+	assert.Same(t, s2, c.Get([]byte("cpu"), []byte("region"), []byte("east")))
+	assert.Same(t, s1, c.Get([]byte("mem"), []byte("region"), []byte("west")))
+
+	c.invalidateMeasurement([]byte("cpu"))
+	assert.False(t, c.hasMeasurement([]byte("cpu")))
+	assert.Equal(t, 1, c.Len())
+
+	// A cache without capacity keeps nothing.
+	c = NewTagValueSeriesIDCache(0)
+	c.Put([]byte("cpu"), []byte("region"), []byte("west"), s1)
+	assert.Nil(t, c.Get([]byte("cpu"), []byte("region"), []byte("west")))
+}
+
+func TestMeasurements_TagValueSeriesIDCache(t *testing.T) {
+	ms := NewMeasurements(DefaultIDLayout)
+	assert.NoError(t, ms.AppendMeasurement([]byte("cpu")))
+	west := models.NewTags(map[string]string{"region": "west"})
+	id1, _, err := ms.SetTags([]byte("cpu"), west)
+	assert.NoError(t, err)
+
+	seriesIDs := func(key, value string) []uint64 {
+		itr, err := ms.TagValueSeriesIDIterator([]byte("cpu"), []byte(key), []byte(value))
+		assert.NoError(t, err)
+		return itr.SeriesIDSet().Slice()
+	}
+	assert.Equal(t, []uint64{id1}, seriesIDs("region", "west"))
+	assert.Empty(t, seriesIDs("region", "east"))
+	assert.Equal(t, 2, ms.cache.Len())
+
+	// A new series only invalidates the sets it belongs to.
+	id2, _, err := ms.SetTags([]byte("cpu"), models.NewTags(map[string]string{"region": "west", "host": "a"}))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ms.cache.Len())
+	assert.Equal(t, []uint64{id1, id2}, seriesIDs("region", "west"))
+	assert.Equal(t, []uint64{id1}, seriesIDs("host", ""))
+
+	// Existing tags invalidate nothing.
+	_, _, err = ms.SetTags([]byte("cpu"), west)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, ms.cache.Len())
+
+	m, err := ms.MeasurementByName([]byte("cpu"))
+	assert.NoError(t, err)
+	ms.DropSeriesID(m, id1)
+	assert.Equal(t, []uint64{id2}, seriesIDs("region", "west"))
+	assert.Empty(t, seriesIDs("host", ""))
+
+	assert.NoError(t, ms.DropMeasurement([]byte("cpu")))
+	assert.Equal(t, 0, ms.cache.Len())
+}
@@ -14,6 +14,13 @@ func PowUint64(x, y int) uint64 {
 	return uint64(math.Pow(float64(x), float64(y)))
 }
 
+func maxInt(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
+
 // VariableBaseConvert: dimension: [[value,capacity]], if value==all, value==-1
 func VariableBaseConvert(indexes []int, capacities []uint64, idx int, previous []uint64) []uint64 {
 	if idx == len(indexes) {
@@ -37,32 +44,32 @@ func VariableBaseConvert(indexes []int, capacities []uint64, idx int, previous [
 	}
 }
 
-// // unionStringSets returns the union of two sets
-// func unionStringSets(a, b map[string]struct{}) map[string]struct{} {
-// 	other := make(map[string]struct{})
-// 	for k := range a {
-// 		other[k] = struct{}{}
-// 	}
-// 	for k := range b {
-// 		other[k] = struct{}{}
-// 	}
-// 	return other
-// }
+// unionStringSets returns the union of two sets
+func unionStringSets(a, b map[string]struct{}) map[string]struct{} {
+	other := make(map[string]struct{})
+	for k := range a {
+		other[k] = struct{}{}
+	}
+	for k := range b {
+		other[k] = struct{}{}
+	}
+	return other
+}
 
-// // intersectStringSets returns the intersection of two sets.
-// func intersectStringSets(a, b map[string]struct{}) map[string]struct{} {
-// 	if len(a) < len(b) {
-// 		a, b = b, a
-// 	}
-
-// 	other := make(map[string]struct{})
-// 	for k := range a {
-// 		if _, ok := b[k]; ok {
-// 			other[k] = struct{}{}
-// 		}
-// 	}
-// 	return other
-// }
+// intersectStringSets returns the intersection of two sets.
+func intersectStringSets(a, b map[string]struct{}) map[string]struct{} {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+
+	other := make(map[string]struct{})
+	for k := range a {
+		if _, ok := b[k]; ok {
+			other[k] = struct{}{}
+		}
+	}
+	return other
+}
 
 // unionStringSets returns the union of two sets
 func unionStringSets2(a map[string]struct{}, b map[string]int) map[string]struct{} {
@@ -76,6 +83,27 @@ func unionStringSets2(a map[string]struct{}, b map[string]int) map[string]struct
 	return other
 }
 
+// containsString returns true if a contains s.
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// tagValueSet returns the set of values of the tag key in sets, after
+// adding it if it does not exist.
+func tagValueSet(sets map[string]map[string]struct{}, key string) map[string]struct{} {
+	values, ok := sets[key]
+	if !ok {
+		values = map[string]struct{}{}
+		sets[key] = values
+	}
+	return values
+}
+
 func mapToSlice(m map[string]struct{}) [][]byte {
 	res := make([][]byte, 0, len(m))
 	for key, _ := range m {
@@ -0,0 +1,183 @@
+package tsi2
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+
+	"cycledb/pkg/tsdb"
+
+	"github.com/influxdata/influxdb/v2/models"
+)
+
+// VerifyIndexFile checks the index file at path for corruption. It validates
+// the signature, trailer, checksums, sketches and measurement block of the
+// file, then decodes the tag block and the grids of each measurement. The ids
+// of each grid must be coordinates of the grid within the id layout, and the
+// grids of a measurement must hold exactly the series of the measurement.
+//
+// If sfile is not nil, each series must have the same measurement and tags in
+// the series file. Series which are deleted or missing from the series file
+// are skipped, as index files keep dropped series until they are compacted.
+//
+// Returns the first problem found, wrapping ErrInvalidIndexFile,
+// ErrInvalidGrid or ErrInvalidTagBlock.
+func VerifyIndexFile(path string, sfile *tsdb.SeriesFile) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Every grid is decoded once, the file is read without mmap.
+	ifile := NewIndexFile(path)
+	ifile.gridCache = newGridCache(0)
+	if err := ifile.unmarshal(data); err != nil {
+		return err
+	}
+	if ifile.version >= 6 && crc32.ChecksumIEEE(ifile.gridBlock) != ifile.gridBlockChecksum {
+		return fmt.Errorf("%q: grid block checksum mismatch: %w", path, ErrInvalidIndexFile)
+	}
+	if _, _, err := ifile.SeriesSketches(); err != nil {
+		return fmt.Errorf("%q: series sketches: %v: %w", path, err, ErrInvalidIndexFile)
+	} else if _, _, err := ifile.MeasurementsSketches(); err != nil {
+		return fmt.Errorf("%q: measurement sketches: %v: %w", path, err, ErrInvalidIndexFile)
+	}
+
+	ids := map[uint64][]byte{}
+	itr := ifile.MeasurementIterator()
+	for e := itr.Next(); e != nil; e = itr.Next() {
+		if name, ok := ids[e.ID()]; ok {
+			return fmt.Errorf("%q: measurements %q and %q have id %d: %w", path, name, e.Name(), e.ID(), ErrInvalidIndexFile)
+		} else if e.ID() > ifile.layout.MaxMeasurementID() {
+			return fmt.Errorf("%q: measurement %q: id %d overflows the id layout %s: %w", path, e.Name(), e.ID(), ifile.layout, ErrInvalidIndexFile)
+		}
+		ids[e.ID()] = e.Name()
+
+		if err := verifyMeasurement(ifile, *e, sfile); err != nil {
+			return fmt.Errorf("%q: measurement %q: %w", path, e.Name(), err)
+		}
+	}
+	if len(itr.data) != 0 {
+		return fmt.Errorf("%q: measurement block: truncated element: %w", path, ErrInvalidIndexFile)
+	}
+	return nil
+}
+
+// verifyMeasurement checks the grids of the measurement against its series,
+// tag block and the series file.
+func verifyMeasurement(ifile *IndexFile, e MeasurementBlockElem, sfile *tsdb.SeriesFile) error {
+	if found, ok := ifile.mblk.Elem(e.Name()); !ok || found.ID() != e.ID() {
+		return fmt.Errorf("not in the hash index: %w", ErrInvalidIndexFile)
+	}
+	blk, hasTagBlock, err := ifile.tagBlock(e)
+	if err != nil {
+		return err
+	}
+
+	type span struct{ start, end uint64 }
+	spans := make([]span, 0, len(e.grids))
+	ss := tsdb.NewSeriesIDSet()
+	for i := range e.grids {
+		g, err := ifile.grid(e, i)
+		if err != nil {
+			return fmt.Errorf("grid %d: %w", i, err)
+		}
+
+		// The ids of the grid are coordinates of the grid.
+		capacity := g.getCapacityOfIDs()
+		if max := ifile.layout.MaxIndexID(); g.offset > max || capacity > max-g.offset+1 {
+			return fmt.Errorf("grid %d: %d ids from %d overflow the id layout %s: %w", i, capacity, g.offset, ifile.layout, ErrInvalidIndexFile)
+		}
+		spans = append(spans, span{start: g.offset, end: g.offset + capacity})
+		var idErr error
+		g.seriesIDSet.ForEach(func(id uint64) {
+			if idErr != nil {
+				return
+			} else if id < g.offset || id-g.offset >= capacity {
+				idErr = fmt.Errorf("grid %d: series id %d is not within %d..%d: %w", i, id, g.offset, g.offset+capacity, ErrInvalidIndexFile)
+				return
+			}
+			tags := g.tagsForID(id)
+			if tags == nil {
+				idErr = fmt.Errorf("grid %d: series id %d has no tag values: %w", i, id, ErrInvalidIndexFile)
+			} else if sfile != nil {
+				idErr = verifySeries(sfile, ifile.layout.seriesID(e.ID(), id), e.Name(), tags)
+			}
+			ss.Add(id)
+		})
+		if idErr != nil {
+			return idErr
+		}
+
+		// The tag block finds the grid from each of its keys and values.
+		if hasTagBlock {
+			if err := verifyTagBlockGrid(blk, g, i); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The grids do not share ids, and hold the series of the measurement.
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	for i := 1; i < len(spans); i++ {
+		if spans[i].start < spans[i-1].end {
+			return fmt.Errorf("grids overlap at ids %d..%d: %w", spans[i].start, spans[i-1].end, ErrInvalidIndexFile)
+		}
+	}
+	if !ss.Equals(e.SeriesIDSet()) {
+		return fmt.Errorf("grids hold %d series, measurement has %d: %w", ss.Cardinality(), e.SeriesIDSet().Cardinality(), ErrInvalidIndexFile)
+	}
+	return nil
+}
+
+// verifyTagBlockGrid checks the tag block maps the keys and values of the
+// i-th grid to it.
+func verifyTagBlockGrid(blk *TagBlock, g *Grid, i int) error {
+	for d, key := range g.tagKeys {
+		if grids, _, err := blk.TagKeyGrids([]byte(key)); err != nil {
+			return err
+		} else if !containsInt(grids, i) {
+			return fmt.Errorf("grid %d: tag key %q is not in the tag block: %w", i, key, ErrInvalidTagBlock)
+		}
+		for _, value := range g.tagValuesSlice[d].values {
+			if grids, _, err := blk.TagValueGrids([]byte(key), []byte(value)); err != nil {
+				return err
+			} else if !containsInt(grids, i) {
+				return fmt.Errorf("grid %d: tag value %q=%q is not in the tag block: %w", i, key, value, ErrInvalidTagBlock)
+			}
+		}
+	}
+	return nil
+}
+
+// verifySeries checks the series file holds the series with the name and
+// tags, unless it was deleted.
+func verifySeries(sfile *tsdb.SeriesFile, id uint64, name []byte, tags models.Tags) error {
+	if sfile.IsDeleted(id) {
+		return nil
+	}
+	sname, stags := sfile.Series(id)
+	if !bytes.Equal(sname, name) {
+		return fmt.Errorf("series id %d belongs to measurement %q in the series file: %w", id, sname, ErrInvalidIndexFile)
+	}
+
+	// Keys with the empty value are not tags of the series.
+	nonEmpty := make(models.Tags, 0, len(stags))
+	for _, tag := range stags {
+		if len(tag.Value) != 0 {
+			nonEmpty = append(nonEmpty, tag)
+		}
+	}
+	if !nonEmpty.Equal(tags) {
+		return fmt.Errorf("series id %d has tags %s in the series file, not %s: %w", id, stags.HashKey(), tags.HashKey(), ErrInvalidIndexFile)
+	}
+	return nil
+}
+
+// containsInt returns true if the sorted slice a holds v.
+func containsInt(a []int, v int) bool {
+	i := sort.SearchInts(a, v)
+	return i < len(a) && a[i] == v
+}
@@ -0,0 +1,120 @@
+package tsi2_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cycledb/pkg/tsdb/index/tsi2"
+
+	"github.com/influxdata/influxdb/v2/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyIndexFile(t *testing.T) {
+	idx := MustOpenDefaultIndex(t)
+	t.Cleanup(func() { assert.NoError(t, idx.Close()) })
+
+	assert.NoError(t, idx.CreateSeriesSliceIfNotExists([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "web-1", "region": "east"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "web-2", "region": "west"})},
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "web-3"})},
+		{Name: []byte("mem"), Tags: models.NewTags(map[string]string{"host": "web-1"})},
+	}))
+	assert.NoError(t, idx.Compact(1))
+	path := mustIndexFilePath(t, idx)
+	assert.NoError(t, tsi2.VerifyIndexFile(path, idx.SeriesFile.SeriesFile))
+	assert.NoError(t, tsi2.VerifyIndexFile(path, nil))
+
+	// The same ids belong to other series in another series file.
+	other := MustOpenDefaultIndex(t)
+	t.Cleanup(func() { assert.NoError(t, other.Close()) })
+	assert.NoError(t, other.CreateSeriesSliceIfNotExists([]Series{
+		{Name: []byte("cpu"), Tags: models.NewTags(map[string]string{"host": "db-1", "region": "north"})},
+	}))
+	assert.ErrorIs(t, tsi2.VerifyIndexFile(path, other.SeriesFile.SeriesFile), tsi2.ErrInvalidIndexFile)
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	corrupt := filepath.Join(t.TempDir(), tsi2.FormatIndexFileName(2, 1))
+
+	// Truncated files are invalid, and cannot be restored.
+	for _, n := range []int{0, 3, len(tsi2.FileSignature), len(data) / 2, len(data) - 1} {
+		assert.NoError(t, os.WriteFile(corrupt, data[:n], 0666))
+		assert.Error(t, tsi2.VerifyIndexFile(corrupt, nil), "truncated to %d bytes", n)
+		f := tsi2.NewIndexFile(corrupt)
+		if err := f.Restore(); err == nil {
+			assert.NoError(t, f.Close())
+			t.Fatalf("truncated to %d bytes: restored", n)
+		}
+	}
+
+	// Sections out of the file are invalid, without panicking.
+	for i := len(data) - tsi2.IndexFileTrailerSize; i < len(data)-tsi2.IndexFileVersionSize-2; i += 8 {
+		modified := append([]byte(nil), data...)
+		copy(modified[i:i+8], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+		assert.NoError(t, os.WriteFile(corrupt, modified, 0666))
+		assert.ErrorIs(t, tsi2.VerifyIndexFile(corrupt, nil), tsi2.ErrInvalidIndexFile, "corrupt trailer field at %d", i)
+		f := tsi2.NewIndexFile(corrupt)
+		if err := f.Restore(); err == nil {
+			assert.NoError(t, f.Close())
+			t.Fatalf("corrupt trailer field at %d: restored", i)
+		}
+	}
+
+	// The checksums catch any corrupt byte. The grid block is only checked
+	// by VerifyIndexFile, the rest of the file also when it is restored.
+	// Only a sample of the bytes of the sketches is corrupted, they take
+	// most of the file.
+	tl, err := tsi2.ReadIndexFileTrailer(data)
+	assert.NoError(t, err)
+	for i := range data {
+		if sketch := int64(i) - tl.SeriesSketch.Offset; sketch >= 0 && i < len(data)-tsi2.IndexFileTrailerSize && sketch%1021 != 0 {
+			continue
+		}
+		modified := append([]byte(nil), data...)
+		modified[i] ^= 0xff
+		assert.NoError(t, os.WriteFile(corrupt, modified, 0666))
+		assert.Error(t, tsi2.VerifyIndexFile(corrupt, nil), "corrupt byte at %d", i)
+		if int64(i) < tl.MeasurementBlock.Offset {
+			continue
+		}
+		f := tsi2.NewIndexFile(corrupt)
+		if err := f.Restore(); err == nil {
+			assert.NoError(t, f.Close())
+			t.Fatalf("corrupt byte at %d: restored", i)
+		}
+	}
+
+	// Files of version 5 have no checksums, their sketches are checked
+	// before they are decoded.
+	v5 := append([]byte(nil), data[:len(data)-tsi2.IndexFileVersionSize-2*tsi2.IndexFileChecksumSize]...)
+	v5 = append(v5, 0, 5)
+	assert.NoError(t, os.WriteFile(corrupt, v5, 0666))
+	assert.NoError(t, tsi2.VerifyIndexFile(corrupt, nil))
+	for _, offset := range []int64{tl.SeriesSketch.Offset, tl.TombstoneSeriesSketch.Offset, tl.MeasurementSketch.Offset, tl.TombstoneMeasurementSketch.Offset} {
+		modified := append([]byte(nil), v5...)
+		copy(modified[offset+3:], []byte{0, 1, 0, 1})
+		assert.NoError(t, os.WriteFile(corrupt, modified, 0666))
+		assert.ErrorIs(t, tsi2.VerifyIndexFile(corrupt, nil), tsi2.ErrInvalidIndexFile, "corrupt sketch at %d", offset)
+		f := tsi2.NewIndexFile(corrupt)
+		if err := f.Restore(); err == nil {
+			assert.NoError(t, f.Close())
+			t.Fatalf("corrupt sketch at %d: restored", offset)
+		}
+	}
+}
+
+// mustIndexFilePath returns the path of the last index file of the index.
+func mustIndexFilePath(tb testing.TB, idx *Index) string {
+	tb.Helper()
+	m, _, err := tsi2.ReadManifestFile(idx.PartitionAt(0).ManifestPath())
+	assert.NoError(tb, err)
+	var path string
+	for _, filename := range m.Files {
+		if filepath.Ext(filename) == tsi2.IndexFileExt {
+			path = filepath.Join(idx.PartitionAt(0).Path(), filename)
+		}
+	}
+	return path
+}
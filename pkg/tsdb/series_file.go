@@ -22,6 +22,7 @@ import (
 var (
 	ErrSeriesFileClosed         = errors.New("tsdb: series file closed")
 	ErrInvalidSeriesPartitionID = errors.New("tsdb: invalid series partition id")
+	ErrSeriesIDInUse            = errors.New("tsdb: series id in use")
 )
 
 // SeriesIDSize is the size in bytes of a series key ID.
@@ -216,6 +217,43 @@ func (f *SeriesFile) CreateSeriesListIfNotExistsWithDesignatedIDs(names [][]byte
 	return ids, nil
 }
 
+// ReassignSeriesIDs gives new ids to existing series, such as after their
+// index packed them. Series missing from the file are created with their ids.
+// The previous ids are deleted, and the new ids must not have been used by
+// other series, so that an id never refers to two series. Series which have
+// their new ids already are left as they are.
+func (f *SeriesFile) ReassignSeriesIDs(names [][]byte, tagsSlice []models.Tags, ids []uint64) error {
+	keys := GenerateSeriesKeys(names, tagsSlice)
+	keyPartitionIDs := f.SeriesKeysPartitionIDs(keys)
+
+	for i := range keys {
+		if f.partitions[keyPartitionIDs[i]].FindIDBySeriesKey(keys[i]) != ids[i] && f.HasSeriesID(ids[i]) {
+			return fmt.Errorf("series id %d: %w", ids[i], ErrSeriesIDInUse)
+		}
+	}
+
+	var g errgroup.Group
+	for i := range f.partitions {
+		p := f.partitions[i]
+		g.Go(func() error {
+			return p.ReassignSeriesIDs(keys, keyPartitionIDs, ids)
+		})
+	}
+	return g.Wait()
+}
+
+// HasSeriesID returns true if the id was given to a series, even if the
+// series was deleted since the last compaction of its partition. Designated
+// ids are looked up in all partitions.
+func (f *SeriesFile) HasSeriesID(id uint64) bool {
+	for _, p := range f.partitions {
+		if p.HasSeriesID(id) {
+			return true
+		}
+	}
+	return false
+}
+
 // DeleteSeriesID flags a series as permanently deleted.
 // If the series is reintroduced later then it must create a new id.
 func (f *SeriesFile) DeleteSeriesID(id uint64) error {
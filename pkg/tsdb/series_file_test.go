@@ -219,6 +219,58 @@ func TestSeriesFile_DeleteSeriesID(t *testing.T) {
 	}
 }
 
+// Ensure series ids can be reassigned to unused ids, and never reuse ids.
+func TestSeriesFile_ReassignSeriesIDs(t *testing.T) {
+	sfile := MustOpenSeriesFile(t)
+	defer sfile.Close()
+
+	names := [][]byte{[]byte("cpu"), []byte("cpu"), []byte("cpu")}
+	tagsSlice := []models.Tags{
+		models.NewTags(map[string]string{"host": "a"}),
+		models.NewTags(map[string]string{"host": "b"}),
+		models.NewTags(map[string]string{"host": "c"}),
+	}
+	ids, err := sfile.CreateSeriesListIfNotExistsWithDesignatedIDs(names, tagsSlice, []uint64{10, 20, 30})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{10, 20, 30}, ids)
+	require.NoError(t, sfile.ForceCompact())
+
+	// The ids of other series are refused.
+	require.ErrorIs(t, sfile.ReassignSeriesIDs(names, tagsSlice, []uint64{20, 10, 30}), tsdb.ErrSeriesIDInUse)
+	require.Equal(t, uint64(10), sfile.SeriesID(names[0], tagsSlice[0], nil))
+
+	want := []uint64{40, 20, 5}
+	require.NoError(t, sfile.ReassignSeriesIDs(names, tagsSlice, want))
+	require.True(t, sfile.IsDeleted(10))
+	require.True(t, sfile.IsDeleted(30))
+
+	// The previous ids are deleted, and are not given again.
+	require.ErrorIs(t, sfile.ReassignSeriesIDs(names[:1], tagsSlice[:1], []uint64{10}), tsdb.ErrSeriesIDInUse)
+
+	verify := func(state string) {
+		t.Helper()
+		for i := range names {
+			require.Equal(t, want[i], sfile.SeriesID(names[i], tagsSlice[i], nil), state)
+		}
+		ids, err := sfile.CreateSeriesListIfNotExists(names, tagsSlice)
+		require.NoError(t, err, state)
+		require.Equal(t, want, ids, state)
+
+		// Reassigning the same ids again changes nothing.
+		require.NoError(t, sfile.ReassignSeriesIDs(names, tagsSlice, want), state)
+	}
+	verify("before reopen")
+
+	require.NoError(t, sfile.Reopen())
+	verify("after reopen")
+
+	require.NoError(t, sfile.ForceCompact())
+	verify("after compaction")
+
+	require.NoError(t, sfile.Reopen())
+	verify("after compaction and reopen")
+}
+
 func TestSeriesFile_Compaction(t *testing.T) {
 	sfile := MustOpenSeriesFile(t)
 	defer sfile.Close()
@@ -153,6 +153,15 @@ func (idx *SeriesIndex) Delete(id uint64) {
 	idx.execEntry(SeriesEntryTombstoneFlag, id, 0, nil)
 }
 
+// HasID returns true if the id was inserted, even if it was deleted since.
+// The ids deleted before the last compaction are not known.
+func (idx *SeriesIndex) HasID(id uint64) bool {
+	if _, ok := idx.tombstones[id]; ok {
+		return true
+	}
+	return idx.FindOffsetByID(id) != 0
+}
+
 // IsDeleted returns true if series id has been deleted.
 func (idx *SeriesIndex) IsDeleted(id uint64) bool {
 	if _, ok := idx.tombstones[id]; ok {
@@ -496,6 +496,76 @@ func (p *SeriesPartition) DeleteSeriesID(id uint64) error {
 	return nil
 }
 
+// ReassignSeriesIDs gives new ids to existing series of the partition.
+// The previous ids of the series are tombstoned, and the series inserted
+// again with the new ids, which must not be in use.
+func (p *SeriesPartition) ReassignSeriesIDs(keys [][]byte, keyPartitionIDs []int, ids []uint64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrSeriesPartitionClosed
+	}
+
+	// Find the series to reassign, and tombstone their ids.
+	type keyID struct {
+		key []byte
+		id  uint64
+	}
+	reassigned := make([]keyID, 0, len(keys))
+	for i := range keys {
+		if keyPartitionIDs[i] != p.id {
+			continue
+		}
+		oldID := p.index.FindIDBySeriesKey(p.segments, keys[i])
+		if oldID == ids[i] {
+			continue
+		} else if p.index.HasID(ids[i]) {
+			return fmt.Errorf("series id %d: %w", ids[i], ErrSeriesIDInUse)
+		}
+		if oldID != 0 {
+			if _, err := p.writeLogEntry(AppendSeriesEntry(nil, SeriesEntryTombstoneFlag, oldID, nil)); err != nil {
+				return err
+			}
+			p.index.Delete(oldID)
+		}
+		reassigned = append(reassigned, keyID{keys[i], ids[i]})
+	}
+
+	// Insert the series with their new ids.
+	offsets := make([]int64, len(reassigned))
+	for i, r := range reassigned {
+		_, offset, err := p.insertWithDesignatedIDs(r.key, r.id)
+		if err != nil {
+			return err
+		}
+		offsets[i] = offset
+	}
+
+	// Flush active segment writes so we can access data in mmap.
+	if segment := p.activeSegment(); segment != nil {
+		if err := segment.Flush(); err != nil {
+			return err
+		}
+	}
+
+	for i, r := range reassigned {
+		p.index.Insert(p.seriesKeyByOffset(offsets[i]), r.id, offsets[i])
+	}
+	return nil
+}
+
+// HasSeriesID returns true if the id was given to a series of the partition,
+// even if the series was deleted since the last compaction.
+func (p *SeriesPartition) HasSeriesID(id uint64) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return false
+	}
+	return p.index.HasID(id)
+}
+
 // IsDeleted returns true if the ID has been deleted before.
 func (p *SeriesPartition) IsDeleted(id uint64) bool {
 	p.mu.RLock()
@@ -50,6 +50,19 @@ func (s *SeriesIDSet) AddNoLock(id uint64) {
 	s.bitmap.Add(uint32(id))
 }
 
+// AddRange adds the ids in the range [start, end) to the set.
+func (s *SeriesIDSet) AddRange(start, end uint64) {
+	s.Lock()
+	defer s.Unlock()
+	s.AddRangeNoLock(start, end)
+}
+
+// AddRangeNoLock adds the ids in the range [start, end) to the set. AddRangeNoLock
+// is not safe for use from multiple goroutines. Callers must manage synchronization.
+func (s *SeriesIDSet) AddRangeNoLock(start, end uint64) {
+	s.bitmap.AddRange(start, end)
+}
+
 // AddMany adds multiple ids to the SeriesIDSet. AddMany takes a lock, so may not be
 // optimal to call many times with few ids.
 func (s *SeriesIDSet) AddMany(ids ...uint64) {
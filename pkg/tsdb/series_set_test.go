@@ -63,6 +63,15 @@ func TestSeriesIDSet_AndNot(t *testing.T) {
 	}
 }
 
+func TestSeriesIDSet_AddRange(t *testing.T) {
+	s := NewSeriesIDSet(1)
+	s.AddRange(10, 13)
+	s.AddRange(20, 20)
+	if got, exp := s.Slice(), []uint64{1, 10, 11, 12}; fmt.Sprint(got) != fmt.Sprint(exp) {
+		t.Fatalf("got %v, expected %v", got, exp)
+	}
+}
+
 // Ensure that cloning is race-free.
 func TestSeriesIDSet_Clone_Race(t *testing.T) {
 	main := NewSeriesIDSet()